@@ -2,6 +2,8 @@ package binary
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 
 	"github.com/omniscale/imposm3/element"
 )
@@ -51,7 +53,7 @@ func MarshalIDRefsBunch2(idRefs []element.IDRefs, buf []byte) []byte {
 	lastID := int64(0)
 	nextPos := 0
 
-	estSize := len(idRefs)*(4+1+6) + binary.MaxVarintLen64
+	estSize := marshaledBunchSize(idRefs)
 	if cap(buf) < estSize {
 		buf = make([]byte, estSize)
 	} else {
@@ -92,6 +94,56 @@ func MarshalIDRefsBunch2(idRefs []element.IDRefs, buf []byte) []byte {
 	return buf[:nextPos]
 }
 
+// marshaledBunchSize returns an upper bound of the size of idRefs
+// marshaled with MarshalIDRefsBunch2. The size of the refs is estimated
+// with the size of the largest encoded delta, so that large ids with large
+// deltas do not require reallocations of the buffer.
+func marshaledBunchSize(idRefs []element.IDRefs) int {
+	size := binary.MaxVarintLen64
+	numRefs := 0
+	// largest delta in zigzag encoding, as written by PutVarint. Positive
+	// deltas need more bytes than negative deltas of the same magnitude.
+	maxDelta := uint64(0)
+	lastID := int64(0)
+	lastRef := int64(0)
+	for _, idRef := range idRefs {
+		size += varintSize(idRef.ID-lastID) + uvarintSize(uint64(len(idRef.Refs)))
+		lastID = idRef.ID
+		numRefs += len(idRef.Refs)
+		for _, ref := range idRef.Refs {
+			if delta := zigzag(ref - lastRef); delta > maxDelta {
+				maxDelta = delta
+			}
+			lastRef = ref
+		}
+	}
+	return size + numRefs*uvarintSize(maxDelta)
+}
+
+// varintSize returns the number of bytes of v encoded with PutVarint.
+func varintSize(v int64) int {
+	return uvarintSize(zigzag(v))
+}
+
+// zigzag returns v in the zigzag encoding of PutVarint.
+func zigzag(v int64) uint64 {
+	ux := uint64(v) << 1
+	if v < 0 {
+		ux = ^ux
+	}
+	return ux
+}
+
+// uvarintSize returns the number of bytes of v encoded with PutUvarint.
+func uvarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
 func UnmarshalIDRefsBunch(buf []byte) []element.IDRefs {
 	length, n := binary.Uvarint(buf)
 	if n <= 0 {
@@ -187,3 +239,387 @@ func UnmarshalIDRefsBunch2(buf []byte, idRefs []element.IDRefs) []element.IDRefs
 	}
 	return idRefs
 }
+
+// UnmarshalIDRefsBunchRefs decodes only the refs of id from buf (see
+// MarshalIDRefsBunch2). The refs are stored in refs[:0], refs is only
+// reallocated if its capacity is too small. It returns false if id is not
+// in the bunch.
+func UnmarshalIDRefsBunchRefs(buf []byte, id int64, refs []int64) ([]int64, bool) {
+	return AppendIDRefsBunchRefs(buf, id, refs[:0])
+}
+
+// AppendIDRefsBunchRefs is like UnmarshalIDRefsBunchRefs, but it appends the
+// refs of id to refs.
+func AppendIDRefsBunchRefs(buf []byte, id int64, refs []int64) ([]int64, bool) {
+	return appendIDRefsBunchRefs(buf, id, refs, nil)
+}
+
+// AppendIDRefsBunchRefsFiltered is like AppendIDRefsBunchRefs, but it only
+// appends the refs of id for which keep returns true. keep is called while
+// the refs are decoded, refs only grows for the kept refs.
+func AppendIDRefsBunchRefsFiltered(buf []byte, id int64, refs []int64, keep func(ref int64) bool) ([]int64, bool) {
+	return appendIDRefsBunchRefs(buf, id, refs, keep)
+}
+
+func appendIDRefsBunchRefs(buf []byte, id int64, refs []int64, keep func(ref int64) bool) ([]int64, bool) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return refs, false
+	}
+	offset := n
+
+	idx := -1
+	last := int64(0)
+	for i := 0; uint64(i) < length; i++ {
+		delta, n := binary.Varint(buf[offset:])
+		if n <= 0 {
+			panic("no data")
+		}
+		offset += n
+		last += delta
+		if last == id {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		return refs, false
+	}
+
+	// number of refs stored before the refs of id
+	var skip, numRefs uint64
+	for i := 0; uint64(i) < length; i++ {
+		num, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			panic("no data")
+		}
+		offset += n
+		if i < idx {
+			skip += num
+		} else if i == idx {
+			numRefs = num
+		}
+	}
+
+	if keep == nil && uint64(cap(refs)-len(refs)) < numRefs {
+		grown := make([]int64, len(refs), uint64(len(refs))+numRefs)
+		copy(grown, refs)
+		refs = grown
+	}
+
+	// refs are delta encoded across all ids, decode all preceding refs
+	last = 0
+	for i := uint64(0); i < skip+numRefs; i++ {
+		delta, n := binary.Varint(buf[offset:])
+		if n <= 0 {
+			panic("no data")
+		}
+		offset += n
+		last += delta
+		if i >= skip && (keep == nil || keep(last)) {
+			refs = append(refs, last)
+		}
+	}
+	return refs, true
+}
+
+// UnmarshalIDRefsBunchCounts calls fn for each id in buf (see
+// MarshalIDRefsBunch2) with the number of refs of that id. The refs
+// themselves are not decoded.
+func UnmarshalIDRefsBunchCounts(buf []byte, fn func(id int64, numRefs int)) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return
+	}
+	idOffset := n
+
+	// skip ids to get the offset of the counts
+	countOffset := idOffset
+	for i := 0; uint64(i) < length; i++ {
+		_, n := binary.Varint(buf[countOffset:])
+		if n <= 0 {
+			panic("no data")
+		}
+		countOffset += n
+	}
+
+	last := int64(0)
+	for i := 0; uint64(i) < length; i++ {
+		delta, n := binary.Varint(buf[idOffset:])
+		idOffset += n
+		last += delta
+		numRefs, n := binary.Uvarint(buf[countOffset:])
+		if n <= 0 {
+			panic("no data")
+		}
+		countOffset += n
+		fn(last, int(numRefs))
+	}
+}
+
+// MergeIDRefsBunch merges the sorted newBunch into the marshaled bunch buf
+// (see MarshalIDRefsBunch2) and marshals the result into out[:0]. IDs of
+// newBunch without refs are removed from the bunch, the refs of all other
+// IDs are merged without duplicates.
+//
+// The refs of buf are decoded and encoded in a single pass. They are never
+// decoded into slices, so memory is bounded by the size of the result, even
+// for IDs with very many refs.
+func MergeIDRefsBunch(buf []byte, newBunch []element.IDRefs, out []byte) []byte {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return MarshalIDRefsBunch2(dropEmptyIDRefs(newBunch), out)
+	}
+	offset := n
+
+	ids := make([]int64, length)
+	counts := make([]int, length)
+	last := int64(0)
+	for i := range ids {
+		delta, n := binary.Varint(buf[offset:])
+		if n <= 0 {
+			panic("no data")
+		}
+		offset += n
+		last += delta
+		ids[i] = last
+	}
+	for i := range counts {
+		num, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			panic("no data")
+		}
+		offset += n
+		counts[i] = int(num)
+	}
+
+	merged := make([]mergedID, 0, len(ids)+len(newBunch))
+	removed := 0
+	i, j := 0, 0
+	for i < len(ids) || j < len(newBunch) {
+		switch {
+		case j == len(newBunch) || (i < len(ids) && ids[i] < newBunch[j].ID):
+			merged = append(merged, mergedID{ids[i], i, -1})
+			i++
+		case i == len(ids) || ids[i] > newBunch[j].ID:
+			if len(newBunch[j].Refs) > 0 {
+				merged = append(merged, mergedID{newBunch[j].ID, -1, j})
+			}
+			j++
+		default:
+			if len(newBunch[j].Refs) > 0 {
+				merged = append(merged, mergedID{ids[i], i, j})
+			} else {
+				// remove existing ID, its refs are skipped
+				merged = append(merged, mergedID{ids[i], i, -2})
+				removed++
+			}
+			i++
+			j++
+		}
+	}
+
+	// Encode the merged refs behind space reserved for the header, as the
+	// number of merged refs is only known afterwards. The refs are moved
+	// directly behind the actual header afterwards.
+	headerSize := binary.MaxVarintLen64 * (1 + 2*len(merged))
+	if cap(out) < headerSize+len(buf) {
+		out = make([]byte, headerSize, headerSize+len(buf)+binary.MaxVarintLen64*len(newBunch))
+	} else {
+		out = out[:headerSize]
+	}
+	mergedCounts := make([]int, len(merged))
+	r := refsReader{buf: buf, offset: offset}
+	w := refsWriter{out: out}
+	for idx, m := range merged {
+		if m.new == -2 {
+			r.skip(m.oldCount(counts))
+			continue
+		}
+		w.count = 0
+		w.merge(&r, m.oldCount(counts), m.newRefs(newBunch))
+		mergedCounts[idx] = w.count
+	}
+	out = w.out
+
+	header := make([]byte, 0, headerSize)
+	header = appendUvarint(header, uint64(len(merged)-removed))
+	last = 0
+	for _, m := range merged {
+		if m.new != -2 {
+			header = appendVarint(header, m.id-last)
+			last = m.id
+		}
+	}
+	for idx, m := range merged {
+		if m.new != -2 {
+			header = appendUvarint(header, uint64(mergedCounts[idx]))
+		}
+	}
+	n = copy(out, header)
+	n += copy(out[n:], out[headerSize:])
+	return out[:n]
+}
+
+// mergedID is an ID of MergeIDRefsBunch. old/new are the indices in the
+// existing and new bunch, or -1 if the ID is not in the bunch. new is -2
+// for existing IDs that are removed.
+type mergedID struct {
+	id       int64
+	old, new int
+}
+
+func (m mergedID) oldCount(counts []int) int {
+	if m.old < 0 {
+		return 0
+	}
+	return counts[m.old]
+}
+
+func (m mergedID) newRefs(newBunch []element.IDRefs) []int64 {
+	if m.new < 0 {
+		return nil
+	}
+	return newBunch[m.new].Refs
+}
+
+// refsWriter delta encodes merged refs into out.
+type refsWriter struct {
+	out   []byte
+	last  int64
+	count int
+}
+
+func (w *refsWriter) emit(ref int64) {
+	w.count++
+	if cap(w.out)-len(w.out) < binary.MaxVarintLen64 {
+		grown := make([]byte, len(w.out), cap(w.out)*2+binary.MaxVarintLen64)
+		copy(grown, w.out)
+		w.out = grown
+	}
+	n := binary.PutVarint(w.out[len(w.out):cap(w.out)], ref-w.last)
+	w.out = w.out[:len(w.out)+n]
+	w.last = ref
+}
+
+// merge emits the next count refs of r and newRefs in sorted order,
+// without duplicates.
+func (w *refsWriter) merge(r *refsReader, count int, newRefs []int64) {
+	j := 0
+	for ; count > 0; count-- {
+		ref := r.next()
+		for j < len(newRefs) && newRefs[j] < ref {
+			w.emit(newRefs[j])
+			j++
+		}
+		if j < len(newRefs) && newRefs[j] == ref {
+			j++
+		}
+		w.emit(ref)
+	}
+	for ; j < len(newRefs); j++ {
+		w.emit(newRefs[j])
+	}
+}
+
+// refsReader decodes the delta encoded refs of a marshaled bunch.
+type refsReader struct {
+	buf    []byte
+	offset int
+	last   int64
+}
+
+func (r *refsReader) next() int64 {
+	delta, n := binary.Varint(r.buf[r.offset:])
+	if n <= 0 {
+		panic("no data")
+	}
+	r.offset += n
+	r.last += delta
+	return r.last
+}
+
+func (r *refsReader) skip(count int) {
+	for ; count > 0; count-- {
+		r.next()
+	}
+}
+
+func dropEmptyIDRefs(idRefs []element.IDRefs) []element.IDRefs {
+	result := make([]element.IDRefs, 0, len(idRefs))
+	for _, idRef := range idRefs {
+		if len(idRef.Refs) > 0 {
+			result = append(result, idRef)
+		}
+	}
+	return result
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// ValidateIDRefsBunch checks that buf is a valid bunch (see
+// MarshalIDRefsBunch2): all varints decode, IDs are increasing, the refs of
+// each ID are increasing and there is no trailing data. It returns the IDs
+// of the bunch. Unlike UnmarshalIDRefsBunch2, it does not panic for
+// malformed data.
+func ValidateIDRefsBunch(buf []byte) ([]int64, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errors.New("invalid number of ids")
+	}
+	if length > uint64(len(buf)) {
+		return nil, fmt.Errorf("number of ids %d exceeds value size", length)
+	}
+	offset := n
+
+	ids := make([]int64, length)
+	last := int64(0)
+	for i := range ids {
+		delta, n := binary.Varint(buf[offset:])
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid id #%d", i)
+		}
+		if i > 0 && delta <= 0 {
+			return nil, fmt.Errorf("id #%d not increasing (delta %d)", i, delta)
+		}
+		offset += n
+		last += delta
+		ids[i] = last
+	}
+	counts := make([]uint64, length)
+	for i := range counts {
+		num, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid number of refs for id %d", ids[i])
+		}
+		offset += n
+		counts[i] = num
+	}
+	last = 0
+	for i, count := range counts {
+		for j := uint64(0); j < count; j++ {
+			delta, n := binary.Varint(buf[offset:])
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid ref #%d of id %d", j, ids[i])
+			}
+			if j > 0 && delta <= 0 {
+				return nil, fmt.Errorf("ref #%d of id %d not increasing (delta %d)", j, ids[i], delta)
+			}
+			offset += n
+			last += delta
+		}
+	}
+	if offset != len(buf) {
+		return nil, fmt.Errorf("%d bytes of trailing data", len(buf)-offset)
+	}
+	return ids, nil
+}
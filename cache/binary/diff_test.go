@@ -54,3 +54,255 @@ func BenchmarkMarshalBunch(b *testing.B) {
 		idRefs = UnmarshalIDRefsBunch2(buf, idRefs)
 	}
 }
+
+func TestUnmarshalBunchRefs(t *testing.T) {
+	bunch := []element.IDRefs{
+		{ID: 123923123, Refs: []int64{1213123}},
+		{ID: 123923133, Refs: []int64{}},
+		{ID: 123924123, Refs: []int64{912412210, 912412213}},
+		{ID: 123924132, Refs: []int64{912412210, 9124213, 212412210}},
+	}
+	buf := MarshalIDRefsBunch2(bunch, nil)
+
+	refs := make([]int64, 0, 2)
+	for _, idRefs := range bunch {
+		var ok bool
+		refs, ok = UnmarshalIDRefsBunchRefs(buf, idRefs.ID, refs)
+		if !ok || len(refs) != len(idRefs.Refs) {
+			t.Fatal(idRefs, refs)
+		}
+		for i := range refs {
+			if refs[i] != idRefs.Refs[i] {
+				t.Fatal(idRefs, refs)
+			}
+		}
+	}
+	if refs, ok := UnmarshalIDRefsBunchRefs(buf, 123923124, refs); ok || len(refs) != 0 {
+		t.Fatal(refs)
+	}
+	if refs, ok := UnmarshalIDRefsBunchRefs(nil, 1, nil); ok || len(refs) != 0 {
+		t.Fatal(refs)
+	}
+
+	refs = []int64{1}
+	refs, ok := AppendIDRefsBunchRefs(buf, 123924123, refs)
+	if !ok || len(refs) != 3 || refs[0] != 1 || refs[1] != 912412210 || refs[2] != 912412213 {
+		t.Fatal(refs)
+	}
+	if refs, ok := AppendIDRefsBunchRefs(buf, 123923124, refs); ok || len(refs) != 3 {
+		t.Fatal(refs)
+	}
+}
+
+func TestAppendIDRefsBunchRefsFiltered(t *testing.T) {
+	bunch := []element.IDRefs{
+		{ID: 123923123, Refs: []int64{1213123}},
+		{ID: 123924123, Refs: []int64{10, 11, 12, 13, 14}},
+		{ID: 123924132, Refs: []int64{15}},
+	}
+	buf := MarshalIDRefsBunch2(bunch, nil)
+
+	even := func(ref int64) bool { return ref%2 == 0 }
+	refs, ok := AppendIDRefsBunchRefsFiltered(buf, 123924123, []int64{1}, even)
+	if !ok || len(refs) != 4 || refs[0] != 1 || refs[1] != 10 || refs[2] != 12 || refs[3] != 14 {
+		t.Fatal(refs)
+	}
+	none := func(ref int64) bool { return false }
+	if refs, ok := AppendIDRefsBunchRefsFiltered(buf, 123924123, nil, none); !ok || refs != nil {
+		t.Fatal(refs)
+	}
+	if refs, ok := AppendIDRefsBunchRefsFiltered(buf, 123923124, nil, even); ok || len(refs) != 0 {
+		t.Fatal(refs)
+	}
+}
+
+func TestUnmarshalBunchCounts(t *testing.T) {
+	bunch := []element.IDRefs{
+		{ID: 123923123, Refs: []int64{1213123}},
+		{ID: 123923133, Refs: []int64{}},
+		{ID: 123924132, Refs: []int64{912412210, 9124213, 212412210}},
+	}
+	buf := MarshalIDRefsBunch2(bunch, nil)
+
+	i := 0
+	UnmarshalIDRefsBunchCounts(buf, func(id int64, numRefs int) {
+		if id != bunch[i].ID || numRefs != len(bunch[i].Refs) {
+			t.Fatal(i, id, numRefs)
+		}
+		i++
+	})
+	if i != 3 {
+		t.Fatal(i)
+	}
+}
+
+func TestMergeBunch(t *testing.T) {
+	bunch := []element.IDRefs{
+		{ID: 10, Refs: []int64{1, 5, 9}},
+		{ID: 11, Refs: []int64{}},
+		{ID: 12, Refs: []int64{3}},
+		{ID: 15, Refs: []int64{7, 8}},
+	}
+	buf := MarshalIDRefsBunch2(bunch, nil)
+
+	merged := UnmarshalIDRefsBunch2(MergeIDRefsBunch(buf, []element.IDRefs{
+		{ID: 9, Refs: []int64{2}},
+		{ID: 10, Refs: []int64{0, 5, 6, 10}},
+		{ID: 11, Refs: []int64{4}},
+		{ID: 12, Refs: []int64{}},
+		{ID: 13, Refs: []int64{}},
+		{ID: 16, Refs: []int64{1}},
+	}, nil), nil)
+
+	expected := []element.IDRefs{
+		{ID: 9, Refs: []int64{2}},
+		{ID: 10, Refs: []int64{0, 1, 5, 6, 9, 10}},
+		{ID: 11, Refs: []int64{4}},
+		{ID: 15, Refs: []int64{7, 8}},
+		{ID: 16, Refs: []int64{1}},
+	}
+	if len(merged) != len(expected) {
+		t.Fatal(merged)
+	}
+	for i := range expected {
+		if merged[i].ID != expected[i].ID || len(merged[i].Refs) != len(expected[i].Refs) {
+			t.Fatal(merged[i], expected[i])
+		}
+		for j := range expected[i].Refs {
+			if merged[i].Refs[j] != expected[i].Refs[j] {
+				t.Fatal(merged[i], expected[i])
+			}
+		}
+	}
+
+	if merged := UnmarshalIDRefsBunch2(MergeIDRefsBunch(nil, []element.IDRefs{
+		{ID: 1, Refs: []int64{}}, {ID: 2, Refs: []int64{3}},
+	}, nil), nil); len(merged) != 1 || merged[0].ID != 2 {
+		t.Fatal(merged)
+	}
+}
+
+func highDegreeBunch(numRefs int) ([]byte, []element.IDRefs) {
+	refs := make([]int64, numRefs)
+	for i := range refs {
+		refs[i] = int64(i * 2)
+	}
+	buf := MarshalIDRefsBunch2([]element.IDRefs{{ID: 1, Refs: refs}}, nil)
+
+	newRefs := make([]int64, 1000)
+	for i := range newRefs {
+		newRefs[i] = int64(i*numRefs/len(newRefs)*2 + 1)
+	}
+	return buf, []element.IDRefs{{ID: 1, Refs: newRefs}}
+}
+
+func BenchmarkMergeBunchHighDegree(b *testing.B) {
+	buf, newBunch := highDegreeBunch(500000)
+	out := []byte{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out = MergeIDRefsBunch(buf, newBunch, out)
+	}
+}
+
+// BenchmarkUnmarshalMergeBunchHighDegree is the decode, merge and marshal
+// approach for comparison with BenchmarkMergeBunchHighDegree.
+func BenchmarkUnmarshalMergeBunchHighDegree(b *testing.B) {
+	buf, newBunch := highDegreeBunch(500000)
+	newRefs := newBunch[0].Refs
+	out := []byte{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bunch := UnmarshalIDRefsBunch2(buf, nil)
+		refs := bunch[0].Refs
+		merged := make([]int64, 0, len(refs)+len(newRefs))
+		j := 0
+		for _, ref := range refs {
+			for j < len(newRefs) && newRefs[j] < ref {
+				merged = append(merged, newRefs[j])
+				j++
+			}
+			merged = append(merged, ref)
+		}
+		merged = append(merged, newRefs[j:]...)
+		bunch[0].Refs = merged
+		out = MarshalIDRefsBunch2(bunch, out)
+	}
+}
+
+func TestValidateBunch(t *testing.T) {
+	buf := MarshalIDRefsBunch2([]element.IDRefs{
+		{ID: 10, Refs: []int64{5, 9}},
+		{ID: 11, Refs: []int64{}},
+		{ID: 12, Refs: []int64{3}},
+	}, nil)
+	if ids, err := ValidateIDRefsBunch(buf); err != nil || len(ids) != 3 || ids[2] != 12 {
+		t.Fatal(ids, err)
+	}
+
+	for _, bad := range [][]byte{
+		{},
+		buf[:len(buf)-1],                   // truncated refs
+		append(buf[:len(buf):len(buf)], 0), // trailing data
+		MarshalIDRefsBunch2([]element.IDRefs{{ID: 10, Refs: []int64{9, 5}}}, nil),
+		MarshalIDRefsBunch2([]element.IDRefs{{ID: 10}, {ID: 10}}, nil),
+	} {
+		if _, err := ValidateIDRefsBunch(bad); err == nil {
+			t.Error("expected error for", bad)
+		}
+	}
+}
+
+// planetBunch returns a bunch with planet-scale node ids and way refs.
+func planetBunch() []element.IDRefs {
+	bunch := make([]element.IDRefs, 64)
+	ref := int64(900000000)
+	for i := range bunch {
+		bunch[i].ID = 10000000000 + int64(i)
+		bunch[i].Refs = make([]int64, 20)
+		for j := range bunch[i].Refs {
+			ref += 7919 * int64(j+1)
+			bunch[i].Refs[j] = ref
+		}
+	}
+	return bunch
+}
+
+func BenchmarkMarshalBunchPlanet(b *testing.B) {
+	bunch := planetBunch()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		MarshalIDRefsBunch2(bunch, nil)
+	}
+}
+
+func TestMarshaledBunchSize(t *testing.T) {
+	for _, bunch := range [][]element.IDRefs{
+		nil,
+		{{ID: 1}},
+		{{ID: 1, Refs: []int64{1 << 62, -(1 << 62)}}, {ID: 2, Refs: []int64{-1}}},
+		planetBunch(),
+	} {
+		buf := MarshalIDRefsBunch2(bunch, nil)
+		if size := marshaledBunchSize(bunch); size < len(buf) {
+			t.Error("size too small", size, len(buf))
+		}
+	}
+	// positive deltas at a varint boundary need more bytes than negative
+	// deltas of the same magnitude
+	for _, delta := range []int64{64, 1 << 20} {
+		bunch := []element.IDRefs{{ID: 1}}
+		for i := int64(1); i <= 20; i++ {
+			bunch[0].Refs = append(bunch[0].Refs, i*delta)
+		}
+		buf := MarshalIDRefsBunch2(bunch, nil)
+		if size := marshaledBunchSize(bunch); size < len(buf) {
+			t.Error("size too small for delta", delta, size, len(buf))
+		}
+	}
+	if varintSize(-64) != 1 || varintSize(64) != 2 || uvarintSize(1<<63) != 10 {
+		t.Error(varintSize(-64), varintSize(64), uvarintSize(1<<63))
+	}
+}
@@ -1,7 +1,6 @@
 package cache
 
 import (
-	"encoding/json"
 	"io/ioutil"
 	"os"
 
@@ -15,6 +14,46 @@ type cacheOptions struct {
 	WriteBufferSizeM     int
 	BlockSizeK           int
 	MaxFileSizeM         int
+	// AutoRepair repairs the LevelDB if it can not be opened because it
+	// is corrupt (e.g. after a crash) and retries to open it. Other
+	// errors, like the lock of another process, are returned without a
+	// repair. Repairing can discard data that was not completely written.
+	AutoRepair bool
+	// Storage is the type of the disk of the cache: "hdd", "ssd" or
+	// "auto" to detect it (only on Linux, defaults to ssd). LevelDB uses
+	// larger blocks and a larger block cache on hdd, to read more data
+	// with each seek. Empty uses the configured sizes, like ssd.
+	Storage string
+	// Comparator is the name of a custom LevelDB comparator for the key
+	// order (see RegisterComparator). Empty for the default bytewise
+	// order. A database can only be opened with the comparator it was
+	// created with.
+	Comparator string
+	// Preset applies a set of LevelDB options (see OptionsPreset) before
+	// all other options of the cache config, so that single options of
+	// the preset can be overridden.
+	Preset OptionsPreset
+	// BloomFilterBits enables a bloom filter with this number of bits per
+	// key, to skip reads of files that do not contain a key. 0 disables
+	// the filter.
+	BloomFilterBits int
+	// Compression of the LevelDB blocks: "snappy" (default) or "none".
+	Compression string
+	// SyncWrites syncs each write to disk before it returns. This makes
+	// writes durable on a system crash, but much slower.
+	SyncWrites bool
+	// CompactionStatsIntervalSec is the interval of the compaction
+	// statistics for OnCompactionStats. 0 disables the sampling.
+	CompactionStatsIntervalSec int
+	// InMemory keeps the LevelDB files in memory instead of the cache
+	// directory, e.g. for tests. All data is lost when the cache is
+	// closed. This requires the LevelDB memenv helper and the ldbmemenv
+	// build tag. Ref indices create no files on disk: the metadata is
+	// kept in memory, the touch timestamps, generations and overflow
+	// indices are in memory too, and the spill file, the degree sketch
+	// file, unflushed refs and the Optimize progress are disabled. Clone
+	// of an in-memory index creates the clone on disk.
+	InMemory bool
 }
 
 type coordsCacheOptions struct {
@@ -22,13 +61,153 @@ type coordsCacheOptions struct {
 	BunchSize          int
 	BunchCacheCapacity int
 }
+type refIndexOptions struct {
+	cacheOptions
+	// RefsBufferSizeM limits the approx. size of all refs that are
+	// buffered during linear import, in addition to the fixed number of
+	// buffered bunches. 0 disables the limit.
+	RefsBufferSizeM int
+	// WriteQueueDepth is the number of full buffers that are queued
+	// for the writer during linear import, before adds block. It only
+	// sets the depth of the queue: the writer still marshals and writes
+	// one buffer after another, so a deeper queue only helps if the input
+	// is bursty, and it increases the memory usage. Defaults to 2.
+	WriteQueueDepth int
+	// FlushReadConcurrency limits the number of write workers that read
+	// the stored values at the same time during a flush. The workers still
+	// merge and marshal the values in parallel. Lower values reduce the
+	// read load on the index, e.g. for reads of a cold cache that stall
+	// the LevelDB. 0 allows reads of all workers.
+	FlushReadConcurrency int
+	// testOptions for deterministic tests can only be set with the
+	// testing build tag (see diff_testing.go). They are not configurable
+	// with IMPOSM_CACHE_CONFIG.
+	testOptions testOptions
+	// WayNodesIndex enables an additional index of the nodes of each way
+	// for the coords index. This doubles the write costs.
+	WayNodesIndex bool
+	// WayNodeRangeIndex enables an additional index of the smallest and
+	// largest node ID of each way for the coords index (see WayNodeRange).
+	// This adds two refs for each way.
+	WayNodeRangeIndex bool
+	// Codec is the name of the value codec for new indices. Existing
+	// indices always use the codec they were created with.
+	Codec string
+	// DegreeSketch maintains an approximate number of refs per id for
+	// ApproxRefsCount. Requires 1MB of memory per index.
+	DegreeSketch bool
+	// AutoTune measures the write throughput during the first flushes
+	// of the linear import with different numbers of write workers and
+	// buffer sizes and continues with the fastest combination. The
+	// chosen values are logged.
+	AutoTune bool
+	// CompactBuffer buffers added refs in a single slice during linear
+	// import, instead of a map of bunches. This requires less memory per
+	// ref, so that more refs can be buffered before a flush. The refs
+	// are flushed after 16 times the number of bunches of the map buffer,
+	// or after RefsBufferSizeM.
+	CompactBuffer bool
+	// CompactAfterDiff compacts the key range of all values that were
+	// changed outside of the linear import with each Flush, e.g. after each
+	// diff import. This merges the small files of the changes, without the
+	// cost of a compaction of the whole index.
+	CompactAfterDiff bool
+	// FlushEveryWays flushes the buffer of the coords index after every
+	// FlushEveryWays calls of AddFromWay during linear import, e.g. to
+	// align the flushes with checkpoints of the input. The buffer is
+	// still flushed when it is full. 0 only flushes full buffers.
+	FlushEveryWays int
+	// MinWayNodes is the minimal number of nodes of a way for the coords
+	// index. Refs of ways with less nodes (e.g. degenerated ways with a
+	// single node) are not stored. 0 stores all ways.
+	MinWayNodes int
+	// RecoverPanics recovers panics in the background goroutines of the
+	// linear import. Recovered panics are logged and reported as errors
+	// (see Errors and LastError) and they abort the writes like
+	// ErrorAbort: the refs that were not written are saved as unflushed
+	// refs and Close returns the error. Without recovery, a panic crashes
+	// the process.
+	RecoverPanics bool
+	// TTLDays enables a timestamp of the last change for each id. Sweep
+	// removes the refs of all ids that were not changed for more than
+	// TTLDays days. 0 disables the timestamps.
+	TTLDays int
+	// ReadTimeoutMs limits the duration of Get/GetOrErr in milliseconds.
+	// Reads that take longer fail with ErrReadTimeout, but the read of
+	// LevelDB continues in the background till it completes.
+	// 0 disables the timeout.
+	ReadTimeoutMs int
+	// RelationsIndex enables an additional index of the relations that
+	// reference a relation (super-relations), for the ways index. Relation
+	// members of relations are ignored without this index.
+	RelationsIndex bool
+	// SpillThresholdK stores values (bunches) larger than this size in KB
+	// in a separate append-only file, LevelDB only stores a pointer. This
+	// keeps huge values of nodes with very many refs out of the LevelDB
+	// compactions. Space of replaced values is not reclaimed. 0 disables
+	// spilling.
+	SpillThresholdK int
+	// MaxValueRefs limits the refs of each id in the values of the index.
+	// The remaining refs of ids with more refs (e.g. nodes of huge
+	// relations) are stored in a separate overflow index and they are
+	// merged on read. This keeps the values small, only reads of ids
+	// with exactly MaxValueRefs stored refs read the overflow index too.
+	// See OverflowCount for the number of overflowed ids. Not supported
+	// with DedupOnRead. 0 disables the limit. The limit is recorded in the
+	// metadata of the index, later opens use the recorded limit.
+	MaxValueRefs int
+	// TrackGenerations stores the generation of the last change of each
+	// id, for ChangedSince and IterRefsGenerations. The generation is
+	// incremented with each flush of the linear import.
+	TrackGenerations bool
+	// DedupOnRead appends the refs of the linear import to the stored refs
+	// without sorting and deduplication. Reads sort the refs and remove
+	// duplicates. This speeds up writes of streams with many duplicate
+	// refs, at the cost of larger values and slower reads. CompactRefs
+	// sorts and deduplicates the stored refs afterwards. The option is
+	// recorded in the metadata of the index and stays enabled for all
+	// later opens of the index.
+	DedupOnRead bool
+	// MaxHeapSizeM checks the heap of the process every second during
+	// linear import. While more than MaxHeapSizeM MB are allocated, the
+	// buffer is flushed after an eighth of the bunches, to reduce the
+	// memory of the buffers on hosts with little or varying free memory.
+	// 0 always uses the fixed buffer size.
+	MaxHeapSizeM int
+	// DropPageCache removes the table files of the index from the page
+	// cache of the OS after each flush of the linear import, so that bulk
+	// writes do not push other data (e.g. the values that are merged
+	// with the new refs) out of the page cache. LevelDB does not support
+	// direct I/O, this uses posix_fadvise and it is only supported on
+	// Linux. Reads of the dropped files are slower.
+	DropPageCache bool
+	// SortedInput appends the refs of the linear import to the buffer
+	// without the sorted insert, for inputs that add the refs of each id
+	// in increasing order, e.g. AddFromWay with ways sorted by ID and with
+	// sorted node IDs for the WayNodesIndex. Refs that are added out of
+	// order are detected and their bunches are sorted before the flush.
+	// Ignored with CompactBuffer and DedupOnRead.
+	SortedInput bool
+	// ErrorPolicy decides whether failed writes of the linear import are
+	// skipped, retried or abort the import (see ErrorAction). Only
+	// available from code, see SetErrorPolicy. nil logs and skips errors.
+	ErrorPolicy ErrorPolicy `json:"-"`
+	// PinWriter locks the background writer of the linear import to a
+	// single OS thread, so that the writes of LevelDB stay on one core.
+	// This can reduce the traffic between the sockets of NUMA machines,
+	// but it can be slower on single socket machines.
+	PinWriter bool
+	// LogSummary logs the totals of the linear import (see Summary) at
+	// Close.
+	LogSummary bool
+}
 type osmCacheOptions struct {
 	Coords      coordsCacheOptions
 	Ways        cacheOptions
 	Nodes       cacheOptions
 	Relations   cacheOptions
-	CoordsIndex cacheOptions
-	WaysIndex   cacheOptions
+	CoordsIndex refIndexOptions
+	WaysIndex   refIndexOptions
 }
 
 const defaultConfig = `
@@ -73,7 +252,19 @@ const defaultConfig = `
         "BlockSizeK": 0,
         "MaxOpenFiles": 256,
         "MaxFileSizeM": 8,
-        "BlockRestartInterval": 256
+        "BlockRestartInterval": 256,
+        "RefsBufferSizeM": 0,
+        "WriteQueueDepth": 2,
+        "Codec": "deltavarint",
+        "WayNodesIndex": false,
+        "DegreeSketch": false,
+        "AutoTune": false,
+        "CompactBuffer": false,
+        "MinWayNodes": 0,
+        "RecoverPanics": false,
+        "TTLDays": 0,
+        "ReadTimeoutMs": 0,
+        "SpillThresholdK": 0
     },
     "WaysIndex": {
         "CacheSizeM": 16,
@@ -81,7 +272,18 @@ const defaultConfig = `
         "BlockSizeK": 0,
         "MaxOpenFiles": 64,
         "MaxFileSizeM": 8,
-        "BlockRestartInterval": 128
+        "BlockRestartInterval": 128,
+        "RefsBufferSizeM": 0,
+        "WriteQueueDepth": 2,
+        "Codec": "deltavarint",
+        "DegreeSketch": false,
+        "AutoTune": false,
+        "CompactBuffer": false,
+        "RelationsIndex": false,
+        "RecoverPanics": false,
+        "TTLDays": 0,
+        "ReadTimeoutMs": 0,
+        "SpillThresholdK": 0
     }
 }
 `
@@ -89,20 +291,20 @@ const defaultConfig = `
 var globalCacheOptions osmCacheOptions
 
 func init() {
-	err := json.Unmarshal([]byte(defaultConfig), &globalCacheOptions)
-	if err != nil {
-		panic(err)
-	}
-
+	var data []byte
+	var err error
 	cacheConfFile := os.Getenv("IMPOSM_CACHE_CONFIG")
 	if cacheConfFile != "" {
-		data, err := ioutil.ReadFile(cacheConfFile)
+		data, err = ioutil.ReadFile(cacheConfFile)
 		if err != nil {
 			log.Fatal("[fatal] Reading cache config:", err)
 		}
-		err = json.Unmarshal(data, &globalCacheOptions)
-		if err != nil {
-			log.Fatal("[fatal] Parsing cache config:", err)
+	}
+	globalCacheOptions, err = loadCacheOptions(data)
+	if err != nil {
+		if data == nil {
+			panic(err)
 		}
+		log.Fatal("[fatal] Parsing cache config:", err)
 	}
 }
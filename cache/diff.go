@@ -1,25 +1,36 @@
 package cache
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
 
 	osm "github.com/omniscale/go-osm"
-	"github.com/omniscale/imposm3/cache/binary"
 	"github.com/omniscale/imposm3/element"
 	"github.com/omniscale/imposm3/log"
 )
 
 type DiffCache struct {
-	Dir       string
+	Dir string
+	// IndexPath returns the directory of the index with the name (e.g.
+	// coords_index or ways_index), e.g. to store the indices on
+	// different disks. The index directories are in Dir if IndexPath is
+	// nil. Dir still contains the transaction journal of DiffTx.
+	IndexPath func(name string) string
 	Coords    *CoordsRefIndex    // Stores which ways a coord references
 	CoordsRel *CoordsRelRefIndex // Stores which relations a coord references
 	Ways      *WaysRefIndex      // Stores which relations a way references
+	// Stores which relations a relation references, nil if the
+	// RelationsIndex option is disabled
+	Relations *RelationsRefIndex
 	opened    bool
 }
 
@@ -28,19 +39,58 @@ func NewDiffCache(dir string) *DiffCache {
 	return cache
 }
 
-func (c *DiffCache) Close() {
+// NewDiffCacheWithPaths returns a DiffCache with the indices in the
+// directories of indexPath, see DiffCache.IndexPath.
+func NewDiffCacheWithPaths(dir string, indexPath func(name string) string) *DiffCache {
+	return &DiffCache{Dir: dir, IndexPath: indexPath}
+}
+
+func (c *DiffCache) indexPath(name string) string {
+	if c.IndexPath != nil {
+		return c.IndexPath(name)
+	}
+	return filepath.Join(c.Dir, name)
+}
+
+// Close closes all indices. The indices are closed concurrently, so that
+// the final flushes of the linear import run in parallel. It returns the
+// first error of the final flushes, in the order Coords, CoordsRel, Ways
+// and Relations.
+func (c *DiffCache) Close() error {
+	var closers []func() error
 	if c.Coords != nil {
-		c.Coords.Close()
+		closers = append(closers, c.Coords.Close)
 		c.Coords = nil
 	}
 	if c.CoordsRel != nil {
-		c.CoordsRel.Close()
+		closers = append(closers, c.CoordsRel.Close)
 		c.CoordsRel = nil
 	}
 	if c.Ways != nil {
-		c.Ways.Close()
+		closers = append(closers, c.Ways.Close)
 		c.Ways = nil
 	}
+	if c.Relations != nil {
+		closers = append(closers, c.Relations.Close)
+		c.Relations = nil
+	}
+
+	errs := make([]error, len(closers))
+	wg := sync.WaitGroup{}
+	for i, closeIndex := range closers {
+		wg.Add(1)
+		go func(i int, closeIndex func() error) {
+			errs[i] = closeIndex()
+			wg.Done()
+		}(i, closeIndex)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *DiffCache) Flush() {
@@ -53,25 +103,92 @@ func (c *DiffCache) Flush() {
 	if c.Ways != nil {
 		c.Ways.Flush()
 	}
+	if c.Relations != nil {
+		c.Relations.Flush()
+	}
+}
+
+// SetBufferSize flushes all indices and changes their flush size, see
+// bunchRefCache.SetBufferSize.
+func (c *DiffCache) SetBufferSize(n int) {
+	if c.Coords != nil {
+		c.Coords.SetBufferSize(n)
+	}
+	if c.CoordsRel != nil {
+		c.CoordsRel.SetBufferSize(n)
+	}
+	if c.Ways != nil {
+		c.Ways.SetBufferSize(n)
+	}
+	if c.Relations != nil {
+		c.Relations.SetBufferSize(n)
+	}
+}
+
+// SetWriteMode changes the write mode of all indices.
+func (c *DiffCache) SetWriteMode(mode WriteMode) {
+	if c.Coords != nil {
+		c.Coords.SetWriteMode(mode)
+		if c.Coords.wayNodes != nil {
+			c.Coords.wayNodes.SetWriteMode(mode)
+		}
+		if c.Coords.wayNodeRange != nil {
+			c.Coords.wayNodeRange.SetWriteMode(mode)
+		}
+	}
+	if c.CoordsRel != nil {
+		c.CoordsRel.SetWriteMode(mode)
+	}
+	if c.Ways != nil {
+		c.Ways.SetWriteMode(mode)
+	}
+	if c.Relations != nil {
+		c.Relations.SetWriteMode(mode)
+	}
 }
 
 func (c *DiffCache) Open() error {
 	var err error
-	c.Coords, err = newCoordsRefIndex(filepath.Join(c.Dir, "coords_index"))
+	c.Coords, err = newCoordsRefIndex(c.indexPath("coords_index"))
 	if err != nil {
 		c.Close()
 		return err
 	}
-	c.CoordsRel, err = newCoordsRelRefIndex(filepath.Join(c.Dir, "coords_rel_index"))
+	c.CoordsRel, err = newCoordsRelRefIndex(c.indexPath("coords_rel_index"))
 	if err != nil {
 		c.Close()
 		return err
 	}
-	c.Ways, err = newWaysRefIndex(filepath.Join(c.Dir, "ways_index"))
+	c.Ways, err = newWaysRefIndex(c.indexPath("ways_index"))
 	if err != nil {
 		c.Close()
 		return err
 	}
+	if globalCacheOptions.CoordsIndex.WayNodesIndex {
+		c.Coords.wayNodes, err = newRefIndex(c.indexPath("way_nodes_index"), &globalCacheOptions.CoordsIndex)
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+	if globalCacheOptions.CoordsIndex.WayNodeRangeIndex {
+		c.Coords.wayNodeRange, err = newRefIndex(c.indexPath("way_node_range_index"), &globalCacheOptions.CoordsIndex)
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+	if globalCacheOptions.WaysIndex.RelationsIndex {
+		c.Relations, err = newRelationsRefIndex(c.indexPath("relations_index"))
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+	if err := c.replayTx(); err != nil {
+		c.Close()
+		return err
+	}
 	c.opened = true
 	return nil
 }
@@ -80,13 +197,22 @@ func (c *DiffCache) Exists() bool {
 	if c.opened {
 		return true
 	}
-	if _, err := os.Stat(filepath.Join(c.Dir, "coords_index")); !os.IsNotExist(err) {
+	if _, err := os.Stat(c.indexPath("coords_index")); !os.IsNotExist(err) {
+		return true
+	}
+	if _, err := os.Stat(c.indexPath("coords_rel_index")); !os.IsNotExist(err) {
+		return true
+	}
+	if _, err := os.Stat(c.indexPath("ways_index")); !os.IsNotExist(err) {
 		return true
 	}
-	if _, err := os.Stat(filepath.Join(c.Dir, "coords_rel_index")); !os.IsNotExist(err) {
+	if _, err := os.Stat(c.indexPath("way_nodes_index")); !os.IsNotExist(err) {
 		return true
 	}
-	if _, err := os.Stat(filepath.Join(c.Dir, "ways_index")); !os.IsNotExist(err) {
+	if _, err := os.Stat(c.indexPath("way_node_range_index")); !os.IsNotExist(err) {
+		return true
+	}
+	if _, err := os.Stat(c.indexPath("relations_index")); !os.IsNotExist(err) {
 		return true
 	}
 	return false
@@ -96,20 +222,109 @@ func (c *DiffCache) Remove() error {
 	if c.opened {
 		c.Close()
 	}
-	if err := os.RemoveAll(filepath.Join(c.Dir, "coords_index")); err != nil {
+	if err := os.RemoveAll(c.indexPath("coords_index")); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(c.indexPath("coords_rel_index")); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(c.indexPath("ways_index")); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(c.indexPath("way_nodes_index")); err != nil {
 		return err
 	}
-	if err := os.RemoveAll(filepath.Join(c.Dir, "coords_rel_index")); err != nil {
+	if err := os.RemoveAll(c.indexPath("way_node_range_index")); err != nil {
 		return err
 	}
-	if err := os.RemoveAll(filepath.Join(c.Dir, "ways_index")); err != nil {
+	if err := os.RemoveAll(c.indexPath("relations_index")); err != nil {
 		return err
 	}
+	return removeTxJournal(c.Dir)
+}
+
+// Clone copies all indices into a new diff cache at destDir. The cache
+// is flushed before all values are copied. The cache remains open and it can
+// be used as before. destDir must not contain an existing diff cache. All
+// indices are copied into destDir, also with IndexPath.
+func (c *DiffCache) Clone(destDir string) error {
+	if !c.opened {
+		return errors.New("diff cache not opened")
+	}
+	if NewDiffCache(destDir).Exists() {
+		return errors.Errorf("diff cache in %s already exists", destDir)
+	}
+	c.Flush()
+	if err := c.Coords.copyTo(filepath.Join(destDir, "coords_index")); err != nil {
+		return errors.Wrap(err, "cloning coords index")
+	}
+	if err := c.CoordsRel.copyTo(filepath.Join(destDir, "coords_rel_index")); err != nil {
+		return errors.Wrap(err, "cloning coords rel index")
+	}
+	if err := c.Ways.copyTo(filepath.Join(destDir, "ways_index")); err != nil {
+		return errors.Wrap(err, "cloning ways index")
+	}
+	if c.Coords.wayNodes != nil {
+		if err := c.Coords.wayNodes.copyTo(filepath.Join(destDir, "way_nodes_index")); err != nil {
+			return errors.Wrap(err, "cloning way nodes index")
+		}
+	}
+	if c.Coords.wayNodeRange != nil {
+		if err := c.Coords.wayNodeRange.copyTo(filepath.Join(destDir, "way_node_range_index")); err != nil {
+			return errors.Wrap(err, "cloning way node range index")
+		}
+	}
+	if c.Relations != nil {
+		if err := c.Relations.copyTo(filepath.Join(destDir, "relations_index")); err != nil {
+			return errors.Wrap(err, "cloning relations index")
+		}
+	}
 	return nil
 }
 
+// AffectedRelations returns the sorted IDs of all relations that reference
+// nodeID, either directly as a node member or indirectly as a member of one of
+// the ways of the node.
+func (c *DiffCache) AffectedRelations(nodeID int64) ([]int64, error) {
+	refs, err := c.CoordsRel.GetBatch([]int64{nodeID})
+	if err != nil {
+		return nil, err
+	}
+	rels := mergeRefs(nil, refs[nodeID])
+
+	refs, err = c.Coords.GetBatch([]int64{nodeID})
+	if err != nil {
+		return nil, err
+	}
+	ways := refs[nodeID]
+	if len(ways) == 0 {
+		return rels, nil
+	}
+
+	refs, err = c.Ways.GetBatch(ways)
+	if err != nil {
+		return nil, err
+	}
+	for _, wayRels := range refs {
+		rels = mergeRefs(rels, wayRels)
+	}
+	return rels, nil
+}
+
+// ErrRefNotFound is returned by GetOrErr for ids that are not in the index.
+// It is the same error as NotFound, which is returned by all other caches.
+var ErrRefNotFound = NotFound
+
+// ErrClosed is returned by writes to a closed ref index, e.g. by AddFromWay
+// after Close.
+var ErrClosed = errors.New("ref index closed")
+
 const bufferSize = 64 * 1024
 
+// defaultWriteQueueDepth is the number of full buffers that can wait
+// for the writer, before AddFromWay/AddFromMembers block.
+const defaultWriteQueueDepth = 2
+
 type idRef struct {
 	id  int64
 	ref int64
@@ -119,6 +334,8 @@ type idRef struct {
 type idRefBunch struct {
 	id     int64 // the bunch id
 	idRefs []element.IDRefs
+	// unsorted is set by appendRef if the refs of an id are not sorted
+	unsorted bool
 }
 
 // idRefBunches can hold multiple idRefBunch
@@ -129,6 +346,37 @@ func (bunches *idRefBunches) add(bunchID, id, ref int64) {
 	idRefs.Add(ref)
 }
 
+// appendRef is like add, but it appends ref without the sorted insert.
+// Bunches with refs out of order (or duplicate refs) are marked as
+// unsorted, see sortUnsorted.
+func (bunches *idRefBunches) appendRef(bunchID, id, ref int64) {
+	bunch, ok := (*bunches)[bunchID]
+	if !ok {
+		bunch = idRefBunch{id: bunchID}
+	}
+	idRefs := bunch.getCreate(id)
+	if n := len(idRefs.Refs); n > 0 && idRefs.Refs[n-1] >= ref {
+		bunch.unsorted = true
+	}
+	idRefs.Refs = append(idRefs.Refs, ref)
+	(*bunches)[bunchID] = bunch
+}
+
+// sortUnsorted sorts and deduplicates the refs of all bunches that were
+// marked as unsorted by appendRef.
+func (bunches idRefBunches) sortUnsorted() {
+	for bunchID, bunch := range bunches {
+		if !bunch.unsorted {
+			continue
+		}
+		for i := range bunch.idRefs {
+			bunch.idRefs[i].Refs = sortDedupRefs(bunch.idRefs[i].Refs)
+		}
+		bunch.unsorted = false
+		bunches[bunchID] = bunch
+	}
+}
+
 func (bunches *idRefBunches) getCreate(bunchID, id int64) *element.IDRefs {
 	bunch, ok := (*bunches)[bunchID]
 	if !ok {
@@ -175,40 +423,211 @@ func (bunch *idRefBunch) getCreate(id int64) *element.IDRefs {
 	return result
 }
 
-var idRefBunchesPool chan idRefBunches
-
-func init() {
-	idRefBunchesPool = make(chan idRefBunches, 1)
-}
-
 // bunchRefCache
 type bunchRefCache struct {
+	generation uint64 // atomic, first field for 64-bit alignment
 	cache
+	indexOptions *refIndexOptions
+	path         string
+	meta         *refIndexMeta
+	sketch       *degreeSketch // nil if DegreeSketch is disabled
+	codec        refCodec
 	linearImport bool
 	buffer       idRefBunches
 	write        chan idRefBunches
+	bufferPool   chan idRefBunches // written buffers for reuse, see recycleBuffer
 	addc         chan idRef
+	addBatchc    chan []element.IDRefs
+	done         chan struct{} // closed to stop the dispatch of the linear import
+	addMu        sync.RWMutex  // held by adds of the linear import while they send
+	addOpen      bool          // protected by addMu, adds are accepted
+	barrier      chan barrierReq
+	errc         chan error
 	mu           sync.Mutex
+	syncWo       *levigo.WriteOptions
+	writeMode    WriteMode // protected by mu
+	hadDeletes   bool      // protected by mu
+	changedMin   []byte    // protected by mu, see CompactAfterDiff
+	changedMax   []byte    // protected by mu
+	flushSize    int32     // number of buffered bunches before a flush, atomic
+	workers      int32     // number of goroutines for writeRefs, atomic
+	memPressure  int32     // 1 if the heap exceeds MaxHeapSizeM, atomic
+	memStop      chan struct{}
+	memDone      chan struct{}
+	tuner        *refIndexTuner
+	snapshots    []refSnapshot                  // protected by mu
+	onFlush      func(entries int, bytes int64) // protected by mu
+	lastErr      error                          // protected by mu
+	errCount     int                            // protected by mu, number of background errors
+	abortErr     error                          // protected by mu, see ErrorAbort
+	summary      Summary                        // protected by mu
+	opened       time.Time
+	closed       time.Time      // protected by mu
+	touched      *cache         // nil if TTLDays is 0
+	generations  *cache         // nil if TrackGenerations is disabled
+	overflow     *cache         // nil if MaxValueRefs is 0
+	flushReads   chan struct{}  // semaphore of FlushReadConcurrency, nil without limit
+	changes      chan RefChange // protected by mu
+	spill        *spillFile     // nil if no value was or will be spilled
+	changeSeq    uint64         // protected by mu
+	lastSnapshot uint64         // protected by mu
+	flushMu      sync.RWMutex   // protects linear import changes against reads
+	flushSnap    *levigo.Snapshot
+	flushRo      *levigo.ReadOptions // reads during linear import, nil otherwise
+	subscribers  []*refSubscriber    // protected by mu, see Subscribe
 	waitAdd      sync.WaitGroup
 	waitWrite    sync.WaitGroup
 }
 
-func newRefIndex(path string, opts *cacheOptions) (*bunchRefCache, error) {
+func newRefIndex(path string, opts *refIndexOptions) (_ *bunchRefCache, err error) {
 	index := bunchRefCache{}
-	index.options = opts
-	err := index.open(path)
-	if err != nil {
+	index.options = &opts.cacheOptions
+	index.indexOptions = opts
+	index.path = path
+	index.opened = time.Now()
+	if !opts.InMemory {
+		if err := checkComparator(path, opts.Comparator); err != nil {
+			return nil, err
+		}
+	}
+	if err := index.open(path); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if index.touched != nil {
+			index.touched.Close()
+		}
+		if index.generations != nil {
+			index.generations.Close()
+		}
+		if index.overflow != nil {
+			index.overflow.Close()
+		}
+		if index.spill != nil {
+			index.spill.close()
+		}
+		if index.syncWo != nil {
+			index.syncWo.Close()
+		}
+		index.cache.Close()
+	}()
+	if err := index.initMeta(path); err != nil {
+		return nil, err
+	}
+	if opts.TTLDays > 0 {
+		index.touched = &cache{options: &cacheOptions{InMemory: opts.InMemory}}
+		if err := index.touched.open(filepath.Join(path, touchedIndexDir)); err != nil {
+			return nil, errors.Wrap(err, "opening touch timestamps")
+		}
+	}
+	if opts.TrackGenerations {
+		if err := index.initGenerations(filepath.Join(path, generationsIndexDir)); err != nil {
+			return nil, errors.Wrap(err, "opening generations")
+		}
+	}
+	// the recorded MaxValueRefs of initMeta, also if it is not configured
+	if index.indexOptions.MaxValueRefs > 0 {
+		if err := index.initOverflow(filepath.Join(path, overflowIndexDir)); err != nil {
+			return nil, errors.Wrap(err, "opening overflow index")
+		}
+	}
+	if err := index.initSpill(path); err != nil {
 		return nil, err
 	}
-	index.write = make(chan idRefBunches, 2)
-	index.buffer = make(idRefBunches, bufferSize)
-	index.addc = make(chan idRef, 1024)
+	if opts.DegreeSketch {
+		if err := index.initSketch(path); err != nil {
+			return nil, err
+		}
+	} else if !opts.InMemory {
+		// a sketch from an earlier run gets stale with the following writes
+		os.Remove(filepath.Join(path, degreeSketchFile))
+	}
+	index.flushSize = bufferSize
+	index.workers = int32(runtime.NumCPU())
+	if opts.FlushReadConcurrency > 0 {
+		index.flushReads = make(chan struct{}, opts.FlushReadConcurrency)
+	}
+	index.errc = make(chan error, 16)
+	index.syncWo = levigo.NewWriteOptions()
+	index.syncWo.SetSync(true)
 
+	if err := index.replayUnflushed(); err != nil {
+		return nil, err
+	}
 	return &index, nil
 }
 
+// WriteMode sets how ref indices write to LevelDB.
+type WriteMode int
+
+const (
+	// BulkWriteMode does not sync writes to disk. Writes since the last
+	// sync can get lost if the machine crashes. This is the default.
+	BulkWriteMode WriteMode = iota
+	// UpdateWriteMode syncs each write to disk before it returns.
+	UpdateWriteMode
+)
+
+// SetWriteMode changes the write mode of the index, e.g. from
+// BulkWriteMode for the initial import to UpdateWriteMode for diff imports.
+// The new mode is used for all following writes, including the
+// writes of refs that are already buffered for linear import.
+func (index *bunchRefCache) SetWriteMode(mode WriteMode) {
+	index.mu.Lock()
+	index.writeMode = mode
+	index.mu.Unlock()
+}
+
+func (index *bunchRefCache) writeOptions() *levigo.WriteOptions {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if index.writeMode == UpdateWriteMode {
+		return index.syncWo
+	}
+	return index.wo
+}
+
+// OnFlush registers fn to be called after each buffer of the linear
+// import was written successfully, with the number of written bunches
+// (LevelDB entries) and their size in bytes, including the keys. fn is
+// called from the background writer, it should return quickly as it blocks
+// further writes. A nil fn removes the callback.
+func (index *bunchRefCache) OnFlush(fn func(entries int, bytes int64)) {
+	index.mu.Lock()
+	index.onFlush = fn
+	index.mu.Unlock()
+}
+
+// Errors returns a channel for errors from the background writer (see
+// also LastError).
+//
+// In linear import mode, AddFromWay and AddFromMembers only pass the refs to
+// a background goroutine and return before the refs are written. Errors from
+// writing the refs are always logged and they are additionally sent to this
+// channel, so that callers can detect that refs were lost. Errors are dropped
+// (only logged) if the channel is full and no one receives them. The
+// channel is never closed. All pending writes are finished after
+// SetLinearImport(false), Flush or Close returned, so errors of these writes
+// are available in the channel at that point.
+func (index *bunchRefCache) Errors() <-chan error {
+	return index.errc
+}
+
 type CoordsRefIndex struct {
+	skippedWays int64 // atomic, first fields for 64-bit alignment
+	emptyWays   int64 // atomic
+	addedWays   int64 // atomic, for FlushEveryWays
 	*bunchRefCache
+	// wayNodes stores which nodes a way references, if the WayNodesIndex
+	// option is enabled
+	wayNodes *bunchRefCache
+	// wayNodeRange stores the smallest and largest node ID of each way, if
+	// the WayNodeRangeIndex option is enabled
+	wayNodeRange *bunchRefCache
+	onEmptyWay   func(way *osm.Way)
 }
 type CoordsRelRefIndex struct {
 	*bunchRefCache
@@ -216,13 +635,16 @@ type CoordsRelRefIndex struct {
 type WaysRefIndex struct {
 	*bunchRefCache
 }
+type RelationsRefIndex struct {
+	*bunchRefCache
+}
 
 func newCoordsRefIndex(dir string) (*CoordsRefIndex, error) {
 	cache, err := newRefIndex(dir, &globalCacheOptions.CoordsIndex)
 	if err != nil {
 		return nil, err
 	}
-	return &CoordsRefIndex{cache}, nil
+	return &CoordsRefIndex{bunchRefCache: cache}, nil
 }
 
 func newCoordsRelRefIndex(dir string) (*CoordsRelRefIndex, error) {
@@ -241,142 +663,725 @@ func newWaysRefIndex(dir string) (*WaysRefIndex, error) {
 	return &WaysRefIndex{cache}, nil
 }
 
+func newRelationsRefIndex(dir string) (*RelationsRefIndex, error) {
+	cache, err := newRefIndex(dir, &globalCacheOptions.WaysIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &RelationsRefIndex{cache}, nil
+}
+
 func (index *bunchRefCache) getBunchID(id int64) int64 {
 	return id / 64
 }
 
+// Flush writes all buffered refs of the linear import. Outside of the
+// linear import, it compacts the values that were changed since the last
+// Flush if CompactAfterDiff is enabled.
 func (index *bunchRefCache) Flush() {
+	index.flushMu.Lock()
+	defer index.flushMu.Unlock()
 	if index.linearImport {
 		// disable linear import flushes buffer
-		index.SetLinearImport(false)
-		index.SetLinearImport(true)
+		index.setLinearImport(false)
+		index.setLinearImport(true)
+		return
+	}
+	if index.indexOptions.CompactAfterDiff {
+		index.compactChanged()
+	}
+}
+
+// SetBufferSize flushes all buffered refs and changes the number of
+// buffered bunches before the next flush of the linear import to n, e.g. to
+// flush promptly after the initial import. n <= 0 restores the default size.
+// The dispatch and writer goroutines are stopped for the resize, so no refs
+// that were added before are lost. The flush size of the AutoTune option is
+// not changed afterwards.
+func (index *bunchRefCache) SetBufferSize(n int) {
+	if n <= 0 {
+		n = bufferSize
+	}
+	index.flushMu.Lock()
+	defer index.flushMu.Unlock()
+	linearImport := index.linearImport
+	if linearImport {
+		index.setLinearImport(false)
+	}
+	if index.tuner != nil && index.tuner.phase < 2 {
+		// keep the current workers, but stop tuning the flush size
+		index.tuner.phase = 2
+	}
+	atomic.StoreInt32(&index.flushSize, int32(n))
+	if linearImport {
+		index.setLinearImport(true)
 	}
 }
 
-func (index *bunchRefCache) Close() {
+// Close flushes all buffered refs and closes the index. It returns the
+// error of the final flush in linear import mode, e.g. if the disk is
+// full, or the error that aborted the writes (see ErrorAbort). The refs of
+// failed writes are saved next to the index and they are added when the
+// index is opened again (see saveUnflushed).
+func (index *bunchRefCache) Close() error {
+	var err error
 	if index.linearImport {
 		// disable linear import first to flush buffer
+		index.mu.Lock()
+		errCount := index.errCount
+		index.mu.Unlock()
 		index.SetLinearImport(false)
+		index.mu.Lock()
+		if index.errCount != errCount {
+			err = index.lastErr
+		}
+		index.mu.Unlock()
+	}
+	if abortErr := index.aborted(); abortErr != nil && err == nil {
+		err = abortErr
+	}
+	index.mu.Lock()
+	index.closed = time.Now()
+	index.mu.Unlock()
+	index.stopSubscribers()
+	if index.indexOptions.LogSummary {
+		log.Printf("[info] %s: %s", index.path, index.Summary())
 	}
 
+	index.releaseSnapshots()
+	if index.touched != nil {
+		index.touched.Close()
+		index.touched = nil
+	}
+	if index.generations != nil {
+		index.generations.Close()
+		index.generations = nil
+	}
+	if index.sketch != nil {
+		// the sketch of an in-memory index is lost like the refs
+		if !index.options.InMemory {
+			if err := index.sketch.write(index.path); err != nil {
+				log.Println("[error] writing degree sketch:", err)
+			}
+		}
+		index.sketch = nil
+	}
+	// wait for reads, e.g. reads that continue after a read timeout
+	index.flushMu.Lock()
 	index.cache.Close()
+	if index.overflow != nil {
+		index.overflow.Close()
+		index.overflow = nil
+	}
+	if index.spill != nil {
+		if err := index.spill.close(); err != nil {
+			log.Println("[error] closing spill file:", err)
+		}
+		index.spill = nil
+	}
+	index.flushMu.Unlock()
+	if index.syncWo != nil {
+		index.syncWo.Close()
+		index.syncWo = nil
+	}
+	return err
 }
 
 func (index *bunchRefCache) Get(id int64) []int64 {
-	if index.linearImport {
-		panic("programming error: get not supported in linearImport mode")
+	refs, _, err := index.get(id)
+	if err != nil {
+		panic(err)
 	}
-	keyBuf := idToKeyBuf(index.getBunchID(id))
+	return refs
+}
 
-	data, err := index.db.Get(index.ro, keyBuf)
+// GetOrErr returns the refs of id. It returns ErrRefNotFound if id is
+// not present in the index, this includes ids that lost all refs by Delete
+// or DeleteRef.
+func (index *bunchRefCache) GetOrErr(id int64) ([]int64, error) {
+	refs, ok, err := index.get(id)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	if !ok {
+		return nil, ErrRefNotFound
+	}
+	return refs, nil
+}
 
-	if data != nil {
-		idRefs := idRefsPool.get()
-		defer idRefsPool.release(idRefs)
-		for _, idRef := range binary.UnmarshalIDRefsBunch2(data, idRefs) {
-			if idRef.ID == id {
-				return idRef.Refs
+// GetBatch returns the refs for all ids. Each bunch is only read once, even
+// if it contains multiple ids. ids that are not present in the index are
+// missing in the result.
+func (index *bunchRefCache) GetBatch(ids []int64) (map[int64][]int64, error) {
+	return index.GetBatchCtx(context.Background(), ids)
+}
+
+// GetBatchCtx is like GetBatch, but it stops reading if ctx is done. ctx is
+// checked before each bunch is read. On cancellation it returns
+// the partial results of all bunches that were read so far, together
+// with ctx.Err().
+func (index *bunchRefCache) GetBatchCtx(ctx context.Context, ids []int64) (map[int64][]int64, error) {
+	ro, done := index.beginRead()
+	defer done()
+	sorted := make([]int64, len(ids))
+	copy(sorted, ids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	result := make(map[int64][]int64, len(ids))
+	for len(sorted) > 0 {
+		bunchID := index.getBunchID(sorted[0])
+		n := 1
+		for n < len(sorted) && index.getBunchID(sorted[n]) == bunchID {
+			n++
+		}
+		bunchIDs := sorted[:n]
+		sorted = sorted[n:]
+
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		key := getKeyBuf(bunchID)
+		_, err := index.viewValue(ro, key[:], func(data []byte) {
+			idRefs := index.codec.Unmarshal(data, nil)
+			for _, idRef := range idRefs {
+				i := sort.Search(len(bunchIDs), func(i int) bool {
+					return bunchIDs[i] >= idRef.ID
+				})
+				if i < len(bunchIDs) && bunchIDs[i] == idRef.ID {
+					result[idRef.ID] = idRef.Refs
+				}
 			}
+		})
+		releaseKeyBuf(key)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	return result, nil
 }
 
-func (index *bunchRefCache) Add(id, ref int64) error {
-	keyBuf := idToKeyBuf(index.getBunchID(id))
-
-	data, err := index.db.Get(index.ro, keyBuf)
+// GetBatchOrdered is like GetBatch, but it returns the results in the
+// order of ids, one result for each id (including duplicates). ids that are
+// not present in the index are returned with nil Refs.
+func (index *bunchRefCache) GetBatchOrdered(ids []int64) ([]element.IDRefs, error) {
+	refs, err := index.GetBatch(ids)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	var idRefs []element.IDRefs
-	if data != nil {
-		idRefs = idRefsPool.get()
-		defer idRefsPool.release(idRefs)
-		idRefs = binary.UnmarshalIDRefsBunch2(data, idRefs)
+	result := make([]element.IDRefs, len(ids))
+	for i, id := range ids {
+		result[i] = element.IDRefs{ID: id, Refs: refs[id]}
 	}
+	return result, nil
+}
 
-	idRefBunch := idRefBunch{index.getBunchID(id), idRefs}
-	idRef := idRefBunch.getCreate(id)
-	idRef.Add(ref)
-
-	data = bytePool.get()
-	defer bytePool.release(data)
-	data = binary.MarshalIDRefsBunch2(idRefBunch.idRefs, data)
-
-	return index.db.Put(index.wo, keyBuf, data)
+const getStreamBatchSize = 256
+
+// GetStream returns the refs for each id received from in. The results are
+// sent in the same order as the ids, ids that are not present in the index
+// are sent with nil Refs. Ids that are already waiting in the in channel are
+// read in batches (see GetBatch). The returned channel is closed after in was
+// closed and all results were sent.
+//
+// Read errors are sent to the error channel, which receives at most one
+// error and which is closed after the results channel. No more results are
+// sent after an error, but the remaining ids of in are still received, so
+// that the sender does not block. Check the error channel after all results
+// were received.
+func (index *bunchRefCache) GetStream(in <-chan int64) (<-chan element.IDRefs, <-chan error) {
+	out := make(chan element.IDRefs, getStreamBatchSize)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(out)
+		ids := make([]int64, 0, getStreamBatchSize)
+		for id := range in {
+			ids = append(ids[:0], id)
+		collect:
+			for len(ids) < getStreamBatchSize {
+				select {
+				case id, ok := <-in:
+					if !ok {
+						break collect
+					}
+					ids = append(ids, id)
+				default:
+					break collect
+				}
+			}
+			refs, err := index.GetBatch(ids)
+			if err != nil {
+				errc <- err
+				for range in {
+				}
+				return
+			}
+			for _, id := range ids {
+				out <- element.IDRefs{ID: id, Refs: refs[id]}
+			}
+		}
+	}()
+	return out, errc
 }
 
-func (index *bunchRefCache) DeleteRef(id, ref int64) error {
-	if index.linearImport {
-		panic("programming error: delete not supported in linearImport mode")
+// GetInto returns the refs of id and whether id is present in the index.
+// The refs are decoded into dst, which is only reallocated if its
+// capacity is too small. The result shares the memory of dst, so callers
+// can reuse the result as dst of the next call, but they must not use the
+// refs of a previous call after that.
+func (index *bunchRefCache) GetInto(id int64, dst []int64) ([]int64, bool) {
+	ro, done := index.beginRead()
+	defer done()
+	key := getKeyBuf(index.getBunchID(id))
+	defer releaseKeyBuf(key)
+	keyBuf := key[:]
+
+	refs := dst[:0]
+	var found bool
+	_, err := index.viewValue(ro, keyBuf, func(data []byte) {
+		refs, found = index.codec.AppendRefs(data, id, dst[:0])
+	})
+	if err != nil {
+		panic(err)
 	}
+	return refs, found
+}
 
-	keyBuf := idToKeyBuf(index.getBunchID(id))
-
-	data, err := index.db.Get(index.ro, keyBuf)
+// AppendRefs appends the refs of id to dst and returns the extended slice
+// and whether id is present in the index. The refs are decoded directly
+// from LevelDB into dst, without an intermediate slice. This can be used to
+// fill a repeated field of a message, e.g.
+// msg.Refs, _ = index.AppendRefs(msg.Refs, id)
+func (index *bunchRefCache) AppendRefs(dst []int64, id int64) ([]int64, bool) {
+	ro, done := index.beginRead()
+	defer done()
+	key := getKeyBuf(index.getBunchID(id))
+	defer releaseKeyBuf(key)
+	keyBuf := key[:]
+
+	refs := dst
+	var found bool
+	_, err := index.viewValue(ro, keyBuf, func(data []byte) {
+		refs, found = index.codec.AppendRefs(data, id, dst)
+	})
 	if err != nil {
-		return err
+		panic(err)
 	}
+	return refs, found
+}
 
-	if data != nil {
-		idRefs := idRefsPool.get()
-		defer idRefsPool.release(idRefs)
-		idRefs = binary.UnmarshalIDRefsBunch2(data, idRefs)
-		idRefBunch := idRefBunch{index.getBunchID(id), idRefs}
-		idRef := idRefBunch.get(id)
-		if idRef != nil {
-			idRef.Delete(ref)
-			data := bytePool.get()
-			defer bytePool.release(data)
-			data = binary.MarshalIDRefsBunch2(idRefs, data)
-			return index.db.Put(index.wo, keyBuf, data)
+// GetRefsFiltered returns the refs of id for which keep returns true, e.g.
+// only the ways of an ID range. keep is called while the refs are decoded,
+// without a slice of all refs. It is nil if id is not present or if no ref
+// is kept.
+func (index *bunchRefCache) GetRefsFiltered(id int64, keep func(ref int64) bool) []int64 {
+	ro, done := index.beginRead()
+	defer done()
+	key := getKeyBuf(index.getBunchID(id))
+	defer releaseKeyBuf(key)
+	keyBuf := key[:]
+
+	var refs []int64
+	_, err := index.viewValue(ro, keyBuf, func(data []byte) {
+		if filterer, ok := index.codec.(refFilterer); ok {
+			refs, _ = filterer.AppendRefsFiltered(data, id, nil, keep)
+			return
+		}
+		// codecs that sort or extend the refs after decoding (DedupOnRead,
+		// MaxValueRefs)
+		all, _ := index.codec.AppendRefs(data, id, nil)
+		for _, ref := range all {
+			if keep(ref) {
+				refs = append(refs, ref)
+			}
 		}
+	})
+	if err != nil {
+		panic(err)
 	}
-	return nil
+	return refs
 }
 
-func (index *bunchRefCache) Delete(id int64) error {
-	if index.linearImport {
-		panic("programming error: delete not supported in linearImport mode")
-	}
-
-	keyBuf := idToKeyBuf(index.getBunchID(id))
-
-	data, err := index.db.Get(index.ro, keyBuf)
+// GetRaw returns the stored value of the bunch of id without decoding,
+// e.g. to copy or hash values. The value contains all ids of the bunch
+// (see getBunchID) in the encoding of the index codec. Spilled values are
+// read from the spill file, refs in the overflow index (see MaxValueRefs)
+// are not included. The bool is false if the bunch is not stored. The
+// returned slice is a copy that is safe to retain.
+func (index *bunchRefCache) GetRaw(id int64) ([]byte, bool) {
+	ro, done := index.beginRead()
+	defer done()
+	key := getKeyBuf(index.getBunchID(id))
+	defer releaseKeyBuf(key)
+
+	data, err := index.getValue(ro, key[:])
 	if err != nil {
-		return err
+		panic(err)
 	}
+	return data, data != nil
+}
 
-	if data != nil {
-		idRefs := idRefsPool.get()
-		defer idRefsPool.release(idRefs)
-		idRefs = binary.UnmarshalIDRefsBunch2(data, idRefs)
-		idRefBunch := idRefBunch{index.getBunchID(id), idRefs}
-		idRef := idRefBunch.get(id)
-		if idRef != nil {
-			idRef.Refs = []int64{}
-			data := bytePool.get()
-			defer bytePool.release(data)
-			data = binary.MarshalIDRefsBunch2(idRefs, data)
-			return index.db.Put(index.wo, keyBuf, data)
-		}
+// GetRefsReverse returns the refs of id in descending order, e.g. to
+// process the most recent ways first. The refs are decoded into a new slice
+// and reversed in place, Get returns them in ascending order.
+func (index *bunchRefCache) GetRefsReverse(id int64) []int64 {
+	refs, _ := index.AppendRefs(nil, id)
+	for i, j := 0, len(refs)-1; i < j; i, j = i+1, j-1 {
+		refs[i], refs[j] = refs[j], refs[i]
 	}
-	return nil
+	return refs
 }
 
-func (index *CoordsRefIndex) AddFromWay(way *osm.Way) {
+// RefSet is a read-only set of the refs of an id, see GetSet.
+type RefSet struct {
+	refs []int64 // sorted
+}
+
+// Contains returns whether ref is in the set.
+func (s RefSet) Contains(ref int64) bool {
+	i := sort.Search(len(s.refs), func(i int) bool { return s.refs[i] >= ref })
+	return i < len(s.refs) && s.refs[i] == ref
+}
+
+// Len returns the number of refs in the set.
+func (s RefSet) Len() int {
+	return len(s.refs)
+}
+
+// Each calls fn for all refs in ascending order, till fn returns false.
+func (s RefSet) Each(fn func(ref int64) bool) {
+	for _, ref := range s.refs {
+		if !fn(ref) {
+			return
+		}
+	}
+}
+
+// GetSet returns the refs of id as a RefSet. Refs are stored sorted, so
+// the set uses the refs from Get without further processing.
+func (index *bunchRefCache) GetSet(id int64) RefSet {
+	return RefSet{refs: index.Get(id)}
+}
+
+// get returns the refs of id and whether id is present in the index.
+func (index *bunchRefCache) get(id int64) ([]int64, bool, error) {
+	if index.indexOptions.ReadTimeoutMs > 0 {
+		return index.getTimeout(id, time.Duration(index.indexOptions.ReadTimeoutMs)*time.Millisecond)
+	}
+	ro, done := index.beginRead()
+	defer done()
+	return index.getWith(ro, id)
+}
+
+// ErrReadTimeout is returned if a read takes longer than the
+// ReadTimeoutMs option.
+var ErrReadTimeout = errors.New("read timeout")
+
+// getTimeout reads id in a separate goroutine and returns ErrReadTimeout if
+// the read does not finish within timeout. A timed out read continues in
+// the background till LevelDB returns, Close waits for these reads.
+func (index *bunchRefCache) getTimeout(id int64, timeout time.Duration) ([]int64, bool, error) {
+	type result struct {
+		refs  []int64
+		found bool
+		err   error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		ro, done := index.beginRead()
+		defer done()
+		refs, found, err := index.getWith(ro, id)
+		resc <- result{refs, found, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-resc:
+		return r.refs, r.found, r.err
+	case <-timer.C:
+		return nil, false, ErrReadTimeout
+	}
+}
+
+// beginRead returns the read options for Get and all other reads of refs
+// and a func that needs to be called after the read.
+//
+// In linear import mode, reads use a snapshot that is created after each
+// Flush (and when the linear import is enabled). Reads only see the refs
+// that were added before the last Flush, even if the background writer
+// has already written further refs. Reads that are concurrent with Flush
+// wait till Flush returned. Reads never see a partially written Flush.
+func (index *bunchRefCache) beginRead() (*levigo.ReadOptions, func()) {
+	index.flushMu.RLock()
+	if index.flushRo != nil {
+		return index.flushRo, index.flushMu.RUnlock
+	}
+	return index.ro, index.flushMu.RUnlock
+}
+
+func (index *bunchRefCache) getWith(ro *levigo.ReadOptions, id int64) ([]int64, bool, error) {
+	key := getKeyBuf(index.getBunchID(id))
+	defer releaseKeyBuf(key)
+	keyBuf := key[:]
+
+	var refs []int64
+	var found bool
+	// decode directly from the LevelDB buffer, UnmarshalIDRefsBunch2
+	// copies all refs into Go memory
+	_, err := index.viewValue(ro, keyBuf, func(data []byte) {
+		idRefs := idRefsPool.get()
+		defer idRefsPool.release(idRefs)
+		for _, idRef := range index.codec.Unmarshal(data, idRefs) {
+			if idRef.ID == id {
+				refs = idRef.Refs
+				found = true
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return refs, found, nil
+}
+
+func (index *bunchRefCache) Add(id, ref int64) error {
+	if index.isClosed() {
+		return ErrClosed
+	}
+	key := getKeyBuf(index.getBunchID(id))
+	defer releaseKeyBuf(key)
+	keyBuf := key[:]
+
+	data, err := index.getValue(index.ro, keyBuf)
+	if err != nil {
+		return err
+	}
+
+	var idRefs []element.IDRefs
+	if data != nil {
+		idRefs = idRefsPool.get()
+		defer idRefsPool.release(idRefs)
+		idRefs = index.codec.Unmarshal(data, idRefs)
+	}
+
+	idRefBunch := idRefBunch{id: index.getBunchID(id), idRefs: idRefs}
+	idRef := idRefBunch.getCreate(id)
+	numRefs := len(idRef.Refs)
+	var oldRefs []int64
+	subscribed := index.hasSubscribers()
+	if subscribed {
+		oldRefs = append(oldRefs, idRef.Refs...)
+	}
+	idRef.Add(ref)
+	if index.sketch != nil && len(idRef.Refs) > numRefs {
+		index.sketch.add(id, 1)
+	}
+
+	stored, err := index.capOverflow(idRefBunch.idRefs)
+	if err != nil {
+		return err
+	}
+	data = bytePool.get()
+	defer bytePool.release(data)
+	data = index.codec.Marshal(stored, data)
+
+	if err := index.putValue(keyBuf, data); err != nil {
+		return err
+	}
+	if subscribed {
+		index.notify(id, oldRefs, idRef.Refs)
+	}
+	index.emitChange(ChangeSet, id, idRef.Refs)
+	return index.touch(id)
+}
+
+func (index *bunchRefCache) DeleteRef(id, ref int64) error {
+	if index.linearImport {
+		panic("programming error: delete not supported in linearImport mode")
+	}
+	if index.isClosed() {
+		return ErrClosed
+	}
+
+	key := getKeyBuf(index.getBunchID(id))
+	defer releaseKeyBuf(key)
+	keyBuf := key[:]
+
+	data, err := index.getValue(index.ro, keyBuf)
+	if err != nil {
+		return err
+	}
+
+	if data != nil {
+		idRefs := idRefsPool.get()
+		defer idRefsPool.release(idRefs)
+		idRefs = index.codec.Unmarshal(data, idRefs)
+		idRefBunch := idRefBunch{id: index.getBunchID(id), idRefs: idRefs}
+		idRef := idRefBunch.get(id)
+		if idRef != nil {
+			numRefs := len(idRef.Refs)
+			var oldRefs []int64
+			subscribed := index.hasSubscribers()
+			if subscribed {
+				oldRefs = append(oldRefs, idRef.Refs...)
+			}
+			idRef.Delete(ref)
+			index.markDeletes()
+			if index.sketch != nil && len(idRef.Refs) < numRefs {
+				index.sketch.add(id, -1)
+			}
+			if err := index.putBunch(keyBuf, idRefs); err != nil {
+				return err
+			}
+			if subscribed {
+				index.notify(id, oldRefs, idRef.Refs)
+			}
+			index.emitChange(ChangeSet, id, idRef.Refs)
+			return index.touch(id)
+		}
+	}
+	return nil
+}
+
+func (index *bunchRefCache) Delete(id int64) error {
+	if index.linearImport {
+		panic("programming error: delete not supported in linearImport mode")
+	}
+	if index.isClosed() {
+		return ErrClosed
+	}
+
+	key := getKeyBuf(index.getBunchID(id))
+	defer releaseKeyBuf(key)
+	keyBuf := key[:]
+
+	data, err := index.getValue(index.ro, keyBuf)
+	if err != nil {
+		return err
+	}
+
+	if data != nil {
+		idRefs := idRefsPool.get()
+		defer idRefsPool.release(idRefs)
+		idRefs = index.codec.Unmarshal(data, idRefs)
+		idRefBunch := idRefBunch{id: index.getBunchID(id), idRefs: idRefs}
+		idRef := idRefBunch.get(id)
+		if idRef != nil {
+			if index.sketch != nil {
+				index.sketch.add(id, -len(idRef.Refs))
+			}
+			oldRefs := idRef.Refs
+			idRef.Refs = []int64{}
+			index.markDeletes()
+			if err := index.putBunch(keyBuf, idRefs); err != nil {
+				return err
+			}
+			index.notify(id, oldRefs, nil)
+			index.emitChange(ChangeDelete, id, nil)
+			return index.touch(id)
+		}
+	}
+	return nil
+}
+
+// putBunch stores the bunch after a delete. IDs without refs are removed
+// from the bunch and the key is deleted if no ID is left. Deleted IDs are
+// absent afterwards, as IDs that were never added, and fully deleted
+// bunches do not keep an empty value in LevelDB.
+func (index *bunchRefCache) putBunch(keyBuf []byte, idRefs []element.IDRefs) error {
+	idRefs, err := index.capOverflow(idRefs)
+	if err != nil {
+		return err
+	}
+	idRefs = withoutEmptyRefs(idRefs)
+	if len(idRefs) == 0 {
+		index.markChanged(keyBuf)
+		return index.db.Delete(index.writeOptions(), keyBuf)
+	}
+	data := bytePool.get()
+	defer bytePool.release(data)
+	data = index.codec.Marshal(idRefs, data)
+	return index.putValue(keyBuf, data)
+}
+
+// withoutEmptyRefs returns idRefs without the IDs that have no refs. It
+// returns idRefs itself if all IDs have refs, otherwise a new slice.
+func withoutEmptyRefs(idRefs []element.IDRefs) []element.IDRefs {
+	for i := range idRefs {
+		if len(idRefs[i].Refs) > 0 {
+			continue
+		}
+		result := make([]element.IDRefs, i, len(idRefs)-1)
+		copy(result, idRefs[:i])
+		for _, idRef := range idRefs[i+1:] {
+			if len(idRef.Refs) > 0 {
+				result = append(result, idRef)
+			}
+		}
+		return result
+	}
+	return idRefs
+}
+
+// AddFromWay adds the way ID as a ref to all nodes of the way. Ways with
+// less than MinWayNodes nodes are skipped. Ways without nodes are malformed
+// and are counted as EmptyWays in Stats. It returns the first error of the
+// adds, e.g. ErrClosed after Close.
+func (index *CoordsRefIndex) AddFromWay(way *osm.Way) error {
+	if err := index.addFromWay(way); err != nil {
+		return err
+	}
+	if n := index.indexOptions.FlushEveryWays; n > 0 && index.linearImport &&
+		atomic.AddInt64(&index.addedWays, 1)%int64(n) == 0 {
+		index.flushBarrier()
+		if index.wayNodes != nil {
+			index.wayNodes.flushBarrier()
+		}
+		if index.wayNodeRange != nil {
+			index.wayNodeRange.flushBarrier()
+		}
+	}
+	return nil
+}
+
+func (index *CoordsRefIndex) addFromWay(way *osm.Way) error {
+	if len(way.Nodes) == 0 {
+		atomic.AddInt64(&index.emptyWays, 1)
+		if index.onEmptyWay != nil {
+			index.onEmptyWay(way)
+		}
+		return nil
+	}
+	if len(way.Nodes) < index.indexOptions.MinWayNodes {
+		atomic.AddInt64(&index.skippedWays, 1)
+		return nil
+	}
 	for _, node := range way.Nodes {
 		if index.linearImport {
-			index.addc <- idRef{id: node.ID, ref: way.ID}
-		} else {
-			index.Add(node.ID, way.ID)
+			if err := index.addLinear(node.ID, way.ID); err != nil {
+				return err
+			}
+		} else if err := index.Add(node.ID, way.ID); err != nil {
+			return err
 		}
 	}
+	if index.wayNodes != nil {
+		for _, node := range way.Nodes {
+			if index.wayNodes.linearImport {
+				if err := index.wayNodes.addLinear(way.ID, node.ID); err != nil {
+					return err
+				}
+			} else if err := index.wayNodes.Add(way.ID, node.ID); err != nil {
+				return err
+			}
+		}
+	}
+	if index.wayNodeRange != nil {
+		return index.addWayNodeRange(way)
+	}
+	return nil
 }
 
 func (index *CoordsRefIndex) DeleteFromWay(way *osm.Way) {
@@ -386,83 +1391,616 @@ func (index *CoordsRefIndex) DeleteFromWay(way *osm.Way) {
 	for _, node := range way.Nodes {
 		index.DeleteRef(node.ID, way.ID)
 	}
+	if index.wayNodes != nil {
+		index.wayNodes.Delete(way.ID)
+	}
+	if index.wayNodeRange != nil {
+		index.wayNodeRange.Delete(way.ID)
+	}
+}
+
+// GetNodesForWay returns the sorted IDs of all nodes that were added with
+// AddFromWay for wayID. The order of the nodes within the way is not
+// preserved. Requires the WayNodesIndex option.
+func (index *CoordsRefIndex) GetNodesForWay(wayID int64) ([]int64, error) {
+	if index.wayNodes == nil {
+		return nil, errors.New("way nodes index not enabled")
+	}
+	refs, _, err := index.wayNodes.get(wayID)
+	return refs, err
+}
+
+func (index *CoordsRefIndex) SetLinearImport(val bool) {
+	index.bunchRefCache.SetLinearImport(val)
+	if index.wayNodes != nil {
+		index.wayNodes.SetLinearImport(val)
+	}
+	if index.wayNodeRange != nil {
+		index.wayNodeRange.SetLinearImport(val)
+	}
+}
+
+func (index *CoordsRefIndex) Flush() {
+	index.bunchRefCache.Flush()
+	if index.wayNodes != nil {
+		index.wayNodes.Flush()
+	}
+	if index.wayNodeRange != nil {
+		index.wayNodeRange.Flush()
+	}
 }
 
-func (index *CoordsRelRefIndex) AddFromMembers(relID int64, members []osm.Member) {
+// SkippedWays returns the number of ways that were skipped by AddFromWay,
+// because they had less than MinWayNodes nodes.
+func (index *CoordsRefIndex) SkippedWays() int64 {
+	return atomic.LoadInt64(&index.skippedWays)
+}
+
+// CoordsRefIndexStats are counters of a CoordsRefIndex.
+type CoordsRefIndexStats struct {
+	// SkippedWays is the number of ways with less than MinWayNodes nodes.
+	SkippedWays int64
+	// EmptyWays is the number of malformed ways without any nodes.
+	EmptyWays int64
+}
+
+// Stats returns the counters of ways that were not added by AddFromWay.
+func (index *CoordsRefIndex) Stats() CoordsRefIndexStats {
+	return CoordsRefIndexStats{
+		SkippedWays: atomic.LoadInt64(&index.skippedWays),
+		EmptyWays:   atomic.LoadInt64(&index.emptyWays),
+	}
+}
+
+// SharesWay returns whether nodeA and nodeB are nodes of a common way. Both
+// refs are decoded into one buffer and the sorted refs are intersected
+// till the first common way.
+func (index *CoordsRefIndex) SharesWay(nodeA, nodeB int64) bool {
+	var buf [64]int64
+	refs, found := index.AppendRefs(buf[:0], nodeA)
+	if !found || len(refs) == 0 {
+		return false
+	}
+	n := len(refs)
+	refs, _ = index.AppendRefs(refs, nodeB)
+	return sortedRefsIntersect(refs[:n], refs[n:])
+}
+
+// sortedRefsIntersect returns whether the sorted refs a and b contain a
+// common ref.
+func sortedRefsIntersect(a, b []int64) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			return true
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return false
+}
+
+// OnEmptyWay registers fn, which is called by AddFromWay for each way
+// without nodes, e.g. to log the IDs of malformed ways. fn is called from
+// the caller of AddFromWay and needs to be registered before the import.
+func (index *CoordsRefIndex) OnEmptyWay(fn func(way *osm.Way)) {
+	index.onEmptyWay = fn
+}
+
+func (index *CoordsRefIndex) Close() error {
+	if skipped := index.SkippedWays(); skipped > 0 {
+		log.Printf("[info] skipped refs of %d ways with less than %d nodes", skipped, index.indexOptions.MinWayNodes)
+	}
+	if empty := atomic.LoadInt64(&index.emptyWays); empty > 0 {
+		log.Printf("[warn] ignored %d malformed ways without nodes", empty)
+	}
+	err := index.bunchRefCache.Close()
+	if index.wayNodes != nil {
+		if wayNodesErr := index.wayNodes.Close(); err == nil {
+			err = wayNodesErr
+		}
+		index.wayNodes = nil
+	}
+	if index.wayNodeRange != nil {
+		if wayNodeRangeErr := index.wayNodeRange.Close(); err == nil {
+			err = wayNodeRangeErr
+		}
+		index.wayNodeRange = nil
+	}
+	return err
+}
+
+// addMember adds relID as a ref to the member id, in linear import mode or
+// with Add. It returns ErrClosed after Close.
+func (index *bunchRefCache) addMember(id, relID int64) error {
+	if index.linearImport {
+		return index.addLinear(id, relID)
+	}
+	return index.Add(id, relID)
+}
+
+// AddFromMembers adds relID as a ref to all node members. Way and relation
+// members are ignored. It returns the first error of the adds, e.g.
+// ErrClosed after Close.
+func (index *CoordsRelRefIndex) AddFromMembers(relID int64, members []osm.Member) error {
 	for _, member := range members {
 		if member.Type == osm.NodeMember {
-			if index.linearImport {
-				index.addc <- idRef{id: member.ID, ref: relID}
-			} else {
-				index.Add(member.ID, relID)
+			if err := index.addMember(member.ID, relID); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
 }
 
-func (index *WaysRefIndex) AddFromMembers(relID int64, members []osm.Member) {
+// AddFromMembers adds relID as a ref to all way members. Node and relation
+// members are ignored. It returns the first error of the adds.
+func (index *WaysRefIndex) AddFromMembers(relID int64, members []osm.Member) error {
 	for _, member := range members {
 		if member.Type == osm.WayMember {
-			if index.linearImport {
-				index.addc <- idRef{id: member.ID, ref: relID}
-			} else {
-				index.Add(member.ID, relID)
+			if err := index.addMember(member.ID, relID); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
+}
+
+// AddFromMembers adds relID as a ref to all relation members (i.e. relID
+// is a super-relation of the members). Node and way members are ignored.
+// It returns the first error of the adds.
+func (index *RelationsRefIndex) AddFromMembers(relID int64, members []osm.Member) error {
+	for _, member := range members {
+		if member.Type == osm.RelationMember {
+			if err := index.addMember(member.ID, relID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // SetLinearImport optimizes the cache for write operations.
-// Get/Delete operations will panic during linear import.
+// During linear import, reads like Get are served from a snapshot of the
+// last Flush (see beginRead) and Delete/DeleteRef will panic.
 func (index *bunchRefCache) SetLinearImport(val bool) {
+	index.flushMu.Lock()
+	defer index.flushMu.Unlock()
+	index.setLinearImport(val)
+}
+
+func (index *bunchRefCache) setLinearImport(val bool) {
 	if val == index.linearImport {
 		// already in this mode
 		return
 	}
 	if val {
+		depth := index.indexOptions.WriteQueueDepth
+		if depth <= 0 {
+			depth = defaultWriteQueueDepth
+		}
+		index.write = make(chan idRefBunches, depth)
+		if index.bufferPool == nil {
+			// enough for all queued buffers, the pool never blocks
+			index.bufferPool = make(chan idRefBunches, depth)
+		}
+		if index.indexOptions.AutoTune && index.tuner == nil {
+			index.tuner = newRefIndexTuner(filepath.Base(index.path))
+			index.tuner.start(index)
+		}
+		if !index.indexOptions.CompactBuffer {
+			index.buffer = make(idRefBunches, bufferSize)
+		}
+		if index.indexOptions.testOptions.unbufferedAdd() {
+			index.addc = make(chan idRef)
+		} else {
+			index.addc = make(chan idRef, 1024)
+		}
+		index.barrier = make(chan barrierReq)
+		index.addBatchc = make(chan []element.IDRefs)
+		index.done = make(chan struct{})
+
 		index.waitWrite.Add(1)
 		index.waitAdd.Add(1)
 
 		go index.writer()
 		go index.dispatch()
+		index.startMemMonitor()
 
+		index.flushSnap = index.db.NewSnapshot()
+		index.flushRo = levigo.NewReadOptions()
+		index.flushRo.SetSnapshot(index.flushSnap)
 		index.linearImport = true
+		index.addMu.Lock()
+		index.addOpen = true
+		index.addMu.Unlock()
 	} else {
-		close(index.addc)
+		// wait for adds that are still sending, the dispatch receives
+		// their refs and all refs are queued before done is closed
+		index.addMu.Lock()
+		index.addOpen = false
+		index.addMu.Unlock()
+		close(index.done)
 		index.waitAdd.Wait()
+		index.stopMemMonitor()
 		close(index.write)
 		index.waitWrite.Wait()
 
+		index.flushRo.Close()
+		index.flushRo = nil
+		index.db.ReleaseSnapshot(index.flushSnap)
+		index.flushSnap = nil
 		index.linearImport = false
 	}
 }
 
 func (index *bunchRefCache) writer() {
+	defer index.waitWrite.Done()
+	if index.indexOptions.PinWriter {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
 	for buffer := range index.write {
-		if err := index.writeRefs(buffer); err != nil {
-			log.Println("[error] writing ref index:", err)
+		index.writeBuffer(buffer)
+	}
+}
+
+// writeBuffer writes a buffer of the linear import. With the RecoverPanics
+// option, a panic aborts the writes: the buffer (unless it was already
+// written) and all following buffers are saved as unflushed refs.
+func (index *bunchRefCache) writeBuffer(buffer idRefBunches) {
+	written := false
+	if index.indexOptions.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err := errors.Errorf("panic in writer of %s: %v", index.path, r)
+				index.backgroundError(err)
+				index.abort(err)
+				if !written && len(buffer) > 0 {
+					index.safeKeepUnflushed(buffer)
+				}
+			}
+		}()
+	}
+	if index.indexOptions.SortedInput {
+		buffer.sortUnsorted()
+	}
+	if index.aborted() != nil {
+		if len(buffer) > 0 {
+			index.keepUnflushed(buffer)
+		}
+		return
+	}
+	var ids, refs int
+	for _, bunch := range buffer {
+		ids += len(bunch.idRefs)
+		for _, idRefs := range bunch.idRefs {
+			refs += len(idRefs.Refs)
+		}
+	}
+	start := time.Now()
+	entries, bytes, err := index.writeRefs(buffer)
+	written = true
+	// the buffer is only reused after all writes, including the timestamps
+	// and generations, and not after a panic
+	index.recycleBuffer(buffer)
+	if err == nil && index.tuner != nil {
+		index.tuner.record(index, refs, time.Since(start))
+	}
+	if err == nil {
+		index.recordFlush(ids, refs, bytes)
+		if index.indexOptions.DropPageCache {
+			if err := dropPageCache(index.path); err != nil {
+				log.Printf("[warn] dropping page cache of %s: %s", index.path, err)
+			}
+		}
+		index.mu.Lock()
+		onFlush := index.onFlush
+		index.mu.Unlock()
+		if onFlush != nil {
+			onFlush(entries, bytes)
 		}
 	}
-	index.waitWrite.Done()
+	if err != nil {
+		index.backgroundError(errors.Wrap(err, "writing ref index"))
+	}
+}
+
+// backgroundError logs err from the background writer and stores it
+// for Errors and LastError.
+func (index *bunchRefCache) backgroundError(err error) {
+	log.Println("[error]", err)
+	index.mu.Lock()
+	index.lastErr = err
+	index.errCount++
+	index.mu.Unlock()
+	select {
+	case index.errc <- err:
+	default:
+	}
+}
+
+// LastError returns the last error of the background writer, including
+// recovered panics (see RecoverPanics option), or nil.
+func (index *bunchRefCache) LastError() error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	return index.lastErr
 }
 
 func (index *bunchRefCache) dispatch() {
-	for idRef := range index.addc {
-		index.buffer.add(index.getBunchID(idRef.id), idRef.id, idRef.ref)
-		if len(index.buffer) >= bufferSize {
-			index.write <- index.buffer
-			select {
-			case index.buffer = <-idRefBunchesPool:
-			default:
-				index.buffer = make(idRefBunches, bufferSize)
+	defer index.waitAdd.Done()
+	// approx. size of all buffered refs, a single bunch can get large
+	// for nodes/ways with a lot of refs (e.g. nodes of large relations)
+	var bufferedBytes int64
+	maxBufferedBytes := int64(index.indexOptions.RefsBufferSizeM) * 1024 * 1024
+
+	// refs for the CompactBuffer option, converted to bunches on flush
+	var compact []idRef
+	compactBuffer := index.indexOptions.CompactBuffer
+	dedupOnRead := index.indexOptions.DedupOnRead
+	sortedInput := index.indexOptions.SortedInput
+
+	if index.indexOptions.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err := errors.Errorf("panic in dispatch of %s: %v", index.path, r)
+				index.backgroundError(err)
+				index.abort(err)
+				index.keepRemainingRefs(compact)
 			}
-		}
+		}()
 	}
-	if len(index.buffer) > 0 {
+
+	flush := func() {
+		if compactBuffer {
+			index.write <- index.compactToBunches(compact)
+			compact = compact[:0]
+			bufferedBytes = 0
+			return
+		}
 		index.write <- index.buffer
-		index.buffer = nil
+		bufferedBytes = 0
+		select {
+		case index.buffer = <-index.bufferPool:
+		default:
+			index.buffer = make(idRefBunches, bufferSize)
+		}
+	}
+
+	add := func(idRef idRef) {
+		if index.sketch != nil {
+			index.sketch.add(idRef.id, 1)
+		}
+		if compactBuffer {
+			compact = append(compact, idRef)
+			bufferedBytes += 16
+			if len(compact) >= index.effectiveFlushSize()*compactRefsPerBunch ||
+				(maxBufferedBytes > 0 && bufferedBytes >= maxBufferedBytes) {
+				flush()
+			}
+			return
+		}
+		if dedupOnRead {
+			idRefs := index.buffer.getCreate(index.getBunchID(idRef.id), idRef.id)
+			idRefs.Refs = append(idRefs.Refs, idRef.ref)
+		} else if sortedInput {
+			index.buffer.appendRef(index.getBunchID(idRef.id), idRef.id, idRef.ref)
+		} else {
+			index.buffer.add(index.getBunchID(idRef.id), idRef.id, idRef.ref)
+		}
+		bufferedBytes += 8
+		if len(index.buffer) >= index.effectiveFlushSize() ||
+			(maxBufferedBytes > 0 && bufferedBytes >= maxBufferedBytes) {
+			flush()
+		}
+	}
+
+	// addBatch merges the sorted refs of each id with a single insert
+	addBatch := func(idRefs []element.IDRefs) {
+		if compactBuffer || dedupOnRead || sortedInput {
+			// these buffers do not sort on insert
+			for _, r := range idRefs {
+				for _, ref := range r.Refs {
+					add(idRef{id: r.ID, ref: ref})
+				}
+			}
+			return
+		}
+		for _, r := range idRefs {
+			if index.sketch != nil {
+				index.sketch.add(r.ID, len(r.Refs))
+			}
+			refs := index.buffer.getCreate(index.getBunchID(r.ID), r.ID)
+			refs.Refs = mergeRefs(refs.Refs, r.Refs)
+			bufferedBytes += 8 * int64(len(r.Refs))
+			if len(index.buffer) >= index.effectiveFlushSize() ||
+				(maxBufferedBytes > 0 && bufferedBytes >= maxBufferedBytes) {
+				flush()
+			}
+		}
+	}
+
+	for {
+		select {
+		case idRef := <-index.addc:
+			add(idRef)
+		case idRefs := <-index.addBatchc:
+			addBatch(idRefs)
+		case <-index.done:
+			// add all refs that were queued before the linear import
+			// ended, later adds return ErrClosed (see addOpen)
+			for n := len(index.addc); n > 0; n-- {
+				add(<-index.addc)
+			}
+			if len(index.buffer) > 0 || len(compact) > 0 {
+				flush()
+			}
+			index.buffer = nil
+			return
+		case req := <-index.barrier:
+			// add all refs that were queued before the barrier
+			for n := len(index.addc); n > 0; n-- {
+				add(<-index.addc)
+			}
+			if req.flush && (len(index.buffer) > 0 || len(compact) > 0) {
+				flush()
+			}
+			close(req.done)
+		}
+	}
+}
+
+// keepRemainingRefs passes the buffered refs and all refs that are added
+// until the end of the linear import to the writer, after a recovered panic
+// of the dispatch. The writes are aborted and the writer saves them as
+// unflushed refs (see writeBuffer).
+func (index *bunchRefCache) keepRemainingRefs(compact []idRef) {
+	rest := index.buffer
+	if rest == nil {
+		rest = make(idRefBunches)
+	}
+	for _, r := range compact {
+		rest.add(index.getBunchID(r.id), r.id, r.ref)
+	}
+	add := func(r idRef) {
+		rest.add(index.getBunchID(r.id), r.id, r.ref)
+	}
+	for {
+		select {
+		case r := <-index.addc:
+			add(r)
+		case idRefs := <-index.addBatchc:
+			for _, r := range idRefs {
+				for _, ref := range r.Refs {
+					add(idRef{id: r.ID, ref: ref})
+				}
+			}
+		case req := <-index.barrier:
+			close(req.done)
+		case <-index.done:
+			for n := len(index.addc); n > 0; n-- {
+				add(<-index.addc)
+			}
+			if len(rest) > 0 {
+				index.write <- rest
+			}
+			index.buffer = nil
+			return
+		}
+	}
+}
+
+// compactRefsPerBunch is the assumed number of refs per bunch for the
+// flush size of the CompactBuffer option.
+const compactRefsPerBunch = 16
+
+// compactToBunches sorts refs and groups them into bunches. The refs of
+// all bunches share a single slice.
+func (index *bunchRefCache) compactToBunches(refs []idRef) idRefBunches {
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].id == refs[j].id {
+			return refs[i].ref < refs[j].ref
+		}
+		return refs[i].id < refs[j].id
+	})
+
+	all := make([]int64, 0, len(refs))
+	bunches := make(idRefBunches)
+	var bunch idRefBunch
+	for i := 0; i < len(refs); {
+		id := refs[i].id
+		start := len(all)
+		for ; i < len(refs) && refs[i].id == id; i++ {
+			if len(all) == start || all[len(all)-1] != refs[i].ref {
+				all = append(all, refs[i].ref)
+			}
+		}
+		bunchID := index.getBunchID(id)
+		if bunchID != bunch.id || bunch.idRefs == nil {
+			if bunch.idRefs != nil {
+				bunches[bunch.id] = bunch
+			}
+			bunch = idRefBunch{id: bunchID}
+		}
+		// limit capacity, appends must not overwrite the refs of the next id
+		bunch.idRefs = append(bunch.idRefs, element.IDRefs{ID: id, Refs: all[start:len(all):len(all)]})
+	}
+	if bunch.idRefs != nil {
+		bunches[bunch.id] = bunch
+	}
+	return bunches
+}
+
+// Barrier blocks till all refs that were added before the call are in the
+// buffer of the linear import (but not necessarily written). Barrier is
+// mainly useful for tests, in combination with the UnbufferedAdd test option
+// (see diff_testing.go).
+func (index *bunchRefCache) Barrier() {
+	if !index.linearImport {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case index.barrier <- barrierReq{done: done}:
+		<-done
+	case <-index.done:
+	}
+}
+
+// addLinear queues a ref for the dispatch of the linear import. It returns
+// ErrClosed if the linear import ended, e.g. by Close.
+func (index *bunchRefCache) addLinear(id, ref int64) error {
+	index.addMu.RLock()
+	defer index.addMu.RUnlock()
+	if !index.addOpen {
+		return ErrClosed
+	}
+	index.addc <- idRef{id: id, ref: ref}
+	return nil
+}
+
+// addBatchLinear passes idRefs to the dispatch of the linear import, e.g.
+// refs that were pre-merged by AddFromWays. The refs of each ID need to be
+// sorted and deduplicated and they must not be modified afterwards. It
+// returns ErrClosed if the linear import ended.
+func (index *bunchRefCache) addBatchLinear(idRefs []element.IDRefs) error {
+	index.addMu.RLock()
+	defer index.addMu.RUnlock()
+	if !index.addOpen {
+		return ErrClosed
+	}
+	index.addBatchc <- idRefs
+	return nil
+}
+
+// isClosed returns whether Close was called.
+func (index *bunchRefCache) isClosed() bool {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	return !index.closed.IsZero()
+}
+
+type barrierReq struct {
+	done  chan struct{}
+	flush bool // flush the buffer after the queued refs
+}
+
+// flushBarrier is like Barrier, but it also passes the buffer with all
+// queued refs to the writer. It does not wait for the write.
+func (index *bunchRefCache) flushBarrier() {
+	if !index.linearImport {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case index.barrier <- barrierReq{done: done, flush: true}:
+		<-done
+	case <-index.done:
 	}
-	index.waitAdd.Done()
 }
 
 type loadBunchItem struct {
@@ -471,11 +2009,15 @@ type loadBunchItem struct {
 }
 
 type writeBunchItem struct {
-	bunchIDBuf []byte
+	bunchIDBuf *[8]byte // from getKeyBuf
 	data       []byte
+	changes    []RefChange // only for ChangeStream
 }
 
-func (index *bunchRefCache) writeRefs(idRefs idRefBunches) error {
+// writeRefs merges and writes all bunches. It returns the number of
+// written bunches and their size in bytes. idRefs can be recycled after
+// writeRefs returned (see recycleBuffer).
+func (index *bunchRefCache) writeRefs(idRefs idRefBunches) (int, int64, error) {
 	batch := levigo.NewWriteBatch()
 	defer batch.Close()
 
@@ -483,43 +2025,252 @@ func (index *bunchRefCache) writeRefs(idRefs idRefBunches) error {
 	putc := make(chan writeBunchItem)
 	loadc := make(chan loadBunchItem)
 
-	for i := 0; i < runtime.NumCPU(); i++ {
+	var errOnce sync.Once
+	var mergeErr error
+	// bunches that were not written because of mergeErr
+	var failedMu sync.Mutex
+	failed := make(idRefBunches)
+	var panicked int32 // merges only fail with recovered panics
+	fail := func(bunchID int64, err error) {
+		errOnce.Do(func() { mergeErr = err })
+		failedMu.Lock()
+		failed[bunchID] = idRefs[bunchID]
+		failedMu.Unlock()
+	}
+	withChanges := index.changeStreamEnabled()
+	workers := int(atomic.LoadInt32(&index.workers))
+	if index.indexOptions.testOptions.orderedWrites() {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
 			for item := range loadc {
-				keyBuf := idToKeyBuf(item.bunchID)
-				putc <- writeBunchItem{
-					keyBuf,
-					index.loadMergeMarshal(keyBuf, item.bunch.idRefs),
+				key := getKeyBuf(item.bunchID)
+				data, err := index.safeLoadMergeMarshal(key[:], item.bunch.idRefs)
+				if err != nil {
+					releaseKeyBuf(key)
+					atomic.StoreInt32(&panicked, 1)
+					fail(item.bunchID, err)
+					continue
+				}
+				var changes []RefChange
+				if withChanges {
+					changes = index.bunchChanges(data, item.bunch.idRefs)
 				}
+				putc <- writeBunchItem{key, data, changes}
 			}
 			wg.Done()
 		}()
 	}
 
 	go func() {
-		for bunchID, bunch := range idRefs {
-			loadc <- loadBunchItem{bunchID, bunch}
+		if index.indexOptions.testOptions.orderedWrites() {
+			bunchIDs := make([]int64, 0, len(idRefs))
+			for bunchID := range idRefs {
+				bunchIDs = append(bunchIDs, bunchID)
+			}
+			sort.Slice(bunchIDs, func(i, j int) bool { return bunchIDs[i] < bunchIDs[j] })
+			for _, bunchID := range bunchIDs {
+				loadc <- loadBunchItem{bunchID, idRefs[bunchID]}
+			}
+		} else {
+			for bunchID, bunch := range idRefs {
+				loadc <- loadBunchItem{bunchID, bunch}
+			}
 		}
 		close(loadc)
 		wg.Wait()
 		close(putc)
 	}()
 
+	var entries int
+	var bytes int64
+	var changes []RefChange
 	for item := range putc {
-		batch.Put(item.bunchIDBuf, item.data)
+		value, err := index.spillValue(item.data)
+		if err != nil {
+			fail(idFromKeyBuf(item.bunchIDBuf[:]), err)
+			bytePool.release(item.data)
+			releaseKeyBuf(item.bunchIDBuf)
+			continue
+		}
+		changes = append(changes, item.changes...)
+		// batch copies key and value
+		batch.Put(item.bunchIDBuf[:], value)
+		entries++
+		bytes += int64(len(item.bunchIDBuf) + len(item.data))
 		bytePool.release(item.data)
+		releaseKeyBuf(item.bunchIDBuf)
 	}
 
-	go func() {
-		for k := range idRefs {
-			delete(idRefs, k)
+	var touchBatch *levigo.WriteBatch
+	if index.touched != nil {
+		touchBatch = index.touchBatch(idRefs)
+		defer touchBatch.Close()
+	}
+	var genBatch *levigo.WriteBatch
+	if index.generations != nil {
+		genBatch = index.generationBatch(idRefs)
+		defer genBatch.Close()
+	}
+
+	if err := index.writeBatch(index.db, batch); err != nil {
+		// keep the refs for replayUnflushed, e.g. if the disk is full
+		index.keepUnflushed(idRefs)
+		return 0, 0, err
+	}
+	if touchBatch != nil {
+		if err := index.writeBatch(index.touched.db, touchBatch); err != nil {
+			return entries, bytes, errors.Wrap(err, "writing touch timestamps")
 		}
-		select {
-		case idRefBunchesPool <- idRefs:
+	}
+	if genBatch != nil {
+		if err := index.writeBatch(index.generations.db, genBatch); err != nil {
+			return entries, bytes, errors.Wrap(err, "writing generations")
+		}
+	}
+	index.emitChanges(changes)
+	if mergeErr != nil {
+		// all other bunches are written, merges are not retried
+		index.keepUnflushed(failed)
+		if atomic.LoadInt32(&panicked) != 0 {
+			// recovered panic of safeLoadMergeMarshal
+			index.abort(mergeErr)
+		} else {
+			index.errorAction(mergeErr, 1)
+		}
+		return entries, bytes, mergeErr
+	}
+	return entries, bytes, nil
+}
+
+// recycleBuffer clears the written buffer idRefs and puts it into the
+// pool for the next buffer of dispatch. idRefs must not be used
+// afterwards. Buffers are dropped if the pool is full.
+func (index *bunchRefCache) recycleBuffer(idRefs idRefBunches) {
+	for k := range idRefs {
+		delete(idRefs, k)
+	}
+	select {
+	case index.bufferPool <- idRefs:
+	default:
+	}
+}
+
+// writeBatch writes batch to db of the index. Failed writes are retried as
+// long as the ErrorPolicy option returns ErrorRetry.
+func (index *bunchRefCache) writeBatch(db *levigo.DB, batch *levigo.WriteBatch) error {
+	err := dbWrite(db, index.writeOptions(), batch)
+	for attempt := 1; err != nil && index.errorAction(err, attempt) == ErrorRetry; attempt++ {
+		log.Printf("[warn] retrying write to %s after: %s", index.path, err)
+		err = dbWrite(db, index.writeOptions(), batch)
+	}
+	return err
+}
+
+// keepUnflushed saves the refs of a buffer that is not written.
+func (index *bunchRefCache) keepUnflushed(idRefs idRefBunches) {
+	if path, saveErr := index.saveUnflushed(idRefs); saveErr != nil {
+		log.Printf("[error] refs of failed write to %s are lost: %s", index.path, saveErr)
+	} else {
+		log.Printf("[warn] saved refs of failed write to %s", path)
+	}
+}
+
+// safeKeepUnflushed calls keepUnflushed and logs panics, e.g. of a codec
+// that also panicked while writing idRefs.
+func (index *bunchRefCache) safeKeepUnflushed(idRefs idRefBunches) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[error] refs of failed write to %s are lost: %v", index.path, r)
 		}
 	}()
-	return index.db.Write(index.wo, batch)
+	index.keepUnflushed(idRefs)
+}
+
+// safeLoadMergeMarshal calls loadMergeMarshal and returns panics as errors,
+// if the RecoverPanics option is enabled.
+func (index *bunchRefCache) safeLoadMergeMarshal(keyBuf []byte, newBunch []element.IDRefs) (data []byte, err error) {
+	if index.indexOptions.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.Errorf("panic while merging bunch %d: %v", idFromKeyBuf(keyBuf), r)
+			}
+		}()
+	}
+	return index.loadMergeMarshal(keyBuf, newBunch), nil
+}
+
+// copyTo copies all values into a new LevelDB at path, created with the same
+// options as this index. The copy reads from a snapshot and is consistent even
+// with concurrent writes. With MaxValueRefs, the overflow index is copied
+// after the values, from a separate snapshot. The copy of an InMemory index
+// is created on disk.
+func (index *bunchRefCache) copyTo(path string) error {
+	opts := *index.options
+	opts.InMemory = false
+	dst := cache{options: &opts}
+	if err := dst.open(path); err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// the clone has no spill file, store spilled values inline
+	if err := copyValues(index.db, &dst, index.resolveValue); err != nil {
+		return err
+	}
+	if index.overflow != nil {
+		overflow := cache{options: &cacheOptions{}}
+		if err := overflow.open(filepath.Join(path, overflowIndexDir)); err != nil {
+			return errors.Wrap(err, "opening overflow index")
+		}
+		defer overflow.Close()
+		if err := copyValues(index.overflow.db, &overflow, nil); err != nil {
+			return errors.Wrap(err, "copying overflow index")
+		}
+	}
+	return writeRefIndexMeta(path, index.meta)
+}
+
+// copyValues copies all entries of a snapshot of src into dst. resolve
+// converts the values before they are written if it is not nil.
+func copyValues(src *levigo.DB, dst *cache, resolve func([]byte) ([]byte, error)) error {
+	snap := src.NewSnapshot()
+	defer src.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+
+	it := src.NewIterator(ro)
+	defer it.Close()
+
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		value := it.Value()
+		if resolve != nil {
+			var err error
+			if value, err = resolve(value); err != nil {
+				return err
+			}
+		}
+		batch.Put(it.Key(), value)
+		n++
+		if n%1024 == 0 {
+			if err := dst.db.Write(dst.wo, batch); err != nil {
+				return err
+			}
+			batch.Clear()
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+	return dst.db.Write(dst.wo, batch)
 }
 
 func mergeBunch(bunch, newBunch []element.IDRefs) []element.IDRefs {
@@ -536,9 +2287,7 @@ NextIDRef:
 					// no new refs -> delete
 					bunch = append(bunch[:i], bunch[i+1:]...)
 				} else { // otherwise add refs
-					for _, r := range newIDRefs.Refs {
-						bunch[i].Add(r)
-					}
+					bunch[i].Refs = mergeRefs(bunch[i].Refs, newIDRefs.Refs)
 				}
 				lastIdx = i
 				continue NextIDRef
@@ -563,30 +2312,94 @@ NextIDRef:
 	return bunch
 }
 
+// mergeRefs merges the sorted newRefs into the sorted refs, without
+// duplicates. newRefs are appended to refs if they are all larger than the
+// existing refs (common for linear imports, as ways are added by ID).
+// Otherwise both are merged in a single pass into a new slice.
+func mergeRefs(refs, newRefs []int64) []int64 {
+	if len(newRefs) == 0 {
+		return refs
+	}
+	if len(refs) == 0 || refs[len(refs)-1] < newRefs[0] {
+		return append(refs, newRefs...)
+	}
+
+	merged := make([]int64, 0, len(refs)+len(newRefs))
+	i, j := 0, 0
+	for i < len(refs) && j < len(newRefs) {
+		if refs[i] < newRefs[j] {
+			merged = append(merged, refs[i])
+			i++
+		} else if refs[i] > newRefs[j] {
+			merged = append(merged, newRefs[j])
+			j++
+		} else {
+			merged = append(merged, refs[i])
+			i++
+			j++
+		}
+	}
+	merged = append(merged, refs[i:]...)
+	merged = append(merged, newRefs[j:]...)
+	return merged
+}
+
+// streamMergeMinSize is the size of marshaled bunches that are merged
+// without decoding (see refMerger). Smaller bunches are faster to decode,
+// but large bunches with high-degree nodes would require huge temporary
+// ref slices.
+const streamMergeMinSize = 64 * 1024
+
 // loadMergeMarshal loads an existing bunch, merges the IDRefs and
 // marshals the result again.
 func (index *bunchRefCache) loadMergeMarshal(keyBuf []byte, newBunch []element.IDRefs) []byte {
-	data, err := index.db.Get(index.ro, keyBuf)
+	if index.flushReads != nil {
+		index.flushReads <- struct{}{}
+	}
+	data, err := index.getValue(index.ro, keyBuf)
+	if index.flushReads != nil {
+		<-index.flushReads
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	subscribed := index.hasSubscribers()
+	if merger, ok := index.codec.(refMerger); ok && len(data) >= streamMergeMinSize && !subscribed {
+		return merger.Merge(data, newBunch, bytePool.get())
+	}
+
+	// decode and append without deduplication for DedupOnRead
+	codec := index.storeCodec()
 	var bunch []element.IDRefs
 
 	if data != nil {
 		bunch = idRefsPool.get()
 		defer idRefsPool.release(bunch)
-		bunch = binary.UnmarshalIDRefsBunch2(data, bunch)
+		bunch = codec.Unmarshal(data, bunch)
+	}
+	var oldRefs map[int64][]int64
+	if subscribed {
+		oldRefs = copyBunchRefs(bunch, newBunch)
 	}
 
 	if bunch == nil {
 		bunch = newBunch
+	} else if index.indexOptions.DedupOnRead {
+		bunch = appendBunch(bunch, newBunch)
 	} else {
 		bunch = mergeBunch(bunch, newBunch)
 	}
+	if subscribed {
+		index.notifyBunch(oldRefs, bunch, newBunch)
+	}
 
+	bunch, err = index.capOverflow(bunch)
+	if err != nil {
+		panic(err)
+	}
 	data = bytePool.get()
-	data = binary.MarshalIDRefsBunch2(bunch, data)
+	data = codec.Marshal(bunch, data)
 	return data
 }
 
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"github.com/omniscale/imposm3/element"
+)
+
+// ChangeOp is the type of a RefChange.
+type ChangeOp int
+
+const (
+	// ChangeSet replaces all refs of the id with Refs.
+	ChangeSet ChangeOp = iota
+	// ChangeDelete removes all refs of the id.
+	ChangeDelete
+)
+
+// RefChange is a single change of a ref index, see ChangeStream.
+type RefChange struct {
+	Seq  uint64 // sequence number, increases by one for each change
+	Op   ChangeOp
+	ID   int64
+	Refs []int64 // all refs of ID after the change
+}
+
+// ChangeStream returns a channel with all following changes of the index,
+// e.g. for a standby index that applies the changes with ApplyChange.
+// Changes are sent after they are written, including all changes of the
+// background writer of the linear import. Changes from LoadFast are not
+// sent.
+//
+// Changes are dropped if the channel (with a buffer of size) is full. Seq
+// is increased for dropped changes as well, so consumers can detect gaps
+// and need to resync the index (e.g. with DumpFast/LoadFast). There is only
+// one stream for each index, ChangeStream panics if it is called twice.
+func (index *bunchRefCache) ChangeStream(size int) <-chan RefChange {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if index.changes != nil {
+		panic("programming error: change stream already created")
+	}
+	index.changes = make(chan RefChange, size)
+	return index.changes
+}
+
+func (index *bunchRefCache) changeStreamEnabled() bool {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	return index.changes != nil
+}
+
+// emitChange sends a change for id with a copy of refs.
+func (index *bunchRefCache) emitChange(op ChangeOp, id int64, refs []int64) {
+	if !index.changeStreamEnabled() {
+		return
+	}
+	index.emitChanges([]RefChange{{Op: op, ID: id, Refs: append([]int64{}, refs...)}})
+}
+
+// emitChanges assigns sequence numbers and sends all changes.
+func (index *bunchRefCache) emitChanges(changes []RefChange) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if index.changes == nil {
+		return
+	}
+	for _, c := range changes {
+		index.changeSeq++
+		c.Seq = index.changeSeq
+		select {
+		case index.changes <- c:
+		default:
+		}
+	}
+}
+
+// bunchChanges returns ChangeSet changes for all ids of newBunch with
+// their refs from the merged and marshaled bunch data.
+func (index *bunchRefCache) bunchChanges(data []byte, newBunch []element.IDRefs) []RefChange {
+	changes := make([]RefChange, 0, len(newBunch))
+	merged := index.codec.Unmarshal(data, nil)
+	for _, idRef := range newBunch {
+		for _, m := range merged {
+			if m.ID == idRef.ID {
+				changes = append(changes, RefChange{Op: ChangeSet, ID: m.ID, Refs: m.Refs})
+				break
+			}
+		}
+	}
+	return changes
+}
+
+// ApplyChange applies a change from the ChangeStream of another index.
+// Changes need to be applied in the order of their sequence numbers.
+func (index *bunchRefCache) ApplyChange(c RefChange) error {
+	if index.linearImport {
+		panic("programming error: apply not supported in linearImport mode")
+	}
+	bunchID := index.getBunchID(c.ID)
+	keyBuf := idToKeyBuf(bunchID)
+	data, err := index.getValue(index.ro, keyBuf)
+	if err != nil {
+		return err
+	}
+	bunch := idRefBunch{id: bunchID}
+	if data != nil {
+		bunch.idRefs = index.codec.Unmarshal(data, nil)
+	}
+	idRef := bunch.getCreate(c.ID)
+	numRefs := len(idRef.Refs)
+	oldRefs := idRef.Refs
+	if c.Op == ChangeDelete {
+		idRef.Refs = []int64{}
+	} else {
+		idRef.Refs = append([]int64{}, c.Refs...)
+	}
+	if len(idRef.Refs) < numRefs {
+		index.markDeletes()
+	}
+	if index.sketch != nil {
+		index.sketch.add(c.ID, len(idRef.Refs)-numRefs)
+	}
+	if err := index.putBunch(keyBuf, bunch.idRefs); err != nil {
+		return err
+	}
+	index.notify(c.ID, oldRefs, idRef.Refs)
+	index.emitChange(c.Op, c.ID, idRef.Refs)
+	return index.touch(c.ID)
+}
@@ -0,0 +1,266 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/omniscale/imposm3/cache/binary"
+	"github.com/omniscale/imposm3/element"
+	"github.com/omniscale/imposm3/log"
+	"github.com/pkg/errors"
+)
+
+// refCodec encodes and decodes the value of a single bunch of a ref index.
+// Implementations can reuse the passed buf/idRefs to reduce allocations.
+type refCodec interface {
+	Marshal(idRefs []element.IDRefs, buf []byte) []byte
+	Unmarshal(data []byte, idRefs []element.IDRefs) []element.IDRefs
+	// AppendRefs decodes only the refs of id and appends them to refs.
+	AppendRefs(data []byte, id int64, refs []int64) ([]int64, bool)
+	// UnmarshalCounts calls fn for each id with the number of refs.
+	UnmarshalCounts(data []byte, fn func(id int64, numRefs int))
+	// Validate checks data without panicking and returns the IDs.
+	Validate(data []byte) ([]int64, error)
+}
+
+// refMerger is implemented by codecs that can merge new IDRefs into
+// marshaled data without decoding all refs (see loadMergeMarshal).
+type refMerger interface {
+	Merge(data []byte, newBunch []element.IDRefs, buf []byte) []byte
+}
+
+// refFilterer is implemented by codecs that can filter the refs of an ID
+// while they are decoded (see GetRefsFiltered).
+type refFilterer interface {
+	AppendRefsFiltered(data []byte, id int64, refs []int64, keep func(ref int64) bool) ([]int64, bool)
+}
+
+// deltaVarintCodec stores IDs and refs delta encoded as varints.
+type deltaVarintCodec struct{}
+
+func (deltaVarintCodec) Marshal(idRefs []element.IDRefs, buf []byte) []byte {
+	return binary.MarshalIDRefsBunch2(idRefs, buf)
+}
+
+func (deltaVarintCodec) Unmarshal(data []byte, idRefs []element.IDRefs) []element.IDRefs {
+	return binary.UnmarshalIDRefsBunch2(data, idRefs)
+}
+
+func (deltaVarintCodec) UnmarshalCounts(data []byte, fn func(id int64, numRefs int)) {
+	binary.UnmarshalIDRefsBunchCounts(data, fn)
+}
+
+func (deltaVarintCodec) AppendRefs(data []byte, id int64, refs []int64) ([]int64, bool) {
+	return binary.AppendIDRefsBunchRefs(data, id, refs)
+}
+
+func (deltaVarintCodec) AppendRefsFiltered(data []byte, id int64, refs []int64, keep func(ref int64) bool) ([]int64, bool) {
+	return binary.AppendIDRefsBunchRefsFiltered(data, id, refs, keep)
+}
+
+func (deltaVarintCodec) Validate(data []byte) ([]int64, error) {
+	return binary.ValidateIDRefsBunch(data)
+}
+
+func (deltaVarintCodec) Merge(data []byte, newBunch []element.IDRefs, buf []byte) []byte {
+	return binary.MergeIDRefsBunch(data, newBunch, buf)
+}
+
+const defaultRefCodec = "deltavarint"
+
+// refCodecs contains all available codecs by their name. The name
+// is stored in the index metadata and must not change.
+var refCodecs = map[string]refCodec{
+	defaultRefCodec: deltaVarintCodec{},
+}
+
+const refIndexMetaFile = "imposm_meta.json"
+
+// keyByteOrder is the byte order of the keys (see idToKeyBuf). Keys are
+// big-endian on all architectures, so that they sort by id.
+const keyByteOrder = "big-endian"
+
+// refIndexMeta is stored as JSON in the LevelDB directory of each ref index.
+type refIndexMeta struct {
+	Codec string
+	// KeyByteOrder is empty for indices that were created before the
+	// byte order was recorded. These always used big-endian keys.
+	KeyByteOrder string `json:",omitempty"`
+	// Comparator is the custom LevelDB comparator of the index, empty
+	// for the default bytewise comparator.
+	Comparator string `json:",omitempty"`
+	// KeyEncoding is the encoding of the ids of the keys (see keyEncoding).
+	KeyEncoding string `json:",omitempty"`
+	// KeyMigration is the target encoding of an unfinished KeyMigrate.
+	KeyMigration string `json:",omitempty"`
+	// DedupOnRead is set once the index was opened with DedupOnRead. The
+	// values can contain unsorted and duplicate refs from then on.
+	DedupOnRead bool `json:",omitempty"`
+	// MaxValueRefs is the MaxValueRefs option the index was first opened
+	// with. Values with exactly this number of refs can have refs in the
+	// overflow index.
+	MaxValueRefs int `json:",omitempty"`
+}
+
+// readRefIndexMeta reads the metadata of the index at path. It returns
+// os.ErrNotExist if the index has no metadata.
+func readRefIndexMeta(path string) (*refIndexMeta, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, refIndexMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	meta := &refIndexMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, errors.Wrapf(err, "parsing metadata of %s", path)
+	}
+	return meta, nil
+}
+
+func writeRefIndexMeta(path string, meta *refIndexMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(path, refIndexMetaFile+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(path, refIndexMetaFile))
+}
+
+// readMeta is readRefIndexMeta, but an in-memory index has no metadata on
+// disk and it is always new.
+func (index *bunchRefCache) readMeta(path string) (*refIndexMeta, error) {
+	if index.options.InMemory {
+		return nil, os.ErrNotExist
+	}
+	return readRefIndexMeta(path)
+}
+
+// writeMeta is writeRefIndexMeta, but the metadata of an in-memory index
+// is only kept in index.meta.
+func (index *bunchRefCache) writeMeta(path string, meta *refIndexMeta) error {
+	if index.options.InMemory {
+		return nil
+	}
+	return writeRefIndexMeta(path, meta)
+}
+
+// checkComparator returns an error if the index at path was created with
+// another comparator than comparator. LevelDB also refuses to open the
+// index in this case, but this check gives a clearer error before the index
+// is opened.
+func checkComparator(path string, comparator string) error {
+	meta, err := readRefIndexMeta(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if meta.Comparator != comparator {
+		return errors.Errorf("index %s uses comparator %q, configured comparator is %q",
+			path, comparatorName(meta.Comparator), comparatorName(comparator))
+	}
+	return nil
+}
+
+func comparatorName(name string) string {
+	if name == "" {
+		return "bytewise"
+	}
+	return name
+}
+
+// initMeta reads the metadata of the opened index at path and selects the
+// codec. New indices are initialized with the configured codec. Indices
+// without metadata, but with data, were created before codecs were
+// configurable and use the default codec.
+func (index *bunchRefCache) initMeta(path string) error {
+	meta, err := index.readMeta(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if meta == nil {
+		meta = &refIndexMeta{Codec: defaultRefCodec, KeyByteOrder: keyByteOrder, Comparator: index.options.Comparator}
+		if index.isEmpty() {
+			if index.indexOptions.Codec != "" {
+				meta.Codec = index.indexOptions.Codec
+			}
+			// indices with data and without metadata use unsigned keys
+			meta.KeyEncoding = keyEncoding
+		}
+		if err := index.writeMeta(path, meta); err != nil {
+			return errors.Wrapf(err, "writing metadata of %s", path)
+		}
+	}
+	if meta.KeyByteOrder != "" && meta.KeyByteOrder != keyByteOrder {
+		return errors.Errorf("index %s uses %s keys, expected %s", path, meta.KeyByteOrder, keyByteOrder)
+	}
+	if err := checkKeyEncoding(path, meta); err != nil {
+		return err
+	}
+	codec, ok := refCodecs[meta.Codec]
+	if !ok {
+		return errors.Errorf("unknown codec %q for %s", meta.Codec, path)
+	}
+	if index.indexOptions != nil {
+		if err := index.initValueFormat(path, meta); err != nil {
+			return err
+		}
+	}
+	index.meta = meta
+	index.codec = codec
+	if index.indexOptions != nil && index.indexOptions.DedupOnRead {
+		index.codec = dedupCodec{codec}
+	}
+	return nil
+}
+
+// initValueFormat records the options that change the format of the stored
+// values in meta, and it enables the options that are recorded in meta
+// but not configured. Without DedupOnRead, reads would return the unsorted
+// and duplicate refs of earlier writes with DedupOnRead. Without the
+// recorded MaxValueRefs, reads would miss the refs in the overflow index.
+func (index *bunchRefCache) initValueFormat(path string, meta *refIndexMeta) error {
+	opts := *index.indexOptions
+	update := false
+	if opts.DedupOnRead && !meta.DedupOnRead {
+		meta.DedupOnRead = true
+		update = true
+	}
+	if meta.DedupOnRead && !opts.DedupOnRead {
+		log.Printf("[warn] %s was written with DedupOnRead, enabling DedupOnRead", path)
+		opts.DedupOnRead = true
+	}
+	if meta.MaxValueRefs == 0 && opts.MaxValueRefs > 0 {
+		meta.MaxValueRefs = opts.MaxValueRefs
+		update = true
+	}
+	if meta.MaxValueRefs == 0 {
+		if _, err := os.Stat(filepath.Join(path, overflowIndexDir)); err == nil {
+			return errors.Errorf("%s has an overflow index, but no recorded MaxValueRefs", path)
+		}
+	} else if meta.MaxValueRefs != opts.MaxValueRefs {
+		log.Printf("[warn] %s was written with MaxValueRefs %d, using %d instead of %d",
+			path, meta.MaxValueRefs, meta.MaxValueRefs, opts.MaxValueRefs)
+		opts.MaxValueRefs = meta.MaxValueRefs
+	}
+	if update {
+		if err := index.writeMeta(path, meta); err != nil {
+			return errors.Wrapf(err, "writing metadata of %s", path)
+		}
+	}
+	index.indexOptions = &opts
+	index.options = &opts.cacheOptions
+	return nil
+}
+
+func (index *bunchRefCache) isEmpty() bool {
+	it := index.db.NewIterator(index.ro)
+	defer it.Close()
+	it.SeekToFirst()
+	return !it.Valid()
+}
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"bytes"
+
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/element"
+	"github.com/pkg/errors"
+)
+
+// RefDiff is a difference between two ref indices, see DiffCaches.
+type RefDiff struct {
+	Index string  // name of the index (e.g. coords_index)
+	ID    int64   // id of the node/way
+	A     []int64 // refs in the first cache, nil if id is missing
+	B     []int64 // refs in the second cache, nil if id is missing
+}
+
+// DiffCaches compares the diff caches in the directories a and b and
+// returns up to maxDiffs ids with different refs. Ids without any refs
+// are handled as missing ids. Both caches are iterated in key order, without
+// loading all refs into memory.
+func DiffCaches(a, b string, maxDiffs int) ([]RefDiff, error) {
+	cacheA := NewDiffCache(a)
+	if err := cacheA.Open(); err != nil {
+		return nil, err
+	}
+	defer cacheA.Close()
+	cacheB := NewDiffCache(b)
+	if err := cacheB.Open(); err != nil {
+		return nil, err
+	}
+	defer cacheB.Close()
+
+	var diffs []RefDiff
+	emit := func(diff RefDiff) bool {
+		diffs = append(diffs, diff)
+		return len(diffs) < maxDiffs
+	}
+
+	for _, idx := range []struct {
+		name string
+		a, b *bunchRefCache
+	}{
+		{"coords_index", cacheA.Coords.bunchRefCache, cacheB.Coords.bunchRefCache},
+		{"coords_rel_index", cacheA.CoordsRel.bunchRefCache, cacheB.CoordsRel.bunchRefCache},
+		{"ways_index", cacheA.Ways.bunchRefCache, cacheB.Ways.bunchRefCache},
+	} {
+		more, err := diffRefIndices(idx.name, idx.a, idx.b, emit)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+	}
+	return diffs, nil
+}
+
+// diffRefIndices calls emit for each difference between a and b. It stops
+// and returns false as soon as emit returns false.
+func diffRefIndices(name string, a, b *bunchRefCache, emit func(RefDiff) bool) (bool, error) {
+	if a.options.Comparator != "" || b.options.Comparator != "" {
+		// the merge of both iterators relies on the bytewise key order
+		return false, errors.Errorf("comparing %s requires the bytewise comparator", name)
+	}
+	roA := levigo.NewReadOptions()
+	defer roA.Close()
+	roA.SetFillCache(false)
+	itA := a.db.NewIterator(roA)
+	defer itA.Close()
+
+	roB := levigo.NewReadOptions()
+	defer roB.Close()
+	roB.SetFillCache(false)
+	itB := b.db.NewIterator(roB)
+	defer itB.Close()
+
+	itA.SeekToFirst()
+	itB.SeekToFirst()
+	for itA.Valid() || itB.Valid() {
+		var bunchA, bunchB []element.IDRefs
+		cmp := 0
+		if !itA.Valid() {
+			cmp = 1
+		} else if !itB.Valid() {
+			cmp = -1
+		} else {
+			cmp = bytes.Compare(itA.Key(), itB.Key())
+		}
+		if cmp <= 0 {
+			data, err := a.resolveValue(itA.Value())
+			if err != nil {
+				return false, err
+			}
+			bunchA = a.codec.Unmarshal(data, nil)
+			itA.Next()
+		}
+		if cmp >= 0 {
+			data, err := b.resolveValue(itB.Value())
+			if err != nil {
+				return false, err
+			}
+			bunchB = b.codec.Unmarshal(data, nil)
+			itB.Next()
+		}
+		if !diffBunches(name, bunchA, bunchB, emit) {
+			return false, nil
+		}
+	}
+	if err := itA.GetError(); err != nil {
+		return false, err
+	}
+	if err := itB.GetError(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// diffBunches calls emit for each id with different refs in a and b. Both
+// bunches need to be sorted by id.
+func diffBunches(name string, a, b []element.IDRefs, emit func(RefDiff) bool) bool {
+	for len(a) > 0 || len(b) > 0 {
+		if len(a) > 0 && len(a[0].Refs) == 0 {
+			a = a[1:]
+			continue
+		}
+		if len(b) > 0 && len(b[0].Refs) == 0 {
+			b = b[1:]
+			continue
+		}
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0].ID < b[0].ID):
+			if !emit(RefDiff{Index: name, ID: a[0].ID, A: a[0].Refs}) {
+				return false
+			}
+			a = a[1:]
+		case len(a) == 0 || b[0].ID < a[0].ID:
+			if !emit(RefDiff{Index: name, ID: b[0].ID, B: b[0].Refs}) {
+				return false
+			}
+			b = b[1:]
+		default:
+			if !equalRefs(a[0].Refs, b[0].Refs) {
+				if !emit(RefDiff{Index: name, ID: a[0].ID, A: a[0].Refs, B: b[0].Refs}) {
+					return false
+				}
+			}
+			a = a[1:]
+			b = b[1:]
+		}
+	}
+	return true
+}
+
+func equalRefs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
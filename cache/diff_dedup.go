@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"sort"
+
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/element"
+	"github.com/pkg/errors"
+)
+
+// dedupCodec wraps the codec of an index with the DedupOnRead option. The
+// stored refs of each ID can be unsorted and contain duplicates, they are
+// sorted and deduplicated after decoding. The writes of the linear import
+// use the wrapped codec directly (see storeCodec). UnmarshalCounts of the
+// wrapped codec includes duplicate refs in the counts.
+type dedupCodec struct {
+	refCodec
+}
+
+func (c dedupCodec) Unmarshal(data []byte, idRefs []element.IDRefs) []element.IDRefs {
+	idRefs = c.refCodec.Unmarshal(data, idRefs)
+	for i := range idRefs {
+		idRefs[i].Refs = sortDedupRefs(idRefs[i].Refs)
+	}
+	return idRefs
+}
+
+func (c dedupCodec) AppendRefs(data []byte, id int64, refs []int64) ([]int64, bool) {
+	n := len(refs)
+	refs, found := c.refCodec.AppendRefs(data, id, refs)
+	if found {
+		refs = append(refs[:n], sortDedupRefs(refs[n:])...)
+	}
+	return refs, found
+}
+
+// Validate checks data without the order of the refs. IDs must still
+// increase. The wrapped codec validates the sorted and deduplicated value,
+// so trailing data of the stored value is not detected.
+func (c dedupCodec) Validate(data []byte) (ids []int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ids, err = nil, errors.Errorf("value can not be decoded: %v", r)
+		}
+	}()
+	return c.refCodec.Validate(c.refCodec.Marshal(c.Unmarshal(data, nil), nil))
+}
+
+// storeCodec returns the codec for the stored values, without the
+// deduplication of DedupOnRead.
+func (index *bunchRefCache) storeCodec() refCodec {
+	if c, ok := index.codec.(dedupCodec); ok {
+		return c.refCodec
+	}
+	return index.codec
+}
+
+// sortDedupRefs sorts refs and removes duplicates in place. Refs that are
+// already strictly increasing are returned unchanged.
+func sortDedupRefs(refs []int64) []int64 {
+	for i := 1; i < len(refs); i++ {
+		if refs[i] <= refs[i-1] {
+			sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+			return dedupRefs(refs)
+		}
+	}
+	return refs
+}
+
+// appendBunch adds the refs of newBunch to bunch like mergeBunch, but it
+// appends the refs of existing IDs without sorting and deduplication.
+func appendBunch(bunch, newBunch []element.IDRefs) []element.IDRefs {
+	for _, newIDRefs := range newBunch {
+		i := sort.Search(len(bunch), func(i int) bool { return bunch[i].ID >= newIDRefs.ID })
+		if i < len(bunch) && bunch[i].ID == newIDRefs.ID {
+			if len(newIDRefs.Refs) == 0 {
+				// no new refs -> delete
+				bunch = append(bunch[:i], bunch[i+1:]...)
+			} else {
+				bunch[i].Refs = append(bunch[i].Refs, newIDRefs.Refs...)
+			}
+			continue
+		}
+		if len(newIDRefs.Refs) > 0 {
+			bunch = append(bunch, element.IDRefs{})
+			copy(bunch[i+1:], bunch[i:])
+			bunch[i] = newIDRefs
+		}
+	}
+	return bunch
+}
+
+// CompactRefs sorts and deduplicates the stored refs of all IDs of an index
+// with the DedupOnRead option. Values are only rewritten if they contain
+// unsorted or duplicate refs. It returns the number of rewritten values.
+func (index *bunchRefCache) CompactRefs() (int, error) {
+	if index.linearImport {
+		panic("programming error: compact not supported in linearImport mode")
+	}
+	codec := index.storeCodec()
+
+	snap := index.db.NewSnapshot()
+	defer index.db.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+	rewritten := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		data, err := index.resolveValue(it.Value())
+		if err != nil {
+			return rewritten, err
+		}
+		if _, err := codec.Validate(data); err == nil {
+			continue
+		}
+		// dedupCodec.Unmarshal sorts and deduplicates
+		idRefs, err := index.unmarshalUnchecked(data)
+		if err != nil {
+			return rewritten, errors.Wrapf(err, "bunch %d", idFromKeyBuf(it.Key()))
+		}
+		if err := index.putBunch(it.Key(), idRefs); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, it.GetError()
+}
@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/element"
+)
+
+// distinctChunkRefs is the number of refs (8 bytes each) that DistinctRefs
+// collects in memory, before they are written to a temporary file.
+var distinctChunkRefs = 8 * 1024 * 1024
+
+// DistinctRefs calls fn once for each ref of the index, in ascending order,
+// e.g. with all way ids of the coords index for a consistency check
+// against the ways cache. Refs are collected in memory up to a fixed
+// number (64MB). Larger sets are sorted and written to temporary files in
+// the directory of the index, the files are merged afterwards and removed.
+// An error of fn stops the iteration and it is returned. The scan iterates
+// over the whole index and should not be used during linear import.
+func (index *bunchRefCache) DistinctRefs(fn func(ref int64) error) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+
+	var runs []refRun
+	defer func() {
+		for _, r := range runs {
+			r.close()
+		}
+	}()
+
+	var chunk []int64
+	var idRefs []element.IDRefs
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		data, err := index.resolveValue(it.Value())
+		if err != nil {
+			return err
+		}
+		idRefs = index.codec.Unmarshal(data, idRefs)
+		for _, idRef := range idRefs {
+			chunk = append(chunk, idRef.Refs...)
+		}
+		if len(chunk) >= distinctChunkRefs {
+			run, err := index.spillRefRun(sortDistinct(chunk))
+			if err != nil {
+				return err
+			}
+			runs = append(runs, run)
+			chunk = chunk[:0]
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+	runs = append(runs, &sliceRefRun{refs: sortDistinct(chunk)})
+	return mergeRefRuns(runs, fn)
+}
+
+func sortDistinct(refs []int64) []int64 {
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	return dedupRefs(refs)
+}
+
+// refRun is a sorted list of distinct refs.
+type refRun interface {
+	// next returns the next ref, or io.EOF.
+	next() (int64, error)
+	close()
+}
+
+type sliceRefRun struct {
+	refs []int64
+}
+
+func (r *sliceRefRun) next() (int64, error) {
+	if len(r.refs) == 0 {
+		return 0, io.EOF
+	}
+	ref := r.refs[0]
+	r.refs = r.refs[1:]
+	return ref, nil
+}
+
+func (r *sliceRefRun) close() {}
+
+// fileRefRun reads refs that were written by spillRefRun, as varint deltas.
+type fileRefRun struct {
+	f    *os.File
+	r    *bufio.Reader
+	last int64
+}
+
+func (r *fileRefRun) next() (int64, error) {
+	delta, err := binary.ReadVarint(r.r)
+	if err != nil {
+		return 0, err
+	}
+	r.last += delta
+	return r.last, nil
+}
+
+func (r *fileRefRun) close() {
+	r.f.Close()
+	os.Remove(r.f.Name())
+}
+
+// spillRefRun writes the sorted refs to a temporary file.
+func (index *bunchRefCache) spillRefRun(refs []int64) (refRun, error) {
+	f, err := ioutil.TempFile(index.path, "imposm_distinct_")
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(f)
+	buf := make([]byte, binary.MaxVarintLen64)
+	var last int64
+	for _, ref := range refs {
+		n := binary.PutVarint(buf, ref-last)
+		bw.Write(buf[:n])
+		last = ref
+	}
+	err = bw.Flush()
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &fileRefRun{f: f, r: bufio.NewReader(f)}, nil
+}
+
+type refRunItem struct {
+	ref int64
+	run refRun
+}
+
+type refRunHeap []refRunItem
+
+func (h refRunHeap) Len() int            { return len(h) }
+func (h refRunHeap) Less(i, j int) bool  { return h[i].ref < h[j].ref }
+func (h refRunHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *refRunHeap) Push(x interface{}) { *h = append(*h, x.(refRunItem)) }
+func (h *refRunHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// mergeRefRuns calls fn with each distinct ref of all runs, in ascending
+// order.
+func mergeRefRuns(runs []refRun, fn func(ref int64) error) error {
+	h := make(refRunHeap, 0, len(runs))
+	for _, run := range runs {
+		ref, err := run.next()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		h = append(h, refRunItem{ref, run})
+	}
+	heap.Init(&h)
+
+	first := true
+	var last int64
+	for len(h) > 0 {
+		item := h[0]
+		if first || item.ref != last {
+			if err := fn(item.ref); err != nil {
+				return err
+			}
+			first = false
+			last = item.ref
+		}
+		ref, err := item.run.next()
+		if err == io.EOF {
+			heap.Pop(&h)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		h[0].ref = ref
+		heap.Fix(&h, 0)
+	}
+	return nil
+}
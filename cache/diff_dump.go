@@ -0,0 +1,327 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	bin "encoding/binary"
+	"io"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+// Binary dump format of a ref index:
+//
+//	header:  "imposm-refs" magic, uvarint format version,
+//	         uvarint length and name of the value codec,
+//	         uvarint MaxValueRefs of the index (since version 2)
+//	records: record kind (since version 2), 8 byte key, uvarint value
+//	         length, raw value
+//
+// Keys and values are written exactly as they are stored in LevelDB, so a
+// dump can only be loaded into an index with the same codec and
+// MaxValueRefs. The records of the overflow index (see MaxValueRefs)
+// follow the records of the values. Version 1 dumps have no record kinds
+// and only values.
+const (
+	dumpMagic         = "imposm-refs"
+	dumpFormatVersion = 2
+)
+
+// Record kinds of the dump format.
+const (
+	dumpValueRecord    byte = 0
+	dumpOverflowRecord byte = 1
+)
+
+// maxDumpValueLength is the largest value length that LoadFast accepts.
+// Larger lengths are from corrupt dumps.
+const maxDumpValueLength = 1 << 30
+
+// dumpValueChunk is the value length up to which LoadFast allocates the
+// value before reading it. Larger values are read in chunks, so that a
+// truncated dump does not allocate more memory than the remaining data.
+const dumpValueChunk = 1 << 20
+
+// dumpCursorRecords is the number of records after which DumpFastFrom
+// reports the cursor.
+var dumpCursorRecords = 100000
+
+// DumpFast writes all raw key-values of the index to w. The values are not
+// decoded and the dump is consistent even with concurrent writes.
+func (index *bunchRefCache) DumpFast(w io.Writer) error {
+	return index.DumpFastFrom(w, nil, nil)
+}
+
+// DumpFastFrom writes the raw key-values of the index after the key cursor
+// to w, or all key-values if cursor is nil. onCursor is called with the last
+// written key every dumpCursorRecords records and at the end, after all
+// records up to the cursor are written to w. An interrupted dump can be
+// continued with the last reported cursor, each dump has its own header and
+// both dumps need to be loaded with LoadFast.
+//
+// With MaxValueRefs, each dump contains all records of the overflow index
+// after the values, from a separate snapshot. The cursor only refers to
+// the values, the final cursor is reported after the overflow records.
+func (index *bunchRefCache) DumpFastFrom(w io.Writer, cursor []byte, onCursor func(cursor []byte) error) error {
+	if cursor != nil && len(cursor) != 8 {
+		return errors.Errorf("unexpected cursor length %d", len(cursor))
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(dumpMagic); err != nil {
+		return err
+	}
+	buf := make([]byte, bin.MaxVarintLen64)
+	n := bin.PutUvarint(buf, dumpFormatVersion)
+	if _, err := bw.Write(buf[:n]); err != nil {
+		return err
+	}
+	n = bin.PutUvarint(buf, uint64(len(index.meta.Codec)))
+	if _, err := bw.Write(buf[:n]); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString(index.meta.Codec); err != nil {
+		return err
+	}
+	n = bin.PutUvarint(buf, uint64(index.indexOptions.MaxValueRefs))
+	if _, err := bw.Write(buf[:n]); err != nil {
+		return err
+	}
+
+	snap := index.db.NewSnapshot()
+	defer index.db.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+
+	if cursor != nil {
+		it.Seek(cursor)
+		if it.Valid() && bytes.Equal(it.Key(), cursor) {
+			it.Next()
+		}
+	} else {
+		it.SeekToFirst()
+	}
+
+	var lastKey []byte
+	records := 0
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		value, err := index.resolveValue(it.Value())
+		if err != nil {
+			return err
+		}
+		if err := writeDumpRecord(bw, dumpValueRecord, key, value); err != nil {
+			return err
+		}
+		lastKey = key
+		records++
+		if onCursor != nil && records%dumpCursorRecords == 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			if err := onCursor(append([]byte(nil), key...)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+	if index.overflow != nil {
+		if err := dumpOverflow(bw, index.overflow.db); err != nil {
+			return errors.Wrap(err, "dumping overflow index")
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if onCursor != nil && lastKey != nil && records%dumpCursorRecords != 0 {
+		return onCursor(append([]byte(nil), lastKey...))
+	}
+	return nil
+}
+
+// dumpOverflow writes all key-values of a snapshot of the overflow index db
+// as overflow records.
+func dumpOverflow(bw *bufio.Writer, db *levigo.DB) error {
+	snap := db.NewSnapshot()
+	defer db.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+
+	it := db.NewIterator(ro)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if err := writeDumpRecord(bw, dumpOverflowRecord, it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.GetError()
+}
+
+func writeDumpRecord(bw *bufio.Writer, kind byte, key, value []byte) error {
+	if len(key) != 8 {
+		return errors.Errorf("unexpected key length %d", len(key))
+	}
+	if err := bw.WriteByte(kind); err != nil {
+		return err
+	}
+	if _, err := bw.Write(key); err != nil {
+		return err
+	}
+	buf := make([]byte, bin.MaxVarintLen64)
+	n := bin.PutUvarint(buf, uint64(len(value)))
+	if _, err := bw.Write(buf[:n]); err != nil {
+		return err
+	}
+	_, err := bw.Write(value)
+	return err
+}
+
+// LoadFast reads a dump created by DumpFast and stores all key-values in
+// the index. Existing values with the same keys are overwritten. LoadFast
+// must not be used in linear import mode.
+func (index *bunchRefCache) LoadFast(r io.Reader) error {
+	if index.linearImport {
+		panic("programming error: load not supported in linearImport mode")
+	}
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(dumpMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return errors.Wrap(err, "reading dump header")
+	}
+	if string(magic) != dumpMagic {
+		return errors.New("not a ref index dump")
+	}
+	version, err := bin.ReadUvarint(br)
+	if err != nil {
+		return errors.Wrap(err, "reading dump header")
+	}
+	if version != 1 && version != dumpFormatVersion {
+		return errors.Errorf("unsupported dump format version %d", version)
+	}
+	length, err := bin.ReadUvarint(br)
+	if err != nil {
+		return errors.Wrap(err, "reading dump header")
+	}
+	if length > 255 {
+		return errors.New("invalid codec name in dump header")
+	}
+	codec := make([]byte, length)
+	if _, err := io.ReadFull(br, codec); err != nil {
+		return errors.Wrap(err, "reading dump header")
+	}
+	if string(codec) != index.meta.Codec {
+		return errors.Errorf("dump uses codec %q, index uses %q", codec, index.meta.Codec)
+	}
+	maxValueRefs := uint64(0)
+	if version >= 2 {
+		if maxValueRefs, err = bin.ReadUvarint(br); err != nil {
+			return errors.Wrap(err, "reading dump header")
+		}
+	}
+	if maxValueRefs != uint64(index.indexOptions.MaxValueRefs) {
+		return errors.Errorf("dump uses MaxValueRefs %d, index uses %d",
+			maxValueRefs, index.indexOptions.MaxValueRefs)
+	}
+
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+
+	key := make([]byte, 8)
+	var value []byte
+	n := 0
+	for {
+		kind := dumpValueRecord
+		if version >= 2 {
+			if kind, err = br.ReadByte(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return errors.Wrap(err, "reading dump record")
+			}
+			if kind != dumpValueRecord && kind != dumpOverflowRecord ||
+				kind == dumpOverflowRecord && index.overflow == nil {
+				return errors.Errorf("invalid record kind %d in dump", kind)
+			}
+		}
+		if _, err := io.ReadFull(br, key); err != nil {
+			if err == io.EOF && version < 2 {
+				break
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return errors.Wrap(err, "reading dump record")
+		}
+		length, err := bin.ReadUvarint(br)
+		if err != nil {
+			return errors.Wrap(err, "reading dump record")
+		}
+		if length > maxDumpValueLength {
+			return errors.Errorf("invalid value length %d in dump record", length)
+		}
+		value, err = readDumpValue(br, value, int(length))
+		if err != nil {
+			return errors.Wrap(err, "reading dump record")
+		}
+		if kind == dumpOverflowRecord {
+			// the overflow index is small, write without batch
+			if err := index.overflow.db.Put(index.writeOptions(), key, value); err != nil {
+				return err
+			}
+			continue
+		}
+		spilled, err := index.spillValue(value)
+		if err != nil {
+			return err
+		}
+		batch.Put(key, spilled)
+		n++
+		if n%1024 == 0 {
+			if err := index.db.Write(index.writeOptions(), batch); err != nil {
+				return err
+			}
+			batch.Clear()
+		}
+	}
+	if err := index.db.Write(index.writeOptions(), batch); err != nil {
+		return err
+	}
+	if index.sketch != nil {
+		// overwritten values are not reflected in the sketch
+		sketch, err := index.buildSketch()
+		if err != nil {
+			return errors.Wrap(err, "building degree sketch")
+		}
+		index.sketch = sketch
+	}
+	return nil
+}
+
+// readDumpValue reads a value of length bytes into buf, which is reused if
+// it is large enough.
+func readDumpValue(r io.Reader, buf []byte, length int) ([]byte, error) {
+	if length <= cap(buf) || length <= dumpValueChunk {
+		if cap(buf) < length {
+			buf = make([]byte, length)
+		}
+		buf = buf[:length]
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	value := bytes.Buffer{}
+	n, err := io.CopyN(&value, r, int64(length))
+	if err == io.EOF && n < int64(length) {
+		err = io.ErrUnexpectedEOF
+	}
+	return value.Bytes(), err
+}
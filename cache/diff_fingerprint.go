@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"crypto/sha256"
+	bin "encoding/binary"
+	"hash"
+	"runtime"
+	"sync"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+// fingerprintPartitionBunches is the number of bunch keys of each partition
+// of Fingerprint. The partitions only depend on the keys, so that the
+// fingerprint does not depend on the number of workers.
+const fingerprintPartitionBunches = 1 << 14
+
+// Fingerprint returns a SHA-256 digest of the logical contents of all
+// indices of the cache, see bunchRefCache.Fingerprint. Caches with the same
+// ids and refs in the same indices have the same fingerprint, e.g. to
+// verify a copied, rebuilt or migrated cache. Optional indices (e.g.
+// WayNodesIndex) are only included if they are enabled.
+func (c *DiffCache) Fingerprint() ([]byte, error) {
+	if !c.opened {
+		return nil, errors.New("diff cache not opened")
+	}
+	h := sha256.New()
+	for _, idx := range c.indices() {
+		digest, err := idx.index.Fingerprint()
+		if err != nil {
+			return nil, errors.Wrapf(err, "fingerprint of %s", idx.name)
+		}
+		h.Write([]byte(idx.name))
+		h.Write(digest)
+	}
+	return h.Sum(nil), nil
+}
+
+// Fingerprint returns a SHA-256 digest of all ids and their sorted and
+// deduplicated refs in the order of the ids (sorted by key, negative ids
+// are sorted after positive ids). Ids without refs are ignored. The
+// fingerprint does not depend on the codec or the LevelDB files, e.g. a
+// compacted index or an index with DedupOnRead values has the same
+// fingerprint as the same index after Optimize.
+//
+// The keys are split into partitions of fingerprintPartitionBunches
+// bunches that are hashed in parallel. The fingerprint is the hash of the
+// digests of all non-empty partitions in key order. The values are read
+// from a snapshot, so the fingerprint is consistent with concurrent writes.
+// This does not hold with MaxValueRefs: the overflow refs are read from the
+// latest state of the overflow index (see overflowCodec) and writes can
+// mix refs of the snapshot with newer overflow refs.
+func (index *bunchRefCache) Fingerprint() ([]byte, error) {
+	if index.options.Comparator != "" {
+		// the partitions rely on the bytewise key order
+		return nil, errors.New("fingerprint requires the bytewise comparator")
+	}
+	snap := index.db.NewSnapshot()
+	defer index.db.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+
+	type partition struct {
+		num    uint64
+		digest []byte // nil for partitions without refs
+		err    error
+	}
+	var partitions []*partition
+	todo := make(chan *partition)
+	wg := sync.WaitGroup{}
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range todo {
+				p.digest, p.err = index.fingerprintPartition(snap, p.num)
+			}
+		}()
+	}
+
+	// find the non-empty partitions with a seek to the start of each
+	// partition
+	it := index.db.NewIterator(ro)
+	for it.SeekToFirst(); it.Valid(); {
+		key := it.Key()
+		if len(key) != 8 {
+			it.Next()
+			continue
+		}
+		p := &partition{num: bin.BigEndian.Uint64(key) / fingerprintPartitionBunches}
+		partitions = append(partitions, p)
+		todo <- p
+		if p.num == (1<<64-1)/fingerprintPartitionBunches {
+			break
+		}
+		it.Seek(uint64Key((p.num + 1) * fingerprintPartitionBunches))
+	}
+	err := it.GetError()
+	it.Close()
+	close(todo)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	buf := make([]byte, 8)
+	for _, p := range partitions {
+		if p.err != nil {
+			return nil, p.err
+		}
+		if p.digest == nil {
+			continue
+		}
+		bin.BigEndian.PutUint64(buf, p.num)
+		h.Write(buf)
+		h.Write(p.digest)
+	}
+	return h.Sum(nil), nil
+}
+
+// fingerprintPartition returns the digest of the ids and refs of partition
+// num, or nil if the partition has no refs.
+func (index *bunchRefCache) fingerprintPartition(snap *levigo.Snapshot, num uint64) ([]byte, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+
+	h := sha256.New()
+	empty := true
+	for it.Seek(uint64Key(num * fingerprintPartitionBunches)); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) != 8 {
+			continue
+		}
+		if bin.BigEndian.Uint64(key)/fingerprintPartitionBunches != num {
+			break
+		}
+		data, err := index.resolveValue(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		idRefs, err := index.unmarshalUnchecked(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bunch %d", idFromKeyBuf(key))
+		}
+		for _, idRef := range sortIDRefs(withoutEmptyRefs(idRefs)) {
+			writeFingerprintRefs(h, idRef.ID, idRef.Refs)
+			empty = false
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return nil, err
+	}
+	if empty {
+		return nil, nil
+	}
+	return h.Sum(nil), nil
+}
+
+func writeFingerprintRefs(h hash.Hash, id int64, refs []int64) {
+	buf := make([]byte, bin.MaxVarintLen64*(len(refs)+2))
+	n := bin.PutVarint(buf, id)
+	n += bin.PutUvarint(buf[n:], uint64(len(refs)))
+	for _, ref := range refs {
+		n += bin.PutVarint(buf[n:], ref)
+	}
+	h.Write(buf[:n])
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/element"
+	"github.com/pkg/errors"
+)
+
+// generationsIndexDir is the LevelDB with the generation of the last change
+// of each id, inside the directory of the ref index.
+const generationsIndexDir = "generations"
+
+// generationKey stores the current generation in the generations index.
+// It is longer than the 8 byte keys of the ids.
+var generationKey = []byte("imposm_generation")
+
+func generationValue(gen uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, gen)
+	return buf[:n]
+}
+
+// initGenerations opens the generations index and loads the current
+// generation.
+func (index *bunchRefCache) initGenerations(path string) error {
+	index.generations = &cache{options: &cacheOptions{InMemory: index.options.InMemory}}
+	if err := index.generations.open(path); err != nil {
+		index.generations = nil
+		return err
+	}
+	data, err := index.generations.db.Get(index.generations.ro, generationKey)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		gen, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid generation")
+		}
+		index.generation = gen
+	}
+	return nil
+}
+
+// Generation returns the current generation of the index. The generation
+// is incremented with each flush of the linear import. Changes outside of
+// the linear import belong to the next generation. ChangedSince(gen)
+// returns all ids that changed after Generation returned gen. Generation
+// is 0 if TrackGenerations is not enabled.
+func (index *bunchRefCache) Generation() uint64 {
+	return atomic.LoadUint64(&index.generation)
+}
+
+// tagGeneration records the change of a single id for the next generation.
+func (index *bunchRefCache) tagGeneration(id int64) error {
+	if index.generations == nil {
+		return nil
+	}
+	value := generationValue(index.Generation() + 1)
+	key := getKeyBuf(id)
+	defer releaseKeyBuf(key)
+	return index.generations.db.Put(index.writeOptions(), key[:], value)
+}
+
+// generationBatch starts a new generation and returns a batch that tags all
+// ids in idRefs with it and that stores the new generation.
+func (index *bunchRefCache) generationBatch(idRefs idRefBunches) *levigo.WriteBatch {
+	gen := atomic.AddUint64(&index.generation, 1)
+	batch := levigo.NewWriteBatch()
+	value := generationValue(gen)
+	key := getKeyBuf(0)
+	defer releaseKeyBuf(key)
+	for _, bunch := range idRefs {
+		for _, idRef := range bunch.idRefs {
+			// batch copies the key
+			binary.BigEndian.PutUint64(key[:], uint64(idRef.ID))
+			batch.Put(key[:], value)
+		}
+	}
+	batch.Put(generationKey, value)
+	return batch
+}
+
+// ChangedSince returns the sorted ids that were changed after generation
+// gen, e.g. for incremental exports: store Generation() with each export
+// and export ChangedSince of the stored generation next time. Removed ids
+// are included. The generation of each id is only kept for the last
+// change of the id, see TrimGenerations to limit the size.
+func (index *bunchRefCache) ChangedSince(gen uint64) ([]int64, error) {
+	var ids []int64
+	err := index.iterGenerations(func(id int64, idGen uint64) error {
+		if idGen > gen {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// TrimGenerations removes the generations of all ids that did not change
+// after generation gen, e.g. after an export of all ids up to gen. It
+// returns the number of removed ids. These ids are not returned by
+// ChangedSince of older generations afterwards.
+func (index *bunchRefCache) TrimGenerations(gen uint64) (int, error) {
+	removed := 0
+	// the iterator does not see the deletes of the loop
+	err := index.iterGenerations(func(id int64, idGen uint64) error {
+		if idGen > gen {
+			return nil
+		}
+		removed++
+		return index.generations.db.Delete(index.writeOptions(), idToKeyBuf(id))
+	})
+	if err != nil {
+		return removed, err
+	}
+	index.generations.db.CompactRange(levigo.Range{})
+	return removed, nil
+}
+
+func (index *bunchRefCache) iterGenerations(fn func(id int64, gen uint64) error) error {
+	if index.generations == nil {
+		return errors.New("generations not enabled")
+	}
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := index.generations.db.NewIterator(ro)
+	defer it.Close()
+
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) != 8 {
+			// generationKey
+			continue
+		}
+		id := idFromKeyBuf(key)
+		gen, n := binary.Uvarint(it.Value())
+		if n <= 0 {
+			return errors.Errorf("invalid generation for %d", id)
+		}
+		if err := fn(id, gen); err != nil {
+			return err
+		}
+	}
+	return it.GetError()
+}
+
+// IterRefsGenerations calls fn with the refs of each id of the index, in
+// key order, and with the generation of the last change of the id, e.g. to
+// find the flush or diff import that added an unexpected ref. The
+// generation is 0 for ids that were not changed since TrackGenerations was
+// enabled, or if the generation was removed by TrimGenerations. An error of
+// fn stops the iteration and it is returned. The scan iterates over the
+// whole index and should not be used during linear import.
+func (index *bunchRefCache) IterRefsGenerations(fn func(id int64, refs []int64, gen uint64) error) error {
+	if index.generations == nil {
+		return errors.New("generations not enabled")
+	}
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+
+	var idRefs []element.IDRefs
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		data, err := index.resolveValue(it.Value())
+		if err != nil {
+			return err
+		}
+		idRefs = index.codec.Unmarshal(data, idRefs)
+		for _, idRef := range idRefs {
+			value, err := index.generations.db.Get(ro, idToKeyBuf(idRef.ID))
+			if err != nil {
+				return err
+			}
+			var gen uint64
+			if value != nil {
+				var n int
+				if gen, n = binary.Uvarint(value); n <= 0 {
+					return errors.Errorf("invalid generation for %d", idRef.ID)
+				}
+			}
+			if err := fn(idRef.ID, idRef.Refs, gen); err != nil {
+				return err
+			}
+		}
+	}
+	return it.GetError()
+}
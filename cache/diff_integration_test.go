@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/go-osm/parser/pbf"
+)
+
+// parseTestPBF returns all ways and relations of the PBF file.
+func parseTestPBF(t testing.TB, file string) ([]osm.Way, []osm.Relation) {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	nodes := make(chan []osm.Node)
+	coords := make(chan []osm.Node)
+	waysc := make(chan []osm.Way)
+	relsc := make(chan []osm.Relation)
+	parser := pbf.New(f, pbf.Config{
+		Nodes: nodes, Coords: coords, Ways: waysc, Relations: relsc,
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- parser.Parse(context.Background()) }()
+
+	var ways []osm.Way
+	var rels []osm.Relation
+	for nodes != nil || coords != nil || waysc != nil || relsc != nil {
+		select {
+		case _, ok := <-nodes:
+			if !ok {
+				nodes = nil
+			}
+		case _, ok := <-coords:
+			if !ok {
+				coords = nil
+			}
+		case batch, ok := <-waysc:
+			if !ok {
+				waysc = nil
+			}
+			ways = append(ways, batch...)
+		case batch, ok := <-relsc:
+			if !ok {
+				relsc = nil
+			}
+			rels = append(rels, batch...)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return ways, rels
+}
+
+func TestDiffCacheImportPBF(t *testing.T) {
+	ways, rels := parseTestPBF(t, "testdata/monaco-20150428.osm.pbf")
+	if len(ways) != 2398 || len(rels) != 108 {
+		t.Fatal("unexpected test data", len(ways), len(rels))
+	}
+
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	diffCache := NewDiffCache(cacheDir)
+	if err := diffCache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer diffCache.Close()
+
+	// same order and linear import modes as import_
+	diffCache.Coords.SetLinearImport(true)
+	diffCache.Ways.SetLinearImport(true)
+	for _, rel := range rels {
+		diffCache.Ways.AddFromMembers(rel.ID, rel.Members)
+		diffCache.CoordsRel.AddFromMembers(rel.ID, rel.Members)
+	}
+	nodeWays := make(map[int64]map[int64]bool)
+	for i := range ways {
+		way := &ways[i]
+		// Nodes are filled from the coords cache during the import
+		way.Nodes = make([]osm.Node, len(way.Refs))
+		for j, ref := range way.Refs {
+			way.Nodes[j].ID = ref
+			if nodeWays[ref] == nil {
+				nodeWays[ref] = make(map[int64]bool)
+			}
+			nodeWays[ref][way.ID] = true
+		}
+		diffCache.Coords.AddFromWay(way)
+	}
+	diffCache.Coords.SetLinearImport(false)
+	diffCache.Ways.SetLinearImport(false)
+
+	// node in six ways, referenced twice by the closed way 254757004
+	if refs := diffCache.Coords.Get(2605737763); !equalRefs(refs, []int64{
+		254756999, 254757000, 254757001, 254757002, 254757003, 254757004,
+	}) {
+		t.Error(refs)
+	}
+	// outer way and admin_centre node of the relation 36990
+	if refs := diffCache.Ways.Get(24874398); !containsRef(refs, 36990) {
+		t.Error(refs)
+	}
+	if refs := diffCache.CoordsRel.Get(1790048269); !containsRef(refs, 36990) {
+		t.Error(refs)
+	}
+
+	for node, wayIDs := range nodeWays {
+		refs := diffCache.Coords.Get(node)
+		if len(refs) != len(wayIDs) {
+			t.Fatal(node, refs, wayIDs)
+		}
+		for _, ref := range refs {
+			if !wayIDs[ref] {
+				t.Fatal(node, refs, wayIDs)
+			}
+		}
+	}
+	for _, rel := range rels {
+		for _, m := range rel.Members {
+			var refs []int64
+			switch m.Type {
+			case osm.NodeMember:
+				refs = diffCache.CoordsRel.Get(m.ID)
+			case osm.WayMember:
+				refs = diffCache.Ways.Get(m.ID)
+			default:
+				continue
+			}
+			if !containsRef(refs, rel.ID) {
+				t.Fatal(rel.ID, m, refs)
+			}
+		}
+	}
+}
+
+// importTestWays imports ways into a new DiffCache in cacheDir with
+// AddFromWays batches of batchSize ways, or with AddFromWay if batchSize is
+// 0, and returns the opened cache.
+func importTestWays(t testing.TB, cacheDir string, ways []osm.Way, batchSize int) *DiffCache {
+	diffCache := NewDiffCache(cacheDir)
+	if err := diffCache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := t.(*testing.B); ok {
+		b.StartTimer()
+		defer b.StopTimer()
+	}
+	diffCache.Coords.SetLinearImport(true)
+	var batch []*osm.Way
+	for i := range ways {
+		if batchSize == 0 {
+			if err := diffCache.Coords.AddFromWay(&ways[i]); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		batch = append(batch, &ways[i])
+		if len(batch) == batchSize || i == len(ways)-1 {
+			if err := diffCache.Coords.AddFromWays(batch); err != nil {
+				t.Fatal(err)
+			}
+			batch = batch[:0]
+		}
+	}
+	diffCache.Coords.SetLinearImport(false)
+	return diffCache
+}
+
+// parseTestWays returns the ways of the monaco extract with the node IDs
+// of the refs.
+func parseTestWays(t testing.TB) []osm.Way {
+	ways, _ := parseTestPBF(t, "testdata/monaco-20150428.osm.pbf")
+	for i := range ways {
+		way := &ways[i]
+		way.Nodes = make([]osm.Node, len(way.Refs))
+		for j, ref := range way.Refs {
+			way.Nodes[j].ID = ref
+		}
+	}
+	return ways
+}
+
+func TestCoordsRefIndexAddFromWays(t *testing.T) {
+	ways := parseTestWays(t)
+
+	globalCacheOptions.CoordsIndex.WayNodesIndex = true
+	globalCacheOptions.CoordsIndex.WayNodeRangeIndex = true
+	defer func() {
+		globalCacheOptions.CoordsIndex.WayNodesIndex = false
+		globalCacheOptions.CoordsIndex.WayNodeRangeIndex = false
+	}()
+
+	fingerprint := func(batchSize int) []byte {
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		defer os.RemoveAll(cacheDir)
+		diffCache := importTestWays(t, cacheDir, ways, batchSize)
+		defer diffCache.Close()
+		fp, err := diffCache.Fingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+
+	expected := fingerprint(0)
+	for _, batchSize := range []int{1, 7, 100, len(ways)} {
+		if fp := fingerprint(batchSize); !bytes.Equal(fp, expected) {
+			t.Errorf("batch size %d: fingerprint %x, expected %x", batchSize, fp, expected)
+		}
+	}
+
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	diffCache := importTestWays(t, cacheDir, ways, 100)
+	defer diffCache.Close()
+	// node in six ways, referenced twice by the closed way 254757004
+	if refs := diffCache.Coords.Get(2605737763); !equalRefs(refs, []int64{
+		254756999, 254757000, 254757001, 254757002, 254757003, 254757004,
+	}) {
+		t.Error(refs)
+	}
+
+	// ways outside of the linear import are added one by one
+	way := osm.Way{Element: osm.Element{ID: 1}, Nodes: []osm.Node{
+		{Element: osm.Element{ID: 2605737763}},
+		{Element: osm.Element{ID: 2}},
+	}}
+	if err := diffCache.Coords.AddFromWays([]*osm.Way{&way}); err != nil {
+		t.Fatal(err)
+	}
+	if refs := diffCache.Coords.Get(2605737763); !containsRef(refs, 1) {
+		t.Error(refs)
+	}
+	if min, max, ok := diffCache.Coords.WayNodeRange(1); !ok || min != 2 || max != 2605737763 {
+		t.Error(min, max, ok)
+	}
+}
+
+func BenchmarkAddFromWay(b *testing.B) {
+	benchmarkAddFromWays(b, 0)
+}
+
+func BenchmarkAddFromWays(b *testing.B) {
+	benchmarkAddFromWays(b, 1000)
+}
+
+func benchmarkAddFromWays(b *testing.B, batchSize int) {
+	ways := parseTestWays(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		// only the import is timed, see importTestWays
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		diffCache := importTestWays(b, cacheDir, ways, batchSize)
+		diffCache.Close()
+		os.RemoveAll(cacheDir)
+	}
+}
+
+func containsRef(refs []int64, ref int64) bool {
+	for _, r := range refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,296 @@
+package cache
+
+import (
+	bin "encoding/binary"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// keyEncodingUnsigned stores ids as unsigned integers: negative ids
+	// sort after all positive ids. Indices without KeyEncoding in their
+	// metadata use this encoding.
+	keyEncodingUnsigned = ""
+	// keyEncodingSignFlip flips the sign bit of the ids, so that the keys
+	// sort in the order of the ids, including negative ids.
+	keyEncodingSignFlip = "sign-flip"
+)
+
+// keyEncoding is the encoding of the keys of idToKeyBuf and getKeyBuf,
+// which is recorded in the metadata of new indices. It must be changed
+// together with these functions. Indices with another encoding can not be
+// opened, KeyMigrate converts them.
+var keyEncoding = keyEncodingUnsigned
+
+const signBit = 1 << 63
+
+func keyEncodingName(encoding string) string {
+	if encoding == keyEncodingUnsigned {
+		return "unsigned"
+	}
+	return encoding
+}
+
+// keyMigrateKey stores the progress of the migration of a LevelDB: the
+// last migrated key of the lower half of the keys. It is longer than the 8
+// byte keys of the ids.
+var keyMigrateKey = []byte("imposm_key_migrate")
+
+// keyMigrateBatchSize is the number of key pairs that are migrated with
+// each write.
+var keyMigrateBatchSize = 1024
+
+// diffCacheIndexDirs are the directories of the ref indices of a DiffCache.
+var diffCacheIndexDirs = []string{"coords_index", "coords_rel_index", "ways_index", "way_nodes_index", "way_node_range_index", "relations_index"}
+
+// KeyMigrate converts the keys of all ref indices of the DiffCache in dir
+// to the current key encoding, e.g. after an upgrade that changed the key
+// encoding, so that the cache does not need to be rebuilt. The cache must
+// not be opened. Indices that already use the current encoding are not
+// changed. It returns the number of moved keys.
+//
+// The migration records its progress in each LevelDB and an interrupted
+// migration continues with the next call. Indices with an unfinished
+// migration can not be opened.
+func KeyMigrate(dir string) (int, error) {
+	moved := 0
+	for _, name := range diffCacheIndexDirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		n, err := keyMigrateIndex(path)
+		moved += n
+		if err != nil {
+			return moved, errors.Wrapf(err, "migrating keys of %s", path)
+		}
+	}
+	return moved, nil
+}
+
+// keyMigrateIndex migrates the index at path and the LevelDBs of the index
+// with id keys. Both encodings only differ in the sign bit, the migration
+// swaps the values of all pairs of keys that only differ in the sign bit.
+// A swap is not idempotent, each LevelDB stores the last swapped pair with
+// the batch of the swaps. The metadata records the migration while the
+// keys are swapped (KeyMigration) and while the progress is removed
+// (KeyMigration and KeyEncoding).
+func keyMigrateIndex(path string) (int, error) {
+	meta, err := readRefIndexMeta(path)
+	if os.IsNotExist(err) {
+		meta = &refIndexMeta{Codec: defaultRefCodec, KeyByteOrder: keyByteOrder}
+	} else if err != nil {
+		return 0, err
+	}
+	if meta.KeyMigration == "" && meta.KeyEncoding == keyEncoding {
+		return 0, nil
+	}
+	if meta.KeyMigration != "" && meta.KeyMigration != keyEncoding {
+		return 0, errors.Errorf("unfinished key migration to %s", keyEncodingName(meta.KeyMigration))
+	}
+	if meta.Comparator != "" {
+		return 0, errors.Errorf("key migration not supported with comparator %q", meta.Comparator)
+	}
+
+	paths := []string{path}
+	for _, dir := range []string{touchedIndexDir, generationsIndexDir, overflowIndexDir} {
+		if _, err := os.Stat(filepath.Join(path, dir)); err == nil {
+			paths = append(paths, filepath.Join(path, dir))
+		}
+	}
+
+	moved := 0
+	if meta.KeyEncoding != keyEncoding {
+		meta.KeyMigration = keyEncoding
+		if err := writeRefIndexMeta(path, meta); err != nil {
+			return 0, err
+		}
+		for _, p := range paths {
+			n, err := swapSignBitKeys(p)
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+		}
+		meta.KeyEncoding = keyEncoding
+		if err := writeRefIndexMeta(path, meta); err != nil {
+			return moved, err
+		}
+	}
+
+	for _, p := range paths {
+		if err := removeKeyMigrateProgress(p); err != nil {
+			return moved, err
+		}
+	}
+	meta.KeyMigration = ""
+	return moved, writeRefIndexMeta(path, meta)
+}
+
+// swapSignBitKeys swaps the values of each pair of 8 byte keys that only
+// differ in the sign bit, starting after the recorded progress. It returns
+// the number of moved keys.
+func swapSignBitKeys(path string) (int, error) {
+	c := cache{options: &cacheOptions{}}
+	if err := c.open(path); err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	var start uint64
+	progress, err := c.db.Get(c.ro, keyMigrateKey)
+	if err != nil {
+		return 0, err
+	}
+	if progress != nil {
+		if len(progress) != 8 {
+			return 0, errors.New("invalid key migration progress")
+		}
+		last := bin.BigEndian.Uint64(progress)
+		if last == signBit-1 {
+			return 0, nil
+		}
+		start = last + 1
+	}
+
+	snap := c.db.NewSnapshot()
+	defer c.db.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+
+	// lower keys have no sign bit, upper keys have the sign bit
+	lower := c.db.NewIterator(ro)
+	defer lower.Close()
+	upper := c.db.NewIterator(ro)
+	defer upper.Close()
+	lower.Seek(uint64Key(start))
+	upper.Seek(uint64Key(start | signBit))
+
+	// next returns the next 8 byte key of it (without the sign bit) and
+	// its value, ok is false at the end
+	next := func(it *levigo.Iterator, sign bool) (key uint64, value []byte, ok bool) {
+		for ; it.Valid(); it.Next() {
+			k := it.Key()
+			if len(k) != 8 {
+				continue
+			}
+			key = bin.BigEndian.Uint64(k)
+			if (key&signBit != 0) != sign {
+				return 0, nil, false
+			}
+			return key &^ signBit, it.Value(), true
+		}
+		return 0, nil, false
+	}
+
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+	ticker := time.NewTicker(validateProgressInterval)
+	defer ticker.Stop()
+
+	moved := 0
+	pairs := 0
+	lowerKey, lowerValue, lowerOK := next(lower, false)
+	upperKey, upperValue, upperOK := next(upper, true)
+	for lowerOK || upperOK {
+		pair := lowerKey
+		if !lowerOK || (upperOK && upperKey < lowerKey) {
+			pair = upperKey
+		}
+		var fromLower, fromUpper []byte
+		if lowerOK && lowerKey == pair {
+			fromLower = lowerValue
+			lower.Next()
+			lowerKey, lowerValue, lowerOK = next(lower, false)
+		}
+		if upperOK && upperKey == pair {
+			fromUpper = upperValue
+			upper.Next()
+			upperKey, upperValue, upperOK = next(upper, true)
+		}
+		moved += swapValues(batch, pair, fromLower, fromUpper)
+
+		pairs++
+		if pairs%keyMigrateBatchSize == 0 {
+			batch.Put(keyMigrateKey, uint64Key(pair))
+			if err := c.db.Write(c.wo, batch); err != nil {
+				return moved, err
+			}
+			batch.Clear()
+		}
+		select {
+		case <-ticker.C:
+			log.Printf("[progress] migrated %d keys of %s", moved, path)
+		default:
+		}
+	}
+	if err := lower.GetError(); err != nil {
+		return moved, err
+	}
+	if err := upper.GetError(); err != nil {
+		return moved, err
+	}
+	// all pairs are migrated
+	batch.Put(keyMigrateKey, uint64Key(signBit-1))
+	return moved, c.db.Write(c.wo, batch)
+}
+
+// swapValues adds the swap of the values of the key pair to batch. A nil
+// value is a missing key. It returns the number of moved keys.
+func swapValues(batch *levigo.WriteBatch, pair uint64, fromLower, fromUpper []byte) int {
+	lowerKey := uint64Key(pair)
+	upperKey := uint64Key(pair | signBit)
+	if fromUpper != nil {
+		batch.Put(lowerKey, fromUpper)
+	} else {
+		batch.Delete(lowerKey)
+	}
+	if fromLower != nil {
+		batch.Put(upperKey, fromLower)
+	} else {
+		batch.Delete(upperKey)
+	}
+	moved := 0
+	if fromLower != nil {
+		moved++
+	}
+	if fromUpper != nil {
+		moved++
+	}
+	return moved
+}
+
+func removeKeyMigrateProgress(path string) error {
+	c := cache{options: &cacheOptions{}}
+	if err := c.open(path); err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.db.Delete(c.wo, keyMigrateKey)
+}
+
+func uint64Key(key uint64) []byte {
+	b := make([]byte, 8)
+	bin.BigEndian.PutUint64(b, key)
+	return b
+}
+
+// checkKeyEncoding returns an error if the index of meta uses another key
+// encoding than keyEncoding, or if a key migration is not finished.
+func checkKeyEncoding(path string, meta *refIndexMeta) error {
+	if meta.KeyMigration != "" {
+		return errors.Errorf("key migration of index %s is not finished, run KeyMigrate", path)
+	}
+	if meta.KeyEncoding != keyEncoding {
+		return errors.Errorf("index %s uses %s keys, expected %s keys, run KeyMigrate",
+			path, keyEncodingName(meta.KeyEncoding), keyEncodingName(keyEncoding))
+	}
+	return nil
+}
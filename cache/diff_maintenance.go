@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+// MaintenanceStats are the results of DiffCache.Maintenance.
+type MaintenanceStats struct {
+	Compacted   []string // names of the compacted indices
+	BytesBefore int64    // size of the compacted indices before compaction
+	BytesAfter  int64    // size of the compacted indices after compaction
+}
+
+// Reclaimed returns the number of bytes that were freed by the compaction.
+// It can be negative, as LevelDB might not remove obsolete files right away.
+func (s MaintenanceStats) Reclaimed() int64 {
+	return s.BytesBefore - s.BytesAfter
+}
+
+// Maintenance compacts all indices that had deletes since the cache was
+// opened or since the last Maintenance call. Compaction removes the
+// tombstones of deleted values and merges fragmented files. Indices without
+// deletes are skipped, unless force is true, so Maintenance returns quickly
+// if there is nothing to do and it can be called periodically.
+// Compaction can take a long time for large indices and it competes with
+// other writes for I/O.
+func (c *DiffCache) Maintenance(force bool) (MaintenanceStats, error) {
+	stats := MaintenanceStats{}
+	if !c.opened {
+		return stats, errors.New("diff cache not opened")
+	}
+	for _, idx := range c.indices() {
+		if !idx.index.takeDeletes() && !force {
+			continue
+		}
+		before, err := dirSize(idx.index.path)
+		if err != nil {
+			return stats, errors.Wrapf(err, "compacting %s", idx.name)
+		}
+		idx.index.db.CompactRange(levigo.Range{})
+		after, err := dirSize(idx.index.path)
+		if err != nil {
+			return stats, errors.Wrapf(err, "compacting %s", idx.name)
+		}
+		stats.Compacted = append(stats.Compacted, idx.name)
+		stats.BytesBefore += before
+		stats.BytesAfter += after
+	}
+	return stats, nil
+}
+
+// takeDeletes returns whether refs were deleted since the last call.
+func (index *bunchRefCache) takeDeletes() bool {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	hadDeletes := index.hadDeletes
+	index.hadDeletes = false
+	return hadDeletes
+}
+
+func (index *bunchRefCache) markDeletes() {
+	index.mu.Lock()
+	index.hadDeletes = true
+	index.mu.Unlock()
+}
+
+// markChanged extends the changed key range by the key of a value that was
+// written or deleted outside of the linear import, for CompactAfterDiff.
+func (index *bunchRefCache) markChanged(keyBuf []byte) {
+	if !index.indexOptions.CompactAfterDiff || index.linearImport {
+		return
+	}
+	index.mu.Lock()
+	if index.changedMin == nil || bytes.Compare(keyBuf, index.changedMin) < 0 {
+		index.changedMin = append(index.changedMin[:0], keyBuf...)
+	}
+	if index.changedMax == nil || bytes.Compare(keyBuf, index.changedMax) > 0 {
+		index.changedMax = append(index.changedMax[:0], keyBuf...)
+	}
+	index.mu.Unlock()
+}
+
+// dbCompactRange compacts the range r of db. Tests replace it to check the
+// compacted ranges.
+var dbCompactRange = func(db *levigo.DB, r levigo.Range) {
+	db.CompactRange(r)
+}
+
+// compactChanged compacts the changed key range since the last call.
+func (index *bunchRefCache) compactChanged() {
+	index.mu.Lock()
+	start, limit := index.changedMin, index.changedMax
+	index.changedMin, index.changedMax = nil, nil
+	index.mu.Unlock()
+	if start == nil {
+		return
+	}
+	// the limit of the range is exclusive
+	limit = append(limit, 0)
+	dbCompactRange(index.db, levigo.Range{Start: start, Limit: limit})
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/omniscale/imposm3/log"
+)
+
+// memCheckInterval is the interval of the heap checks for the MaxHeapSizeM
+// option. runtime.ReadMemStats stops the world, it should not run for
+// each add.
+var memCheckInterval = time.Second
+
+// memPressureDivisor reduces the flush size while the heap is larger than
+// MaxHeapSizeM.
+const memPressureDivisor = 8
+
+// heapAlloc returns the size of the allocated heap objects. Tests replace
+// it to simulate memory pressure.
+var heapAlloc = func() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// startMemMonitor checks the heap periodically during linear import and
+// sets memPressure if it exceeds the MaxHeapSizeM option.
+func (index *bunchRefCache) startMemMonitor() {
+	limit := uint64(index.indexOptions.MaxHeapSizeM) * 1024 * 1024
+	if limit == 0 {
+		return
+	}
+	index.memStop = make(chan struct{})
+	index.memDone = make(chan struct{})
+	go func() {
+		defer close(index.memDone)
+		ticker := time.NewTicker(memCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-index.memStop:
+				atomic.StoreInt32(&index.memPressure, 0)
+				return
+			case <-ticker.C:
+			}
+			heap := heapAlloc()
+			pressure := int32(0)
+			if heap > limit {
+				pressure = 1
+			}
+			if atomic.SwapInt32(&index.memPressure, pressure) != pressure {
+				if pressure == 1 {
+					log.Printf("[warn] heap of %dMB exceeds %dMB, %s flushes early",
+						heap/1024/1024, limit/1024/1024, index.path)
+				} else {
+					log.Printf("[info] heap of %dMB below %dMB, %s flushes normally",
+						heap/1024/1024, limit/1024/1024, index.path)
+				}
+			}
+		}
+	}()
+}
+
+func (index *bunchRefCache) stopMemMonitor() {
+	if index.memStop == nil {
+		return
+	}
+	close(index.memStop)
+	<-index.memDone
+	index.memStop = nil
+	index.memDone = nil
+}
+
+// effectiveFlushSize returns the number of buffered bunches before a
+// flush. It is smaller than flushSize while the heap exceeds MaxHeapSizeM.
+func (index *bunchRefCache) effectiveFlushSize() int {
+	n := int(atomic.LoadInt32(&index.flushSize))
+	if atomic.LoadInt32(&index.memPressure) != 0 {
+		n /= memPressureDivisor
+		if n < 1 {
+			n = 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	osm "github.com/omniscale/go-osm"
+)
+
+// wayNodeIDRange returns the smallest and largest node ID of way. way must
+// have nodes.
+func wayNodeIDRange(way *osm.Way) (int64, int64) {
+	min, max := way.Nodes[0].ID, way.Nodes[0].ID
+	for _, node := range way.Nodes[1:] {
+		if node.ID < min {
+			min = node.ID
+		} else if node.ID > max {
+			max = node.ID
+		}
+	}
+	return min, max
+}
+
+// addWayNodeRange stores the node ID range of way as the refs of the way.
+// The range of an existing way is replaced outside of the linear import.
+func (index *CoordsRefIndex) addWayNodeRange(way *osm.Way) error {
+	min, max := wayNodeIDRange(way)
+	if index.wayNodeRange.linearImport {
+		if err := index.wayNodeRange.addLinear(way.ID, min); err != nil {
+			return err
+		}
+		return index.wayNodeRange.addLinear(way.ID, max)
+	}
+	if err := index.wayNodeRange.Delete(way.ID); err != nil {
+		return err
+	}
+	if err := index.wayNodeRange.Add(way.ID, min); err != nil {
+		return err
+	}
+	return index.wayNodeRange.Add(way.ID, max)
+}
+
+// WayNodeRange returns the smallest and largest node ID of the way wayID,
+// as added with AddFromWay, e.g. to filter ways by the node IDs without
+// reading the nodes of each way. ok is false if the way is not present, or
+// if the WayNodeRangeIndex option is not enabled.
+func (index *CoordsRefIndex) WayNodeRange(wayID int64) (minID, maxID int64, ok bool) {
+	if index.wayNodeRange == nil {
+		return 0, 0, false
+	}
+	refs := index.wayNodeRange.Get(wayID)
+	if len(refs) == 0 {
+		return 0, 0, false
+	}
+	// the linear import adds multiple ranges for duplicate ways, the refs
+	// are sorted
+	return refs[0], refs[len(refs)-1], true
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+// optimizeProgressFile contains the key of the last value that Optimize
+// checked, while Optimize is not finished.
+const optimizeProgressFile = "imposm_optimize"
+
+// optimizeCheckpointValues is the number of values after which Optimize
+// records its progress.
+var optimizeCheckpointValues = 10000
+
+// OptimizeSummary is the result of Optimize.
+type OptimizeSummary struct {
+	// Values and Rewritten are the checked and rewritten values of this
+	// call, without the values of an interrupted call.
+	Values    int
+	Rewritten int
+	// BytesSaved is the difference of the size of the rewritten values.
+	BytesSaved int64
+	// Resumed is true if Optimize continued an interrupted call.
+	Resumed bool
+}
+
+// Optimize rewrites all values of the index that are not in the canonical
+// encoding of the codec, with sorted and deduplicated IDs and refs. Values
+// written with DedupOnRead, or values that were repaired, can contain
+// unsorted or duplicate refs that are larger than necessary. Optimize
+// converts such an index into a smaller index for reads, e.g. after the
+// initial import and before diff imports. Values are only rewritten if the
+// encoding changes.
+//
+// The progress is recorded in the directory of the index. Optimize
+// continues after the last recorded value if an earlier call was
+// interrupted (e.g. by a crash or an error), and it removes the progress
+// once all values are checked.
+func (index *bunchRefCache) Optimize() (OptimizeSummary, error) {
+	if index.linearImport {
+		panic("programming error: optimize not supported in linearImport mode")
+	}
+	summary := OptimizeSummary{}
+	// an in-memory index can not be resumed, it records no progress
+	inMemory := index.options.InMemory
+	progressPath := filepath.Join(index.path, optimizeProgressFile)
+	var lastKey []byte
+	var err error
+	if !inMemory {
+		lastKey, err = ioutil.ReadFile(progressPath)
+		if err != nil && !os.IsNotExist(err) {
+			return summary, errors.Wrap(err, "reading optimize progress")
+		}
+	}
+	summary.Resumed = lastKey != nil
+	codec := index.storeCodec()
+
+	snap := index.db.NewSnapshot()
+	defer index.db.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+	if lastKey != nil {
+		it.Seek(lastKey)
+		if it.Valid() && bytes.Equal(it.Key(), lastKey) {
+			it.Next()
+		}
+	} else {
+		it.SeekToFirst()
+	}
+
+	buf := bytePool.get()
+	defer func() { bytePool.release(buf) }()
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		data, err := index.resolveValue(it.Value())
+		if err != nil {
+			return summary, err
+		}
+		// dedupCodec.Unmarshal already sorts and deduplicates the refs
+		idRefs, err := index.unmarshalUnchecked(data)
+		if err != nil {
+			return summary, errors.Wrapf(err, "bunch %d", idFromKeyBuf(key))
+		}
+		idRefs = sortIDRefs(withoutEmptyRefs(idRefs))
+		buf = codec.Marshal(idRefs, buf)
+		if !bytes.Equal(buf, data) {
+			if err := index.putBunch(key, idRefs); err != nil {
+				return summary, err
+			}
+			summary.Rewritten++
+			summary.BytesSaved += int64(len(data) - len(buf))
+		}
+		summary.Values++
+		if !inMemory && summary.Values%optimizeCheckpointValues == 0 {
+			if err := writeOptimizeProgress(index.path, key); err != nil {
+				return summary, errors.Wrap(err, "writing optimize progress")
+			}
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return summary, err
+	}
+	if inMemory {
+		return summary, nil
+	}
+	if err := os.Remove(progressPath); err != nil && !os.IsNotExist(err) {
+		return summary, err
+	}
+	return summary, nil
+}
+
+func writeOptimizeProgress(path string, key []byte) error {
+	tmp := filepath.Join(path, optimizeProgressFile+".tmp")
+	if err := ioutil.WriteFile(tmp, key, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(path, optimizeProgressFile))
+}
@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/element"
+	"github.com/pkg/errors"
+)
+
+// overflowIndexDir is the LevelDB with the refs above MaxValueRefs, inside
+// the directory of the ref index.
+const overflowIndexDir = "overflow"
+
+// overflowCodec is the codec of an index with the MaxValueRefs option.
+// Values contain the max smallest refs of each ID, the remaining refs are
+// stored in the overflow index with the ID as key. Only IDs with exactly
+// max refs in the value can have overflow refs, they are merged after
+// decoding. Reads of the overflow index always see the latest state, also
+// for reads of older snapshots.
+type overflowCodec struct {
+	refCodec
+	max      int
+	overflow *cache
+}
+
+func (c overflowCodec) overflowRefs(id int64) []int64 {
+	key := getKeyBuf(id)
+	defer releaseKeyBuf(key)
+	data, err := c.overflow.db.Get(c.overflow.ro, key[:])
+	if err != nil {
+		panic(err)
+	}
+	if data == nil {
+		return nil
+	}
+	idRefs := c.refCodec.Unmarshal(data, nil)
+	if len(idRefs) == 0 {
+		return nil
+	}
+	return idRefs[0].Refs
+}
+
+func (c overflowCodec) Unmarshal(data []byte, idRefs []element.IDRefs) []element.IDRefs {
+	idRefs = c.refCodec.Unmarshal(data, idRefs)
+	for i := range idRefs {
+		if len(idRefs[i].Refs) != c.max {
+			continue
+		}
+		if overflow := c.overflowRefs(idRefs[i].ID); len(overflow) > 0 {
+			// decoded refs can share an array, do not append in place
+			refs := append([]int64{}, idRefs[i].Refs...)
+			idRefs[i].Refs = mergeRefs(refs, overflow)
+		}
+	}
+	return idRefs
+}
+
+func (c overflowCodec) AppendRefs(data []byte, id int64, refs []int64) ([]int64, bool) {
+	n := len(refs)
+	refs, found := c.refCodec.AppendRefs(data, id, refs)
+	if found && len(refs)-n == c.max {
+		if overflow := c.overflowRefs(id); len(overflow) > 0 {
+			merged := mergeRefs(append([]int64{}, refs[n:]...), overflow)
+			refs = append(refs[:n], merged...)
+		}
+	}
+	return refs, found
+}
+
+func (c overflowCodec) UnmarshalCounts(data []byte, fn func(id int64, numRefs int)) {
+	c.refCodec.UnmarshalCounts(data, func(id int64, numRefs int) {
+		if numRefs == c.max {
+			numRefs += len(c.overflowRefs(id))
+		}
+		fn(id, numRefs)
+	})
+}
+
+// initOverflow opens the overflow index and wraps the codec.
+func (index *bunchRefCache) initOverflow(path string) error {
+	if index.indexOptions.DedupOnRead {
+		return errors.New("MaxValueRefs is not supported with DedupOnRead")
+	}
+	index.overflow = &cache{options: &cacheOptions{InMemory: index.options.InMemory}}
+	if err := index.overflow.open(path); err != nil {
+		index.overflow = nil
+		return err
+	}
+	index.codec = overflowCodec{
+		refCodec: index.codec,
+		max:      index.indexOptions.MaxValueRefs,
+		overflow: index.overflow,
+	}
+	return nil
+}
+
+// capOverflow limits the refs of each ID to MaxValueRefs before idRefs are
+// stored. The remaining refs replace the refs in the overflow index. It
+// returns idRefs itself if no ID exceeds the limit, otherwise a new slice.
+// idRefs must contain all refs of each ID, including the overflow refs,
+// as returned by Unmarshal of the overflowCodec.
+//
+// The overflow refs are written directly, before and not atomically with
+// the write of the value. A crash or a failed write of the value can leave
+// overflow refs of a newer state next to an older value. ValidateAll
+// reports overflow refs that do not continue the refs of the value (see
+// validateOverflow) and RepairAll merges and rewrites them.
+func (index *bunchRefCache) capOverflow(idRefs []element.IDRefs) ([]element.IDRefs, error) {
+	if index.overflow == nil {
+		return idRefs, nil
+	}
+	max := index.indexOptions.MaxValueRefs
+	result := idRefs
+	var buf []byte
+	for i, idRef := range idRefs {
+		n := len(idRef.Refs)
+		if n < max && n > 0 {
+			// overflow refs of values with less than max refs are never
+			// read, they are replaced or removed if the ID grows again
+			continue
+		}
+		key := idToKeyBuf(idRef.ID)
+		if n <= max {
+			if err := index.overflow.db.Delete(index.writeOptions(), key); err != nil {
+				return idRefs, err
+			}
+			continue
+		}
+		buf = index.codec.(overflowCodec).refCodec.Marshal(
+			[]element.IDRefs{{ID: idRef.ID, Refs: idRef.Refs[max:]}}, buf)
+		if err := index.overflow.db.Put(index.writeOptions(), key, buf); err != nil {
+			return idRefs, err
+		}
+		if &result[0] == &idRefs[0] {
+			result = append([]element.IDRefs{}, idRefs...)
+		}
+		result[i].Refs = idRef.Refs[:max]
+	}
+	return result, nil
+}
+
+// validateOverflow checks the overflow refs of all IDs of the value data
+// with exactly MaxValueRefs refs: they need to be sorted and larger than
+// the refs of the value. Overflow refs of IDs with less refs are never
+// read and they are not checked.
+func (index *bunchRefCache) validateOverflow(data []byte) error {
+	codec := index.codec.(overflowCodec)
+	for _, idRef := range codec.refCodec.Unmarshal(data, nil) {
+		if len(idRef.Refs) != codec.max {
+			continue
+		}
+		value, err := index.overflow.db.Get(index.overflow.ro, idToKeyBuf(idRef.ID))
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		if _, err := codec.refCodec.Validate(value); err != nil {
+			return errors.Wrapf(err, "overflow refs of id %d", idRef.ID)
+		}
+		overflow := codec.refCodec.Unmarshal(value, nil)
+		if len(overflow) != 1 || overflow[0].ID != idRef.ID {
+			return errors.Errorf("overflow refs of id %d stored for another id", idRef.ID)
+		}
+		last := idRef.Refs[len(idRef.Refs)-1]
+		for _, ref := range overflow[0].Refs {
+			if ref <= last {
+				return errors.Errorf("overflow refs of id %d do not continue its refs", idRef.ID)
+			}
+			last = ref
+		}
+	}
+	return nil
+}
+
+// OverflowCount returns the number of IDs with refs in the overflow index,
+// see MaxValueRefs. Overflow refs of IDs that were reduced to less refs are
+// included.
+func (index *bunchRefCache) OverflowCount() (int, error) {
+	if index.overflow == nil {
+		return 0, errors.New("MaxValueRefs not enabled")
+	}
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := index.overflow.db.NewIterator(ro)
+	defer it.Close()
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		n++
+	}
+	return n, it.GetError()
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DiffOpType is the type of a DiffOp.
+type DiffOpType uint8
+
+const (
+	// DiffAdd adds Ref to the refs of ID, see Add.
+	DiffAdd DiffOpType = iota
+	// DiffDeleteRef removes Ref from the refs of ID, see DeleteRef.
+	DiffDeleteRef
+	// DiffDelete removes all refs of ID, see Delete.
+	DiffDelete
+)
+
+// DiffOp is a single write of ApplyDiffParallel.
+type DiffOp struct {
+	Op  DiffOpType
+	ID  int64
+	Ref int64
+}
+
+// diffRangesPerWorker is the number of id ranges for each worker of
+// ApplyDiffParallel, so that workers with fast ranges take over more ranges.
+const diffRangesPerWorker = 4
+
+// ApplyDiffParallel applies all ops with up to workers concurrent writers.
+// The ops are grouped by bunch and split into ranges of consecutive bunches,
+// so that each bunch, and thus each id, is only updated by a single writer.
+// Ops of the same id are applied in the given order, ops of different ids
+// in any order. Each range is written with a single synced write batch, see
+// DiffTx. ApplyDiffParallel is not supported in linear import mode.
+func (index *bunchRefCache) ApplyDiffParallel(ops []DiffOp, workers int) error {
+	if index.linearImport {
+		panic("programming error: apply not supported in linearImport mode")
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	bunches := make(map[int64][]txOp)
+	for _, op := range ops {
+		var t txOpType
+		switch op.Op {
+		case DiffAdd:
+			t = txAdd
+		case DiffDeleteRef:
+			t = txDeleteRef
+		case DiffDelete:
+			t = txDelete
+		default:
+			return errors.Errorf("unknown diff op %d", op.Op)
+		}
+		bunchID := index.getBunchID(op.ID)
+		bunches[bunchID] = append(bunches[bunchID], txOp{op: t, id: op.ID, ref: op.Ref})
+	}
+	bunchIDs := make([]int64, 0, len(bunches))
+	for bunchID := range bunches {
+		bunchIDs = append(bunchIDs, bunchID)
+	}
+	sort.Slice(bunchIDs, func(i, j int) bool { return bunchIDs[i] < bunchIDs[j] })
+
+	ranges := splitDiffRanges(bunchIDs, bunches, len(ops), workers*diffRangesPerWorker)
+	if len(ranges) == 1 {
+		return index.applyTxOps(ranges[0])
+	}
+
+	todo := make(chan []txOp)
+	errc := make(chan error, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rangeOps := range todo {
+				if err := index.applyTxOps(rangeOps); err != nil {
+					errc <- err
+					// drain remaining ranges
+					for range todo {
+					}
+					return
+				}
+			}
+		}()
+	}
+	for _, rangeOps := range ranges {
+		todo <- rangeOps
+	}
+	close(todo)
+	wg.Wait()
+	close(errc)
+	return <-errc
+}
+
+// splitDiffRanges returns the ops of the sorted bunchIDs in up to n ranges
+// of consecutive bunches with about the same number of ops.
+func splitDiffRanges(bunchIDs []int64, bunches map[int64][]txOp, numOps, n int) [][]txOp {
+	if len(bunchIDs) < n {
+		n = len(bunchIDs)
+	}
+	if n <= 1 {
+		var all []txOp
+		for _, bunchID := range bunchIDs {
+			all = append(all, bunches[bunchID]...)
+		}
+		return [][]txOp{all}
+	}
+	size := (numOps + n - 1) / n
+	var ranges [][]txOp
+	var current []txOp
+	for _, bunchID := range bunchIDs {
+		current = append(current, bunches[bunchID]...)
+		if len(current) >= size {
+			ranges = append(ranges, current)
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		ranges = append(ranges, current)
+	}
+	return ranges
+}
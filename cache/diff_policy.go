@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrorAction is the result of an ErrorPolicy.
+type ErrorAction int
+
+const (
+	// ErrorContinue logs the error and continues with the next buffer.
+	// The refs of a failed write are saved for the next open of the index
+	// (see saveUnflushed).
+	ErrorContinue ErrorAction = iota
+	// ErrorRetry writes the failed batch again. Errors that can not be
+	// retried (e.g. bunches that can not be merged) continue.
+	ErrorRetry
+	// ErrorAbort stops all writes of the linear import. The refs of the
+	// failed and of all following buffers are saved for the next open of
+	// the index and Close returns the error.
+	ErrorAbort
+)
+
+// ErrorPolicy decides how the background writer of the linear import
+// handles err. attempt is the number of failed writes of the same batch,
+// starting with 1. A policy that retries should limit the attempts.
+type ErrorPolicy func(err error, attempt int) ErrorAction
+
+// SetErrorPolicy sets the ErrorPolicy option of all ref indices that are
+// opened afterwards. nil restores the default ErrorContinue.
+func SetErrorPolicy(policy ErrorPolicy) {
+	globalCacheOptions.CoordsIndex.ErrorPolicy = policy
+	globalCacheOptions.WaysIndex.ErrorPolicy = policy
+}
+
+// RetryPolicy returns an ErrorPolicy that retries each write up to
+// retries times and then continues with action.
+func RetryPolicy(retries int, action ErrorAction) ErrorPolicy {
+	return func(err error, attempt int) ErrorAction {
+		if attempt <= retries {
+			return ErrorRetry
+		}
+		return action
+	}
+}
+
+// errorAction returns the action of the ErrorPolicy option for err and
+// records an abort.
+func (index *bunchRefCache) errorAction(err error, attempt int) ErrorAction {
+	if index.indexOptions.ErrorPolicy == nil {
+		return ErrorContinue
+	}
+	action := index.indexOptions.ErrorPolicy(err, attempt)
+	if action == ErrorAbort {
+		index.abort(err)
+	}
+	return action
+}
+
+// abort stops all writes of the linear import like ErrorAbort, e.g. after
+// a recovered panic. Only the first error is recorded.
+func (index *bunchRefCache) abort(err error) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if index.abortErr == nil {
+		index.abortErr = errors.Wrapf(err, "writes to %s aborted", index.path)
+	}
+}
+
+// aborted returns the error that aborted the writes, or nil.
+func (index *bunchRefCache) aborted() error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	return index.abortErr
+}
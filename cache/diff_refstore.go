@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// RefStore returns the refs of an id. It returns ErrRefNotFound for
+// unknown ids. All ref indices of the DiffCache are RefStores.
+type RefStore interface {
+	GetOrErr(id int64) ([]int64, error)
+}
+
+// RefFetcher fetches the refs of an id from another (e.g. remote) index.
+// It returns ErrRefNotFound for unknown ids. The RefFetcher implements
+// the network protocol and it needs to be safe for concurrent use.
+type RefFetcher func(id int64) ([]int64, error)
+
+// ReadThroughRefStore reads refs from a local store and falls back to a
+// RefFetcher for ids that are missing in the local store.
+// Fetched refs (and ids that are unknown to the fetcher) are kept in
+// an in-memory LRU cache. The local store is never modified.
+// ReadThroughRefStore is safe for concurrent use.
+type ReadThroughRefStore struct {
+	local    RefStore
+	fetch    RefFetcher
+	capacity int
+
+	mu      sync.Mutex
+	cached  map[int64]*list.Element
+	lruList *list.List
+}
+
+type fetchedRefs struct {
+	id   int64
+	refs []int64 // nil if not found
+}
+
+// NewReadThroughRefStore returns a new ReadThroughRefStore that caches
+// the fetched refs of up to capacity ids.
+func NewReadThroughRefStore(local RefStore, fetch RefFetcher, capacity int) *ReadThroughRefStore {
+	return &ReadThroughRefStore{
+		local:    local,
+		fetch:    fetch,
+		capacity: capacity,
+		cached:   make(map[int64]*list.Element),
+		lruList:  list.New(),
+	}
+}
+
+// GetOrErr returns the refs of id from the local store, the cache or
+// the fetcher, in this order. Errors of the fetcher are not cached.
+func (s *ReadThroughRefStore) GetOrErr(id int64) ([]int64, error) {
+	refs, err := s.local.GetOrErr(id)
+	if err != ErrRefNotFound {
+		return refs, err
+	}
+
+	s.mu.Lock()
+	if elem, ok := s.cached[id]; ok {
+		s.lruList.MoveToFront(elem)
+		refs := elem.Value.(*fetchedRefs).refs
+		s.mu.Unlock()
+		if refs == nil {
+			return nil, ErrRefNotFound
+		}
+		return refs, nil
+	}
+	s.mu.Unlock()
+
+	refs, err = s.fetch(id)
+	if err != nil && err != ErrRefNotFound {
+		return nil, err
+	}
+	if err == ErrRefNotFound {
+		refs = nil
+	} else if refs == nil {
+		refs = []int64{}
+	}
+
+	s.mu.Lock()
+	if _, ok := s.cached[id]; !ok && s.capacity > 0 {
+		s.cached[id] = s.lruList.PushFront(&fetchedRefs{id, refs})
+		for s.lruList.Len() > s.capacity {
+			elem := s.lruList.Back()
+			delete(s.cached, s.lruList.Remove(elem).(*fetchedRefs).id)
+		}
+	}
+	s.mu.Unlock()
+	return refs, err
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"sort"
+
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/element"
+	"github.com/pkg/errors"
+)
+
+// RepairSummary is the result of RepairAll.
+type RepairSummary struct {
+	Values   int
+	Repaired int
+	// Errors are the bad values that could not be repaired, e.g. truncated
+	// values or values with IDs of other bunches.
+	Errors []ValidationError
+}
+
+// RepairValue repairs the value (bunch) that contains id, if it does not
+// pass the checks of ValidateAll: IDs and refs are sorted, duplicates are
+// removed and the value is rewritten. It returns whether the value was
+// rewritten. Values that can not be decoded, or that contain IDs of other
+// bunches, are not changed and return an error.
+func (index *bunchRefCache) RepairValue(id int64) (bool, error) {
+	return index.repairBunch(idToKeyBuf(index.getBunchID(id)))
+}
+
+// RepairAll calls RepairValue for all bad values of the index, as found by
+// ValidateAll. It iterates over a snapshot of the index, repaired values
+// are written to the index while iterating. The returned error is only for
+// errors of LevelDB.
+func (index *bunchRefCache) RepairAll() (RepairSummary, error) {
+	summary := RepairSummary{}
+
+	snap := index.db.NewSnapshot()
+	defer index.db.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		summary.Values++
+		key := it.Key()
+		if index.validateValue(key, it.Value()) == nil {
+			continue
+		}
+		repaired, err := index.repairBunch(key)
+		if err != nil {
+			var bunchID int64
+			if len(key) == 8 {
+				bunchID = idFromKeyBuf(key)
+			}
+			summary.Errors = append(summary.Errors, ValidationError{bunchID, err})
+			continue
+		}
+		if repaired {
+			summary.Repaired++
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+func (index *bunchRefCache) repairBunch(keyBuf []byte) (bool, error) {
+	if index.linearImport {
+		panic("programming error: repair not supported in linearImport mode")
+	}
+	if len(keyBuf) != 8 {
+		return false, errors.Errorf("unexpected key length %d", len(keyBuf))
+	}
+	data, err := index.getValue(index.ro, keyBuf)
+	if err != nil || data == nil {
+		return false, err
+	}
+	if index.validateValue(keyBuf, data) == nil {
+		return false, nil
+	}
+	idRefs, err := index.unmarshalUnchecked(data)
+	if err != nil {
+		return false, err
+	}
+	bunchID := idFromKeyBuf(keyBuf)
+	for _, idRef := range idRefs {
+		if index.getBunchID(idRef.ID) != bunchID {
+			return false, errors.Errorf("id %d does not belong to bunch", idRef.ID)
+		}
+	}
+
+	counts := make(map[int64]int, len(idRefs))
+	for _, idRef := range idRefs {
+		counts[idRef.ID] += len(idRef.Refs)
+	}
+	idRefs = sortIDRefs(idRefs)
+	if err := index.putBunch(keyBuf, idRefs); err != nil {
+		return false, err
+	}
+	for _, idRef := range idRefs {
+		if index.sketch != nil {
+			index.sketch.add(idRef.ID, len(idRef.Refs)-counts[idRef.ID])
+		}
+		index.emitChange(ChangeSet, idRef.ID, idRef.Refs)
+		if err := index.touch(idRef.ID); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// unmarshalUnchecked decodes a value that failed the validation. It returns
+// an error if the codec panics, e.g. for a truncated value.
+func (index *bunchRefCache) unmarshalUnchecked(data []byte) (idRefs []element.IDRefs, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("value can not be decoded: %v", r)
+		}
+	}()
+	return index.codec.Unmarshal(data, nil), nil
+}
+
+// sortIDRefs sorts idRefs by ID and the refs of each ID, and removes
+// duplicate refs. The refs of duplicate IDs are merged.
+func sortIDRefs(idRefs []element.IDRefs) []element.IDRefs {
+	sort.SliceStable(idRefs, func(i, j int) bool { return idRefs[i].ID < idRefs[j].ID })
+	result := idRefs[:0]
+	for _, idRef := range idRefs {
+		refs := idRef.Refs
+		n := len(result)
+		if n > 0 && result[n-1].ID == idRef.ID {
+			// refs of decoded values can share an array, do not append
+			// in place
+			refs = append(append([]int64{}, result[n-1].Refs...), refs...)
+		}
+		sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+		refs = dedupRefs(refs)
+		if n > 0 && result[n-1].ID == idRef.ID {
+			result[n-1].Refs = refs
+			continue
+		}
+		result = append(result, element.IDRefs{ID: idRef.ID, Refs: refs})
+	}
+	return result
+}
+
+// dedupRefs removes duplicates of the sorted refs in place.
+func dedupRefs(refs []int64) []int64 {
+	if len(refs) < 2 {
+		return refs
+	}
+	n := 1
+	for _, ref := range refs[1:] {
+		if ref != refs[n-1] {
+			refs[n] = ref
+			n++
+		}
+	}
+	return refs[:n]
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/element"
+)
+
+// CompressionSample is the result of SampleCompression.
+type CompressionSample struct {
+	Values int // number of sampled values (bunches)
+	IDs    int
+	Refs   int
+	// RawSize is the size of all sampled ids and refs as 64-bit integers.
+	RawSize int64
+	// StoredSize is the size of the sampled values as they are stored.
+	StoredSize int64
+	// CodecSizes is the size of the sampled values for each codec.
+	CodecSizes map[string]int64
+}
+
+// Ratio returns the compression ratio (raw size / compressed size) of the
+// codec. It returns 0 for unknown codecs.
+func (s CompressionSample) Ratio(codec string) float64 {
+	size := s.CodecSizes[codec]
+	if size == 0 {
+		return 0
+	}
+	return float64(s.RawSize) / float64(size)
+}
+
+// SampleCompression reads up to n random values of the index and
+// marshals them with each available codec (see refCodecs), to guide the
+// selection of the Codec option without rebuilding the index. Values are
+// selected by seeking to random bunch ids between the first and last key,
+// values after large gaps of the id space are more likely to be sampled.
+func (index *bunchRefCache) SampleCompression(n int) (CompressionSample, error) {
+	sample := CompressionSample{CodecSizes: make(map[string]int64)}
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+
+	it.SeekToFirst()
+	if !it.Valid() {
+		return sample, it.GetError()
+	}
+	first := idFromKeyBuf(it.Key())
+	it.SeekToLast()
+	last := idFromKeyBuf(it.Key())
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var idRefs []element.IDRefs
+	var buf []byte
+	for i := 0; i < n; i++ {
+		it.Seek(idToKeyBuf(first + rnd.Int63n(last-first+1)))
+		if !it.Valid() {
+			break
+		}
+		data, err := index.resolveValue(it.Value())
+		if err != nil {
+			return sample, err
+		}
+		idRefs = index.codec.Unmarshal(data, idRefs)
+
+		sample.Values++
+		sample.StoredSize += int64(len(data))
+		sample.IDs += len(idRefs)
+		for _, idRef := range idRefs {
+			sample.Refs += len(idRef.Refs)
+		}
+		for name, codec := range refCodecs {
+			buf = codec.Marshal(idRefs, buf)
+			sample.CodecSizes[name] += int64(len(buf))
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return sample, err
+	}
+	sample.RawSize = int64(sample.IDs+sample.Refs) * 8
+	return sample, nil
+}
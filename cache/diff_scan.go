@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"github.com/jmhodges/levigo"
+)
+
+// ScanHighDegree returns the sorted ids of the index that have at least min
+// refs. Only the number of refs is decoded for each id. The scan iterates
+// over the whole index and should not be used during linear import.
+func (index *bunchRefCache) ScanHighDegree(min int) ([]int64, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+
+	var ids []int64
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		data, err := index.resolveValue(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		index.codec.UnmarshalCounts(data, func(id int64, numRefs int) {
+			if numRefs >= min {
+				ids = append(ids, id)
+			}
+		})
+	}
+	if err := it.GetError(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// IterKeys calls fn with each id of the index in key order (ascending with
+// the default comparator). The LevelDB keys of the index are bunches of
+// ids, so only the ids at the start of each value are decoded, the refs are
+// never decoded. This is the cheapest scan to check the presence of ids or
+// to count them. Deleted ids are removed from the index and they are not
+// included. The scan iterates over the whole index and should not be used during linear
+// import.
+func (index *bunchRefCache) IterKeys(fn func(id int64)) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		data, err := index.resolveValue(it.Value())
+		if err != nil {
+			return err
+		}
+		index.codec.UnmarshalCounts(data, func(id int64, _ int) {
+			fn(id)
+		})
+	}
+	return it.GetError()
+}
+
+// Count returns the number of ids in the index, see IterKeys.
+func (index *bunchRefCache) Count() (int, error) {
+	n := 0
+	err := index.IterKeys(func(int64) { n++ })
+	return n, err
+}
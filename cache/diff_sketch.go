@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+const (
+	degreeSketchFile  = "imposm_degree_sketch"
+	degreeSketchDepth = 4
+	degreeSketchWidth = 1 << 16
+)
+
+// degreeSketch is a count-min sketch of the number of refs per id. It
+// never underestimates the number of refs, as long as it is in sync with
+// the index, but it can overestimate it for ids that collide with ids
+// with many refs.
+type degreeSketch struct {
+	counts [degreeSketchDepth * degreeSketchWidth]uint32
+}
+
+func degreeSketchHash(id int64, row int) int {
+	// splitmix64 finalizer with a different seed for each row
+	x := uint64(id) + uint64(row+1)*0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x = x ^ (x >> 31)
+	return row*degreeSketchWidth + int(x%degreeSketchWidth)
+}
+
+func (s *degreeSketch) add(id int64, n int) {
+	for row := 0; row < degreeSketchDepth; row++ {
+		c := &s.counts[degreeSketchHash(id, row)]
+		if n >= 0 {
+			atomic.AddUint32(c, uint32(n))
+			continue
+		}
+		for {
+			old := atomic.LoadUint32(c)
+			v := uint32(0)
+			if old > uint32(-n) {
+				v = old - uint32(-n)
+			}
+			if atomic.CompareAndSwapUint32(c, old, v) {
+				break
+			}
+		}
+	}
+}
+
+func (s *degreeSketch) estimate(id int64) int {
+	min := uint32(0)
+	for row := 0; row < degreeSketchDepth; row++ {
+		c := atomic.LoadUint32(&s.counts[degreeSketchHash(id, row)])
+		if row == 0 || c < min {
+			min = c
+		}
+	}
+	return int(min)
+}
+
+func (s *degreeSketch) write(path string) error {
+	buf := make([]byte, len(s.counts)*4)
+	for i := range s.counts {
+		binary.LittleEndian.PutUint32(buf[i*4:], atomic.LoadUint32(&s.counts[i]))
+	}
+	tmp := filepath.Join(path, degreeSketchFile+".tmp")
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(path, degreeSketchFile))
+}
+
+// readDegreeSketch reads the sketch of the index at path. It returns
+// nil without an error if there is no sketch.
+func readDegreeSketch(path string) (*degreeSketch, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(path, degreeSketchFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &degreeSketch{}
+	if len(buf) != len(s.counts)*4 {
+		return nil, errors.Errorf("invalid size of %s", degreeSketchFile)
+	}
+	for i := range s.counts {
+		s.counts[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return s, nil
+}
+
+// initSketch loads the degree sketch of the index at path, or builds it
+// from all stored refs if the index has no sketch yet.
+func (index *bunchRefCache) initSketch(path string) error {
+	var s *degreeSketch
+	var err error
+	if !index.options.InMemory {
+		s, err = readDegreeSketch(path)
+		if err != nil {
+			return errors.Wrap(err, "reading degree sketch")
+		}
+	}
+	if s == nil {
+		s, err = index.buildSketch()
+		if err != nil {
+			return errors.Wrap(err, "building degree sketch")
+		}
+	}
+	index.sketch = s
+	return nil
+}
+
+// buildSketch creates a new degree sketch from all stored refs.
+func (index *bunchRefCache) buildSketch() (*degreeSketch, error) {
+	s := &degreeSketch{}
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		data, err := index.resolveValue(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		index.codec.UnmarshalCounts(data, func(id int64, numRefs int) {
+			s.add(id, numRefs)
+		})
+	}
+	if err := it.GetError(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ApproxRefsCount returns an estimate of the number of refs of id, without
+// reading the refs from LevelDB. The estimate is never lower than the
+// actual number of refs, but it can be higher, especially for ids with
+// few refs. Refs that are added again are counted twice during linear
+// import. The sketch is only stored when the index is closed, estimates can
+// be too low after a crash.
+//
+// Requires the DegreeSketch option and returns an error otherwise.
+func (index *bunchRefCache) ApproxRefsCount(id int64) (int, error) {
+	if index.sketch == nil {
+		return 0, errors.New("degree sketch not enabled")
+	}
+	return index.sketch.estimate(id), nil
+}
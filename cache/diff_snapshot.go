@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+// maxSnapshots is the number of snapshots that are retained by each
+// ref index.
+const maxSnapshots = 8
+
+// ErrSnapshotReleased is returned for reads of snapshots that are no
+// longer retained.
+var ErrSnapshotReleased = errors.New("snapshot released")
+
+type refSnapshot struct {
+	seq  uint64
+	snap *levigo.Snapshot
+	ro   *levigo.ReadOptions
+}
+
+// Snapshot captures the current state of the index and returns a sequence
+// number for GetAtSnapshot. Sequence numbers increase with each call.
+//
+// Only the last maxSnapshots (8) snapshots are retained, older snapshots are
+// released. Snapshots are kept in memory and all snapshots are released when
+// the index is closed. A snapshot prevents LevelDB from removing obsolete
+// values, so snapshots increase the disk usage till they are released.
+func (index *bunchRefCache) Snapshot() uint64 {
+	snap := index.db.NewSnapshot()
+	ro := levigo.NewReadOptions()
+	ro.SetSnapshot(snap)
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.lastSnapshot++
+	index.snapshots = append(index.snapshots, refSnapshot{index.lastSnapshot, snap, ro})
+	if len(index.snapshots) > maxSnapshots {
+		index.releaseSnapshot(index.snapshots[0])
+		index.snapshots = index.snapshots[1:]
+	}
+	return index.lastSnapshot
+}
+
+// GetAtSnapshot returns the refs of id as they were when the snapshot seq
+// was captured. It returns ErrSnapshotReleased if the snapshot is no
+// longer retained.
+func (index *bunchRefCache) GetAtSnapshot(seq uint64, id int64) ([]int64, error) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	for _, s := range index.snapshots {
+		if s.seq == seq {
+			refs, _, err := index.getWith(s.ro, id)
+			return refs, err
+		}
+	}
+	return nil, ErrSnapshotReleased
+}
+
+// GetMultiVersion returns the refs of id for all retained snapshots,
+// by sequence number.
+func (index *bunchRefCache) GetMultiVersion(id int64) (map[uint64][]int64, error) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	result := make(map[uint64][]int64, len(index.snapshots))
+	for _, s := range index.snapshots {
+		refs, _, err := index.getWith(s.ro, id)
+		if err != nil {
+			return nil, err
+		}
+		result[s.seq] = refs
+	}
+	return result, nil
+}
+
+func (index *bunchRefCache) releaseSnapshot(s refSnapshot) {
+	s.ro.Close()
+	index.db.ReleaseSnapshot(s.snap)
+}
+
+func (index *bunchRefCache) releaseSnapshots() {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	for _, s := range index.snapshots {
+		index.releaseSnapshot(s)
+	}
+	index.snapshots = nil
+}
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+const spillFileName = "imposm_spill"
+
+// spillMarker is the first byte of values that point to the spill file.
+// Marshaled bunches start with the number of IDs as uvarint, which is
+// smaller than 0x80 for all bunch sizes.
+const spillMarker = 0xff
+
+// spillFile is an append-only file for values that exceed the
+// SpillThresholdK option. LevelDB only stores a pointer (offset and length)
+// to these values. Replaced values are not removed from the file.
+type spillFile struct {
+	mu   sync.Mutex // protects appends
+	f    *os.File
+	size int64
+}
+
+func openSpillFile(path string) (*spillFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &spillFile{f: f, size: fi.Size()}, nil
+}
+
+// append writes data to the end of the file and returns the pointer for
+// LevelDB.
+func (s *spillFile) append(data []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.WriteAt(data, s.size); err != nil {
+		return nil, err
+	}
+	ptr := make([]byte, 1+2*binary.MaxVarintLen64)
+	ptr[0] = spillMarker
+	n := 1
+	n += binary.PutUvarint(ptr[n:], uint64(s.size))
+	n += binary.PutUvarint(ptr[n:], uint64(len(data)))
+	s.size += int64(len(data))
+	return ptr[:n], nil
+}
+
+// read returns the value for the pointer ptr.
+func (s *spillFile) read(ptr []byte) ([]byte, error) {
+	offset, n := binary.Uvarint(ptr[1:])
+	if n <= 0 {
+		return nil, errors.New("invalid spill pointer")
+	}
+	length, m := binary.Uvarint(ptr[1+n:])
+	if m <= 0 {
+		return nil, errors.New("invalid spill pointer")
+	}
+	data := make([]byte, length)
+	if _, err := s.f.ReadAt(data, int64(offset)); err != nil {
+		return nil, errors.Wrap(err, "reading spilled value")
+	}
+	return data, nil
+}
+
+func (s *spillFile) close() error {
+	return s.f.Close()
+}
+
+// initSpill opens the spill file if spilling is enabled, or if the index
+// already contains spilled values from an earlier run.
+func (index *bunchRefCache) initSpill(path string) error {
+	if index.options.InMemory {
+		// keep all values in the in-memory LevelDB
+		return nil
+	}
+	spillPath := filepath.Join(path, spillFileName)
+	if index.indexOptions.SpillThresholdK <= 0 {
+		if _, err := os.Stat(spillPath); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	spill, err := openSpillFile(spillPath)
+	if err != nil {
+		return errors.Wrap(err, "opening spill file")
+	}
+	index.spill = spill
+	return nil
+}
+
+// spillValue returns the value that should be stored in LevelDB for data.
+// This is data itself, or a pointer if data was appended to the spill file.
+func (index *bunchRefCache) spillValue(data []byte) ([]byte, error) {
+	threshold := index.indexOptions.SpillThresholdK * 1024
+	if threshold <= 0 || len(data) < threshold || index.spill == nil {
+		return data, nil
+	}
+	return index.spill.append(data)
+}
+
+// resolveValue returns the actual value of the LevelDB value data, which
+// can be a pointer to the spill file.
+func (index *bunchRefCache) resolveValue(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != spillMarker {
+		return data, nil
+	}
+	if index.spill == nil {
+		return nil, errors.New("spilled value without spill file")
+	}
+	return index.spill.read(data)
+}
+
+// getValue is like db.Get, but it resolves spilled values.
+func (index *bunchRefCache) getValue(ro *levigo.ReadOptions, key []byte) ([]byte, error) {
+	data, err := index.db.Get(ro, key)
+	if err != nil {
+		return nil, err
+	}
+	return index.resolveValue(data)
+}
+
+// putValue is like db.Put, but it spills large values.
+func (index *bunchRefCache) putValue(key, data []byte) error {
+	value, err := index.spillValue(data)
+	if err != nil {
+		return err
+	}
+	index.markChanged(key)
+	return index.db.Put(index.writeOptions(), key, value)
+}
+
+// viewValue is like the viewValue function, but it resolves spilled
+// values. fn is called with the spilled value in Go memory in this case.
+func (index *bunchRefCache) viewValue(ro *levigo.ReadOptions, key []byte, fn func(data []byte)) (bool, error) {
+	var spilled []byte
+	found, err := viewValue(index.db, ro, key, func(data []byte) {
+		if len(data) > 0 && data[0] == spillMarker {
+			spilled = append([]byte{}, data...)
+			return
+		}
+		fn(data)
+	})
+	if err != nil || spilled == nil {
+		return found, err
+	}
+	data, err := index.resolveValue(spilled)
+	if err != nil {
+		return true, err
+	}
+	fn(data)
+	return true, nil
+}
@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"bufio"
+	bin "encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Stream format of a DiffCache:
+//
+//	header:   "imposm-diffcache" magic, uvarint format version
+//	sections: uvarint length and name of the index, followed by the
+//	          DumpFast output of the index in chunks: uvarint chunk length
+//	          and chunk data, terminated by a chunk of length 0
+//	end:      a section with an empty name
+//
+// The chunks frame the dumps, so that the reader knows where each dump ends
+// without reading ahead.
+const (
+	streamMagic         = "imposm-diffcache"
+	streamFormatVersion = 1
+	streamChunkSize     = 64 * 1024
+	maxStreamChunkSize  = 16 * 1024 * 1024
+)
+
+type namedIndex struct {
+	name  string
+	index *bunchRefCache
+}
+
+// indices returns all opened indices with the name of their directory.
+func (c *DiffCache) indices() []namedIndex {
+	indices := []namedIndex{
+		{"coords_index", c.Coords.bunchRefCache},
+		{"coords_rel_index", c.CoordsRel.bunchRefCache},
+		{"ways_index", c.Ways.bunchRefCache},
+	}
+	if c.Coords.wayNodes != nil {
+		indices = append(indices, namedIndex{"way_nodes_index", c.Coords.wayNodes})
+	}
+	if c.Coords.wayNodeRange != nil {
+		indices = append(indices, namedIndex{"way_node_range_index", c.Coords.wayNodeRange})
+	}
+	if c.Relations != nil {
+		indices = append(indices, namedIndex{"relations_index", c.Relations.bunchRefCache})
+	}
+	return indices
+}
+
+// StreamTo writes all indices of the cache to w, e.g. to a pipe or socket of
+// a new process that loads the cache with StreamFrom, without writing the
+// cache to disk in between. Each index is written with DumpFast.
+func (c *DiffCache) StreamTo(w io.Writer) error {
+	if !c.opened {
+		return errors.New("diff cache not opened")
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(streamMagic); err != nil {
+		return err
+	}
+	if err := writeUvarint(bw, streamFormatVersion); err != nil {
+		return err
+	}
+	for _, idx := range c.indices() {
+		if err := writeStreamString(bw, idx.name); err != nil {
+			return err
+		}
+		cw := &chunkWriter{w: bw}
+		if err := idx.index.DumpFast(cw); err != nil {
+			return errors.Wrapf(err, "streaming %s", idx.name)
+		}
+		if err := cw.close(); err != nil {
+			return err
+		}
+	}
+	if err := writeStreamString(bw, ""); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// StreamFrom reads a stream of StreamTo and loads each index with
+// LoadFast. The cache must be opened and it must contain all indices of the
+// stream (e.g. Relations). The indices must not be in linear import mode.
+func (c *DiffCache) StreamFrom(r io.Reader) error {
+	if !c.opened {
+		return errors.New("diff cache not opened")
+	}
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return errors.Wrap(err, "reading stream header")
+	}
+	if string(magic) != streamMagic {
+		return errors.New("not a diff cache stream")
+	}
+	version, err := bin.ReadUvarint(br)
+	if err != nil {
+		return errors.Wrap(err, "reading stream header")
+	}
+	if version != streamFormatVersion {
+		return errors.Errorf("unsupported stream format version %d", version)
+	}
+
+	indices := make(map[string]*bunchRefCache)
+	for _, idx := range c.indices() {
+		indices[idx.name] = idx.index
+	}
+	for {
+		name, err := readStreamString(br)
+		if err != nil {
+			return errors.Wrap(err, "reading stream section")
+		}
+		if name == "" {
+			return nil
+		}
+		index, ok := indices[name]
+		if !ok {
+			return errors.Errorf("index %s of stream not in cache", name)
+		}
+		cr := &chunkReader{r: br}
+		if err := index.LoadFast(cr); err != nil {
+			return errors.Wrapf(err, "loading %s", name)
+		}
+		if !cr.done {
+			return errors.Errorf("unexpected data after dump of %s", name)
+		}
+	}
+}
+
+// chunkWriter writes chunks of up to streamChunkSize bytes.
+type chunkWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		free := streamChunkSize - len(cw.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		cw.buf = append(cw.buf, p[:free]...)
+		p = p[free:]
+		if len(cw.buf) == streamChunkSize {
+			if err := cw.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (cw *chunkWriter) flush() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	if err := writeUvarint(cw.w, uint64(len(cw.buf))); err != nil {
+		return err
+	}
+	if _, err := cw.w.Write(cw.buf); err != nil {
+		return err
+	}
+	cw.buf = cw.buf[:0]
+	return nil
+}
+
+// close writes the remaining data and the final chunk.
+func (cw *chunkWriter) close() error {
+	if err := cw.flush(); err != nil {
+		return err
+	}
+	return writeUvarint(cw.w, 0)
+}
+
+// chunkReader reads the chunks of a chunkWriter. It returns io.EOF after
+// the final chunk, without reading the data that follows.
+type chunkReader struct {
+	r    *bufio.Reader
+	left uint64 // of the current chunk
+	done bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+	if cr.left == 0 {
+		length, err := bin.ReadUvarint(cr.r)
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if length > maxStreamChunkSize {
+			return 0, errors.Errorf("invalid chunk length %d", length)
+		}
+		if length == 0 {
+			cr.done = true
+			return 0, io.EOF
+		}
+		cr.left = length
+	}
+	if uint64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	cr.left -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) error {
+	buf := make([]byte, bin.MaxVarintLen64)
+	n := bin.PutUvarint(buf, v)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+func writeStreamString(w *bufio.Writer, s string) error {
+	if err := writeUvarint(w, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+func readStreamString(r *bufio.Reader) (string, error) {
+	length, err := bin.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if length > 255 {
+		return "", errors.New("invalid name")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
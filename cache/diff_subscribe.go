@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"sync/atomic"
+
+	"github.com/omniscale/imposm3/element"
+	"github.com/omniscale/imposm3/log"
+)
+
+// subscribeBufferSize is the number of notifications that are queued for
+// each subscriber before notifications are dropped.
+const subscribeBufferSize = 1024
+
+type refNotification struct {
+	id      int64
+	oldRefs []int64
+	newRefs []int64
+}
+
+type refSubscriber struct {
+	fn            func(id int64, oldRefs, newRefs []int64)
+	notifications chan refNotification
+	done          chan struct{}
+	dropped       int64 // atomic
+}
+
+// Subscribe calls fn for each id with changed refs, with the refs before
+// and after the change, e.g. to invalidate tiles of changed nodes. fn is
+// called for the writes of the linear import (see loadMergeMarshal) and
+// for Add, DeleteRef, Delete, DiffTx and ApplyDiffParallel. oldRefs is
+// empty for new ids and newRefs is empty for deleted ids. Refs of
+// DedupOnRead indices are sorted and deduplicated.
+//
+// fn is called from a separate goroutine for each subscriber, in the order
+// of the changes. The calls never block the writers: notifications are
+// dropped if a subscriber falls behind by more than subscribeBufferSize
+// changes. Subscribers are stopped with Close. Large bunches of the linear
+// import are decoded for the notifications, instead of the faster merge
+// without decoding.
+func (index *bunchRefCache) Subscribe(fn func(id int64, oldRefs, newRefs []int64)) {
+	sub := &refSubscriber{
+		fn:            fn,
+		notifications: make(chan refNotification, subscribeBufferSize),
+		done:          make(chan struct{}),
+	}
+	go func() {
+		defer close(sub.done)
+		for n := range sub.notifications {
+			sub.fn(n.id, n.oldRefs, n.newRefs)
+		}
+	}()
+	index.mu.Lock()
+	index.subscribers = append(index.subscribers, sub)
+	index.mu.Unlock()
+}
+
+func (index *bunchRefCache) hasSubscribers() bool {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	return len(index.subscribers) > 0
+}
+
+// notify sends copies of oldRefs and newRefs to all subscribers if the refs
+// differ.
+func (index *bunchRefCache) notify(id int64, oldRefs, newRefs []int64) {
+	if !index.hasSubscribers() {
+		return
+	}
+	if index.indexOptions.DedupOnRead {
+		oldRefs = sortDedupRefs(append([]int64(nil), oldRefs...))
+		newRefs = sortDedupRefs(append([]int64(nil), newRefs...))
+	}
+	if equalRefs(oldRefs, newRefs) {
+		return
+	}
+	n := refNotification{
+		id:      id,
+		oldRefs: append([]int64{}, oldRefs...),
+		newRefs: append([]int64{}, newRefs...),
+	}
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	for _, sub := range index.subscribers {
+		select {
+		case sub.notifications <- n:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+// copyBunchRefs returns copies of the refs in bunch of all ids of newBunch.
+func copyBunchRefs(bunch, newBunch []element.IDRefs) map[int64][]int64 {
+	refs := make(map[int64][]int64, len(newBunch))
+	for _, idRef := range newBunch {
+		refs[idRef.ID] = nil
+		for _, b := range bunch {
+			if b.ID == idRef.ID {
+				refs[idRef.ID] = append([]int64(nil), b.Refs...)
+				break
+			}
+		}
+	}
+	return refs
+}
+
+// notifyBunch notifies the changes of all ids of newBunch, with the refs of
+// oldRefs (see copyBunchRefs) and the merged bunch.
+func (index *bunchRefCache) notifyBunch(oldRefs map[int64][]int64, merged, newBunch []element.IDRefs) {
+	for _, idRef := range newBunch {
+		var newRefs []int64
+		for _, m := range merged {
+			if m.ID == idRef.ID {
+				newRefs = m.Refs
+				break
+			}
+		}
+		index.notify(idRef.ID, oldRefs[idRef.ID], newRefs)
+	}
+}
+
+// stopSubscribers waits till all subscribers received the queued
+// notifications.
+func (index *bunchRefCache) stopSubscribers() {
+	index.mu.Lock()
+	subscribers := index.subscribers
+	index.subscribers = nil
+	for _, sub := range subscribers {
+		close(sub.notifications)
+	}
+	index.mu.Unlock()
+	for _, sub := range subscribers {
+		<-sub.done
+		if dropped := atomic.LoadInt64(&sub.dropped); dropped > 0 {
+			log.Printf("[warn] %s: dropped %d change notifications of a slow subscriber", index.path, dropped)
+		}
+	}
+}
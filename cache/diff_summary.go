@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// Summary are the totals of the linear import of an index, see Summary
+// and the LogSummary option.
+type Summary struct {
+	// IDs and Refs are the number of written ids and refs. Ids that are
+	// written with multiple flushes are counted for each flush.
+	IDs     int64
+	Refs    int64
+	Bytes   int64 // size of the written values, including the keys
+	Flushes int
+	Errors  int // number of background errors, see Errors
+	Elapsed time.Duration
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d ids, %d refs, %d bytes written in %d flushes, %d errors, %s",
+		s.IDs, s.Refs, s.Bytes, s.Flushes, s.Errors, s.Elapsed.Round(time.Millisecond))
+}
+
+// recordFlush adds a successful flush to the summary.
+func (index *bunchRefCache) recordFlush(ids, refs int, bytes int64) {
+	index.mu.Lock()
+	index.summary.IDs += int64(ids)
+	index.summary.Refs += int64(refs)
+	index.summary.Bytes += bytes
+	index.summary.Flushes++
+	index.mu.Unlock()
+}
+
+// Summary returns the totals of all linear imports since the index was
+// opened. Elapsed is the time since the open, or till Close.
+func (index *bunchRefCache) Summary() Summary {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	s := index.summary
+	s.Errors = index.errCount
+	if index.closed.IsZero() {
+		s.Elapsed = time.Since(index.opened)
+	} else {
+		s.Elapsed = index.closed.Sub(index.opened)
+	}
+	return s
+}
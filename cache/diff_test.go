@@ -1,10 +1,26 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	bin "encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/jmhodges/levigo"
 	osm "github.com/omniscale/go-osm"
 	"github.com/omniscale/imposm3/element"
 )
@@ -99,6 +115,134 @@ func BenchmarkWriteDiff(b *testing.B) {
 
 }
 
+// BenchmarkWriteRefsTrackGenerations measures the allocations of flushes
+// that create a key for each id of the buffer.
+func BenchmarkWriteRefsTrackGenerations(b *testing.B) {
+	b.StopTimer()
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.TrackGenerations = true
+	cache, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// writeRefs recycles the buffer
+		idRefs := make(idRefBunches)
+		for n := int64(0); n < 64*100; n++ {
+			idRefs.add(cache.getBunchID(n), n, int64(i))
+		}
+		b.StartTimer()
+		if _, _, err := cache.writeRefs(idRefs); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+	}
+}
+
+func BenchmarkWriteDiffQueueDepth(b *testing.B) {
+	for _, depth := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("depth-%d", depth), func(b *testing.B) {
+			b.StopTimer()
+			cacheDir, _ := ioutil.TempDir("", "imposm_test")
+			defer os.RemoveAll(cacheDir)
+
+			opts := globalCacheOptions.CoordsIndex
+			opts.WriteQueueDepth = depth
+			cache, err := newRefIndex(cacheDir, &opts)
+			if err != nil {
+				b.Fatal()
+			}
+			defer cache.Close()
+
+			b.StartTimer()
+			for i := 0; i < b.N; i++ {
+				cache.SetLinearImport(true)
+				// one bunch for each id, to fill 4 buffers
+				for n := 0; n < bufferSize*4; n++ {
+					cache.addc <- idRef{id: int64(n * 64), ref: int64(i)}
+				}
+				cache.SetLinearImport(false)
+			}
+		})
+	}
+}
+
+// BenchmarkWriteDiffFlushReadConcurrency measures flushes that merge refs
+// into existing values, with limits for the reads of the write workers.
+// The index is reopened before each flush, so that the block cache is cold.
+func BenchmarkWriteDiffFlushReadConcurrency(b *testing.B) {
+	for _, reads := range []int{0, 1, 2} {
+		b.Run(fmt.Sprintf("reads-%d", reads), func(b *testing.B) {
+			b.StopTimer()
+			cacheDir, _ := ioutil.TempDir("", "imposm_test")
+			defer os.RemoveAll(cacheDir)
+
+			opts := globalCacheOptions.CoordsIndex
+			opts.FlushReadConcurrency = reads
+			cache, err := newRefIndex(cacheDir, &opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			cache.SetLinearImport(true)
+			for n := 0; n < bufferSize; n++ {
+				cache.addc <- idRef{id: int64(n * 64), ref: -1}
+			}
+			cache.SetLinearImport(false)
+
+			for i := 0; i < b.N; i++ {
+				cache.Close()
+				cache, err = newRefIndex(cacheDir, &opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				cache.SetLinearImport(true)
+				b.StartTimer()
+				for n := 0; n < bufferSize; n++ {
+					cache.addc <- idRef{id: int64(n * 64), ref: int64(i)}
+				}
+				cache.SetLinearImport(false)
+				b.StopTimer()
+			}
+			cache.Close()
+		})
+	}
+}
+
+// BenchmarkWriteDiffPinWriter compares the linear import with and without
+// the PinWriter option. The difference is only expected on NUMA machines.
+func BenchmarkWriteDiffPinWriter(b *testing.B) {
+	for _, pin := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pin-%t", pin), func(b *testing.B) {
+			b.StopTimer()
+			cacheDir, _ := ioutil.TempDir("", "imposm_test")
+			defer os.RemoveAll(cacheDir)
+
+			opts := globalCacheOptions.CoordsIndex
+			opts.PinWriter = pin
+			cache, err := newRefIndex(cacheDir, &opts)
+			if err != nil {
+				b.Fatal()
+			}
+			defer cache.Close()
+
+			b.StartTimer()
+			for i := 0; i < b.N; i++ {
+				cache.SetLinearImport(true)
+				for n := 0; n < bufferSize*4; n++ {
+					cache.addc <- idRef{id: int64(n * 64), ref: int64(i)}
+				}
+				cache.SetLinearImport(false)
+			}
+		})
+	}
+}
+
 func TestMergeIDRefs(t *testing.T) {
 	bunch := []element.IDRefs{}
 
@@ -151,6 +295,148 @@ func TestMergeIDRefs(t *testing.T) {
 
 }
 
+func TestMergeRefs(t *testing.T) {
+	for _, tc := range []struct {
+		refs, newRefs, expected []int64
+	}{
+		{nil, nil, nil},
+		{[]int64{1, 2}, nil, []int64{1, 2}},
+		{nil, []int64{1, 2}, []int64{1, 2}},
+		{[]int64{1, 2}, []int64{3, 4}, []int64{1, 2, 3, 4}},
+		{[]int64{3, 4}, []int64{1, 2}, []int64{1, 2, 3, 4}},
+		{[]int64{1, 3, 5}, []int64{2, 4, 6}, []int64{1, 2, 3, 4, 5, 6}},
+		{[]int64{1, 3, 5}, []int64{1, 3, 5}, []int64{1, 3, 5}},
+		{[]int64{1, 5}, []int64{2, 3, 4, 5, 9}, []int64{1, 2, 3, 4, 5, 9}},
+	} {
+		result := mergeRefs(tc.refs, tc.newRefs)
+		if len(result) != len(tc.expected) {
+			t.Fatal(tc, result)
+		}
+		for i := range result {
+			if result[i] != tc.expected[i] {
+				t.Fatal(tc, result)
+			}
+		}
+	}
+}
+
+// appendSortRefs merges by appending newRefs and sorting the result, with
+// a fast path that skips the sort if newRefs are all larger than refs.
+func appendSortRefs(refs, newRefs []int64, skipSorted bool) []int64 {
+	sorted := skipSorted && (len(refs) == 0 || len(newRefs) == 0 || refs[len(refs)-1] < newRefs[0])
+	refs = append(refs, newRefs...)
+	if sorted {
+		return refs
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	return dedupRefs(refs)
+}
+
+// gallopMergeRefs merges the sorted newRefs into the sorted refs, without
+// duplicates. It searches the position of the next ref of the other slice
+// with exponential steps, to copy long runs at once.
+func gallopMergeRefs(refs, newRefs []int64) []int64 {
+	merged := make([]int64, 0, len(refs)+len(newRefs))
+	a, b := refs, newRefs
+	for len(a) > 0 && len(b) > 0 {
+		if a[0] > b[0] {
+			a, b = b, a
+		}
+		// copy all of a that are smaller than b[0]
+		n := gallop(a, b[0])
+		merged = append(merged, a[:n]...)
+		a = a[n:]
+		if len(a) > 0 && a[0] == b[0] {
+			a = a[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// gallop returns the number of values of sorted that are smaller than v.
+func gallop(sorted []int64, v int64) int {
+	step := 1
+	for step < len(sorted) && sorted[step-1] < v {
+		step *= 2
+	}
+	lo := step / 2
+	hi := step
+	if hi > len(sorted) {
+		hi = len(sorted)
+	}
+	return lo + sort.Search(hi-lo, func(i int) bool { return sorted[lo+i] >= v })
+}
+
+func TestMergeRefsVariants(t *testing.T) {
+	refs := []int64{1, 3, 5, 7, 100, 101, 102}
+	newRefs := []int64{0, 3, 4, 50, 60, 102, 200}
+	expected := []int64{0, 1, 3, 4, 5, 7, 50, 60, 100, 101, 102, 200}
+	if result := gallopMergeRefs(refs, newRefs); !equalRefs(result, expected) {
+		t.Error(result)
+	}
+	if result := appendSortRefs(append([]int64{}, refs...), newRefs, true); !equalRefs(result, expected) {
+		t.Error(result)
+	}
+	if result := appendSortRefs([]int64{1, 2}, []int64{3, 4}, true); !equalRefs(result, []int64{1, 2, 3, 4}) {
+		t.Error(result)
+	}
+}
+
+// BenchmarkMergeRefs compares the merge of M new refs into K existing refs
+// with append-then-sort (with and without the skip-sort fast path for
+// monotonic refs), galloping merge and mergeRefs (linear merge, with the
+// same fast path). Interleaved new refs are distributed over the range of
+// the existing refs, monotonic new refs are all larger.
+func BenchmarkMergeRefs(b *testing.B) {
+	variants := []struct {
+		name  string
+		merge func(refs, newRefs []int64) []int64
+	}{
+		{"append-sort", func(refs, newRefs []int64) []int64 { return appendSortRefs(refs, newRefs, false) }},
+		{"append-skip-sort", func(refs, newRefs []int64) []int64 { return appendSortRefs(refs, newRefs, true) }},
+		{"gallop", gallopMergeRefs},
+		{"merge", mergeRefs},
+	}
+	for _, km := range [][2]int{{10, 1000}, {1000, 10}, {1000, 1000}, {100000, 100}} {
+		k, m := km[0], km[1]
+		for _, monotonic := range []bool{false, true} {
+			var existing, newRefs []int64
+			total := k + m
+			for j := 0; j < total; j++ {
+				isNew := j >= k
+				if !monotonic {
+					// evenly spaced
+					isNew = j*m/total != (j+1)*m/total
+				}
+				if isNew {
+					newRefs = append(newRefs, int64(j*10))
+				} else {
+					existing = append(existing, int64(j*10))
+				}
+			}
+			dist := "interleaved"
+			if monotonic {
+				dist = "monotonic"
+			}
+			for _, v := range variants {
+				b.Run(fmt.Sprintf("K%d-M%d-%s-%s", k, m, dist, v.name), func(b *testing.B) {
+					buf := make([]int64, 0, k)
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						// existing refs are decoded into a new slice for
+						// each merge
+						refs := append(buf[:0], existing...)
+						if merged := v.merge(refs, newRefs); len(merged) != k+m {
+							b.Fatal(len(merged))
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
 func TestIDRefBunches(t *testing.T) {
 	bunches := make(idRefBunches)
 	bunches.add(1, 100, 999)
@@ -199,3 +485,3833 @@ func TestIDRefBunches(t *testing.T) {
 		t.Fatal(bunches)
 	}
 }
+
+func benchmarkRefIndexGet(b *testing.B, get func(cache *bunchRefCache, id int64) []int64) {
+	b.StopTimer()
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		b.Fatal()
+	}
+	defer cache.Close()
+
+	cache.SetLinearImport(true)
+	for w := 0; w < 20; w++ {
+		for n := 0; n < 64*100; n++ {
+			cache.addc <- idRef{id: int64(n), ref: int64(w)}
+		}
+	}
+	cache.SetLinearImport(false)
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if refs := get(cache, int64(i%(64*100))); len(refs) != 20 {
+			b.Fatal(refs)
+		}
+	}
+}
+
+func BenchmarkRefIndexGet(b *testing.B) {
+	benchmarkRefIndexGet(b, func(cache *bunchRefCache, id int64) []int64 {
+		return cache.Get(id)
+	})
+}
+
+// refsMessage is a stand-in for a message with a repeated int64 field
+type refsMessage struct {
+	Refs []int64
+}
+
+func BenchmarkRefIndexGetAppend(b *testing.B) {
+	msg := refsMessage{}
+	benchmarkRefIndexGet(b, func(cache *bunchRefCache, id int64) []int64 {
+		msg.Refs = append(msg.Refs[:0], cache.Get(id)...)
+		return msg.Refs
+	})
+}
+
+func BenchmarkRefIndexAppendRefs(b *testing.B) {
+	msg := refsMessage{}
+	benchmarkRefIndexGet(b, func(cache *bunchRefCache, id int64) []int64 {
+		msg.Refs, _ = cache.AppendRefs(msg.Refs[:0], id)
+		return msg.Refs
+	})
+}
+
+func BenchmarkRefIndexGetCopy(b *testing.B) {
+	benchmarkRefIndexGet(b, func(cache *bunchRefCache, id int64) []int64 {
+		data, err := cache.db.Get(cache.ro, idToKeyBuf(cache.getBunchID(id)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		idRefs := idRefsPool.get()
+		defer idRefsPool.release(idRefs)
+		for _, idRef := range cache.codec.Unmarshal(data, idRefs) {
+			if idRef.ID == id {
+				return idRef.Refs
+			}
+		}
+		return nil
+	})
+}
+
+// benchmarkSharesWay measures the check of two nodes with 200 ways each,
+// with a single common way at the end.
+func benchmarkSharesWay(b *testing.B, shares func(cache *CoordsRefIndex, a, b int64) bool) {
+	b.StopTimer()
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newCoordsRefIndex(cacheDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.SetLinearImport(true)
+	for n := 0; n < 64*10; n++ {
+		for w := 0; w < 200; w++ {
+			cache.addc <- idRef{id: int64(n), ref: int64(n%2*1000 + w)}
+		}
+		cache.addc <- idRef{id: int64(n), ref: 9999}
+	}
+	cache.SetLinearImport(false)
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		n := int64(i % (64*10 - 1))
+		if !shares(cache, n, n+1) {
+			b.Fatal(n)
+		}
+	}
+}
+
+func BenchmarkSharesWay(b *testing.B) {
+	benchmarkSharesWay(b, func(cache *CoordsRefIndex, a, b int64) bool {
+		return cache.SharesWay(a, b)
+	})
+}
+
+func BenchmarkSharesWayGet(b *testing.B) {
+	benchmarkSharesWay(b, func(cache *CoordsRefIndex, a, b int64) bool {
+		ways := make(map[int64]struct{})
+		for _, ref := range cache.Get(a) {
+			ways[ref] = struct{}{}
+		}
+		for _, ref := range cache.Get(b) {
+			if _, ok := ways[ref]; ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestDiffCacheClone(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	cloneDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cloneDir)
+
+	globalCacheOptions.WaysIndex.MaxValueRefs = 3
+	defer func() { globalCacheOptions.WaysIndex.MaxValueRefs = 0 }()
+
+	cache := NewDiffCache(cacheDir)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Coords.Add(1000, 100)
+	cache.Ways.Add(100, 5000)
+	// with refs in the overflow index
+	overflowed := []int64{1, 2, 3, 4, 5, 6}
+	for _, ref := range overflowed {
+		cache.Ways.Add(200, ref)
+	}
+
+	if err := cache.Clone(cloneDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Clone(cloneDir); err == nil {
+		t.Fatal("clone into existing cache did not fail")
+	}
+
+	// source stays usable and changes do not affect the clone
+	cache.Coords.Add(1000, 101)
+
+	clone := NewDiffCache(cloneDir)
+	if err := clone.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+
+	if ids := clone.Coords.Get(1000); len(ids) != 1 || ids[0] != 100 {
+		t.Fatal(ids)
+	}
+	if ids := clone.Ways.Get(100); len(ids) != 1 || ids[0] != 5000 {
+		t.Fatal(ids)
+	}
+	if ids := clone.Ways.Get(200); !equalRefs(ids, overflowed) {
+		t.Error(ids)
+	}
+	if ids := cache.Coords.Get(1000); len(ids) != 2 {
+		t.Fatal(ids)
+	}
+}
+
+func TestRefIndexGetOrErr(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal()
+	}
+	defer cache.Close()
+
+	cache.Add(1000, 100)
+	cache.Add(1001, 100)
+	cache.Delete(1001)
+
+	if refs, err := cache.GetOrErr(1000); err != nil || len(refs) != 1 || refs[0] != 100 {
+		t.Fatal(refs, err)
+	}
+	// deleted id
+	if refs, err := cache.GetOrErr(1001); err != ErrRefNotFound {
+		t.Fatal(refs, err)
+	}
+	// missing id in existing bunch
+	if _, err := cache.GetOrErr(1002); !errors.Is(err, ErrRefNotFound) {
+		t.Fatal(err)
+	}
+	// missing bunch
+	if _, err := cache.GetOrErr(99999); err != ErrRefNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestRefIndexDumpFast(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	loadDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(loadDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for n := 0; n < 2000; n++ {
+		cache.Add(int64(n), int64(n%7))
+		cache.Add(int64(n), int64(n%7+1))
+	}
+
+	buf := bytes.Buffer{}
+	if err := cache.DumpFast(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := newRefIndex(loadDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if err := loaded.LoadFast(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2000; n++ {
+		if refs := loaded.Get(int64(n)); len(refs) != 2 || refs[0] != int64(n%7) {
+			t.Fatal(n, refs)
+		}
+	}
+
+	if err := loaded.LoadFast(bytes.NewReader([]byte("imposm-refs\x03"))); err == nil {
+		t.Fatal("expected error for unknown format version")
+	}
+	if err := loaded.LoadFast(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Fatal("expected error for truncated dump")
+	}
+
+	// header of the dump and a record with a huge value length
+	header := buf.Bytes()[:len(dumpMagic)+3+len(loaded.meta.Codec)]
+	corrupt := append(append([]byte{}, header...), dumpValueRecord, 0, 0, 0, 0, 0, 0, 0, 1)
+	corrupt = append(corrupt, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f)
+	if err := loaded.LoadFast(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("expected error for invalid value length")
+	}
+	// truncated value that is larger than dumpValueChunk
+	corrupt = append(append([]byte{}, header...), dumpValueRecord, 0, 0, 0, 0, 0, 0, 0, 1)
+	corrupt = append(corrupt, 0x80, 0x80, 0x80, 0x02, 1, 2, 3)
+	if err := loaded.LoadFast(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("expected error for truncated value")
+	}
+	// overflow record for an index without MaxValueRefs
+	corrupt = append(append([]byte{}, header...), dumpOverflowRecord, 0, 0, 0, 0, 0, 0, 0, 1, 0)
+	if err := loaded.LoadFast(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("expected error for overflow record")
+	}
+
+	// version 1 dumps have no MaxValueRefs and no record kinds
+	data, err := cache.getValue(cache.ro, idToKeyBuf(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := append([]byte(dumpMagic), 1, byte(len(loaded.meta.Codec)))
+	v1 = append(append(v1, loaded.meta.Codec...), idToKeyBuf(0)...)
+	length := make([]byte, bin.MaxVarintLen64)
+	length = length[:bin.PutUvarint(length, uint64(len(data)))]
+	v1 = append(append(v1, length...), data...)
+	loaded.Delete(1)
+	if err := loaded.LoadFast(bytes.NewReader(v1)); err != nil {
+		t.Fatal(err)
+	}
+	if refs := loaded.Get(1); len(refs) != 2 {
+		t.Error(refs)
+	}
+}
+
+func TestRefIndexDumpFastMaxValueRefs(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	loadDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(loadDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.MaxValueRefs = 3
+	cache, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	all := []int64{1, 2, 3, 4, 5, 6}
+	for _, ref := range all {
+		cache.Add(5, ref)
+	}
+
+	buf := bytes.Buffer{}
+	if err := cache.DumpFast(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := newRefIndex(loadDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if err := loaded.LoadFast(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if refs := loaded.Get(5); !reflect.DeepEqual(refs, all) {
+		t.Error(refs)
+	}
+
+	// the values of the dump are limited to MaxValueRefs
+	other, err := newRefIndex(filepath.Join(loadDir, "other"), &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.LoadFast(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("expected error for index without MaxValueRefs")
+	}
+}
+
+func TestRefIndexDumpFastFrom(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	loadDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(loadDir)
+
+	records := dumpCursorRecords
+	dumpCursorRecords = 10
+	defer func() { dumpCursorRecords = records }()
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for n := 0; n < 2000; n++ {
+		cache.Add(int64(n), int64(n%7))
+	}
+
+	// an interrupted dump, only the data up to the reported cursors
+	// was written
+	buf := bytes.Buffer{}
+	var cursors [][]byte
+	var written []int
+	if err := cache.DumpFastFrom(&buf, nil, func(cursor []byte) error {
+		cursors = append(cursors, cursor)
+		written = append(written, buf.Len())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 32 bunches
+	if len(cursors) != 4 {
+		t.Fatal(len(cursors))
+	}
+	if idFromKeyBuf(cursors[3]) != 1999/64 {
+		t.Fatal(idFromKeyBuf(cursors[3]))
+	}
+	interrupted := buf.Bytes()[:written[1]]
+
+	resumed := bytes.Buffer{}
+	if err := cache.DumpFastFrom(&resumed, cursors[1], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := newRefIndex(loadDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if err := loaded.LoadFast(bytes.NewReader(interrupted)); err != nil {
+		t.Fatal(err)
+	}
+	if refs := loaded.Get(1999); len(refs) != 0 {
+		t.Fatal(refs)
+	}
+	if err := loaded.LoadFast(bytes.NewReader(resumed.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2000; n++ {
+		if refs := loaded.Get(int64(n)); len(refs) != 1 || refs[0] != int64(n%7) {
+			t.Fatal(n, refs)
+		}
+	}
+
+	if err := cache.DumpFastFrom(&resumed, []byte{1}, nil); err == nil {
+		t.Fatal("expected error for invalid cursor")
+	}
+}
+
+func TestDiffCacheStream(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	loadDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(loadDir)
+
+	globalCacheOptions.WaysIndex.MaxValueRefs = 3
+	defer func() { globalCacheOptions.WaysIndex.MaxValueRefs = 0 }()
+
+	cache := NewDiffCache(cacheDir)
+	if err := cache.StreamTo(ioutil.Discard); err == nil {
+		t.Error("expected error for unopened cache")
+	}
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	// more than one chunk
+	cache.Coords.SetLinearImport(true)
+	for n := 0; n < 64*5000; n++ {
+		cache.Coords.addc <- idRef{id: int64(n), ref: int64(n % 7)}
+	}
+	cache.Coords.SetLinearImport(false)
+	cache.Ways.Add(2, 200)
+	// with refs in the overflow index
+	overflowed := []int64{1, 2, 3, 4, 5, 6}
+	for _, ref := range overflowed {
+		cache.Ways.Add(3, ref)
+	}
+
+	loaded := NewDiffCache(loadDir)
+	if err := loaded.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+
+	r, w := io.Pipe()
+	streamed := make(chan error, 1)
+	go func() {
+		err := cache.StreamTo(w)
+		w.CloseWithError(err)
+		streamed <- err
+	}()
+	if err := loaded.StreamFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-streamed; err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int64{0, 1, 64*5000 - 1} {
+		if refs := loaded.Coords.Get(n); !equalRefs(refs, []int64{n % 7}) {
+			t.Error(n, refs)
+		}
+	}
+	if refs := loaded.Ways.Get(2); !equalRefs(refs, []int64{200}) {
+		t.Error(refs)
+	}
+	if refs := loaded.Ways.Get(3); !equalRefs(refs, overflowed) {
+		t.Error(refs)
+	}
+	fp, err := cache.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedFp, err := loaded.Fingerprint(); err != nil || !bytes.Equal(fp, loadedFp) {
+		t.Error(fp, loadedFp, err)
+	}
+
+	buf := bytes.Buffer{}
+	if err := cache.StreamTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.StreamFrom(bytes.NewReader(buf.Bytes()[:buf.Len()-10])); err == nil {
+		t.Error("expected error for truncated stream")
+	}
+	if err := loaded.StreamFrom(bytes.NewReader([]byte("imposm-diffcache\x02"))); err == nil {
+		t.Error("expected error for unknown format version")
+	}
+}
+
+func TestDiffCacheAffectedRelations(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache := NewDiffCache(cacheDir)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Coords.Add(1000, 100)
+	cache.Coords.Add(1000, 200)
+	cache.Coords.Add(1000, 30000) // in other bunch
+	cache.CoordsRel.Add(1000, 5003)
+	cache.Ways.Add(100, 5001)
+	cache.Ways.Add(200, 5001)
+	cache.Ways.Add(200, 5002)
+	cache.Ways.Add(30000, 5004)
+	cache.Ways.Add(101, 5005) // unrelated way in same bunch
+
+	refs, err := cache.Ways.GetBatch([]int64{200, 100, 999999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || len(refs[100]) != 1 || len(refs[200]) != 2 {
+		t.Fatal(refs)
+	}
+
+	rels, err := cache.AffectedRelations(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int64{5001, 5002, 5003, 5004}
+	if len(rels) != len(expected) {
+		t.Fatal(rels)
+	}
+	for i := range expected {
+		if rels[i] != expected[i] {
+			t.Fatal(rels)
+		}
+	}
+
+	if rels, err := cache.AffectedRelations(1001); err != nil || len(rels) != 0 {
+		t.Fatal(rels, err)
+	}
+}
+
+func TestRefIndexCodecMeta(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Add(1000, 100)
+	cache.Close()
+
+	meta, err := readRefIndexMeta(cacheDir)
+	if err != nil || meta.Codec != defaultRefCodec || meta.KeyByteOrder != keyByteOrder {
+		t.Fatal(meta, err)
+	}
+
+	// metadata without byte order from older versions
+	if err := writeRefIndexMeta(cacheDir, &refIndexMeta{Codec: defaultRefCodec}); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+
+	if err := writeRefIndexMeta(cacheDir, &refIndexMeta{Codec: defaultRefCodec, KeyByteOrder: "little-endian"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex); err == nil {
+		t.Fatal("expected error for byte order")
+	}
+
+	if err := writeRefIndexMeta(cacheDir, &refIndexMeta{Codec: "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex); err == nil {
+		t.Fatal("expected error for unknown codec")
+	}
+}
+
+func TestRefIndexGetStream(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for n := 0; n < 1000; n += 2 {
+		cache.Add(int64(n), int64(n*10))
+	}
+
+	in := make(chan int64)
+	go func() {
+		for n := 999; n >= 0; n-- {
+			in <- int64(n)
+		}
+		close(in)
+	}()
+
+	expected := int64(999)
+	results, errc := cache.GetStream(in)
+	for idRefs := range results {
+		if idRefs.ID != expected {
+			t.Fatal(idRefs, expected)
+		}
+		if expected%2 == 0 {
+			if len(idRefs.Refs) != 1 || idRefs.Refs[0] != expected*10 {
+				t.Fatal(idRefs)
+			}
+		} else if idRefs.Refs != nil {
+			t.Fatal(idRefs)
+		}
+		expected--
+	}
+	if expected != -1 {
+		t.Fatal("missing results", expected)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefIndexGetStreamError(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.Add(1, 10)
+	// spilled value without spill file
+	if err := cache.db.Put(cache.wo, idToKeyBuf(cache.getBunchID(1000)), []byte{spillMarker, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan int64)
+	go func() {
+		for n := 0; n < 3000; n++ {
+			in <- 1
+			in <- 1000
+		}
+		close(in)
+	}()
+	results, errc := cache.GetStream(in)
+	for idRefs := range results {
+		if idRefs.ID == 1000 {
+			t.Fatal("result for unreadable id", idRefs)
+		}
+	}
+	if err := <-errc; err == nil {
+		t.Fatal("expected read error")
+	}
+}
+
+func TestDiffCacheOpenCreatesDir(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache := NewDiffCache(filepath.Join(cacheDir, "does", "not", "exist"))
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+	if !cache.Exists() {
+		t.Fatal("cache not created")
+	}
+}
+
+func TestRefIndexGetInto(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.Add(1000, 100)
+	cache.Add(1000, 101)
+	cache.Add(1001, 102)
+
+	refs := make([]int64, 0, 16)
+	refs, ok := cache.GetInto(1000, refs)
+	if !ok || len(refs) != 2 || refs[0] != 100 || refs[1] != 101 {
+		t.Fatal(refs, ok)
+	}
+	refs, ok = cache.GetInto(1001, refs)
+	if !ok || len(refs) != 1 || refs[0] != 102 || cap(refs) != 16 {
+		t.Fatal(refs, ok)
+	}
+	refs, ok = cache.GetInto(1002, refs)
+	if ok || len(refs) != 0 {
+		t.Fatal(refs, ok)
+	}
+	refs, ok = cache.GetInto(99999, refs)
+	if ok || len(refs) != 0 {
+		t.Fatal(refs, ok)
+	}
+}
+
+func TestRefIndexScanHighDegree(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for n := 0; n < 1000; n++ {
+		for r := 0; r < n%10; r++ {
+			cache.Add(int64(n), int64(r))
+		}
+	}
+
+	ids, err := cache.ScanHighDegree(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 100 {
+		t.Fatal(len(ids), ids)
+	}
+	for i, id := range ids {
+		if id != int64(i*10+9) {
+			t.Fatal(ids)
+		}
+	}
+}
+
+func TestRefIndexIterKeys(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for _, id := range []int64{5000, 3, 1, 64, 2} {
+		cache.Add(id, 1)
+	}
+	cache.Delete(2)
+
+	var ids []int64
+	if err := cache.IterKeys(func(id int64) { ids = append(ids, id) }); err != nil {
+		t.Fatal(err)
+	}
+	if !equalRefs(ids, []int64{1, 3, 64, 5000}) {
+		t.Error(ids)
+	}
+	if n, err := cache.Count(); err != nil || n != 4 {
+		t.Error(n, err)
+	}
+}
+
+func TestDiffCacheWayNodesIndex(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	globalCacheOptions.CoordsIndex.WayNodesIndex = true
+	defer func() { globalCacheOptions.CoordsIndex.WayNodesIndex = false }()
+
+	cache := NewDiffCache(cacheDir)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	w1 := osm.Way{}
+	w1.ID = 100
+	w1.Nodes = []osm.Node{
+		{Element: osm.Element{ID: 1002}},
+		{Element: osm.Element{ID: 1000}},
+		{Element: osm.Element{ID: 1001}},
+	}
+	cache.Coords.SetLinearImport(true)
+	cache.Coords.AddFromWay(&w1)
+	cache.Coords.SetLinearImport(false)
+
+	if nodes, err := cache.Coords.GetNodesForWay(100); err != nil ||
+		len(nodes) != 3 || nodes[0] != 1000 || nodes[2] != 1002 {
+		t.Fatal(nodes, err)
+	}
+
+	cache.Coords.DeleteFromWay(&w1)
+	if nodes, err := cache.Coords.GetNodesForWay(100); err != nil || len(nodes) != 0 {
+		t.Fatal(nodes, err)
+	}
+}
+
+func TestDiffCacheIndexPath(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	waysDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(waysDir)
+
+	indexPath := func(name string) string {
+		if name == "ways_index" {
+			return filepath.Join(waysDir, name)
+		}
+		return filepath.Join(cacheDir, name)
+	}
+	cache := NewDiffCacheWithPaths(cacheDir, indexPath)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cache.Ways.Add(1, 100)
+	cache.Close()
+
+	if _, err := os.Stat(filepath.Join(waysDir, "ways_index")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "ways_index")); !os.IsNotExist(err) {
+		t.Fatal("ways index in cache dir", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(cacheDir, "coords_index")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(cacheDir, "coords_rel_index")); err != nil {
+		t.Fatal(err)
+	}
+	if !cache.Exists() {
+		t.Fatal("ways index not found")
+	}
+	if NewDiffCache(cacheDir).Exists() {
+		t.Fatal("ways index found without IndexPath")
+	}
+
+	cache = NewDiffCacheWithPaths(cacheDir, indexPath)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if refs := cache.Ways.Get(1); !equalRefs(refs, []int64{100}) {
+		t.Fatal(refs)
+	}
+	if err := cache.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if NewDiffCacheWithPaths(cacheDir, indexPath).Exists() {
+		t.Fatal("indices not removed")
+	}
+}
+
+func TestDiffCacheWayNodeRangeIndex(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	globalCacheOptions.CoordsIndex.WayNodeRangeIndex = true
+	defer func() { globalCacheOptions.CoordsIndex.WayNodeRangeIndex = false }()
+
+	cache := NewDiffCache(cacheDir)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	w1 := osm.Way{}
+	w1.ID = 100
+	w1.Nodes = []osm.Node{
+		{Element: osm.Element{ID: 1002}},
+		{Element: osm.Element{ID: 1000}},
+		{Element: osm.Element{ID: 1001}},
+	}
+	cache.Coords.SetLinearImport(true)
+	cache.Coords.AddFromWay(&w1)
+	cache.Coords.SetLinearImport(false)
+
+	if min, max, ok := cache.Coords.WayNodeRange(100); !ok || min != 1000 || max != 1002 {
+		t.Fatal(min, max, ok)
+	}
+	if _, _, ok := cache.Coords.WayNodeRange(101); ok {
+		t.Fatal("range for missing way")
+	}
+
+	// diff replaces the range
+	w1.Nodes = []osm.Node{
+		{Element: osm.Element{ID: 1001}},
+		{Element: osm.Element{ID: 1005}},
+	}
+	cache.Coords.AddFromWay(&w1)
+	if min, max, ok := cache.Coords.WayNodeRange(100); !ok || min != 1001 || max != 1005 {
+		t.Fatal(min, max, ok)
+	}
+
+	cache.Coords.DeleteFromWay(&w1)
+	if min, max, ok := cache.Coords.WayNodeRange(100); ok {
+		t.Fatal(min, max, ok)
+	}
+}
+
+func TestCoordsRefIndexWayNodeRangeDisabled(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newCoordsRefIndex(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	w := &osm.Way{Element: osm.Element{ID: 1}, Nodes: []osm.Node{{Element: osm.Element{ID: 10}}}}
+	cache.AddFromWay(w)
+	if _, _, ok := cache.WayNodeRange(1); ok {
+		t.Fatal("range without WayNodeRangeIndex")
+	}
+}
+
+func TestRefIndexSetWriteMode(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	if cache.writeOptions() != cache.wo {
+		t.Fatal("bulk mode not default")
+	}
+
+	cache.SetLinearImport(true)
+	done := make(chan struct{})
+	go func() {
+		for n := 0; n < bufferSize*2; n++ {
+			cache.addc <- idRef{id: int64(n * 64), ref: 1}
+		}
+		close(done)
+	}()
+	cache.SetWriteMode(UpdateWriteMode)
+	<-done
+	cache.SetLinearImport(false)
+
+	if cache.writeOptions() != cache.syncWo {
+		t.Fatal("update mode not set")
+	}
+	if err := cache.Add(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if refs := cache.Get(64 * 100); len(refs) != 1 {
+		t.Fatal(refs)
+	}
+}
+
+func TestDiffCacheSetWriteModeUnopened(t *testing.T) {
+	// indices that are not opened are skipped
+	cache := &DiffCache{}
+	cache.SetWriteMode(UpdateWriteMode)
+}
+
+func TestDiffCaches(t *testing.T) {
+	dirA, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(dirA)
+	dirB, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(dirB)
+
+	for _, dir := range []string{dirA, dirB} {
+		cache := NewDiffCache(dir)
+		if err := cache.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < 1000; n++ {
+			cache.Coords.Add(int64(n), 1)
+		}
+		cache.Ways.Add(100, 5000)
+		if dir == dirA {
+			cache.Coords.Add(500, 2)  // different refs
+			cache.Coords.Add(2000, 1) // only in a
+			cache.Coords.Add(999, 2)  // different refs
+			cache.Coords.Delete(998)  // empty refs, same as missing (in b)
+			cache.Ways.Add(100000, 1) // only in a, other bunch
+		} else {
+			cache.Coords.Delete(998)
+			cache.Ways.Add(200, 5000) // only in b
+		}
+		cache.Close()
+	}
+
+	diffs, err := DiffCaches(dirA, dirB, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RefDiff{
+		{"coords_index", 500, []int64{1, 2}, []int64{1}},
+		{"coords_index", 999, []int64{1, 2}, []int64{1}},
+		{"coords_index", 2000, []int64{1}, nil},
+		{"ways_index", 200, nil, []int64{5000}},
+		{"ways_index", 100000, []int64{1}, nil},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatal(diffs)
+	}
+	for i := range expected {
+		if diffs[i].Index != expected[i].Index || diffs[i].ID != expected[i].ID ||
+			!equalRefs(diffs[i].A, expected[i].A) || !equalRefs(diffs[i].B, expected[i].B) ||
+			(diffs[i].A == nil) != (expected[i].A == nil) || (diffs[i].B == nil) != (expected[i].B == nil) {
+			t.Error(i, diffs[i], expected[i])
+		}
+	}
+
+	diffs, err = DiffCaches(dirA, dirB, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 {
+		t.Fatal(diffs)
+	}
+}
+
+func TestRefIndexApproxRefsCount(t *testing.T) {
+	cache_dir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cache_dir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.DegreeSketch = true
+	index, err := newRefIndex(cache_dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := int64(0); n < 100; n++ {
+		index.Add(1, n)
+	}
+	index.Add(1, 5) // duplicate
+	index.Add(2, 1)
+	index.Add(2, 2)
+	index.DeleteRef(2, 2)
+	index.Add(3, 1)
+	index.Delete(3)
+
+	index.SetLinearImport(true)
+	for n := int64(0); n < 10; n++ {
+		index.addc <- idRef{id: 4, ref: n}
+	}
+	index.SetLinearImport(false)
+
+	check := func(index *bunchRefCache) {
+		for _, tc := range []struct {
+			id       int64
+			expected int
+		}{{1, 100}, {2, 1}, {3, 0}, {4, 10}, {5, 0}} {
+			count, err := index.ApproxRefsCount(tc.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the sketch is exact for so few ids
+			if count != tc.expected {
+				t.Errorf("%d: %d != %d", tc.id, count, tc.expected)
+			}
+		}
+	}
+	check(index)
+	index.Close()
+
+	// stored sketch
+	index, err = newRefIndex(cache_dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(index)
+	index.Close()
+
+	// sketch is built from existing index
+	if err := os.Remove(filepath.Join(cache_dir, degreeSketchFile)); err != nil {
+		t.Fatal(err)
+	}
+	index, err = newRefIndex(cache_dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(index)
+	index.Close()
+
+	index, err = newRefIndex(cache_dir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.ApproxRefsCount(1); err == nil {
+		t.Error("expected error without DegreeSketch")
+	}
+	index.Close()
+	if _, err := os.Stat(filepath.Join(cache_dir, degreeSketchFile)); !os.IsNotExist(err) {
+		t.Error("stale sketch not removed", err)
+	}
+}
+
+func TestRefIndexGetBatchCtx(t *testing.T) {
+	cache_dir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cache_dir)
+
+	index, err := newRefIndex(cache_dir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.Add(1, 100)
+	index.Add(1000, 200)
+
+	result, err := index.GetBatchCtx(context.Background(), []int64{1000, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 {
+		t.Fatal(result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = index.GetBatchCtx(ctx, []int64{1000, 1})
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Fatal(result)
+	}
+}
+
+func TestDiffCacheMaintenance(t *testing.T) {
+	cache_dir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cache_dir)
+
+	cache := NewDiffCache(cache_dir)
+	if _, err := cache.Maintenance(true); err == nil {
+		t.Error("expected error for unopened cache")
+	}
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Coords.Add(1, 100)
+	cache.Ways.Add(2, 200)
+	stats, err := cache.Maintenance(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Compacted) != 0 {
+		t.Error(stats)
+	}
+
+	cache.Ways.Delete(2)
+	stats, err = cache.Maintenance(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Compacted) != 1 || stats.Compacted[0] != "ways_index" || stats.BytesBefore == 0 {
+		t.Error(stats)
+	}
+	stats, err = cache.Maintenance(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Compacted) != 0 {
+		t.Error(stats)
+	}
+
+	stats, err = cache.Maintenance(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Compacted) != 3 {
+		t.Error(stats)
+	}
+}
+
+func TestRefIndexCompactAfterDiff(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	var compacted []levigo.Range
+	dbCompactRange = func(db *levigo.DB, r levigo.Range) {
+		compacted = append(compacted, r)
+		db.CompactRange(r)
+	}
+	defer func() {
+		dbCompactRange = func(db *levigo.DB, r levigo.Range) { db.CompactRange(r) }
+	}()
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.CompactAfterDiff = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	// the linear import is not tracked
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 64 * 100, ref: 1}
+	index.SetLinearImport(false)
+	if index.changedMin != nil {
+		t.Error("linear import tracked", index.changedMin)
+	}
+
+	index.Add(64*5, 1)
+	index.Add(64*2, 1)
+	index.Delete(64 * 100)
+	if !bytes.Equal(index.changedMin, idToKeyBuf(2)) || !bytes.Equal(index.changedMax, idToKeyBuf(100)) {
+		t.Error("unexpected changed range", index.changedMin, index.changedMax)
+	}
+	if len(compacted) != 0 {
+		t.Fatal("compacted before Flush", compacted)
+	}
+	index.Flush()
+	if index.changedMin != nil || index.changedMax != nil {
+		t.Error("changed range not reset", index.changedMin, index.changedMax)
+	}
+	// the limit is exclusive, the range includes the key of bunch 100
+	if len(compacted) != 1 || !bytes.Equal(compacted[0].Start, idToKeyBuf(2)) ||
+		!bytes.Equal(compacted[0].Limit, append(idToKeyBuf(100), 0)) {
+		t.Error("unexpected compacted ranges", compacted)
+	}
+	if refs := index.Get(64 * 5); !equalRefs(refs, []int64{1}) {
+		t.Error(refs)
+	}
+
+	// nothing changed, nothing to compact
+	index.Flush()
+	if len(compacted) != 1 {
+		t.Error("unexpected compacted ranges", compacted)
+	}
+
+	// the option is required
+	opts.CompactAfterDiff = false
+	other, err := newRefIndex(filepath.Join(cacheDir, "other"), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Add(1, 1)
+	other.Flush()
+	if len(compacted) != 1 {
+		t.Error("compacted without CompactAfterDiff", compacted)
+	}
+}
+
+// benchmarkGetAfterDiff measures reads after 10 diffs, each with changes to
+// 100 bunches of the index.
+func benchmarkGetAfterDiff(b *testing.B, compact bool) {
+	b.StopTimer()
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.CompactAfterDiff = compact
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer index.Close()
+
+	index.SetLinearImport(true)
+	for n := 0; n < 64*1000; n++ {
+		index.addc <- idRef{id: int64(n), ref: 1}
+	}
+	index.SetLinearImport(false)
+	for diff := 0; diff < 10; diff++ {
+		for n := 0; n < 100; n++ {
+			index.Add(int64((diff*100+n)*64), 2)
+		}
+		index.Flush()
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if refs := index.Get(int64(i % (64 * 1000))); len(refs) == 0 {
+			b.Fatal(i)
+		}
+	}
+}
+
+func BenchmarkRefIndexGetAfterDiff(b *testing.B) {
+	benchmarkGetAfterDiff(b, false)
+}
+
+func BenchmarkRefIndexGetAfterDiffCompact(b *testing.B) {
+	benchmarkGetAfterDiff(b, true)
+}
+
+func TestDiffCacheTx(t *testing.T) {
+	cache_dir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cache_dir)
+
+	cache := NewDiffCache(cache_dir)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cache.Ways.Add(10, 1)
+	cache.Ways.Add(10, 2)
+
+	tx := cache.Begin()
+	tx.Add(TxCoordsRel, 1, 100)
+	tx.Add(TxWays, 10, 100)
+	tx.DeleteRef(TxWays, 10, 1)
+	tx.Add(TxCoords, 5, 7)
+	tx.Delete(TxCoords, 5)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if refs := cache.CoordsRel.Get(1); len(refs) != 1 || refs[0] != 100 {
+		t.Error(refs)
+	}
+	if refs := cache.Ways.Get(10); len(refs) != 2 || refs[0] != 2 || refs[1] != 100 {
+		t.Error(refs)
+	}
+	if refs := cache.Coords.Get(5); len(refs) != 0 {
+		t.Error(refs)
+	}
+	if _, err := os.Stat(filepath.Join(cache_dir, txJournalFile)); !os.IsNotExist(err) {
+		t.Error("journal not removed", err)
+	}
+
+	tx.Add(TxWays, 11, 1)
+	tx.Rollback()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if refs := cache.Ways.Get(11); refs != nil {
+		t.Error(refs)
+	}
+	cache.Close()
+
+	// simulate crash after the journal was written
+	if err := writeTxJournal(cache_dir, []txOp{
+		{TxCoordsRel, txAdd, 2, 200},
+		{TxWays, txDelete, 10, 0},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cache = NewDiffCache(cache_dir)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	if refs := cache.CoordsRel.Get(2); len(refs) != 1 || refs[0] != 200 {
+		t.Error(refs)
+	}
+	if refs := cache.Ways.Get(10); len(refs) != 0 {
+		t.Error(refs)
+	}
+	if _, err := os.Stat(filepath.Join(cache_dir, txJournalFile)); !os.IsNotExist(err) {
+		t.Error("journal not removed", err)
+	}
+}
+
+func TestTxJournalAllIndices(t *testing.T) {
+	cache_dir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cache_dir)
+
+	ops := []txOp{}
+	for index := TxIndex(0); index < numTxIndices; index++ {
+		for op := txAdd; op <= txDelete; op++ {
+			ops = append(ops, txOp{index, op, int64(index)*100 + int64(op), -1 << 40})
+		}
+	}
+	if err := writeTxJournal(cache_dir, ops); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readTxJournal(cache_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, ops) {
+		t.Errorf("journal mismatch %v != %v", read, ops)
+	}
+
+	if err := writeTxJournal(cache_dir, []txOp{{numTxIndices, txAdd, 1, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTxJournal(cache_dir); err == nil {
+		t.Error("expected error for unknown index")
+	}
+}
+
+func TestRefIndexAutoTune(t *testing.T) {
+	cache_dir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cache_dir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.AutoTune = true
+	index, err := newRefIndex(cache_dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	index.SetLinearImport(true)
+	for i := int64(0); i < 30; i++ {
+		for n := int64(0); n < 100; n++ {
+			index.addc <- idRef{id: n * 64, ref: i}
+		}
+		index.Flush()
+	}
+	index.SetLinearImport(false)
+
+	if index.tuner.phase != 2 {
+		t.Fatal("tuner not done", index.tuner.phase)
+	}
+	if index.workers < 1 || index.workers > int32(runtime.NumCPU()*2) {
+		t.Error("unexpected workers", index.workers)
+	}
+	if index.flushSize < bufferSize/4 || index.flushSize > bufferSize*2 {
+		t.Error("unexpected flush size", index.flushSize)
+	}
+	if refs := index.Get(64); len(refs) != 30 {
+		t.Error(refs)
+	}
+}
+
+func TestRefIndexSnapshot(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	index.Add(1, 100)
+	first := index.Snapshot()
+	index.Add(1, 200)
+	second := index.Snapshot()
+	index.Delete(1)
+
+	if refs, err := index.GetAtSnapshot(first, 1); err != nil || len(refs) != 1 || refs[0] != 100 {
+		t.Error(refs, err)
+	}
+	if refs, err := index.GetAtSnapshot(second, 1); err != nil || len(refs) != 2 {
+		t.Error(refs, err)
+	}
+	if refs := index.Get(1); len(refs) != 0 {
+		t.Error(refs)
+	}
+	versions, err := index.GetMultiVersion(1)
+	if err != nil || len(versions) != 2 || len(versions[first]) != 1 || len(versions[second]) != 2 {
+		t.Error(versions, err)
+	}
+
+	for i := 0; i < maxSnapshots; i++ {
+		index.Snapshot()
+	}
+	if _, err := index.GetAtSnapshot(first, 1); err != ErrSnapshotReleased {
+		t.Error(err)
+	}
+	if versions, err := index.GetMultiVersion(1); err != nil || len(versions) != maxSnapshots {
+		t.Error(versions, err)
+	}
+}
+
+func TestRefIndexCompactBuffer(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.CompactBuffer = true
+	opts.RefsBufferSizeM = 1 // flush after 64k refs
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.Add(5, 1)
+
+	index.SetLinearImport(true)
+	for n := int64(100000); n > 0; n-- {
+		index.addc <- idRef{id: n % 1000, ref: n}
+	}
+	index.addc <- idRef{id: 5, ref: 5} // duplicate
+	index.SetLinearImport(false)
+
+	if refs := index.Get(5); len(refs) != 101 || refs[0] != 1 || refs[1] != 5 {
+		t.Fatal(refs)
+	}
+	for id := int64(0); id < 1000; id++ {
+		if id == 5 {
+			continue
+		}
+		refs := index.Get(id)
+		if len(refs) != 100 {
+			t.Fatal(id, len(refs))
+		}
+		for i := range refs {
+			if refs[i] != id+int64(i)*1000 && !(id == 0 && refs[i] == int64(i+1)*1000) {
+				t.Fatal(id, refs)
+			}
+		}
+	}
+}
+
+func TestCompactToBunches(t *testing.T) {
+	index := &bunchRefCache{}
+	bunches := index.compactToBunches([]idRef{
+		{id: 65, ref: 3}, {id: 1, ref: 2}, {id: 65, ref: 1}, {id: 1, ref: 2}, {id: 2, ref: 1},
+	})
+	if len(bunches) != 2 {
+		t.Fatal(bunches)
+	}
+	b := bunches[0].idRefs
+	if len(b) != 2 || b[0].ID != 1 || len(b[0].Refs) != 1 || b[1].ID != 2 || len(b[1].Refs) != 1 {
+		t.Error(b)
+	}
+	b = bunches[1].idRefs
+	if len(b) != 1 || b[0].ID != 65 || len(b[0].Refs) != 2 || b[0].Refs[0] != 1 || b[0].Refs[1] != 3 {
+		t.Error(b)
+	}
+	if cap(bunches[0].idRefs[0].Refs) != 1 {
+		t.Error("refs capacity not limited")
+	}
+}
+
+func TestRefIndexOnFlush(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	var flushes, entries int
+	var bytes int64
+	index.OnFlush(func(e int, b int64) {
+		flushes++
+		entries += e
+		bytes += b
+	})
+
+	index.SetLinearImport(true)
+	for n := int64(0); n < 1000; n++ {
+		index.addc <- idRef{id: n, ref: 1}
+	}
+	index.Flush()
+	for n := int64(0); n < 10; n++ {
+		index.addc <- idRef{id: n * 64, ref: 2}
+	}
+	index.SetLinearImport(false)
+
+	// 1000 ids in 16 bunches, 10 ids in 10 bunches
+	if flushes != 2 || entries != 26 || bytes <= 26*8 {
+		t.Error(flushes, entries, bytes)
+	}
+}
+
+func TestDiffCacheAddFromMembers(t *testing.T) {
+	for _, relationsIndex := range []bool{false, true} {
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		defer os.RemoveAll(cacheDir)
+
+		globalCacheOptions.WaysIndex.RelationsIndex = relationsIndex
+		cache := NewDiffCache(cacheDir)
+		err := cache.Open()
+		globalCacheOptions.WaysIndex.RelationsIndex = false
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		members := []osm.Member{
+			{ID: 10, Type: osm.NodeMember},
+			{ID: 20, Type: osm.WayMember},
+			{ID: 30, Type: osm.RelationMember},
+		}
+		cache.CoordsRel.AddFromMembers(1, members)
+		cache.Ways.AddFromMembers(1, members)
+		if (cache.Relations != nil) != relationsIndex {
+			t.Fatal("unexpected relations index", cache.Relations)
+		}
+		if cache.Relations != nil {
+			cache.Relations.AddFromMembers(1, members)
+		}
+
+		for _, tc := range []struct {
+			index    *bunchRefCache
+			id       int64
+			expected int
+		}{
+			{cache.CoordsRel.bunchRefCache, 10, 1},
+			{cache.CoordsRel.bunchRefCache, 20, 0},
+			{cache.CoordsRel.bunchRefCache, 30, 0},
+			{cache.Ways.bunchRefCache, 10, 0},
+			{cache.Ways.bunchRefCache, 20, 1},
+			{cache.Ways.bunchRefCache, 30, 0},
+		} {
+			if refs := tc.index.Get(tc.id); len(refs) != tc.expected {
+				t.Error(tc.id, refs)
+			}
+		}
+		if cache.Relations != nil {
+			if refs := cache.Relations.Get(30); len(refs) != 1 || refs[0] != 1 {
+				t.Error(refs)
+			}
+			if refs := cache.Relations.Get(10); len(refs) != 0 {
+				t.Error(refs)
+			}
+			if refs := cache.Relations.Get(20); len(refs) != 0 {
+				t.Error(refs)
+			}
+		}
+		cache.Close()
+	}
+}
+
+func TestReadThroughRefStore(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.Add(1, 100)
+
+	fetches := map[int64]int{}
+	fetchErr := errors.New("network error")
+	store := NewReadThroughRefStore(index, func(id int64) ([]int64, error) {
+		fetches[id]++
+		switch id {
+		case 2, 3, 4:
+			return []int64{id * 100}, nil
+		case 5:
+			return nil, fetchErr
+		}
+		return nil, ErrRefNotFound
+	}, 2)
+
+	for i := 0; i < 2; i++ {
+		if refs, err := store.GetOrErr(1); err != nil || len(refs) != 1 || refs[0] != 100 {
+			t.Error(refs, err)
+		}
+		if refs, err := store.GetOrErr(2); err != nil || len(refs) != 1 || refs[0] != 200 {
+			t.Error(refs, err)
+		}
+		if refs, err := store.GetOrErr(9); err != ErrRefNotFound {
+			t.Error(refs, err)
+		}
+		if _, err := store.GetOrErr(5); err != fetchErr {
+			t.Error(err)
+		}
+	}
+	if fetches[1] != 0 || fetches[2] != 1 || fetches[9] != 1 || fetches[5] != 2 {
+		t.Error(fetches)
+	}
+
+	// 3 and 4 evict 2 and 9 from the cache
+	store.GetOrErr(3)
+	store.GetOrErr(4)
+	store.GetOrErr(2)
+	if fetches[2] != 2 {
+		t.Error(fetches)
+	}
+}
+
+func TestRefIndexGetBatchOrdered(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.Add(1, 100)
+	index.Add(1000, 200)
+
+	ids := []int64{1000, 5, 1, 1000}
+	result, err := index.GetBatchOrdered(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(ids) {
+		t.Fatal(result)
+	}
+	for i, expected := range [][]int64{{200}, nil, {100}, {200}} {
+		if result[i].ID != ids[i] || !equalRefs(result[i].Refs, expected) || (result[i].Refs == nil) != (expected == nil) {
+			t.Error(i, result[i])
+		}
+	}
+}
+
+func TestRefIndexGetDuringFlush(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	ids := make([]int64, 1000)
+	for i := range ids {
+		ids[i] = int64(i * 7)
+	}
+
+	index.SetLinearImport(true)
+	done := make(chan struct{})
+	errc := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errc <- nil
+					return
+				default:
+				}
+				refs, err := index.GetBatch(ids)
+				if err != nil {
+					errc <- err
+					return
+				}
+				// all ids are added in each round, all need the same
+				// number of refs
+				n := len(refs[ids[0]])
+				for _, id := range ids {
+					if len(refs[id]) != n {
+						errc <- fmt.Errorf("torn read: %d has %d refs, expected %d", id, len(refs[id]), n)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for round := int64(0); round < 50; round++ {
+		for _, id := range ids {
+			index.addc <- idRef{id: id, ref: round}
+		}
+		index.Flush()
+	}
+	close(done)
+	for r := 0; r < 4; r++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if refs, _ := index.GetBatch(ids); len(refs[ids[0]]) != 50 {
+		t.Error(refs[ids[0]])
+	}
+	index.SetLinearImport(false)
+}
+
+func TestCoordsRefIndexMinWayNodes(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newCoordsRefIndex(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	opts := globalCacheOptions.CoordsIndex
+	opts.MinWayNodes = 2
+	cache.indexOptions = &opts
+
+	cache.AddFromWay(&osm.Way{Element: osm.Element{ID: 1}, Nodes: []osm.Node{{Element: osm.Element{ID: 10}}}})
+	cache.AddFromWay(&osm.Way{Element: osm.Element{ID: 2}, Nodes: []osm.Node{
+		{Element: osm.Element{ID: 10}}, {Element: osm.Element{ID: 11}},
+	}})
+
+	if refs := cache.Get(10); len(refs) != 1 || refs[0] != 2 {
+		t.Error(refs)
+	}
+	if cache.SkippedWays() != 1 {
+		t.Error(cache.SkippedWays())
+	}
+}
+
+func TestCoordsRefIndexFlushEveryWays(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newCoordsRefIndex(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	opts := globalCacheOptions.CoordsIndex
+	opts.FlushEveryWays = 10
+	cache.indexOptions = &opts
+
+	cache.SetLinearImport(true)
+	for id := int64(1); id <= 25; id++ {
+		cache.AddFromWay(&osm.Way{Element: osm.Element{ID: id}, Nodes: []osm.Node{
+			{Element: osm.Element{ID: id}}, {Element: osm.Element{ID: id + 1000}},
+		}})
+	}
+	cache.SetLinearImport(false)
+
+	// after way 10 and 20, and the remaining ways at the end
+	if s := cache.Summary(); s.Flushes != 3 || s.IDs != 50 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+	if refs := cache.Get(1025); !equalRefs(refs, []int64{25}) {
+		t.Error(refs)
+	}
+}
+
+func TestCoordsRefIndexSharesWay(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newCoordsRefIndex(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	for _, way := range []struct {
+		id    int64
+		nodes []int64
+	}{{1, []int64{10, 11}}, {2, []int64{11, 12}}, {3, []int64{12, 200}}} {
+		w := &osm.Way{Element: osm.Element{ID: way.id}}
+		for _, n := range way.nodes {
+			w.Nodes = append(w.Nodes, osm.Node{Element: osm.Element{ID: n}})
+		}
+		cache.AddFromWay(w)
+	}
+
+	for _, tc := range []struct {
+		a, b     int64
+		expected bool
+	}{
+		{10, 11, true},
+		{11, 12, true},
+		{12, 200, true},
+		{10, 12, false},
+		{11, 200, false},
+		{10, 10, true},
+		{10, 99, false},
+		{99, 99, false},
+	} {
+		if shares := cache.SharesWay(tc.a, tc.b); shares != tc.expected {
+			t.Errorf("SharesWay(%d, %d) = %v", tc.a, tc.b, shares)
+		}
+	}
+}
+
+func TestCoordsRefIndexAddFromWayAfterClose(t *testing.T) {
+	for _, linearImport := range []bool{false, true} {
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		defer os.RemoveAll(cacheDir)
+
+		cache, err := newCoordsRefIndex(cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.SetLinearImport(linearImport)
+		way := &osm.Way{Element: osm.Element{ID: 1}, Nodes: []osm.Node{{Element: osm.Element{ID: 10}}}}
+		if err := cache.AddFromWay(way); err != nil {
+			t.Fatal(linearImport, err)
+		}
+		if err := cache.Close(); err != nil {
+			t.Fatal(linearImport, err)
+		}
+		if err := cache.AddFromWay(way); err != ErrClosed {
+			t.Error(linearImport, err)
+		}
+	}
+}
+
+func TestWaysRefIndexAddFromMembersAfterClose(t *testing.T) {
+	members := []osm.Member{{ID: 10, Type: osm.WayMember}}
+	for _, linearImport := range []bool{false, true} {
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		defer os.RemoveAll(cacheDir)
+
+		cache, err := newWaysRefIndex(cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.SetLinearImport(linearImport)
+		if err := cache.AddFromMembers(1, members); err != nil {
+			t.Fatal(linearImport, err)
+		}
+		if err := cache.Close(); err != nil {
+			t.Fatal(linearImport, err)
+		}
+		if err := cache.AddFromMembers(2, members); err != ErrClosed {
+			t.Error(linearImport, err)
+		}
+	}
+}
+
+func TestRefIndexAddLinearRacingClose(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		defer os.RemoveAll(cacheDir)
+
+		cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.SetLinearImport(true)
+
+		// producers that are still adding refs while the index is closed
+		const producers = 4
+		added := make([][]int64, producers)
+		wg := sync.WaitGroup{}
+		for p := 0; p < producers; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for n := int64(p); ; n += producers {
+					if err := cache.addLinear(n, 1); err != nil {
+						return
+					}
+					added[p] = append(added[p], n)
+				}
+			}(p)
+		}
+		time.Sleep(time.Millisecond)
+		if err := cache.Close(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		cache, err = newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ids := range added {
+			for _, id := range ids {
+				if refs := cache.Get(id); !equalRefs(refs, []int64{1}) {
+					t.Fatal("accepted ref not stored", run, id, refs)
+				}
+			}
+		}
+		cache.Close()
+	}
+}
+
+func TestCoordsRefIndexEmptyWays(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newCoordsRefIndex(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	var empty []int64
+	cache.OnEmptyWay(func(way *osm.Way) { empty = append(empty, way.ID) })
+	cache.AddFromWay(&osm.Way{Element: osm.Element{ID: 1}})
+	cache.AddFromWay(&osm.Way{Element: osm.Element{ID: 2}, Nodes: []osm.Node{{Element: osm.Element{ID: 10}}}})
+
+	if stats := cache.Stats(); stats.EmptyWays != 1 || stats.SkippedWays != 0 {
+		t.Error(stats)
+	}
+	if !equalRefs(empty, []int64{1}) {
+		t.Error(empty)
+	}
+	if refs := cache.Get(10); !equalRefs(refs, []int64{2}) {
+		t.Error(refs)
+	}
+}
+
+func TestRefIndexAppendRefs(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.Add(1, 100)
+	index.Add(1, 200)
+	index.Add(2, 300)
+
+	msg := refsMessage{Refs: []int64{1}}
+	var ok bool
+	msg.Refs, ok = index.AppendRefs(msg.Refs, 1)
+	if !ok || !equalRefs(msg.Refs, []int64{1, 100, 200}) {
+		t.Error(msg.Refs)
+	}
+	msg.Refs, ok = index.AppendRefs(msg.Refs, 2)
+	if !ok || !equalRefs(msg.Refs, []int64{1, 100, 200, 300}) {
+		t.Error(msg.Refs)
+	}
+	msg.Refs, ok = index.AppendRefs(msg.Refs, 3)
+	if ok || len(msg.Refs) != 4 {
+		t.Error(msg.Refs)
+	}
+}
+
+func TestRefIndexGetRefsReverse(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for _, ref := range []int64{200, 100, 300, 400} {
+		index.Add(1, ref)
+	}
+	index.Add(2, 500)
+
+	if refs := index.GetRefsReverse(1); !equalRefs(refs, []int64{400, 300, 200, 100}) {
+		t.Error(refs)
+	}
+	if refs := index.GetRefsReverse(2); !equalRefs(refs, []int64{500}) {
+		t.Error(refs)
+	}
+	if refs := index.GetRefsReverse(3); len(refs) != 0 {
+		t.Error(refs)
+	}
+	// default order is ascending
+	if refs := index.Get(1); !equalRefs(refs, []int64{100, 200, 300, 400}) {
+		t.Error(refs)
+	}
+}
+
+type panicCodec struct {
+	deltaVarintCodec
+}
+
+func (panicCodec) Marshal(idRefs []element.IDRefs, buf []byte) []byte {
+	panic("marshal failed")
+}
+
+func TestRefIndexRecoverPanics(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.RecoverPanics = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// panic in OnFlush callback of writer, after the first buffer was
+	// written
+	index.OnFlush(func(int, int64) { panic("callback failed") })
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 1, ref: 100}
+	index.Flush()
+	index.addc <- idRef{id: 2, ref: 200}
+	index.SetLinearImport(false) // must not block
+	if err := index.LastError(); err == nil {
+		t.Error("expected error")
+	}
+	if index.aborted() == nil {
+		t.Error("panic did not abort the writes")
+	}
+	if err := index.Close(); err == nil {
+		t.Error("expected error from Close")
+	}
+
+	// refs after the panic are saved and replayed
+	index, err = newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := index.Get(1); !equalRefs(refs, []int64{100}) {
+		t.Error(refs)
+	}
+	if refs := index.Get(2); !equalRefs(refs, []int64{200}) {
+		t.Error(refs)
+	}
+
+	// panic while merging bunch in writeRefs
+	index.codec = panicCodec{}
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 3, ref: 300}
+	index.SetLinearImport(false)
+	index.codec = deltaVarintCodec{}
+	// the refs can not be saved with the panicking codec either
+	err = index.LastError()
+	if err == nil || !strings.HasSuffix(err.Error(), "marshal failed") {
+		t.Error(err)
+	}
+	if err := index.Close(); err == nil {
+		t.Error("expected error from Close")
+	}
+}
+
+func TestRefIndexRecoverPanicsDispatch(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.RecoverPanics = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index.SetLinearImport(true)
+	// the add of the first ref panics with a nil buffer
+	index.buffer = nil
+	index.addc <- idRef{id: 1, ref: 100}
+	index.addc <- idRef{id: 2, ref: 200}
+	index.Flush() // must not block
+	index.addc <- idRef{id: 3, ref: 300}
+	if err := index.Close(); err == nil {
+		t.Error("expected error from Close")
+	}
+
+	index, err = newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if refs := index.Get(2); !equalRefs(refs, []int64{200}) {
+		t.Error(refs)
+	}
+	if refs := index.Get(3); !equalRefs(refs, []int64{300}) {
+		t.Error(refs)
+	}
+}
+
+func TestRefIndexRecoverPanicsDisabled(t *testing.T) {
+	if globalCacheOptions.CoordsIndex.RecoverPanics || globalCacheOptions.WaysIndex.RecoverPanics {
+		t.Error("RecoverPanics enabled by default")
+	}
+}
+
+func TestRefIndexSweep(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.TTLDays = 30
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	index.Add(1, 100)
+	index.Add(2, 200)
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 3, ref: 300}
+	index.SetLinearImport(false)
+
+	now = now.AddDate(0, 0, 20)
+	index.Add(2, 201) // touch 2
+
+	now = now.AddDate(0, 0, 20)
+	if n, err := index.Sweep(); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	if refs := index.Get(1); len(refs) != 0 {
+		t.Error(refs)
+	}
+	if refs := index.Get(3); len(refs) != 0 {
+		t.Error(refs)
+	}
+	if refs := index.Get(2); len(refs) != 2 {
+		t.Error(refs)
+	}
+	if n, err := index.Sweep(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+
+	now = now.AddDate(0, 0, 40)
+	if n, err := index.Sweep(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+
+	otherDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(otherDir)
+	index2, err := newRefIndex(otherDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index2.Close()
+	if _, err := index2.Sweep(); err == nil {
+		t.Error("expected error without TTLDays")
+	}
+}
+
+func TestRefIndexGetSet(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for _, ref := range []int64{30, 10, 20} {
+		index.Add(1, ref)
+	}
+
+	set := index.GetSet(1)
+	if set.Len() != 3 {
+		t.Error(set.Len())
+	}
+	for ref, expected := range map[int64]bool{5: false, 10: true, 15: false, 20: true, 30: true, 40: false} {
+		if set.Contains(ref) != expected {
+			t.Error(ref, expected)
+		}
+	}
+	var refs []int64
+	set.Each(func(ref int64) bool {
+		refs = append(refs, ref)
+		return ref < 20
+	})
+	if !equalRefs(refs, []int64{10, 20}) {
+		t.Error(refs)
+	}
+
+	if set := index.GetSet(2); set.Len() != 0 || set.Contains(0) {
+		t.Error(set)
+	}
+}
+
+func TestRefIndexReadTimeout(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.ReadTimeoutMs = 50
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	index.Add(1, 100)
+
+	if refs, err := index.GetOrErr(1); err != nil || len(refs) != 1 {
+		t.Fatal(refs, err)
+	}
+
+	// block all reads to simulate stalled storage
+	index.flushMu.Lock()
+	_, err = index.GetOrErr(1)
+	index.flushMu.Unlock()
+	if err != ErrReadTimeout {
+		t.Fatal(err)
+	}
+}
+
+func TestRefIndexChangeStream(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	standbyDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(standbyDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	standby, err := newRefIndex(standbyDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+
+	changes := index.ChangeStream(2)
+
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 1, ref: 100}
+	index.addc <- idRef{id: 1, ref: 101}
+	index.SetLinearImport(false)
+	index.Add(2, 200)
+	index.Add(3, 300) // dropped, channel is full
+
+	var seq uint64
+	for i := 0; i < 2; i++ {
+		c := <-changes
+		if c.Seq != seq+1 {
+			t.Fatal("unexpected gap", c)
+		}
+		seq = c.Seq
+		if err := standby.ApplyChange(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if refs := standby.Get(1); !equalRefs(refs, []int64{100, 101}) {
+		t.Error(refs)
+	}
+	if refs := standby.Get(2); !equalRefs(refs, []int64{200}) {
+		t.Error(refs)
+	}
+
+	index.Delete(1)
+	index.DeleteRef(2, 200)
+	c := <-changes
+	if c.Seq != seq+2 || c.Op != ChangeDelete || c.ID != 1 {
+		t.Error("gap not detected", c)
+	}
+	standby.ApplyChange(c)
+	c = <-changes
+	if c.Op != ChangeSet || c.ID != 2 || len(c.Refs) != 0 {
+		t.Error(c)
+	}
+	standby.ApplyChange(c)
+	if refs := standby.Get(1); len(refs) != 0 {
+		t.Error(refs)
+	}
+	if refs := standby.Get(2); len(refs) != 0 {
+		t.Error(refs)
+	}
+}
+
+func TestRefIndexSpill(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.SpillThresholdK = 1
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index.SetLinearImport(true)
+	for i := int64(0); i < 2000; i++ {
+		index.addc <- idRef{id: 1, ref: i * 1000}
+	}
+	index.SetLinearImport(false)
+	index.Add(2, 5)
+	index.Add(100, 7) // other bunch, not spilled
+
+	value, err := index.db.Get(index.ro, idToKeyBuf(index.getBunchID(1)))
+	if err != nil || len(value) == 0 || value[0] != spillMarker {
+		t.Fatal("value not spilled", len(value), err)
+	}
+	if value, _ := index.db.Get(index.ro, idToKeyBuf(index.getBunchID(100))); value[0] == spillMarker {
+		t.Error("small value spilled")
+	}
+
+	check := func(index *bunchRefCache) {
+		if refs := index.Get(1); len(refs) != 2000 || refs[1999] != 1999000 {
+			t.Error(len(refs))
+		}
+		if refs := index.Get(2); !equalRefs(refs, []int64{5}) {
+			t.Error(refs)
+		}
+		if refs, _ := index.GetInto(100, nil); !equalRefs(refs, []int64{7}) {
+			t.Error(refs)
+		}
+	}
+	check(index)
+	index.Close()
+
+	// spilled values are readable, even if spilling is disabled
+	index, err = newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	check(index)
+	index.DeleteRef(1, 0)
+	if refs := index.Get(1); len(refs) != 1999 {
+		t.Error(len(refs))
+	}
+}
+
+func TestRefIndexSampleCompression(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	if sample, err := index.SampleCompression(10); err != nil || sample.Values != 0 {
+		t.Fatal(sample, err)
+	}
+
+	for id := int64(0); id < 1000; id++ {
+		index.Add(id, 100000+id)
+		index.Add(id, 100001+id)
+	}
+	sample, err := index.SampleCompression(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last bunch contains only 40 ids
+	if sample.Values != 10 || sample.IDs < 10*40 || sample.IDs > 10*64 || sample.Refs != 2*sample.IDs {
+		t.Error(sample)
+	}
+	if sample.CodecSizes[defaultRefCodec] != sample.StoredSize {
+		t.Error(sample)
+	}
+	if r := sample.Ratio(defaultRefCodec); r < 2 {
+		t.Error("unexpected ratio", r)
+	}
+}
+
+func TestRefIndexCloseFailingFlush(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Add(1, 100)
+
+	diskFull := errors.New("IO error: No space left on device")
+	dbWrite = func(db *levigo.DB, wo *levigo.WriteOptions, batch *levigo.WriteBatch) error {
+		return diskFull
+	}
+	defer func() { dbWrite = (*levigo.DB).Write }()
+
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 1, ref: 101}
+	index.addc <- idRef{id: 5000, ref: 500}
+	if err := index.Close(); err == nil || !strings.Contains(err.Error(), diskFull.Error()) {
+		t.Fatal("expected error", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(cacheDir, unflushedFilePattern))
+	if len(files) != 1 {
+		t.Fatal(files)
+	}
+
+	dbWrite = (*levigo.DB).Write
+	index, err = newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if refs := index.Get(1); !equalRefs(refs, []int64{100, 101}) {
+		t.Error(refs)
+	}
+	if refs := index.Get(5000); !equalRefs(refs, []int64{500}) {
+		t.Error(refs)
+	}
+	if files, _ := filepath.Glob(filepath.Join(cacheDir, unflushedFilePattern)); len(files) != 0 {
+		t.Error(files)
+	}
+}
+
+func TestRefIndexChangedSince(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.TrackGenerations = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 1, ref: 100}
+	index.addc <- idRef{id: 2, ref: 200}
+	index.SetLinearImport(false)
+	gen := index.Generation()
+	if gen != 1 {
+		t.Fatal(gen)
+	}
+
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 3, ref: 300}
+	index.SetLinearImport(false)
+	index.Delete(1)
+
+	if ids, err := index.ChangedSince(gen); err != nil || !equalRefs(ids, []int64{1, 3}) {
+		t.Error(ids, err)
+	}
+	if ids, _ := index.ChangedSince(0); !equalRefs(ids, []int64{1, 2, 3}) {
+		t.Error(ids)
+	}
+	index.Close()
+
+	// generation is persisted
+	index, err = newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if index.Generation() != 2 {
+		t.Error(index.Generation())
+	}
+	if n, err := index.TrimGenerations(gen); err != nil || n != 1 {
+		t.Error(n, err)
+	}
+	if ids, _ := index.ChangedSince(0); !equalRefs(ids, []int64{1, 3}) {
+		t.Error(ids)
+	}
+}
+
+func TestRefIndexSetBufferSize(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	index.SetLinearImport(true)
+	for n := int64(0); n < 100; n++ {
+		index.addc <- idRef{id: n * 64, ref: 1}
+	}
+	index.SetBufferSize(10)
+	if index.flushSize != 10 {
+		t.Error("unexpected flush size", index.flushSize)
+	}
+	// buffered refs are flushed by the resize
+	for n := int64(0); n < 100; n++ {
+		if refs := index.Get(n * 64); len(refs) != 1 {
+			t.Fatal(n, refs)
+		}
+	}
+
+	for n := int64(0); n < 25; n++ {
+		index.addc <- idRef{id: n * 64, ref: 2}
+	}
+	index.Barrier()
+	if len(index.buffer) >= 10 {
+		t.Error("buffer not flushed", len(index.buffer))
+	}
+	index.SetBufferSize(0)
+	if index.flushSize != bufferSize {
+		t.Error("unexpected flush size", index.flushSize)
+	}
+	for n := int64(0); n < 25; n++ {
+		if refs := index.Get(n * 64); len(refs) != 2 {
+			t.Fatal(n, refs)
+		}
+	}
+}
+
+func TestRefIndexDeleteToEmpty(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Add(1000, 100)
+	cache.Add(1000, 200)
+	cache.Add(1001, 100)
+	cache.Add(5000, 100)
+
+	// delete one of many refs
+	if err := cache.DeleteRef(1000, 100); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := cache.GetOrErr(1000); err != nil || !equalRefs(refs, []int64{200}) {
+		t.Fatal(refs, err)
+	}
+
+	// delete last ref, bunch is still used by 1000
+	if err := cache.DeleteRef(1001, 100); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := cache.GetOrErr(1001); err != ErrRefNotFound {
+		t.Fatal(refs, err)
+	}
+	if refs := cache.Get(1000); !equalRefs(refs, []int64{200}) {
+		t.Fatal(refs)
+	}
+
+	// delete last ref of single id in bunch removes the key
+	if err := cache.DeleteRef(5000, 100); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := cache.GetOrErr(5000); err != ErrRefNotFound {
+		t.Fatal(refs, err)
+	}
+	if data, err := cache.db.Get(cache.ro, idToKeyBuf(cache.getBunchID(5000))); err != nil || data != nil {
+		t.Fatal("key not deleted", data, err)
+	}
+
+	// delete all refs of the remaining bunch
+	if err := cache.Delete(1000); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cache.db.Get(cache.ro, idToKeyBuf(cache.getBunchID(1000))); err != nil || data != nil {
+		t.Fatal("key not deleted", data, err)
+	}
+	if n, err := cache.Count(); err != nil || n != 0 {
+		t.Error(n, err)
+	}
+
+	// re-add after delete
+	cache.Add(1001, 300)
+	if refs := cache.Get(1001); !equalRefs(refs, []int64{300}) {
+		t.Fatal(refs)
+	}
+}
+
+func TestRefIndexErrorPolicy(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	var failures int32
+	diskFull := errors.New("IO error: No space left on device")
+	dbWrite = func(db *levigo.DB, wo *levigo.WriteOptions, batch *levigo.WriteBatch) error {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return diskFull
+		}
+		return db.Write(wo, batch)
+	}
+	defer func() { dbWrite = (*levigo.DB).Write }()
+
+	var attempts []int
+	opts := globalCacheOptions.CoordsIndex
+	opts.ErrorPolicy = func(err error, attempt int) ErrorAction {
+		attempts = append(attempts, attempt)
+		if err != diskFull {
+			t.Error("unexpected error", err)
+		}
+		return RetryPolicy(2, ErrorAbort)(err, attempt)
+	}
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// retried till the third write succeeds
+	atomic.StoreInt32(&failures, 2)
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 1, ref: 100}
+	index.Flush()
+	if refs := index.Get(1); !equalRefs(refs, []int64{100}) {
+		t.Fatal(refs)
+	}
+	if !reflect.DeepEqual(attempts, []int{1, 2}) {
+		t.Fatal(attempts)
+	}
+
+	// aborted after the third failure, the following buffers are not
+	// written
+	attempts = nil
+	atomic.StoreInt32(&failures, 3)
+	index.addc <- idRef{id: 1, ref: 101}
+	index.Flush()
+	if !reflect.DeepEqual(attempts, []int{1, 2, 3}) {
+		t.Fatal(attempts)
+	}
+	index.addc <- idRef{id: 5000, ref: 500}
+	index.Flush()
+	if len(attempts) != 3 {
+		t.Fatal(attempts)
+	}
+	if refs := index.Get(5000); len(refs) != 0 {
+		t.Fatal(refs)
+	}
+	if err := index.Close(); err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Fatal("expected error", err)
+	}
+
+	// refs of all buffers since the abort are replayed
+	index, err = newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if refs := index.Get(1); !equalRefs(refs, []int64{100, 101}) {
+		t.Error(refs)
+	}
+	if refs := index.Get(5000); !equalRefs(refs, []int64{500}) {
+		t.Error(refs)
+	}
+}
+
+func TestDiffCacheCloseConcurrent(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache := NewDiffCache(cacheDir)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	coords, coordsRel, ways := cache.Coords, cache.CoordsRel, cache.Ways
+	coords.SetLinearImport(true)
+	coordsRel.SetLinearImport(true)
+	ways.SetLinearImport(true)
+	for i := int64(0); i < 1000; i++ {
+		coords.addc <- idRef{id: i, ref: 1}
+		coordsRel.addc <- idRef{id: i, ref: 2}
+		ways.addc <- idRef{id: i, ref: 3}
+	}
+
+	// fail the final flush of the ways index only
+	diskFull := errors.New("IO error: No space left on device")
+	waysDB := ways.db
+	dbWrite = func(db *levigo.DB, wo *levigo.WriteOptions, batch *levigo.WriteBatch) error {
+		if db == waysDB {
+			return diskFull
+		}
+		return db.Write(wo, batch)
+	}
+	defer func() { dbWrite = (*levigo.DB).Write }()
+
+	if err := cache.Close(); err == nil || !strings.Contains(err.Error(), diskFull.Error()) {
+		t.Fatal("expected error", err)
+	}
+	if cache.Coords != nil || cache.CoordsRel != nil || cache.Ways != nil {
+		t.Fatal("indices not removed")
+	}
+	for _, index := range []*bunchRefCache{coords.bunchRefCache, coordsRel.bunchRefCache, ways.bunchRefCache} {
+		if index.db != nil || index.linearImport {
+			t.Error("index not closed", index.path)
+		}
+	}
+
+	dbWrite = (*levigo.DB).Write
+	cache = NewDiffCache(cacheDir)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	if refs := cache.Coords.Get(999); !equalRefs(refs, []int64{1}) {
+		t.Error(refs)
+	}
+	if refs := cache.CoordsRel.Get(999); !equalRefs(refs, []int64{2}) {
+		t.Error(refs)
+	}
+	// replayed from the refs of the failed flush
+	if refs := cache.Ways.Get(999); !equalRefs(refs, []int64{3}) {
+		t.Error(refs)
+	}
+}
+
+func TestRefIndexDedupOnRead(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.DedupOnRead = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	index.SetLinearImport(true)
+	for _, ref := range []int64{300, 100, 300, 200} {
+		index.addc <- idRef{id: 1, ref: ref}
+	}
+	index.addc <- idRef{id: 2, ref: 500}
+	index.Flush()
+	for _, ref := range []int64{100, 50} {
+		index.addc <- idRef{id: 1, ref: ref}
+	}
+	index.SetLinearImport(false)
+
+	stored := func() []int64 {
+		data, err := index.getValue(index.ro, idToKeyBuf(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index.storeCodec().Unmarshal(data, nil)[0].Refs
+	}
+	if refs := stored(); !equalRefs(refs, []int64{300, 100, 300, 200, 100, 50}) {
+		t.Fatal("unexpected stored refs", refs)
+	}
+
+	expected := []int64{50, 100, 200, 300}
+	if refs := index.Get(1); !equalRefs(refs, expected) {
+		t.Error(refs)
+	}
+	if refs, _ := index.AppendRefs([]int64{1}, 1); !equalRefs(refs, append([]int64{1}, expected...)) {
+		t.Error(refs)
+	}
+	if refs := index.Get(2); !equalRefs(refs, []int64{500}) {
+		t.Error(refs)
+	}
+	if summary, err := index.ValidateAll(); err != nil || !summary.OK() {
+		t.Error(summary, err)
+	}
+
+	if n, err := index.CompactRefs(); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if refs := stored(); !equalRefs(refs, expected) {
+		t.Fatal("unexpected stored refs", refs)
+	}
+	if n, err := index.CompactRefs(); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if refs := index.Get(1); !equalRefs(refs, expected) {
+		t.Error(refs)
+	}
+}
+
+func TestRefIndexDedupOnReadReopen(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.DedupOnRead = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.SetLinearImport(true)
+	for _, ref := range []int64{300, 100, 300} {
+		index.addc <- idRef{id: 1, ref: ref}
+	}
+	index.SetLinearImport(false)
+	index.Close()
+
+	// the stored values still need the deduplication without the option
+	index, err = newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if !index.meta.DedupOnRead || !index.indexOptions.DedupOnRead {
+		t.Error("DedupOnRead not enabled from metadata")
+	}
+	if globalCacheOptions.CoordsIndex.DedupOnRead {
+		t.Error("configured options changed")
+	}
+	if refs := index.Get(1); !equalRefs(refs, []int64{100, 300}) {
+		t.Error(refs)
+	}
+}
+
+func TestRefIndexOptimize(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.DedupOnRead = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	index.SetLinearImport(true)
+	for n := int64(0); n < 4; n++ {
+		for _, ref := range []int64{300, 100, 300, 200} {
+			index.addc <- idRef{id: n * 64, ref: ref}
+		}
+		index.addc <- idRef{id: n*64 + 1, ref: 500}
+	}
+	index.SetLinearImport(false)
+
+	// continue an interrupted run after the second bunch
+	if err := writeOptimizeProgress(index.path, idToKeyBuf(1)); err != nil {
+		t.Fatal(err)
+	}
+	summary, err := index.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !summary.Resumed || summary.Values != 2 || summary.Rewritten != 2 || summary.BytesSaved <= 0 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if _, err := os.Stat(filepath.Join(index.path, optimizeProgressFile)); !os.IsNotExist(err) {
+		t.Error("progress not removed", err)
+	}
+	if data, _ := index.GetRaw(0); !equalRefs(index.storeCodec().Unmarshal(data, nil)[0].Refs, []int64{300, 100, 300, 200}) {
+		t.Error("first bunch rewritten")
+	}
+
+	summary, err = index.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Resumed || summary.Values != 4 || summary.Rewritten != 2 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if summary, err := index.Optimize(); err != nil || summary.Rewritten != 0 || summary.BytesSaved != 0 {
+		t.Error(summary, err)
+	}
+	for n := int64(0); n < 4; n++ {
+		data, _ := index.GetRaw(n * 64)
+		if refs := index.storeCodec().Unmarshal(data, nil)[0].Refs; !equalRefs(refs, []int64{100, 200, 300}) {
+			t.Error("unexpected stored refs", n, refs)
+		}
+		if refs := index.Get(n*64 + 1); !equalRefs(refs, []int64{500}) {
+			t.Error(refs)
+		}
+	}
+}
+
+// BenchmarkWriteDuplicateRefs measures the linear import of a stream of
+// 200 ids with 500 refs each. Each ref is added twice and the refs are
+// added in descending order, so that each ref is inserted at the start of
+// the buffered refs without DedupOnRead.
+func BenchmarkWriteDuplicateRefs(b *testing.B) {
+	for _, dedupOnRead := range []bool{false, true} {
+		b.Run(fmt.Sprintf("DedupOnRead-%v", dedupOnRead), func(b *testing.B) {
+			b.StopTimer()
+			cacheDir, _ := ioutil.TempDir("", "imposm_test")
+			defer os.RemoveAll(cacheDir)
+
+			opts := globalCacheOptions.CoordsIndex
+			opts.DedupOnRead = dedupOnRead
+			index, err := newRefIndex(cacheDir, &opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer index.Close()
+
+			b.ReportAllocs()
+			b.StartTimer()
+			for i := 0; i < b.N; i++ {
+				index.SetLinearImport(true)
+				// new ids for each run
+				firstID := int64(i) * 200
+				for ref := int64(500); ref > 0; ref-- {
+					for dup := 0; dup < 2; dup++ {
+						for id := firstID; id < firstID+200; id++ {
+							index.addc <- idRef{id: id, ref: ref}
+						}
+					}
+				}
+				index.SetLinearImport(false)
+			}
+		})
+	}
+}
+
+func TestRefIndexFlushReadConcurrency(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.FlushReadConcurrency = 1
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if cap(index.flushReads) != 1 {
+		t.Fatal(cap(index.flushReads))
+	}
+
+	for _, ref := range []int64{2, 1} {
+		index.SetLinearImport(true)
+		for n := int64(0); n < 64*100; n++ {
+			index.addc <- idRef{id: n, ref: ref}
+		}
+		index.SetLinearImport(false)
+	}
+	if len(index.flushReads) != 0 {
+		t.Error("reads not released", len(index.flushReads))
+	}
+	for _, n := range []int64{0, 64*100 - 1} {
+		if refs := index.Get(n); !equalRefs(refs, []int64{1, 2}) {
+			t.Error(n, refs)
+		}
+	}
+}
+
+func TestRefIndexGetRefsFiltered(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		defer os.RemoveAll(cacheDir)
+
+		opts := globalCacheOptions.CoordsIndex
+		opts.DedupOnRead = dedup
+		index, err := newRefIndex(cacheDir, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+
+		index.SetLinearImport(true)
+		for _, ref := range []int64{105, 3, 100, 7, 100} {
+			index.addc <- idRef{id: 1, ref: ref}
+		}
+		index.addc <- idRef{id: 2, ref: 200}
+		index.SetLinearImport(false)
+
+		large := func(ref int64) bool { return ref >= 100 }
+		if refs := index.GetRefsFiltered(1, large); !equalRefs(refs, []int64{100, 105}) {
+			t.Error(dedup, refs)
+		}
+		if refs := index.GetRefsFiltered(2, large); !equalRefs(refs, []int64{200}) {
+			t.Error(dedup, refs)
+		}
+		if refs := index.GetRefsFiltered(3, large); refs != nil {
+			t.Error(dedup, refs)
+		}
+	}
+}
+
+func TestRefIndexSummary(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.LogSummary = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index.SetLinearImport(true)
+	for n := int64(0); n < 100; n++ {
+		index.addc <- idRef{id: n, ref: 1}
+		index.addc <- idRef{id: n, ref: 2}
+	}
+	index.SetLinearImport(false)
+	s := index.Summary()
+	if s.IDs != 100 || s.Refs != 200 || s.Flushes != 1 || s.Bytes == 0 || s.Errors != 0 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	closed := index.Summary()
+	time.Sleep(time.Millisecond)
+	if index.Summary().Elapsed != closed.Elapsed || closed.Elapsed <= 0 {
+		t.Error("elapsed time not stopped by Close", closed.Elapsed)
+	}
+}
+
+func TestRefIndexSortedInput(t *testing.T) {
+	var indices []*bunchRefCache
+	for _, sorted := range []bool{false, true} {
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		defer os.RemoveAll(cacheDir)
+
+		opts := globalCacheOptions.CoordsIndex
+		opts.SortedInput = sorted
+		index, err := newRefIndex(cacheDir, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		indices = append(indices, index)
+	}
+
+	// mostly increasing refs, with refs out of order and duplicates
+	rnd := rand.New(rand.NewSource(1))
+	var refs []idRef
+	for ref := int64(1); ref < 2000; ref++ {
+		for i := 0; i < 5; i++ {
+			refs = append(refs, idRef{id: rnd.Int63n(500), ref: ref})
+		}
+		if ref%7 == 0 {
+			refs = append(refs, idRef{id: rnd.Int63n(500), ref: rnd.Int63n(ref)})
+		}
+		if ref%11 == 0 {
+			refs = append(refs, refs[len(refs)-1])
+		}
+	}
+
+	for _, index := range indices {
+		index.SetBufferSize(3)
+		index.SetLinearImport(true)
+		for _, r := range refs {
+			index.addc <- r
+		}
+		index.SetLinearImport(false)
+	}
+	for id := int64(0); id < 500; id++ {
+		want := indices[0].Get(id)
+		got := indices[1].Get(id)
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("refs of %d differ: %v != %v", id, got, want)
+		}
+	}
+}
+
+func BenchmarkWriteDiffSortedInput(b *testing.B) {
+	for _, sorted := range []bool{false, true} {
+		b.Run(fmt.Sprintf("sorted-%t", sorted), func(b *testing.B) {
+			b.StopTimer()
+			cacheDir, _ := ioutil.TempDir("", "imposm_test")
+			defer os.RemoveAll(cacheDir)
+
+			opts := globalCacheOptions.CoordsIndex
+			opts.SortedInput = sorted
+			cache, err := newRefIndex(cacheDir, &opts)
+			if err != nil {
+				b.Fatal()
+			}
+			defer cache.Close()
+
+			b.StartTimer()
+			for i := 0; i < b.N; i++ {
+				cache.SetLinearImport(true)
+				// many refs for each id, added in increasing order
+				for ref := 0; ref < 1000; ref++ {
+					for n := 0; n < 1000; n++ {
+						cache.addc <- idRef{id: int64(n), ref: int64(i*1000 + ref)}
+					}
+				}
+				cache.SetLinearImport(false)
+			}
+		})
+	}
+}
+
+func TestRefIndexBufferReuse(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.WriteQueueDepth = 4
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	// slow writes, so that dispatch fills the queue and reuses buffers
+	// of earlier flushes while the writer works on later buffers
+	dbWrite = func(db *levigo.DB, wo *levigo.WriteOptions, batch *levigo.WriteBatch) error {
+		time.Sleep(time.Millisecond)
+		return db.Write(wo, batch)
+	}
+	defer func() { dbWrite = (*levigo.DB).Write }()
+
+	index.SetBufferSize(8)
+	for round := int64(1); round <= 3; round++ {
+		index.SetLinearImport(true)
+		for n := int64(0); n < 1000; n++ {
+			index.addc <- idRef{id: n * 64, ref: round}
+		}
+		index.SetLinearImport(false)
+		if n := len(index.bufferPool); n > cap(index.bufferPool) || cap(index.bufferPool) != 4 {
+			t.Fatal("unexpected pool size", n, cap(index.bufferPool))
+		}
+	}
+	for n := int64(0); n < 1000; n++ {
+		if refs := index.Get(n * 64); !reflect.DeepEqual(refs, []int64{1, 2, 3}) {
+			t.Fatal(n, refs)
+		}
+	}
+}
+
+func TestRefIndexMemPressure(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.MaxHeapSizeM = 100
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	defer func(alloc func() uint64, interval time.Duration) {
+		heapAlloc = alloc
+		memCheckInterval = interval
+	}(heapAlloc, memCheckInterval)
+	var heap uint64 = 50 * 1024 * 1024
+	heapAlloc = func() uint64 { return atomic.LoadUint64(&heap) }
+	memCheckInterval = time.Millisecond
+
+	index.SetBufferSize(80)
+	add := func(round int64) int {
+		flushes := index.Summary().Flushes
+		index.SetLinearImport(true)
+		time.Sleep(20 * time.Millisecond)
+		for n := int64(0); n < 160; n++ {
+			index.addc <- idRef{id: n * 64, ref: round}
+		}
+		index.SetLinearImport(false)
+		return index.Summary().Flushes - flushes
+	}
+	if n := add(1); n != 2 {
+		t.Error("unexpected flushes without pressure", n)
+	}
+	atomic.StoreUint64(&heap, 200*1024*1024)
+	if n := add(2); n != 16 {
+		t.Error("unexpected flushes under pressure", n)
+	}
+	if index.memStop != nil || atomic.LoadInt32(&index.memPressure) != 0 {
+		t.Error("monitor not stopped")
+	}
+	for n := int64(0); n < 160; n++ {
+		if refs := index.Get(n * 64); !reflect.DeepEqual(refs, []int64{1, 2}) {
+			t.Fatal(n, refs)
+		}
+	}
+}
+
+func TestRefIndexDistinctRefs(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	defer func(n int) { distinctChunkRefs = n }(distinctChunkRefs)
+	distinctChunkRefs = 7
+
+	rnd := rand.New(rand.NewSource(1))
+	want := map[int64]bool{}
+	for i := 0; i < 1000; i++ {
+		id, ref := rnd.Int63n(5000), rnd.Int63n(300)-10
+		if err := index.Add(id, ref); err != nil {
+			t.Fatal(err)
+		}
+		want[ref] = true
+	}
+
+	var refs []int64
+	if err := index.DistinctRefs(func(ref int64) error {
+		refs = append(refs, ref)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != len(want) {
+		t.Fatalf("expected %d refs, got %d", len(want), len(refs))
+	}
+	for i, ref := range refs {
+		if !want[ref] || (i > 0 && refs[i-1] >= ref) {
+			t.Fatalf("unexpected ref %d at %d", ref, i)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(cacheDir, "imposm_distinct_*")); len(files) != 0 {
+		t.Error("temporary files not removed", files)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = index.DistinctRefs(func(ref int64) error {
+		n++
+		if n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Error("iteration not stopped", err, n)
+	}
+}
+
+func TestDiffCacheTxElements(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache := NewDiffCache(cacheDir)
+	if err := cache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	way := &osm.Way{Element: osm.Element{ID: 10}, Nodes: []osm.Node{{Element: osm.Element{ID: 1}}, {Element: osm.Element{ID: 2}}}}
+	members := []osm.Member{
+		{ID: 1, Type: osm.NodeMember},
+		{ID: 10, Type: osm.WayMember},
+		{ID: 50, Type: osm.RelationMember},
+	}
+
+	tx := cache.Begin()
+	tx.AddFromWay(way)
+	tx.AddFromMembers(100, members)
+	tx.Rollback()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if refs := cache.Coords.Get(1); len(refs) != 0 {
+		t.Error("rolled back refs added", refs)
+	}
+
+	tx.AddFromWay(way)
+	tx.AddFromMembers(100, members)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{1, 2} {
+		if refs := cache.Coords.Get(id); !reflect.DeepEqual(refs, []int64{10}) {
+			t.Error(id, refs)
+		}
+	}
+	if refs := cache.CoordsRel.Get(1); !reflect.DeepEqual(refs, []int64{100}) {
+		t.Error(refs)
+	}
+	if refs := cache.Ways.Get(10); !reflect.DeepEqual(refs, []int64{100}) {
+		t.Error(refs)
+	}
+
+	// relations index is not enabled
+	tx.Add(TxRelations, 50, 100)
+	if err := tx.Commit(); err == nil {
+		t.Error("commit for disabled index succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, txJournalFile)); !os.IsNotExist(err) {
+		t.Error("journal written", err)
+	}
+}
+
+func TestRefIndexMaxValueRefs(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.MaxValueRefs = 3
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	storedRefs := func(id int64) []int64 {
+		data, err := index.db.Get(index.ro, idToKeyBuf(index.getBunchID(id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bunch := idRefBunch{idRefs: index.codec.(overflowCodec).refCodec.Unmarshal(data, nil)}
+		if idRef := bunch.get(id); idRef != nil {
+			return idRef.Refs
+		}
+		return nil
+	}
+
+	index.SetLinearImport(true)
+	for _, ref := range []int64{8, 2, 6, 4} {
+		index.addc <- idRef{id: 5, ref: ref}
+	}
+	index.addc <- idRef{id: 6, ref: 1}
+	index.SetLinearImport(false)
+	for _, ref := range []int64{10, 1, 3} {
+		if err := index.Add(5, ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all := []int64{1, 2, 3, 4, 6, 8, 10}
+	if refs := index.Get(5); !reflect.DeepEqual(refs, all) {
+		t.Error(refs)
+	}
+	if refs := storedRefs(5); !reflect.DeepEqual(refs, []int64{1, 2, 3}) {
+		t.Error("value not limited", refs)
+	}
+	if refs, _ := index.AppendRefs([]int64{-1}, 5); !reflect.DeepEqual(refs, append([]int64{-1}, all...)) {
+		t.Error(refs)
+	}
+	if refs, err := index.GetBatch([]int64{5, 6}); err != nil || !reflect.DeepEqual(refs[5], all) || len(refs[6]) != 1 {
+		t.Error(refs, err)
+	}
+	if n, err := index.OverflowCount(); err != nil || n != 1 {
+		t.Error("unexpected overflow count", n, err)
+	}
+
+	// from the value and from the overflow
+	index.DeleteRef(5, 2)
+	index.DeleteRef(5, 8)
+	if refs := index.Get(5); !reflect.DeepEqual(refs, []int64{1, 3, 4, 6, 10}) {
+		t.Error(refs)
+	}
+	index.DeleteRef(5, 10)
+	index.DeleteRef(5, 6)
+	if refs := index.Get(5); !reflect.DeepEqual(refs, []int64{1, 3, 4}) {
+		t.Error(refs)
+	}
+	if n, _ := index.OverflowCount(); n != 0 {
+		t.Error("overflow not removed", n)
+	}
+	index.Add(5, 7)
+	index.Delete(5)
+	if refs := index.Get(5); len(refs) != 0 {
+		t.Error(refs)
+	}
+	if n, _ := index.OverflowCount(); n != 0 {
+		t.Error("overflow not removed", n)
+	}
+}
+
+func TestRefIndexMaxValueRefsReopen(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.MaxValueRefs = 3
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := []int64{1, 2, 3, 4, 5, 6}
+	for _, ref := range all {
+		index.Add(5, ref)
+	}
+	index.Close()
+
+	// without the option and with another limit
+	for _, max := range []int{0, 5} {
+		reopenOpts := globalCacheOptions.CoordsIndex
+		reopenOpts.MaxValueRefs = max
+		index, err = newRefIndex(cacheDir, &reopenOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index.indexOptions.MaxValueRefs != 3 {
+			t.Error("recorded MaxValueRefs not used", index.indexOptions.MaxValueRefs)
+		}
+		if refs := index.Get(5); !reflect.DeepEqual(refs, all) {
+			t.Error(max, refs)
+		}
+		index.Close()
+	}
+
+	// overflow index without recorded limit, e.g. of an older version
+	meta, err := readRefIndexMeta(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.MaxValueRefs = 0
+	if err := writeRefIndexMeta(cacheDir, meta); err != nil {
+		t.Fatal(err)
+	}
+	if index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex); err == nil {
+		index.Close()
+		t.Error("expected error for overflow index without MaxValueRefs")
+	}
+}
+
+func TestRefIndexMaxValueRefsValidate(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.MaxValueRefs = 3
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	for ref := int64(1); ref <= 5; ref++ {
+		if err := index.Add(5, ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if summary, err := index.ValidateAll(); err != nil || !summary.OK() {
+		t.Fatal(summary, err)
+	}
+
+	// overflow refs of another state of the value, e.g. after a crash
+	// between the write of the overflow and of the value
+	data := index.codec.(overflowCodec).refCodec.Marshal([]element.IDRefs{{ID: 5, Refs: []int64{2, 7}}}, nil)
+	if err := index.overflow.db.Put(index.overflow.wo, idToKeyBuf(5), data); err != nil {
+		t.Fatal(err)
+	}
+	if summary, err := index.ValidateAll(); err != nil || summary.BadValues != 1 {
+		t.Fatal(summary, err)
+	}
+	if summary, err := index.RepairAll(); err != nil || summary.Repaired != 1 {
+		t.Fatal(summary, err)
+	}
+	if summary, err := index.ValidateAll(); err != nil || !summary.OK() {
+		t.Fatal(summary, err)
+	}
+	if refs := index.Get(5); !reflect.DeepEqual(refs, []int64{1, 2, 3, 7}) {
+		t.Error(refs)
+	}
+}
+func TestRefIndexIterRefsGenerations(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.TrackGenerations = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 1, ref: 100}
+	index.addc <- idRef{id: 70, ref: 200}
+	index.SetLinearImport(false)
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 2, ref: 300}
+	index.SetLinearImport(false)
+	// outside of the linear import, part of the next generation
+	index.Add(70, 201)
+
+	type result struct {
+		id   int64
+		refs []int64
+		gen  uint64
+	}
+	var results []result
+	err = index.IterRefsGenerations(func(id int64, refs []int64, gen uint64) error {
+		results = append(results, result{id, append([]int64{}, refs...), gen})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []result{
+		{1, []int64{100}, 1},
+		{2, []int64{300}, 2},
+		{70, []int64{200, 201}, 3},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("unexpected results %v", results)
+	}
+}
+
+func TestRefIndexGetRaw(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	index, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	index.Add(1, 10)
+	index.Add(2, 20)
+	data, ok := index.GetRaw(1)
+	if !ok {
+		t.Fatal("value not found")
+	}
+	expected := index.codec.Marshal([]element.IDRefs{{ID: 1, Refs: []int64{10}}, {ID: 2, Refs: []int64{20}}}, nil)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("unexpected value %v", data)
+	}
+	// copy is not changed by later writes
+	index.Add(1, 11)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("value changed %v", data)
+	}
+	if data, ok := index.GetRaw(64); ok || data != nil {
+		t.Error("unexpected value", data)
+	}
+}
+
+func TestKeyMigrate(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	defer func(size int) { keyMigrateBatchSize = size }(keyMigrateBatchSize)
+	keyMigrateBatchSize = 1
+	defer func() { keyEncoding = keyEncodingUnsigned }()
+
+	path := filepath.Join(cacheDir, "ways_index")
+	opts := globalCacheOptions.WaysIndex
+	opts.TrackGenerations = true
+	index, err := newRefIndex(path, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{1000, -1000} {
+		if err := index.Add(id, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.Close()
+
+	if n, err := KeyMigrate(cacheDir); err != nil || n != 0 {
+		t.Fatal("migrated without new encoding", n, err)
+	}
+
+	keyEncoding = keyEncodingSignFlip
+	if _, err := newRefIndex(path, &opts); err == nil || !strings.Contains(err.Error(), "KeyMigrate") {
+		t.Fatal("opened index with unsigned keys", err)
+	}
+	// two bunches and two generations
+	if n, err := KeyMigrate(cacheDir); err != nil || n != 4 {
+		t.Fatal(n, err)
+	}
+	c := cache{options: &cacheOptions{}}
+	if err := c.open(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, bunchID := range []int64{15, -15} {
+		key := uint64Key(uint64(bunchID) ^ signBit)
+		if data, err := c.db.Get(c.ro, key); err != nil || data == nil {
+			t.Error("missing sign-flip key for bunch", bunchID, err)
+		}
+	}
+	if data, _ := c.db.Get(c.ro, keyMigrateKey); data != nil {
+		t.Error("progress not removed")
+	}
+	c.Close()
+	if n, err := KeyMigrate(cacheDir); err != nil || n != 0 {
+		t.Fatal("migrated twice", n, err)
+	}
+
+	// interrupted while removing the progress
+	meta, err := readRefIndexMeta(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.KeyMigration = keyEncodingSignFlip
+	if err := writeRefIndexMeta(path, meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRefIndex(path, &opts); err == nil || !strings.Contains(err.Error(), "not finished") {
+		t.Fatal("opened index with unfinished migration", err)
+	}
+	if n, err := KeyMigrate(cacheDir); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+
+	// and back to the keys of idToKeyBuf
+	keyEncoding = keyEncodingUnsigned
+	if n, err := KeyMigrate(cacheDir); err != nil || n != 4 {
+		t.Fatal(n, err)
+	}
+	index, err = newRefIndex(path, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for _, id := range []int64{1000, -1000} {
+		if refs := index.Get(id); !equalRefs(refs, []int64{1}) {
+			t.Error(id, refs)
+		}
+	}
+	if ids, err := index.ChangedSince(0); err != nil || !equalRefs(ids, []int64{1000, -1000}) {
+		t.Error(ids, err)
+	}
+}
+
+func TestRefIndexFingerprint(t *testing.T) {
+	dirA, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(dirA)
+	dirB, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(dirB)
+
+	optsA := globalCacheOptions.CoordsIndex
+	optsA.DedupOnRead = true
+	a, err := newRefIndex(dirA, &optsA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := newRefIndex(dirB, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// ids in multiple partitions
+	ids := []int64{1, 70, 64*fingerprintPartitionBunches*3 + 5, -7}
+	a.SetLinearImport(true)
+	for _, id := range ids {
+		for _, ref := range []int64{9, 3, 9, 5} {
+			a.addc <- idRef{id: id, ref: ref}
+		}
+	}
+	a.SetLinearImport(false)
+	for i := len(ids) - 1; i >= 0; i-- {
+		for _, ref := range []int64{5, 3, 9} {
+			b.Add(ids[i], ref)
+		}
+	}
+	// ids without refs are ignored
+	b.Add(99, 1)
+	b.DeleteRef(99, 1)
+
+	fingerprint := func(index *bunchRefCache) string {
+		digest, err := index.Fingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%x", digest)
+	}
+	fpA := fingerprint(a)
+	if fpB := fingerprint(b); fpA != fpB {
+		t.Fatal(fpA, fpB)
+	}
+
+	b.Add(70, 4)
+	if fpB := fingerprint(b); fpA == fpB {
+		t.Fatal("same fingerprint after Add")
+	}
+	b.DeleteRef(70, 4)
+	if fpB := fingerprint(b); fpA != fpB {
+		t.Fatal(fpA, fpB)
+	}
+	b.Delete(-7)
+	if fpB := fingerprint(b); fpA == fpB {
+		t.Fatal("same fingerprint after Delete")
+	}
+}
+
+func TestRefIndexApplyDiffParallel(t *testing.T) {
+	dirA, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(dirA)
+	dirB, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(dirB)
+
+	a, err := newRefIndex(dirA, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := newRefIndex(dirB, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for n := 0; n < 64*50; n += 3 {
+		a.Add(int64(n), 1)
+		b.Add(int64(n), 1)
+	}
+
+	var ops []DiffOp
+	for n := 0; n < 64*50; n++ {
+		id := int64(n)
+		switch n % 4 {
+		case 0:
+			ops = append(ops, DiffOp{Op: DiffAdd, ID: id, Ref: 2}, DiffOp{Op: DiffDeleteRef, ID: id, Ref: 1})
+		case 1:
+			ops = append(ops, DiffOp{Op: DiffDelete, ID: id}, DiffOp{Op: DiffAdd, ID: id, Ref: 3})
+		case 2:
+			ops = append(ops, DiffOp{Op: DiffAdd, ID: id, Ref: 4}, DiffOp{Op: DiffDelete, ID: id})
+		}
+	}
+	ops = append(ops, DiffOp{Op: DiffAdd, ID: -70, Ref: 5})
+
+	if err := a.ApplyDiffParallel(ops, 4); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case DiffAdd:
+			b.Add(op.ID, op.Ref)
+		case DiffDeleteRef:
+			b.DeleteRef(op.ID, op.Ref)
+		case DiffDelete:
+			b.Delete(op.ID)
+		}
+	}
+
+	for _, n := range []int64{0, 1, 2, 3, 64*50 - 1, -70} {
+		if refsA, refsB := a.Get(n), b.Get(n); !equalRefs(refsA, refsB) {
+			t.Error(n, refsA, refsB)
+		}
+	}
+	fpA, err := a.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fpB, err := b.Fingerprint(); err != nil || !bytes.Equal(fpA, fpB) {
+		t.Error("ApplyDiffParallel differs from serial writes", err)
+	}
+
+	if err := a.ApplyDiffParallel([]DiffOp{{Op: 99, ID: 1}}, 4); err == nil {
+		t.Error("expected error for unknown op")
+	}
+}
+
+func TestRefIndexSubscribe(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type change struct {
+		id       int64
+		old, new []int64
+	}
+	var changes []change
+	cache.Subscribe(func(id int64, oldRefs, newRefs []int64) {
+		changes = append(changes, change{id, oldRefs, newRefs})
+	})
+
+	cache.SetLinearImport(true)
+	cache.addc <- idRef{id: 1, ref: 10}
+	cache.addc <- idRef{id: 1, ref: 11}
+	cache.SetLinearImport(false)
+	cache.SetLinearImport(true)
+	cache.addc <- idRef{id: 1, ref: 12}
+	cache.SetLinearImport(false)
+
+	cache.Add(1, 12) // unchanged
+	cache.Add(2, 20)
+	cache.DeleteRef(1, 10)
+	cache.Delete(2)
+	if err := cache.ApplyDiffParallel([]DiffOp{{Op: DiffAdd, ID: 3, Ref: 30}, {Op: DiffAdd, ID: 3, Ref: 31}}, 1); err != nil {
+		t.Fatal(err)
+	}
+	// waits for all notifications
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []change{
+		{1, []int64{}, []int64{10, 11}},
+		{1, []int64{10, 11}, []int64{10, 11, 12}},
+		{2, []int64{}, []int64{20}},
+		{1, []int64{10, 11, 12}, []int64{11, 12}},
+		{2, []int64{20}, []int64{}},
+		{3, []int64{}, []int64{30, 31}},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatal(changes)
+	}
+}
+
+func TestRefIndexSubscribeSlow(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := make(chan struct{})
+	var calls int
+	cache.Subscribe(func(id int64, oldRefs, newRefs []int64) {
+		<-block
+		calls++
+	})
+	// writes do not block on the blocked subscriber
+	for n := 0; n < subscribeBufferSize+100; n++ {
+		cache.Add(int64(n), 1)
+	}
+	close(block)
+	cache.Close()
+	if calls < subscribeBufferSize || calls >= subscribeBufferSize+100 {
+		t.Fatal(calls)
+	}
+}
@@ -0,0 +1,25 @@
+// +build testing
+
+package cache
+
+// putRawBunch stores data as the value of the bunch that contains id,
+// bypassing MarshalIDRefsBunch2. It is only available with the testing build
+// tag and allows tests to write deliberately malformed values.
+func (index *bunchRefCache) putRawBunch(id int64, data []byte) error {
+	keyBuf := idToKeyBuf(index.getBunchID(id))
+	return index.db.Put(index.writeOptions(), keyBuf, data)
+}
+
+// testOptions of refIndexOptions for deterministic tests.
+type testOptions struct {
+	// UnbufferedAdd disables the queue for added refs during linear
+	// import. Each add blocks till the ref is in the buffer.
+	UnbufferedAdd bool
+	// OrderedWrites writes the bunches of each buffer with a single
+	// worker in the order of the bunch IDs, instead of the fan-out to
+	// multiple workers.
+	OrderedWrites bool
+}
+
+func (o testOptions) unbufferedAdd() bool { return o.UnbufferedAdd }
+func (o testOptions) orderedWrites() bool { return o.OrderedWrites }
@@ -0,0 +1,10 @@
+// +build !testing
+
+package cache
+
+// testOptions of refIndexOptions are only available with the testing build
+// tag, see diff_testing.go.
+type testOptions struct{}
+
+func (testOptions) unbufferedAdd() bool { return false }
+func (testOptions) orderedWrites() bool { return false }
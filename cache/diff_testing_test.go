@@ -0,0 +1,328 @@
+// +build testing
+
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/cache/binary"
+	"github.com/omniscale/imposm3/element"
+)
+
+func TestPutRawBunch(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	if err := cache.Add(1000, 100); err != nil {
+		t.Fatal(err)
+	}
+	// bunch with two ids but missing ref counts and refs
+	if err := cache.putRawBunch(1000, []byte{2, 0x80}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic for malformed bunch")
+		}
+	}()
+	cache.Get(1000)
+}
+
+func TestRefIndexValidateAll(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Add(1, 100)
+	cache.Add(1, 101)
+	cache.Add(2, 200)
+	cache.Add(1000, 100)
+	cache.Add(2000, 100)
+
+	if summary, err := cache.ValidateAll(); err != nil || !summary.OK() || summary.Values != 3 {
+		t.Fatal(summary, err)
+	}
+
+	// missing refs
+	if err := cache.putRawBunch(1000, []byte{2, 0x80}); err != nil {
+		t.Fatal(err)
+	}
+	// id 5000 in bunch of 2000
+	if err := cache.putRawBunch(2000, []byte{1, 0x90, 0x4e, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	summary, err := cache.ValidateAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Values != 3 || summary.BadValues != 2 || len(summary.Errors) != 2 {
+		t.Fatal(summary)
+	}
+	if summary.Errors[0].BunchID != cache.getBunchID(1000) || summary.Errors[1].BunchID != cache.getBunchID(2000) {
+		t.Error(summary.Errors)
+	}
+}
+
+func TestRefIndexComparator(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	registerReverseComparator()
+	opts := globalCacheOptions.CoordsIndex
+	opts.Comparator = reverseComparator
+	cache, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{1, 1000, 100} {
+		cache.Add(id, 1)
+	}
+	var ids []int64
+	if err := cache.IterKeys(func(id int64) { ids = append(ids, id) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != 1000 || ids[1] != 100 || ids[2] != 1 {
+		t.Error(ids)
+	}
+	cache.Close()
+
+	if _, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex); err == nil {
+		t.Fatal("opened index with mismatching comparator")
+	}
+
+	otherDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(otherDir)
+	opts.Comparator = "unknown"
+	if _, err := newRefIndex(otherDir, &opts); err == nil {
+		t.Fatal("opened index with unknown comparator")
+	}
+}
+
+func TestRefIndexValidateAllParallel(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.workers = 4
+
+	for i := int64(0); i < 1000; i++ {
+		cache.Add(i*64, 1)
+	}
+	// corrupt every 50th bunch, from the end so that the first bad values
+	// are not the first that are written
+	for i := int64(999); i >= 0; i -= 50 {
+		if err := cache.putRawBunch(i*64, []byte{2, 0x80}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary, err := cache.ValidateAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Values != 1000 || summary.BadValues != 20 || len(summary.Errors) != maxValidationErrors {
+		t.Fatal(summary.Values, summary.BadValues, len(summary.Errors))
+	}
+	for i, e := range summary.Errors {
+		if e.BunchID != int64(49+i*50) {
+			t.Error(i, e)
+		}
+	}
+}
+
+func TestRefIndexRepair(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := newRefIndex(cacheDir, &globalCacheOptions.CoordsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Add(64, 100)
+	// unsorted ids and refs with duplicates
+	unsorted := binary.MarshalIDRefsBunch2([]element.IDRefs{
+		{ID: 5, Refs: []int64{300, 100, 100}},
+		{ID: 3, Refs: []int64{20}},
+		{ID: 3, Refs: []int64{10, 20}},
+	}, nil)
+	if err := cache.putRawBunch(5, unsorted); err != nil {
+		t.Fatal(err)
+	}
+	// missing refs
+	if err := cache.putRawBunch(1000, []byte{2, 0x80}); err != nil {
+		t.Fatal(err)
+	}
+	// id 5000 in bunch of 2000
+	if err := cache.putRawBunch(2000, []byte{1, 0x90, 0x4e, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if repaired, err := cache.RepairValue(64); err != nil || repaired {
+		t.Fatal("valid value repaired", repaired, err)
+	}
+	if _, err := cache.RepairValue(1000); err == nil {
+		t.Fatal("expected error for truncated value")
+	}
+
+	summary, err := cache.RepairAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Values != 4 || summary.Repaired != 1 || len(summary.Errors) != 2 {
+		t.Fatal(summary)
+	}
+	if summary.Errors[0].BunchID != cache.getBunchID(1000) || summary.Errors[1].BunchID != cache.getBunchID(2000) {
+		t.Error(summary.Errors)
+	}
+	if refs := cache.Get(3); !equalRefs(refs, []int64{10, 20}) {
+		t.Error(refs)
+	}
+	if refs := cache.Get(5); !equalRefs(refs, []int64{100, 300}) {
+		t.Error(refs)
+	}
+	if refs := cache.Get(64); !equalRefs(refs, []int64{100}) {
+		t.Error(refs)
+	}
+
+	validation, err := cache.ValidateAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validation.BadValues != 2 {
+		t.Error(validation)
+	}
+	if repaired, err := cache.RepairValue(5); err != nil || repaired {
+		t.Error("repaired value repaired again", repaired, err)
+	}
+}
+
+func TestRefIndexBarrier(t *testing.T) {
+	for _, unbuffered := range []bool{false, true} {
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		defer os.RemoveAll(cacheDir)
+
+		opts := globalCacheOptions.CoordsIndex
+		opts.testOptions.UnbufferedAdd = unbuffered
+		cache, err := newCoordsRefIndex(cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.indexOptions = &opts
+		cache.SetLinearImport(true)
+
+		for w := 0; w < 10; w++ {
+			way := osm.Way{Element: osm.Element{ID: int64(w)}}
+			way.Nodes = []osm.Node{
+				{Element: osm.Element{ID: 1000}},
+				{Element: osm.Element{ID: 1001 + int64(w)*64}},
+			}
+			cache.AddFromWay(&way)
+		}
+		cache.Barrier()
+		if len(cache.buffer) != 10 {
+			t.Error(unbuffered, len(cache.buffer))
+		}
+		if refs := cache.buffer.getCreate(cache.getBunchID(1000), 1000); len(refs.Refs) != 10 {
+			t.Error(unbuffered, refs)
+		}
+		cache.Close()
+	}
+}
+
+func TestRefIndexAddLinearAfterLinearImport(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.testOptions.UnbufferedAdd = true
+	cache, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	// a producer that is still sending when the linear import ends
+	cache.SetLinearImport(true)
+	errc := make(chan error)
+	go func() {
+		for n := 0; ; n++ {
+			if err := cache.addLinear(int64(n), 1); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cache.SetLinearImport(false)
+	if err := <-errc; err != ErrClosed {
+		t.Fatal(err)
+	}
+	if refs := cache.Get(0); !equalRefs(refs, []int64{1}) {
+		t.Fatal(refs)
+	}
+}
+
+func TestRefIndexOrderedWrites(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.testOptions.OrderedWrites = true
+	opts.testOptions.UnbufferedAdd = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	changes := index.ChangeStream(16)
+
+	index.SetLinearImport(true)
+	for _, id := range []int64{1000, 2, 500, 1} {
+		index.addc <- idRef{id: id, ref: 100}
+	}
+	index.addc <- idRef{id: 1, ref: 101}
+	index.addc <- idRef{id: 2, ref: 200}
+	index.SetLinearImport(false)
+
+	// changes are sent in the order of the bunches
+	var ids []int64
+	for i := 0; i < 4; i++ {
+		ids = append(ids, (<-changes).ID)
+	}
+	if !equalRefs(ids, []int64{1, 2, 500, 1000}) {
+		t.Error(ids)
+	}
+
+	value, err := index.db.Get(index.ro, idToKeyBuf(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ids 1, 2 with refs 100, 101 and 100, 200
+	golden := []byte{2, 2, 2, 2, 2, 0xc8, 1, 2, 1, 0xc8, 1}
+	if !bytes.Equal(value, golden) {
+		t.Errorf("%#v", value)
+	}
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+// touchedIndexDir is the LevelDB with the touch timestamps, inside the
+// directory of the ref index.
+const touchedIndexDir = "touched"
+
+// timeNow returns the time for new touch timestamps, replaced in tests.
+var timeNow = time.Now
+
+// touchDay returns the day of t as the number of days since 1970, as it is
+// stored in the touched index (as uvarint).
+func touchDay(t time.Time) uint64 {
+	return uint64(t.Unix() / (24 * 60 * 60))
+}
+
+func touchValue() []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, touchDay(timeNow()))
+	return buf[:n]
+}
+
+// touch updates the timestamp of id, if TTLDays is enabled, and its
+// generation, if TrackGenerations is enabled.
+func (index *bunchRefCache) touch(id int64) error {
+	if err := index.tagGeneration(id); err != nil {
+		return err
+	}
+	if index.touched == nil {
+		return nil
+	}
+	key := getKeyBuf(id)
+	defer releaseKeyBuf(key)
+	return index.touched.db.Put(index.writeOptions(), key[:], touchValue())
+}
+
+// touchBatch returns a batch that updates the timestamps of all ids in
+// idRefs.
+func (index *bunchRefCache) touchBatch(idRefs idRefBunches) *levigo.WriteBatch {
+	batch := levigo.NewWriteBatch()
+	value := touchValue()
+	key := getKeyBuf(0)
+	defer releaseKeyBuf(key)
+	for _, bunch := range idRefs {
+		for _, idRef := range bunch.idRefs {
+			// batch copies the key
+			binary.BigEndian.PutUint64(key[:], uint64(idRef.ID))
+			batch.Put(key[:], value)
+		}
+	}
+	return batch
+}
+
+// Sweep removes the refs of all ids that were not changed for more than
+// TTLDays days. It returns the number of removed ids. This is a safety net
+// for refs of elements that are deleted upstream, but where the deletion
+// was missed. Ids without timestamp (e.g. ids that were added before
+// TTLDays was enabled) are never removed. Sweep returns an error if
+// TTLDays is not enabled and it is not supported in linear import mode.
+func (index *bunchRefCache) Sweep() (int, error) {
+	if index.touched == nil {
+		return 0, errors.New("touch timestamps not enabled")
+	}
+	if index.linearImport {
+		panic("programming error: sweep not supported in linearImport mode")
+	}
+	minDay := touchDay(timeNow()) - uint64(index.indexOptions.TTLDays)
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := index.touched.db.NewIterator(ro)
+	defer it.Close()
+
+	// the iterator does not see the deletes of the loop
+	removed := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		id := idFromKeyBuf(it.Key())
+		day, n := binary.Uvarint(it.Value())
+		if n <= 0 {
+			return removed, errors.Errorf("invalid touch timestamp for %d", id)
+		}
+		if day >= minDay {
+			continue
+		}
+		if err := index.Delete(id); err != nil {
+			return removed, err
+		}
+		if err := index.touched.db.Delete(index.writeOptions(), idToKeyBuf(id)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, it.GetError()
+}
+
+// Sweep calls Sweep of all indices with enabled TTLDays and returns the
+// total number of removed ids.
+func (c *DiffCache) Sweep() (int, error) {
+	removed := 0
+	for _, index := range []*bunchRefCache{
+		c.Coords.bunchRefCache, c.Coords.wayNodes, c.Coords.wayNodeRange, c.CoordsRel.bunchRefCache,
+		c.Ways.bunchRefCache,
+	} {
+		if index == nil || index.touched == nil {
+			continue
+		}
+		n, err := index.Sweep()
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	if c.Relations != nil && c.Relations.touched != nil {
+		n, err := c.Relations.Sweep()
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
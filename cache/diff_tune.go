@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/omniscale/imposm3/log"
+)
+
+// tuneSamples is the number of flushes that are measured for each
+// candidate value.
+const tuneSamples = 3
+
+// refIndexTuner searches for the flush size and the number of write workers
+// with the best write throughput during linear import. It first tries
+// different worker counts with the default flush size and then different
+// flush sizes with the best worker count. The tuner is only used by the
+// writer goroutine.
+type refIndexTuner struct {
+	name       string
+	phase      int // 0: workers, 1: flush size, 2: done
+	candidates []int
+	current    int
+	samples    int
+	refs       int64
+	dur        time.Duration
+	best       int
+	bestRate   float64
+}
+
+func newRefIndexTuner(name string) *refIndexTuner {
+	cpus := runtime.NumCPU()
+	workers := []int{cpus, cpus * 2}
+	if cpus > 1 {
+		workers = append([]int{cpus / 2}, workers...)
+	}
+	return &refIndexTuner{name: name, candidates: workers}
+}
+
+// start applies the first candidate.
+func (t *refIndexTuner) start(index *bunchRefCache) {
+	t.apply(index, t.candidates[0])
+}
+
+func (t *refIndexTuner) apply(index *bunchRefCache, value int) {
+	if t.phase == 0 {
+		atomic.StoreInt32(&index.workers, int32(value))
+	} else {
+		atomic.StoreInt32(&index.flushSize, int32(value))
+	}
+}
+
+// record adds the measurement of a single flush and switches to the next
+// candidate after enough samples.
+func (t *refIndexTuner) record(index *bunchRefCache, refs int, dur time.Duration) {
+	if t.phase > 1 {
+		return
+	}
+	t.refs += int64(refs)
+	t.dur += dur
+	t.samples++
+	if t.samples < tuneSamples {
+		return
+	}
+
+	rate := float64(t.refs) / t.dur.Seconds()
+	if t.current == 0 || rate > t.bestRate {
+		t.best = t.candidates[t.current]
+		t.bestRate = rate
+	}
+	t.refs, t.dur, t.samples = 0, 0, 0
+	t.current++
+	if t.current < len(t.candidates) {
+		t.apply(index, t.candidates[t.current])
+		return
+	}
+
+	// use best value of this phase and continue with next phase
+	t.apply(index, t.best)
+	t.phase++
+	t.current = 0
+	if t.phase == 1 {
+		t.candidates = []int{bufferSize / 4, bufferSize / 2, bufferSize, bufferSize * 2}
+		t.apply(index, t.candidates[0])
+		return
+	}
+	log.Printf("[info] auto-tuned %s: %d write workers, flush after %d bunches (%.0f refs/s)",
+		t.name,
+		atomic.LoadInt32(&index.workers),
+		atomic.LoadInt32(&index.flushSize),
+		t.bestRate,
+	)
+}
@@ -0,0 +1,418 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/element"
+)
+
+// TxIndex selects the index of a DiffCache for a DiffTx operation.
+type TxIndex uint8
+
+const (
+	TxCoords TxIndex = iota
+	TxCoordsRel
+	TxWays
+	// TxWayNodes requires the WayNodesIndex option.
+	TxWayNodes
+	// TxRelations requires the RelationsIndex option.
+	TxRelations
+	// TxWayNodeRange requires the WayNodeRangeIndex option.
+	TxWayNodeRange
+
+	// numTxIndices is the number of TxIndex values. Add new indices above.
+	numTxIndices
+)
+
+const txJournalFile = "imposm_tx_journal"
+
+type txOpType uint8
+
+const (
+	txAdd txOpType = iota
+	txDeleteRef
+	txDelete
+)
+
+type txOp struct {
+	index TxIndex
+	op    txOpType
+	id    int64
+	ref   int64
+}
+
+// DiffTx collects writes for multiple indices of a DiffCache and applies
+// them together with Commit.
+//
+// Each index is a separate LevelDB, so the writes cannot be applied in a
+// single LevelDB write batch. Commit first stores all writes in a journal
+// file in the cache directory. The writes are then applied with a single
+// synced write batch for each index and the journal is removed afterwards.
+// If the process crashes during Commit, the journal is applied again when
+// the DiffCache is opened the next time. All writes of a committed
+// transaction are applied to all indices (eventually), or none are if the
+// crash happened before the journal was written. Readers in the same process
+// can see the changes of one index before the changes of the other indices.
+type DiffTx struct {
+	c   *DiffCache
+	ops []txOp
+}
+
+// Begin starts a new transaction. Transactions are not supported in linear
+// import mode.
+func (c *DiffCache) Begin() *DiffTx {
+	return &DiffTx{c: c}
+}
+
+// Add adds ref to the refs of id in the given index.
+func (tx *DiffTx) Add(index TxIndex, id, ref int64) {
+	tx.ops = append(tx.ops, txOp{index, txAdd, id, ref})
+}
+
+// DeleteRef removes ref from the refs of id in the given index.
+func (tx *DiffTx) DeleteRef(index TxIndex, id, ref int64) {
+	tx.ops = append(tx.ops, txOp{index, txDeleteRef, id, ref})
+}
+
+// Delete removes all refs of id in the given index.
+func (tx *DiffTx) Delete(index TxIndex, id int64) {
+	tx.ops = append(tx.ops, txOp{index, txDelete, id, 0})
+}
+
+// AddFromWay adds the refs of CoordsRefIndex.AddFromWay: way as a ref of all
+// nodes and the nodes as refs of the way, if the WayNodesIndex option is
+// enabled.
+func (tx *DiffTx) AddFromWay(way *osm.Way) {
+	if len(way.Nodes) == 0 || len(way.Nodes) < tx.c.Coords.indexOptions.MinWayNodes {
+		return
+	}
+	for _, node := range way.Nodes {
+		tx.Add(TxCoords, node.ID, way.ID)
+	}
+	if tx.c.Coords.wayNodes != nil {
+		for _, node := range way.Nodes {
+			tx.Add(TxWayNodes, way.ID, node.ID)
+		}
+	}
+	if tx.c.Coords.wayNodeRange != nil {
+		min, max := wayNodeIDRange(way)
+		tx.Delete(TxWayNodeRange, way.ID)
+		tx.Add(TxWayNodeRange, way.ID, min)
+		tx.Add(TxWayNodeRange, way.ID, max)
+	}
+}
+
+// AddFromMembers adds the refs of AddFromMembers of the CoordsRel, Ways and
+// Relations indices: relID as a ref of all node and way members, and of
+// all relation members if the RelationsIndex option is enabled.
+func (tx *DiffTx) AddFromMembers(relID int64, members []osm.Member) {
+	for _, member := range members {
+		switch member.Type {
+		case osm.NodeMember:
+			tx.Add(TxCoordsRel, member.ID, relID)
+		case osm.WayMember:
+			tx.Add(TxWays, member.ID, relID)
+		case osm.RelationMember:
+			if tx.c.Relations != nil {
+				tx.Add(TxRelations, member.ID, relID)
+			}
+		}
+	}
+}
+
+// Commit applies all writes of the transaction, see DiffTx for the
+// consistency guarantees. The transaction is empty after Commit and it
+// can be reused.
+func (tx *DiffTx) Commit() error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	for _, op := range tx.ops {
+		if tx.c.txIndex(op.index) == nil {
+			return errors.Errorf("transaction for disabled index %d", op.index)
+		}
+	}
+	if tx.c.inMemory() {
+		// nothing to recover after a crash, no journal
+		if err := tx.c.applyTx(tx.ops); err != nil {
+			return err
+		}
+		tx.ops = tx.ops[:0]
+		return nil
+	}
+	if err := writeTxJournal(tx.c.Dir, tx.ops); err != nil {
+		return errors.Wrap(err, "writing transaction journal")
+	}
+	if err := tx.c.applyTx(tx.ops); err != nil {
+		// keep journal, it is applied again on the next Open
+		return err
+	}
+	tx.ops = tx.ops[:0]
+	return removeTxJournal(tx.c.Dir)
+}
+
+// Rollback discards all writes of the transaction.
+func (tx *DiffTx) Rollback() {
+	tx.ops = tx.ops[:0]
+}
+
+func (c *DiffCache) txIndex(index TxIndex) *bunchRefCache {
+	switch index {
+	case TxCoords:
+		return c.Coords.bunchRefCache
+	case TxCoordsRel:
+		return c.CoordsRel.bunchRefCache
+	case TxWays:
+		return c.Ways.bunchRefCache
+	case TxWayNodes:
+		return c.Coords.wayNodes
+	case TxRelations:
+		if c.Relations != nil {
+			return c.Relations.bunchRefCache
+		}
+	case TxWayNodeRange:
+		return c.Coords.wayNodeRange
+	}
+	return nil
+}
+
+// inMemory returns whether all indices of the cache are InMemory indices.
+func (c *DiffCache) inMemory() bool {
+	for _, idx := range c.indices() {
+		if !idx.index.options.InMemory {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *DiffCache) applyTx(ops []txOp) error {
+	for _, index := range []TxIndex{TxCoords, TxCoordsRel, TxWays, TxWayNodes, TxRelations, TxWayNodeRange} {
+		var indexOps []txOp
+		for _, op := range ops {
+			if op.index == index {
+				indexOps = append(indexOps, op)
+			}
+		}
+		if len(indexOps) == 0 {
+			continue
+		}
+		refIndex := c.txIndex(index)
+		if refIndex == nil {
+			return errors.Errorf("transaction for disabled index %d", index)
+		}
+		if err := refIndex.applyTxOps(indexOps); err != nil {
+			return errors.Wrap(err, "applying transaction")
+		}
+	}
+	return nil
+}
+
+// replayTx applies the journal of an interrupted Commit. All operations
+// are idempotent and can be applied multiple times.
+func (c *DiffCache) replayTx() error {
+	if c.inMemory() {
+		return nil
+	}
+	ops, err := readTxJournal(c.Dir)
+	if err != nil {
+		return errors.Wrap(err, "reading transaction journal")
+	}
+	if ops == nil {
+		return nil
+	}
+	if err := c.applyTx(ops); err != nil {
+		return err
+	}
+	return removeTxJournal(c.Dir)
+}
+
+func (index *bunchRefCache) applyTxOps(ops []txOp) error {
+	if index.linearImport {
+		panic("programming error: transactions not supported in linearImport mode")
+	}
+	bunches := make(map[int64]*idRefBunch)
+	// refs before the ops of each id for Subscribe, in the order of the ops
+	var oldIDs []int64
+	var oldRefs map[int64][]int64
+	subscribed := index.hasSubscribers()
+	if subscribed {
+		oldRefs = make(map[int64][]int64)
+	}
+	for _, op := range ops {
+		bunchID := index.getBunchID(op.id)
+		bunch, ok := bunches[bunchID]
+		if !ok {
+			data, err := index.getValue(index.ro, idToKeyBuf(bunchID))
+			if err != nil {
+				return err
+			}
+			bunch = &idRefBunch{id: bunchID}
+			if data != nil {
+				bunch.idRefs = index.codec.Unmarshal(data, nil)
+			}
+			bunches[bunchID] = bunch
+		}
+
+		var idRef *element.IDRefs
+		if op.op == txAdd {
+			idRef = bunch.getCreate(op.id)
+		} else {
+			idRef = bunch.get(op.id)
+		}
+		if idRef == nil {
+			continue
+		}
+		if _, ok := oldRefs[op.id]; subscribed && !ok {
+			oldIDs = append(oldIDs, op.id)
+			oldRefs[op.id] = append([]int64{}, idRef.Refs...)
+		}
+		numRefs := len(idRef.Refs)
+		switch op.op {
+		case txAdd:
+			idRef.Add(op.ref)
+		case txDeleteRef:
+			idRef.Delete(op.ref)
+		case txDelete:
+			idRef.Refs = []int64{}
+		}
+		if op.op != txAdd {
+			index.markDeletes()
+		}
+		if index.sketch != nil {
+			index.sketch.add(op.id, len(idRef.Refs)-numRefs)
+		}
+	}
+
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+	for bunchID, bunch := range bunches {
+		index.markChanged(idToKeyBuf(bunchID))
+		// see putBunch
+		idRefs, err := index.capOverflow(bunch.idRefs)
+		if err != nil {
+			return err
+		}
+		idRefs = withoutEmptyRefs(idRefs)
+		if len(idRefs) == 0 {
+			batch.Delete(idToKeyBuf(bunchID))
+			continue
+		}
+		value, err := index.spillValue(index.codec.Marshal(idRefs, nil))
+		if err != nil {
+			return err
+		}
+		batch.Put(idToKeyBuf(bunchID), value)
+	}
+	if err := index.db.Write(index.syncWo, batch); err != nil {
+		return err
+	}
+	for _, id := range oldIDs {
+		var newRefs []int64
+		if idRef := bunches[index.getBunchID(id)].get(id); idRef != nil {
+			newRefs = idRef.Refs
+		}
+		index.notify(id, oldRefs[id], newRefs)
+	}
+	for _, op := range ops {
+		if err := index.touch(op.id); err != nil {
+			return err
+		}
+	}
+	if index.changeStreamEnabled() {
+		var changes []RefChange
+		seen := make(map[int64]struct{})
+		for _, op := range ops {
+			if _, ok := seen[op.id]; ok {
+				continue
+			}
+			seen[op.id] = struct{}{}
+			if idRef := bunches[index.getBunchID(op.id)].get(op.id); idRef != nil {
+				changes = append(changes, RefChange{Op: ChangeSet, ID: op.id, Refs: idRef.Refs})
+			}
+		}
+		index.emitChanges(changes)
+	}
+	return nil
+}
+
+// writeTxJournal stores ops in the journal file of dir. The journal is
+// written to a temporary file that is synced and renamed, so that only
+// complete journals are applied.
+func writeTxJournal(dir string, ops []txOp) error {
+	tmp := filepath.Join(dir, txJournalFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	buf := make([]byte, 2+2*binary.MaxVarintLen64)
+	for _, op := range ops {
+		buf[0] = byte(op.index)
+		buf[1] = byte(op.op)
+		n := 2
+		n += binary.PutVarint(buf[n:], op.id)
+		n += binary.PutVarint(buf[n:], op.ref)
+		w.Write(buf[:n])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, txJournalFile))
+}
+
+// readTxJournal reads the journal file of dir. It returns nil without an
+// error if there is no journal.
+func readTxJournal(dir string) ([]txOp, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, txJournalFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ops := []txOp{}
+	for len(data) > 0 {
+		if len(data) < 2 || TxIndex(data[0]) >= numTxIndices || txOpType(data[1]) > txDelete {
+			return nil, io.ErrUnexpectedEOF
+		}
+		op := txOp{index: TxIndex(data[0]), op: txOpType(data[1])}
+		data = data[2:]
+		var n int
+		if op.id, n = binary.Varint(data); n <= 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+		if op.ref, n = binary.Varint(data); n <= 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func removeTxJournal(dir string) error {
+	err := os.Remove(filepath.Join(dir, txJournalFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
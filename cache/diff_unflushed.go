@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"bufio"
+	bin "encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/log"
+	"github.com/pkg/errors"
+)
+
+// dbWrite writes batch to db. Tests replace it to simulate failing writes.
+var dbWrite = func(db *levigo.DB, wo *levigo.WriteOptions, batch *levigo.WriteBatch) error {
+	return db.Write(wo, batch)
+}
+
+const unflushedFilePattern = "imposm_unflushed_*.refs"
+
+// saveUnflushed stores the refs of a buffer that could not be written, in
+// a new file next to the index. The file contains one record for each
+// bunch: the 8 byte key, uvarint value length and the value with only the
+// new refs. The records are merged into the index by replayUnflushed. The
+// file is written to a temporary file and renamed, so that only complete
+// files are replayed.
+func (index *bunchRefCache) saveUnflushed(idRefs idRefBunches) (string, error) {
+	if index.options.InMemory {
+		// the refs would be lost with the in-memory LevelDB anyway
+		return "", errors.New("unflushed refs of in-memory index can not be saved")
+	}
+	existing, err := filepath.Glob(filepath.Join(index.path, unflushedFilePattern))
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(index.path, fmt.Sprintf("imposm_unflushed_%06d.refs", len(existing)+1))
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	bw := bufio.NewWriter(f)
+	buf := make([]byte, bin.MaxVarintLen64)
+	var value []byte
+	for bunchID, bunch := range idRefs {
+		value = index.codec.Marshal(bunch.idRefs, value)
+		bw.Write(idToKeyBuf(bunchID))
+		n := bin.PutUvarint(buf, uint64(len(value)))
+		bw.Write(buf[:n])
+		bw.Write(value)
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// replayUnflushed merges the refs of all files from saveUnflushed into the
+// index and removes the files. Refs are merged without duplicates, so
+// replaying a file again after a crash is safe.
+func (index *bunchRefCache) replayUnflushed() error {
+	if index.options.InMemory {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(index.path, unflushedFilePattern))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	// file names are numbered with leading zeros
+	sort.Strings(files)
+	for _, file := range files {
+		n, err := index.replayUnflushedFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "replaying %s", file)
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		log.Printf("[info] added refs of %d bunches from %s", n, file)
+	}
+	return nil
+}
+
+func (index *bunchRefCache) replayUnflushedFile(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	key := make([]byte, 8)
+	n := 0
+	for {
+		if _, err := io.ReadFull(br, key); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		length, err := bin.ReadUvarint(br)
+		if err != nil {
+			return n, err
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(br, value); err != nil {
+			return n, err
+		}
+		newBunch := index.codec.Unmarshal(value, nil)
+		if index.sketch != nil {
+			for _, idRef := range newBunch {
+				index.sketch.add(idRef.ID, len(idRef.Refs))
+			}
+		}
+		data, err := index.safeLoadMergeMarshal(key, newBunch)
+		if err != nil {
+			return n, err
+		}
+		err = index.putValue(key, data)
+		bytePool.release(data)
+		if err != nil {
+			return n, err
+		}
+		for _, idRef := range newBunch {
+			if err := index.touch(idRef.ID); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+}
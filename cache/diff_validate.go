@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmhodges/levigo"
+	"github.com/omniscale/imposm3/log"
+	"github.com/pkg/errors"
+)
+
+// maxValidationErrors is the number of bad values that are reported in
+// detail by ValidateAll.
+const maxValidationErrors = 10
+
+// ValidationError is a bad value found by ValidateAll.
+type ValidationError struct {
+	BunchID int64
+	Err     error
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("bunch %d: %s", e.BunchID, e.Err)
+}
+
+// ValidationSummary is the result of ValidateAll.
+type ValidationSummary struct {
+	Values    int
+	BadValues int
+	// Errors are the first bad values, in the order of the index.
+	Errors []ValidationError
+}
+
+// OK returns true if no bad values were found.
+func (s ValidationSummary) OK() bool {
+	return s.BadValues == 0
+}
+
+// validateProgressInterval is the interval of the progress log of
+// ValidateAll.
+var validateProgressInterval = time.Minute
+
+type validateItem struct {
+	seq   int // position in the index, to report errors in index order
+	key   []byte
+	value []byte
+}
+
+type validateResult struct {
+	seq int
+	err ValidationError
+}
+
+// ValidateAll checks that all values of the index decode cleanly with
+// increasing IDs and refs, and that all IDs belong to the bunch of the key.
+// With MaxValueRefs, the overflow refs are checked too.
+// It iterates over a snapshot of the whole index. The iterator is the only
+// serial part, values are decoded and checked by the write workers of the
+// index (NumCPU by default), like the merges of writeRefs. The progress is
+// logged periodically. The returned error is only for errors of LevelDB,
+// bad values are reported in the summary.
+func (index *bunchRefCache) ValidateAll() (ValidationSummary, error) {
+	summary := ValidationSummary{}
+
+	snap := index.db.NewSnapshot()
+	defer index.db.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+
+	wg := sync.WaitGroup{}
+	itemc := make(chan validateItem, 256)
+	resultc := make(chan validateResult)
+	var validated int64
+	workers := int(atomic.LoadInt32(&index.workers))
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			for item := range itemc {
+				if err := index.validateValue(item.key, item.value); err != nil {
+					var bunchID int64
+					if len(item.key) == 8 {
+						bunchID = idFromKeyBuf(item.key)
+					}
+					resultc <- validateResult{item.seq, ValidationError{bunchID, err}}
+				}
+				atomic.AddInt64(&validated, 1)
+			}
+			wg.Done()
+		}()
+	}
+
+	// collect the first errors of the index order, results of the workers
+	// arrive in any order
+	var results []validateResult
+	collected := make(chan struct{})
+	go func() {
+		for r := range resultc {
+			summary.BadValues++
+			results = append(results, r)
+			sort.Slice(results, func(i, j int) bool { return results[i].seq < results[j].seq })
+			if len(results) > maxValidationErrors {
+				results = results[:maxValidationErrors]
+			}
+		}
+		close(collected)
+	}()
+
+	ticker := time.NewTicker(validateProgressInterval)
+	defer ticker.Stop()
+
+	it := index.db.NewIterator(ro)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		select {
+		case <-ticker.C:
+			log.Printf("[progress] validated %d values of %s", atomic.LoadInt64(&validated), index.path)
+		default:
+		}
+		itemc <- validateItem{summary.Values, it.Key(), it.Value()}
+		summary.Values++
+	}
+	close(itemc)
+	wg.Wait()
+	close(resultc)
+	<-collected
+
+	for _, r := range results {
+		summary.Errors = append(summary.Errors, r.err)
+	}
+	if err := it.GetError(); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+func (index *bunchRefCache) validateValue(key, value []byte) error {
+	if len(key) != 8 {
+		return errors.Errorf("unexpected key length %d", len(key))
+	}
+	bunchID := idFromKeyBuf(key)
+	data, err := index.resolveValue(value)
+	if err != nil {
+		return err
+	}
+	ids, err := index.codec.Validate(data)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if index.getBunchID(id) != bunchID {
+			return errors.Errorf("id %d does not belong to bunch", id)
+		}
+	}
+	if index.overflow != nil {
+		return index.validateOverflow(data)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"sync/atomic"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/element"
+)
+
+// AddFromWays adds the refs of all ways like AddFromWay. In the linear
+// import, the node refs of all ways are merged in a temporary map and
+// they are passed to the buffer with a single, sorted insert for each node,
+// instead of one insert for each node of each way. This saves inserts for
+// nodes that are shared by many ways of the batch, but the temporary map
+// adds allocations; see BenchmarkAddFromWays. Outside of the linear import,
+// the ways are added one by one. It returns ErrClosed after Close.
+func (index *CoordsRefIndex) AddFromWays(ways []*osm.Way) error {
+	if !index.linearImport {
+		for _, way := range ways {
+			if err := index.addFromWay(way); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	nodeWays := make(map[int64][]int64)
+	var wayNodes, wayNodeRanges []element.IDRefs
+	for _, way := range ways {
+		if len(way.Nodes) == 0 {
+			atomic.AddInt64(&index.emptyWays, 1)
+			if index.onEmptyWay != nil {
+				index.onEmptyWay(way)
+			}
+			continue
+		}
+		if len(way.Nodes) < index.indexOptions.MinWayNodes {
+			atomic.AddInt64(&index.skippedWays, 1)
+			continue
+		}
+		for _, node := range way.Nodes {
+			nodeWays[node.ID] = append(nodeWays[node.ID], way.ID)
+		}
+		if index.wayNodes != nil {
+			nodes := make([]int64, len(way.Nodes))
+			for i, node := range way.Nodes {
+				nodes[i] = node.ID
+			}
+			wayNodes = append(wayNodes, element.IDRefs{ID: way.ID, Refs: sortDedupRefs(nodes)})
+		}
+		if index.wayNodeRange != nil {
+			min, max := wayNodeIDRange(way)
+			refs := []int64{min, max}
+			if min == max {
+				refs = refs[:1]
+			}
+			wayNodeRanges = append(wayNodeRanges, element.IDRefs{ID: way.ID, Refs: refs})
+		}
+	}
+
+	nodeRefs := make([]element.IDRefs, 0, len(nodeWays))
+	for id, refs := range nodeWays {
+		nodeRefs = append(nodeRefs, element.IDRefs{ID: id, Refs: sortDedupRefs(refs)})
+	}
+
+	if err := index.addBatchLinear(nodeRefs); err != nil {
+		return err
+	}
+	if index.wayNodes != nil {
+		if err := index.wayNodes.addBatchLinear(wayNodes); err != nil {
+			return err
+		}
+	}
+	if index.wayNodeRange != nil {
+		if err := index.wayNodeRange.addBatchLinear(wayNodeRanges); err != nil {
+			return err
+		}
+	}
+
+	if n := int64(index.indexOptions.FlushEveryWays); n > 0 {
+		added := atomic.AddInt64(&index.addedWays, int64(len(ways)))
+		if added/n != (added-int64(len(ways)))/n {
+			index.flushBarrier()
+			if index.wayNodes != nil {
+				index.wayNodes.flushBarrier()
+			}
+			if index.wayNodeRange != nil {
+				index.wayNodeRange.flushBarrier()
+			}
+		}
+	}
+	return nil
+}
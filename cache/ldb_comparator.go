@@ -0,0 +1,49 @@
+package cache
+
+// #cgo LDFLAGS: -lleveldb
+// #include "leveldb/c.h"
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+var (
+	comparatorsMu sync.Mutex
+	comparators   = map[string]unsafe.Pointer{}
+)
+
+// RegisterComparator makes a custom LevelDB comparator available for the
+// Comparator cache option. LevelDB calls comparators for each key
+// comparison, so they need to be implemented in C: cmp must be a
+// leveldb_comparator_t* created with leveldb_comparator_create. name must
+// be the name that the comparator returns, as LevelDB refuses to open a
+// database with a comparator of another name. Registered comparators are
+// never destroyed.
+func RegisterComparator(name string, cmp unsafe.Pointer) {
+	comparatorsMu.Lock()
+	defer comparatorsMu.Unlock()
+	comparators[name] = cmp
+}
+
+// setComparator sets the registered comparator name for opts. An empty
+// name keeps the default bytewise comparator.
+func setComparator(opts *levigo.Options, name string) error {
+	if name == "" {
+		return nil
+	}
+	comparatorsMu.Lock()
+	cmp, ok := comparators[name]
+	comparatorsMu.Unlock()
+	if !ok {
+		return errors.Errorf("unknown comparator %q", name)
+	}
+	C.leveldb_options_set_comparator(
+		(*C.leveldb_options_t)(unsafe.Pointer(opts.Opt)),
+		(*C.leveldb_comparator_t)(cmp))
+	return nil
+}
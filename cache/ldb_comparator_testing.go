@@ -0,0 +1,44 @@
+// +build testing
+
+package cache
+
+// #cgo LDFLAGS: -lleveldb
+// #include <string.h>
+// #include "leveldb/c.h"
+//
+// static int reverse_compare(void* state, const char* a, size_t alen, const char* b, size_t blen) {
+//     size_t n = alen < blen ? alen : blen;
+//     int r = memcmp(a, b, n);
+//     if (r == 0) {
+//         r = alen < blen ? -1 : (alen > blen ? 1 : 0);
+//     }
+//     return -r;
+// }
+//
+// static const char* reverse_name(void* state) {
+//     return "imposm.ReverseBytewise";
+// }
+//
+// static void reverse_destroy(void* state) {}
+//
+// static leveldb_comparator_t* reverse_comparator() {
+//     return leveldb_comparator_create(NULL, reverse_destroy, reverse_compare, reverse_name);
+// }
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+const reverseComparator = "imposm.ReverseBytewise"
+
+var registerReverseOnce sync.Once
+
+// registerReverseComparator registers a comparator that orders keys in
+// reverse bytewise order. It is only available with the testing build tag.
+func registerReverseComparator() {
+	registerReverseOnce.Do(func() {
+		RegisterComparator(reverseComparator, unsafe.Pointer(C.reverse_comparator()))
+	})
+}
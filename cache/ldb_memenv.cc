@@ -0,0 +1,24 @@
+// +build ldbmemenv
+
+#include "leveldb/c.h"
+#include "leveldb/env.h"
+
+// memenv.h of LevelDB is not installed with the public headers
+namespace leveldb {
+Env* NewMemEnv(Env* base_env);
+}
+
+// leveldb_env_t as defined in leveldb/db/c.cc. The C API of LevelDB has no
+// function to create other envs than the default env.
+struct leveldb_env_t {
+  leveldb::Env* rep;
+  bool is_default;
+};
+
+extern "C" leveldb_env_t* imposm_create_mem_env(void) {
+  leveldb_env_t* env = new leveldb_env_t;
+  env->rep = leveldb::NewMemEnv(leveldb::Env::Default());
+  // leveldb_env_destroy deletes rep of envs that are not the default env
+  env->is_default = false;
+  return env;
+}
@@ -0,0 +1,24 @@
+// +build ldbmemenv
+
+package cache
+
+// #cgo LDFLAGS: -lleveldb
+// #include "leveldb/c.h"
+// leveldb_env_t* imposm_create_mem_env(void);
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/jmhodges/levigo"
+)
+
+// newMemEnv returns a LevelDB env that keeps all files in memory. Close of
+// the env frees the files. NewMemEnv is part of libleveldb since LevelDB
+// 1.21, older versions need -lmemenv in CGO_LDFLAGS.
+func newMemEnv() (*levigo.Env, error) {
+	env := &levigo.Env{}
+	// levigo.Env.Env is a C type of the levigo package
+	*(*unsafe.Pointer)(unsafe.Pointer(&env.Env)) = unsafe.Pointer(C.imposm_create_mem_env())
+	return env, nil
+}
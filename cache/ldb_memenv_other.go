@@ -0,0 +1,14 @@
+// +build !ldbmemenv
+
+package cache
+
+import (
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+// newMemEnv returns an error, the in-memory env requires the ldbmemenv build
+// tag.
+func newMemEnv() (*levigo.Env, error) {
+	return nil, errors.New("in-memory LevelDB requires the ldbmemenv build tag")
+}
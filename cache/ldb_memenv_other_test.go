@@ -0,0 +1,27 @@
+// +build !ldbmemenv
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestInMemoryWithoutBuildTag(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	c := cache{options: &cacheOptions{InMemory: true}}
+	if err := c.open(cacheDir); err == nil {
+		c.Close()
+		t.Fatal("expected error without ldbmemenv build tag")
+	}
+}
+
+// TestRefIndexInMemory of ldb_memenv_test.go needs the ldbmemenv build tag
+// and a LevelDB with NewMemEnv. Report it as skipped instead of silently
+// leaving it out.
+func TestRefIndexInMemory(t *testing.T) {
+	t.Skip("in-memory LevelDB requires the ldbmemenv build tag (go test -tags ldbmemenv)")
+}
@@ -0,0 +1,56 @@
+// +build ldbmemenv
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRefIndexInMemory(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(tmpDir)
+	cacheDir := filepath.Join(tmpDir, "index")
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.InMemory = true
+	// options with files next to the LevelDB
+	opts.TTLDays = 1
+	opts.TrackGenerations = true
+	opts.MaxValueRefs = 3
+	opts.SpillThresholdK = 1
+	opts.DegreeSketch = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.SetLinearImport(true)
+	for n := 0; n < 64*100; n++ {
+		index.addc <- idRef{id: int64(n), ref: int64(n % 7)}
+	}
+	index.SetLinearImport(false)
+	index.Add(1, 100)
+	if refs := index.Get(1); !equalRefs(refs, []int64{1, 100}) {
+		t.Fatal(refs)
+	}
+
+	if _, err := index.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+	if files, _ := ioutil.ReadDir(tmpDir); len(files) != 0 {
+		t.Error("files on disk:", files[0].Name())
+	}
+
+	// contents are lost with Close
+	index, err = newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if refs := index.Get(1); len(refs) != 0 {
+		t.Fatal(refs)
+	}
+}
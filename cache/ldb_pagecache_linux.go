@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPageCache advises the kernel to drop the cached pages of all table
+// files of the LevelDB in dir. Dirty pages are only dropped after they are
+// written back.
+func dropPageCache(dir string) error {
+	for _, pattern := range []string{"*.ldb", "*.sst"} {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			f, err := os.Open(file)
+			if os.IsNotExist(err) {
+				// removed by a compaction
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"encoding/json"
+
+	"github.com/jmhodges/levigo"
+	"github.com/pkg/errors"
+)
+
+// OptionsPreset is a named set of LevelDB options for the Preset cache
+// option. A preset sets CacheSizeM, WriteBufferSizeM, BlockSizeK,
+// BloomFilterBits, Compression and SyncWrites; all other options keep
+// their values.
+type OptionsPreset string
+
+const (
+	// PresetBulkBuild is for the initial import: large write buffers for
+	// fewer compactions, a small block cache, 64KB blocks, no bloom
+	// filters, no compression (the values of the ref indices are already
+	// delta encoded) and no synced writes.
+	PresetBulkBuild OptionsPreset = "bulk-build"
+	// PresetReadServing is for caches that mainly serve reads during diff
+	// imports: a large block cache with the default 4KB blocks, 10-bit
+	// bloom filters to skip files for missing keys, small write buffers,
+	// snappy compression and synced writes.
+	PresetReadServing OptionsPreset = "read-serving"
+	// PresetBalanced is between both: 64MB block cache and write buffers,
+	// 16KB blocks, 10-bit bloom filters, snappy compression and no synced
+	// writes.
+	PresetBalanced OptionsPreset = "balanced"
+)
+
+type presetOptions struct {
+	CacheSizeM       int
+	WriteBufferSizeM int
+	BlockSizeK       int
+	BloomFilterBits  int
+	Compression      string
+	SyncWrites       bool
+}
+
+var optionsPresets = map[OptionsPreset]presetOptions{
+	PresetBulkBuild: {
+		CacheSizeM:       16,
+		WriteBufferSizeM: 256,
+		BlockSizeK:       64,
+		Compression:      "none",
+	},
+	PresetReadServing: {
+		CacheSizeM:       256,
+		WriteBufferSizeM: 16,
+		BlockSizeK:       4,
+		BloomFilterBits:  10,
+		Compression:      "snappy",
+		SyncWrites:       true,
+	},
+	PresetBalanced: {
+		CacheSizeM:       64,
+		WriteBufferSizeM: 64,
+		BlockSizeK:       16,
+		BloomFilterBits:  10,
+		Compression:      "snappy",
+	},
+}
+
+// applyPreset overwrites the options of preset p.
+func (o *cacheOptions) applyPreset(p OptionsPreset) error {
+	preset, ok := optionsPresets[p]
+	if !ok {
+		return errors.Errorf("unknown options preset %q", p)
+	}
+	o.Preset = p
+	o.CacheSizeM = preset.CacheSizeM
+	o.WriteBufferSizeM = preset.WriteBufferSizeM
+	o.BlockSizeK = preset.BlockSizeK
+	o.BloomFilterBits = preset.BloomFilterBits
+	o.Compression = preset.Compression
+	o.SyncWrites = preset.SyncWrites
+	return nil
+}
+
+// all returns the options of each cache and index.
+func (o *osmCacheOptions) all() []*cacheOptions {
+	return []*cacheOptions{
+		&o.Coords.cacheOptions,
+		&o.Ways,
+		&o.Nodes,
+		&o.Relations,
+		&o.CoordsIndex.cacheOptions,
+		&o.WaysIndex.cacheOptions,
+	}
+}
+
+// loadCacheOptions returns the default options with the cache config data
+// (can be nil). The options of a Preset in data are applied before all
+// other options of data, so that each option of the preset can be
+// overridden.
+func loadCacheOptions(data []byte) (osmCacheOptions, error) {
+	var opts osmCacheOptions
+	if err := json.Unmarshal([]byte(defaultConfig), &opts); err != nil {
+		return opts, err
+	}
+	if data == nil {
+		return opts, nil
+	}
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return opts, err
+	}
+	hasPreset := false
+	for _, o := range opts.all() {
+		if o.Preset == "" {
+			continue
+		}
+		if err := o.applyPreset(o.Preset); err != nil {
+			return opts, err
+		}
+		hasPreset = true
+	}
+	if hasPreset {
+		if err := json.Unmarshal(data, &opts); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// SetOptionsPreset applies preset p to all caches and indices that are
+// opened afterwards. It overwrites the options of the cache config file;
+// use the Preset option in the config file to override single options of
+// a preset.
+func SetOptionsPreset(p OptionsPreset) error {
+	if _, ok := optionsPresets[p]; !ok {
+		return errors.Errorf("unknown options preset %q", p)
+	}
+	for _, o := range globalCacheOptions.all() {
+		o.applyPreset(p)
+	}
+	return nil
+}
+
+// setCompression sets the block compression of opts: "snappy" (or empty
+// for the LevelDB default) or "none".
+func setCompression(opts *levigo.Options, compression string) error {
+	switch compression {
+	case "", "snappy":
+		opts.SetCompression(levigo.SnappyCompression)
+	case "none":
+		opts.SetCompression(levigo.NoCompression)
+	default:
+		return errors.Errorf("unknown compression %q", compression)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omniscale/imposm3/log"
+	"github.com/pkg/errors"
+)
+
+// LevelStats are the compaction statistics of one level of a LevelDB.
+type LevelStats struct {
+	Level   int
+	Files   int
+	SizeMB  float64
+	TimeSec float64 // time of all compactions into this level
+	ReadMB  float64 // read by compactions into this level
+	WriteMB float64 // written by compactions into this level
+}
+
+// CompactionStats are the compaction statistics of a LevelDB, as reported
+// by the "leveldb.stats" property. Times and bytes are accumulated since
+// the LevelDB was opened.
+type CompactionStats struct {
+	Time   time.Time
+	Levels []LevelStats // only levels with files or compactions
+}
+
+// ReadMB returns the bytes read by all compactions.
+func (s CompactionStats) ReadMB() float64 {
+	var mb float64
+	for _, l := range s.Levels {
+		mb += l.ReadMB
+	}
+	return mb
+}
+
+// WriteMB returns the bytes written by all compactions.
+func (s CompactionStats) WriteMB() float64 {
+	var mb float64
+	for _, l := range s.Levels {
+		mb += l.WriteMB
+	}
+	return mb
+}
+
+// Sub returns the compaction time and bytes of s since prev, e.g. to find
+// the compactions between two samples. Files and SizeMB are those of s.
+func (s CompactionStats) Sub(prev CompactionStats) CompactionStats {
+	result := CompactionStats{Time: s.Time}
+	for _, l := range s.Levels {
+		for _, p := range prev.Levels {
+			if p.Level == l.Level {
+				l.TimeSec -= p.TimeSec
+				l.ReadMB -= p.ReadMB
+				l.WriteMB -= p.WriteMB
+				break
+			}
+		}
+		result.Levels = append(result.Levels, l)
+	}
+	return result
+}
+
+// CompactionStats returns the current compaction statistics of the cache.
+func (c *cache) CompactionStats() (CompactionStats, error) {
+	stats := CompactionStats{Time: time.Now()}
+	levels, err := parseLevelDBStats(c.db.PropertyValue("leveldb.stats"))
+	if err != nil {
+		return stats, err
+	}
+	stats.Levels = levels
+	return stats, nil
+}
+
+// parseLevelDBStats parses the table of the "leveldb.stats" property:
+//
+//	                               Compactions
+//	Level  Files Size(MB) Time(sec) Read(MB) Write(MB)
+//	--------------------------------------------------
+//	  0        1        0         0        0         0
+func parseLevelDBStats(value string) ([]LevelStats, error) {
+	var levels []LevelStats
+	table := false
+	for _, line := range strings.Split(value, "\n") {
+		if strings.HasPrefix(line, "---") {
+			table = true
+			continue
+		}
+		fields := strings.Fields(line)
+		if !table || len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 6 {
+			return nil, errors.Errorf("unexpected leveldb.stats line %q", line)
+		}
+		var l LevelStats
+		var err error
+		if l.Level, err = strconv.Atoi(fields[0]); err != nil {
+			return nil, errors.Wrapf(err, "parsing leveldb.stats line %q", line)
+		}
+		if l.Files, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, errors.Wrapf(err, "parsing leveldb.stats line %q", line)
+		}
+		for i, v := range []*float64{&l.SizeMB, &l.TimeSec, &l.ReadMB, &l.WriteMB} {
+			if *v, err = strconv.ParseFloat(fields[i+2], 64); err != nil {
+				return nil, errors.Wrapf(err, "parsing leveldb.stats line %q", line)
+			}
+		}
+		levels = append(levels, l)
+	}
+	if !table {
+		return nil, errors.New("leveldb.stats not available")
+	}
+	return levels, nil
+}
+
+// OnCompactionStats calls fn with the compaction statistics of the cache,
+// every CompactionStatsIntervalSec seconds till the cache is closed. Each
+// call replaces fn of earlier calls, nil stops the sampling. fn is called
+// from a separate goroutine and should return quickly. Sampling is
+// disabled if CompactionStatsIntervalSec is 0.
+func (c *cache) OnCompactionStats(fn func(CompactionStats)) {
+	c.stopCompactionStats()
+	interval := time.Duration(c.options.CompactionStatsIntervalSec) * time.Second
+	if fn == nil || interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	c.statsStop, c.statsDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			stats, err := c.CompactionStats()
+			if err != nil {
+				log.Println("[warn] sampling compaction stats:", err)
+				continue
+			}
+			fn(stats)
+		}
+	}()
+}
+
+func (c *cache) stopCompactionStats() {
+	if c.statsStop == nil {
+		return
+	}
+	close(c.statsStop)
+	<-c.statsDone
+	c.statsStop, c.statsDone = nil, nil
+}
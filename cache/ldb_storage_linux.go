@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// isRotational returns whether path is stored on a rotational disk. known
+// is false if the storage type could not be detected.
+func isRotational(path string) (rotational, known bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return false, false
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+
+	// /sys/dev/block/M:m links to the device or to a partition of the device
+	sysPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return false, false
+	}
+	for _, p := range []string{sysPath, filepath.Dir(sysPath)} {
+		data, err := ioutil.ReadFile(filepath.Join(p, "queue", "rotational"))
+		if err == nil {
+			return strings.TrimSpace(string(data)) == "1", true
+		}
+	}
+	return false, false
+}
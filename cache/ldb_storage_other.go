@@ -0,0 +1,10 @@
+// +build !linux
+
+package cache
+
+// isRotational returns whether path is stored on a rotational disk. The
+// storage type is only detected on Linux, known is always false on other
+// systems.
+func isRotational(path string) (rotational, known bool) {
+	return false, false
+}
@@ -0,0 +1,47 @@
+package cache
+
+// #cgo LDFLAGS: -lleveldb
+// #include "leveldb/c.h"
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/jmhodges/levigo"
+)
+
+// viewValue calls fn with the value stored for key. Unlike levigo's Get,
+// the value is not copied into Go memory: data points directly to the
+// buffer returned by LevelDB and it is freed as soon as fn returns.
+//
+// fn must not retain data or any sub-slice of it, and it must not pass it to
+// another goroutine. Decode everything that is needed into Go memory before
+// returning. viewValue returns false if key is not present, fn is not
+// called in this case. The db needs to be open for the duration of the call.
+func viewValue(db *levigo.DB, ro *levigo.ReadOptions, key []byte, fn func(data []byte)) (bool, error) {
+	var errStr *C.char
+	var vallen C.size_t
+	var k *C.char
+	if len(key) != 0 {
+		k = (*C.char)(unsafe.Pointer(&key[0]))
+	}
+
+	value := C.leveldb_get(
+		(*C.leveldb_t)(unsafe.Pointer(db.Ldb)),
+		(*C.leveldb_readoptions_t)(unsafe.Pointer(ro.Opt)),
+		k, C.size_t(len(key)), &vallen, &errStr)
+
+	if errStr != nil {
+		gs := C.GoString(errStr)
+		C.leveldb_free(unsafe.Pointer(errStr))
+		return false, levigo.DatabaseError(gs)
+	}
+	if value == nil {
+		return false, nil
+	}
+	defer C.leveldb_free(unsafe.Pointer(value))
+
+	data := cBytes(unsafe.Pointer(value), int(vallen))
+	fn(data)
+	return true, nil
+}
@@ -0,0 +1,11 @@
+//go:build go1.17
+// +build go1.17
+
+package cache
+
+import "unsafe"
+
+// cBytes returns the n bytes at p as a slice, without copying them.
+func cBytes(p unsafe.Pointer, n int) []byte {
+	return unsafe.Slice((*byte)(p), n)
+}
@@ -0,0 +1,12 @@
+//go:build !go1.17
+// +build !go1.17
+
+package cache
+
+import "unsafe"
+
+// cBytes returns the n bytes at p as a slice, without copying them.
+// unsafe.Slice is not available before Go 1.17, values are limited to 1GB.
+func cBytes(p unsafe.Pointer, n int) []byte {
+	return (*[1 << 30]byte)(p)[:n:n]
+}
@@ -2,12 +2,15 @@ package cache
 
 import (
 	bin "encoding/binary"
-	"errors"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/jmhodges/levigo"
 	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/log"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -152,15 +155,28 @@ type cache struct {
 	db      *levigo.DB
 	options *cacheOptions
 	cache   *levigo.Cache
+	filter  *levigo.FilterPolicy
 	wo      *levigo.WriteOptions
 	ro      *levigo.ReadOptions
+	env     *levigo.Env // in-memory env, nil for the default env
+	// sampling of OnCompactionStats, nil if not running
+	statsStop chan struct{}
+	statsDone chan struct{}
 }
 
 func (c *cache) open(path string) error {
+	// LevelDB only creates the last directory of path, the in-memory env
+	// needs no directory on disk
+	if !c.options.InMemory {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return errors.Wrap(err, "creating cache directory")
+		}
+	}
+	cacheSizeM, blockSizeK := c.storageSizes(path)
 	opts := levigo.NewOptions()
 	opts.SetCreateIfMissing(true)
-	if c.options.CacheSizeM > 0 {
-		c.cache = levigo.NewLRUCache(c.options.CacheSizeM * 1024 * 1024)
+	if cacheSizeM > 0 {
+		c.cache = levigo.NewLRUCache(cacheSizeM * 1024 * 1024)
 		opts.SetCache(c.cache)
 	}
 	if c.options.MaxOpenFiles > 0 {
@@ -172,37 +188,144 @@ func (c *cache) open(path string) error {
 	if c.options.WriteBufferSizeM > 0 {
 		opts.SetWriteBufferSize(c.options.WriteBufferSizeM * 1024 * 1024)
 	}
-	if c.options.BlockSizeK > 0 {
-		opts.SetBlockSize(c.options.BlockSizeK * 1024)
+	if blockSizeK > 0 {
+		opts.SetBlockSize(blockSizeK * 1024)
+	}
+	if err := setComparator(opts, c.options.Comparator); err != nil {
+		return err
+	}
+	if err := setCompression(opts, c.options.Compression); err != nil {
+		return err
+	}
+	if c.options.BloomFilterBits > 0 {
+		c.filter = levigo.NewBloomFilter(c.options.BloomFilterBits)
+		opts.SetFilterPolicy(c.filter)
 	}
 	if c.options.MaxFileSizeM > 0 {
 		// max file size option is only available with LevelDB 1.21 and higher
 		// build with -tags="ldppost121" to enable this option.
 		setMaxFileSize(opts, c.options.MaxFileSizeM*1024*1024)
 	}
+	if c.options.InMemory {
+		env, err := newMemEnv()
+		if err != nil {
+			return err
+		}
+		c.env = env
+		opts.SetEnv(env)
+	}
 
 	db, err := levigo.Open(path, opts)
+	if err != nil && c.options.AutoRepair && isCorruption(err) {
+		// repair can discard data that was not fully written, only
+		// try it if enabled
+		log.Printf("[warn] opening %s failed: %s", path, err)
+		log.Printf("[warn] repairing %s", path)
+		if repairErr := repairDatabase(path, opts); repairErr != nil {
+			return errors.Wrapf(err, "repairing database failed (%s)", repairErr)
+		}
+		log.Printf("[info] repaired %s", path)
+		db, err = levigo.Open(path, opts)
+	}
 	if err != nil {
 		return err
 	}
 	c.db = db
 	c.wo = levigo.NewWriteOptions()
+	if c.options.SyncWrites {
+		c.wo.SetSync(true)
+	}
 	c.ro = levigo.NewReadOptions()
 
 	return nil
 }
 
+// repairDatabase repairs the LevelDB at path. Tests replace it to check
+// when a repair runs.
+var repairDatabase = levigo.RepairDatabase
+
+// isCorruption returns whether err of levigo.Open reports a corrupt
+// database. Other errors, like the lock of a database that is open in
+// another process, must not trigger a repair.
+func isCorruption(err error) bool {
+	return strings.HasPrefix(err.Error(), "Corruption: ")
+}
+
+// Minimal block and cache sizes for caches on rotational disks. Each random
+// read costs a seek, reading larger blocks is almost free.
+const (
+	hddMinBlockSizeK = 256
+	hddMinCacheSizeM = 256
+)
+
+// detectRotational is isRotational. Tests replace it to simulate disks.
+var detectRotational = isRotational
+
+// storageSizes returns the block cache and the block size for the cache at
+// path. The configured sizes are raised to the minimal sizes for rotational
+// disks, see Storage option.
+func (c *cache) storageSizes(path string) (cacheSizeM, blockSizeK int) {
+	cacheSizeM = c.options.CacheSizeM
+	blockSizeK = c.options.BlockSizeK
+	if c.options.InMemory || !c.rotational(path) {
+		return cacheSizeM, blockSizeK
+	}
+	if cacheSizeM > 0 && cacheSizeM < hddMinCacheSizeM {
+		cacheSizeM = hddMinCacheSizeM
+	}
+	if blockSizeK < hddMinBlockSizeK {
+		blockSizeK = hddMinBlockSizeK
+	}
+	return cacheSizeM, blockSizeK
+}
+
+// rotational returns whether the cache at path should be optimized for
+// rotational disks, based on the Storage option. The disk is only detected
+// with "auto".
+func (c *cache) rotational(path string) bool {
+	switch c.options.Storage {
+	case "hdd":
+		return true
+	case "", "ssd":
+		return false
+	case "auto":
+		rotational, _ := detectRotational(path)
+		return rotational
+	}
+	log.Printf("[warn] unknown storage type %q for %s", c.options.Storage, path)
+	return false
+}
+
 func idToKeyBuf(id int64) []byte {
 	b := make([]byte, 8)
 	bin.BigEndian.PutUint64(b, uint64(id))
 	return b[:8]
 }
 
+// keyBufPool reuses the keys of the hot paths of the ref indices (Get, Add
+// and flushes). Keys are passed to C by levigo and they escape to the heap,
+// even as arrays on the stack.
+var keyBufPool = sync.Pool{New: func() interface{} { return new([8]byte) }}
+
+// getKeyBuf returns a pooled key for id. The key must be released with
+// releaseKeyBuf after LevelDB returned and it must not be kept. LevelDB
+// copies the keys of Put, Delete and of write batches.
+func getKeyBuf(id int64) *[8]byte {
+	b := keyBufPool.Get().(*[8]byte)
+	bin.BigEndian.PutUint64(b[:], uint64(id))
+	return b
+}
+
+func releaseKeyBuf(b *[8]byte) {
+	keyBufPool.Put(b)
+}
+
 func idFromKeyBuf(buf []byte) int64 {
 	return int64(bin.BigEndian.Uint64(buf))
 }
 
 func (c *cache) Close() {
+	c.stopCompactionStats()
 	if c.ro != nil {
 		c.ro.Close()
 		c.ro = nil
@@ -215,8 +338,16 @@ func (c *cache) Close() {
 		c.db.Close()
 		c.db = nil
 	}
+	if c.env != nil {
+		c.env.Close()
+		c.env = nil
+	}
 	if c.cache != nil {
 		c.cache.Close()
 		c.cache = nil
 	}
+	if c.filter != nil {
+		c.filter.Close()
+		c.filter = nil
+	}
 }
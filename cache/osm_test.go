@@ -1,11 +1,16 @@
 package cache
 
 import (
+	"bytes"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/jmhodges/levigo"
 	osm "github.com/omniscale/go-osm"
 )
 
@@ -179,3 +184,278 @@ func TestIDs(t *testing.T) {
 	}
 
 }
+
+func TestIDToKeyBufLayout(t *testing.T) {
+	// keys are big-endian on all architectures
+	for _, tc := range []struct {
+		id       int64
+		expected []byte
+	}{
+		{0, []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{1, []byte{0, 0, 0, 0, 0, 0, 0, 1}},
+		{0x0102030405060708, []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{-1, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	} {
+		if buf := idToKeyBuf(tc.id); !bytes.Equal(buf, tc.expected) {
+			t.Errorf("%d: %v != %v", tc.id, buf, tc.expected)
+		}
+	}
+}
+
+func TestLoadCacheOptionsPreset(t *testing.T) {
+	opts, err := loadCacheOptions([]byte(`{
+		"Nodes": {"Preset": "read-serving", "CacheSizeM": 8, "SyncWrites": false},
+		"CoordsIndex": {"Preset": "bulk-build"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := opts.Nodes
+	if nodes.CacheSizeM != 8 || nodes.SyncWrites {
+		t.Errorf("preset options not overridden: %+v", nodes)
+	}
+	if nodes.BloomFilterBits != 10 || nodes.WriteBufferSizeM != 16 || nodes.Compression != "snappy" {
+		t.Errorf("preset options not applied: %+v", nodes)
+	}
+	if nodes.MaxOpenFiles != 64 {
+		t.Errorf("default option changed: %+v", nodes)
+	}
+	coords := opts.CoordsIndex
+	if coords.WriteBufferSizeM != 256 || coords.Compression != "none" || coords.Codec != "deltavarint" {
+		t.Errorf("preset options not applied: %+v", coords.cacheOptions)
+	}
+	if opts.Ways.WriteBufferSizeM != 64 || opts.Ways.Preset != "" {
+		t.Errorf("options without preset changed: %+v", opts.Ways)
+	}
+
+	if _, err := loadCacheOptions([]byte(`{"Ways": {"Preset": "fast"}}`)); err == nil {
+		t.Error("unknown preset accepted")
+	}
+}
+
+func TestOpenCachePreset(t *testing.T) {
+	for p := range optionsPresets {
+		cacheDir, _ := ioutil.TempDir("", "imposm_test")
+		defer os.RemoveAll(cacheDir)
+
+		opts := &cacheOptions{}
+		if err := opts.applyPreset(p); err != nil {
+			t.Fatal(err)
+		}
+		c := &cache{options: opts}
+		if err := c.open(cacheDir); err != nil {
+			t.Fatal(p, err)
+		}
+		if err := c.db.Put(c.wo, []byte("key"), []byte("value")); err != nil {
+			t.Fatal(p, err)
+		}
+		data, err := c.db.Get(c.ro, []byte("key"))
+		if err != nil || string(data) != "value" {
+			t.Error(p, data, err)
+		}
+		c.Close()
+	}
+
+	c := &cache{options: &cacheOptions{Compression: "zlib"}}
+	if err := c.open(os.TempDir()); err == nil {
+		c.Close()
+		t.Error("unknown compression accepted")
+	}
+}
+
+func TestDropPageCache(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	opts := globalCacheOptions.CoordsIndex
+	opts.DropPageCache = true
+	index, err := newRefIndex(cacheDir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "000001.ldb"), []byte("table"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dropPageCache(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+
+	index.SetLinearImport(true)
+	index.addc <- idRef{id: 1, ref: 2}
+	index.SetLinearImport(false)
+	if refs := index.Get(1); len(refs) != 1 {
+		t.Error(refs)
+	}
+}
+
+func TestParseLevelDBStats(t *testing.T) {
+	value := `                               Compactions
+Level  Files Size(MB) Time(sec) Read(MB) Write(MB)
+--------------------------------------------------
+  0        2        4         1        0         4
+  1        5       10         3       12        10
+`
+	levels, err := parseLevelDBStats(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LevelStats{
+		{Level: 0, Files: 2, SizeMB: 4, TimeSec: 1, ReadMB: 0, WriteMB: 4},
+		{Level: 1, Files: 5, SizeMB: 10, TimeSec: 3, ReadMB: 12, WriteMB: 10},
+	}
+	if !reflect.DeepEqual(levels, expected) {
+		t.Fatal(levels)
+	}
+	stats := CompactionStats{Levels: levels}
+	if stats.ReadMB() != 12 || stats.WriteMB() != 14 {
+		t.Error(stats.ReadMB(), stats.WriteMB())
+	}
+
+	prev := CompactionStats{Levels: []LevelStats{{Level: 1, Files: 4, TimeSec: 1, ReadMB: 2, WriteMB: 5}}}
+	delta := stats.Sub(prev)
+	if delta.Levels[0] != expected[0] || delta.Levels[1] != (LevelStats{Level: 1, Files: 5, SizeMB: 10, TimeSec: 2, ReadMB: 10, WriteMB: 5}) {
+		t.Error(delta)
+	}
+
+	if _, err := parseLevelDBStats(""); err == nil {
+		t.Error("missing error for empty stats")
+	}
+}
+
+func TestOnCompactionStats(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	c := cache{options: &cacheOptions{CompactionStatsIntervalSec: 1}}
+	if err := c.open(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CompactionStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	sampled := make(chan CompactionStats, 1)
+	c.OnCompactionStats(func(stats CompactionStats) {
+		select {
+		case sampled <- stats:
+		default:
+		}
+	})
+	select {
+	case stats := <-sampled:
+		if stats.Time.IsZero() {
+			t.Error(stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no compaction stats sampled")
+	}
+	// stops the sampling
+	c.Close()
+}
+
+func TestCacheStorageSizes(t *testing.T) {
+	rotational := true
+	detectRotational = func(string) (bool, bool) { return rotational, true }
+	defer func() { detectRotational = isRotational }()
+
+	for _, tc := range []struct {
+		storage    string
+		rotational bool
+		inMemory   bool
+		cacheSizeM int
+		blockSizeK int
+	}{
+		// empty keeps the configured sizes, even on rotational disks
+		{"", true, false, 32, 4},
+		{"ssd", true, false, 32, 4},
+		{"hdd", false, false, hddMinCacheSizeM, hddMinBlockSizeK},
+		{"auto", true, false, hddMinCacheSizeM, hddMinBlockSizeK},
+		{"auto", false, false, 32, 4},
+		{"hdd", true, true, 32, 4},
+		{"unknown", true, false, 32, 4},
+	} {
+		rotational = tc.rotational
+		c := cache{options: &cacheOptions{
+			Storage: tc.storage, InMemory: tc.inMemory, CacheSizeM: 32, BlockSizeK: 4,
+		}}
+		if cacheSizeM, blockSizeK := c.storageSizes("/tmp"); cacheSizeM != tc.cacheSizeM || blockSizeK != tc.blockSizeK {
+			t.Errorf("%+v: got %d %d", tc, cacheSizeM, blockSizeK)
+		}
+	}
+
+	// larger sizes are not lowered, a disabled block cache stays disabled
+	c := cache{options: &cacheOptions{Storage: "hdd", CacheSizeM: 1024, BlockSizeK: 512}}
+	if cacheSizeM, blockSizeK := c.storageSizes("/tmp"); cacheSizeM != 1024 || blockSizeK != 512 {
+		t.Error(cacheSizeM, blockSizeK)
+	}
+	c = cache{options: &cacheOptions{Storage: "hdd"}}
+	if cacheSizeM, blockSizeK := c.storageSizes("/tmp"); cacheSizeM != 0 || blockSizeK != hddMinBlockSizeK {
+		t.Error(cacheSizeM, blockSizeK)
+	}
+
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+	c = cache{options: &cacheOptions{Storage: "hdd", CacheSizeM: 8}}
+	if err := c.open(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestCacheAutoRepair(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	c := cache{options: &cacheOptions{}}
+	if err := c.open(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.db.Put(c.wo, []byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// LevelDB fails to open a database with a corrupt CURRENT file,
+	// the repair writes a new manifest from the tables and logs
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "CURRENT"), []byte("MANIFEST-corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = cache{options: &cacheOptions{}}
+	if err := c.open(cacheDir); err == nil {
+		c.Close()
+		t.Fatal("expected error for corrupt database without AutoRepair")
+	}
+
+	repairs := 0
+	repairDatabase = func(path string, opts *levigo.Options) error {
+		repairs++
+		return levigo.RepairDatabase(path, opts)
+	}
+	defer func() { repairDatabase = levigo.RepairDatabase }()
+
+	c = cache{options: &cacheOptions{AutoRepair: true}}
+	if err := c.open(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if repairs != 1 {
+		t.Error("expected one repair", repairs)
+	}
+	if value, err := c.db.Get(c.ro, []byte("key")); err != nil || string(value) != "value" {
+		t.Error(string(value), err)
+	}
+
+	// the database is locked by c, a second open must not repair it
+	locked := cache{options: &cacheOptions{AutoRepair: true}}
+	if err := locked.open(cacheDir); err == nil {
+		locked.Close()
+		t.Fatal("expected lock error")
+	}
+	if repairs != 1 {
+		t.Error("repaired locked database")
+	}
+	if value, err := c.db.Get(c.ro, []byte("key")); err != nil || string(value) != "value" {
+		t.Error(string(value), err)
+	}
+}
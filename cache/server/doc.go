@@ -0,0 +1,13 @@
+/*
+Package server provides a read-only HTTP API for the ref indices of a
+DiffCache, e.g. to query which ways reference a node from other languages.
+
+All responses are JSON. The indices are coords, coords_rel, ways and
+relations:
+
+	GET /health
+	GET /{index}/get?id=1
+	GET /{index}/batch?ids=1,2,3
+	GET /{index}/contains?id=1&ref=2
+*/
+package server
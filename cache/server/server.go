@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/imposm3/cache"
+	"github.com/omniscale/imposm3/log"
+	"github.com/pkg/errors"
+)
+
+// MaxBatchIDs is the maximum number of ids of a single batch request.
+const MaxBatchIDs = 10000
+
+// refIndex are the read methods of all ref indices of the DiffCache.
+type refIndex interface {
+	GetOrErr(id int64) ([]int64, error)
+	GetBatchCtx(ctx context.Context, ids []int64) (map[int64][]int64, error)
+}
+
+// Server answers the HTTP requests for a DiffCache. The server only reads
+// from the cache, the indices should not be in linear import mode.
+type Server struct {
+	indices map[string]refIndex
+	sem     chan struct{}
+	mux     *http.ServeMux
+}
+
+// New returns a server for the opened diffCache. maxConcurrent limits the
+// number of requests that read from the cache at the same time, other
+// requests wait till their client cancels them. It defaults to 16 for
+// values <= 0.
+func New(diffCache *cache.DiffCache, maxConcurrent int) *Server {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 16
+	}
+	s := &Server{
+		indices: make(map[string]refIndex),
+		sem:     make(chan struct{}, maxConcurrent),
+		mux:     http.NewServeMux(),
+	}
+	if diffCache.Coords != nil {
+		s.indices["coords"] = diffCache.Coords
+	}
+	if diffCache.CoordsRel != nil {
+		s.indices["coords_rel"] = diffCache.CoordsRel
+	}
+	if diffCache.Ways != nil {
+		s.indices["ways"] = diffCache.Ways
+	}
+	if diffCache.Relations != nil {
+		s.indices["relations"] = diffCache.Relations
+	}
+	s.mux.HandleFunc("/health", s.health)
+	s.mux.HandleFunc("/", s.query)
+	return s
+}
+
+// ListenAndServe serves the requests for diffCache on bind (e.g.
+// "localhost:8090") till the listener fails.
+func ListenAndServe(bind string, diffCache *cache.DiffCache, maxConcurrent int) error {
+	log.Printf("[info] serving cache %s on %s", diffCache.Dir, bind)
+	return http.ListenAndServe(bind, New(diffCache, maxConcurrent))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "ok",
+		"running": len(s.sem),
+	})
+}
+
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET is supported"))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, errors.Errorf("unknown path %s", r.URL.Path))
+		return
+	}
+	index, ok := s.indices[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.Errorf("unknown index %q", parts[0]))
+		return
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	case <-r.Context().Done():
+		writeError(w, http.StatusServiceUnavailable, errors.New("too many requests"))
+		return
+	}
+
+	switch parts[1] {
+	case "get":
+		s.get(w, r, index)
+	case "batch":
+		s.batch(w, r, index)
+	case "contains":
+		s.contains(w, r, index)
+	default:
+		writeError(w, http.StatusNotFound, errors.Errorf("unknown query %q", parts[1]))
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, index refIndex) {
+	id, err := paramID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	refs, err := index.GetOrErr(id)
+	if err == cache.ErrRefNotFound {
+		writeError(w, http.StatusNotFound, errors.Errorf("id %d not found", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "refs": refs})
+}
+
+func (s *Server) batch(w http.ResponseWriter, r *http.Request, index refIndex) {
+	param := r.URL.Query().Get("ids")
+	if param == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing ids"))
+		return
+	}
+	fields := strings.Split(param, ",")
+	if len(fields) > MaxBatchIDs {
+		writeError(w, http.StatusBadRequest, errors.Errorf("more than %d ids", MaxBatchIDs))
+		return
+	}
+	ids := make([]int64, 0, len(fields))
+	for _, f := range fields {
+		id, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.Errorf("invalid id %q", f))
+			return
+		}
+		ids = append(ids, id)
+	}
+	refs, err := index.GetBatchCtx(r.Context(), ids)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// JSON objects only have string keys
+	result := make(map[string][]int64, len(refs))
+	for id, idRefs := range refs {
+		result[strconv.FormatInt(id, 10)] = idRefs
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) contains(w http.ResponseWriter, r *http.Request, index refIndex) {
+	id, err := paramID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ref, err := paramID(r, "ref")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	refs, err := index.GetOrErr(id)
+	if err != nil && err != cache.ErrRefNotFound {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	i := sort.Search(len(refs), func(i int) bool { return refs[i] >= ref })
+	found := i < len(refs) && refs[i] == ref
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "ref": ref, "contains": found})
+}
+
+func paramID(r *http.Request, name string) (int64, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return 0, errors.Errorf("missing %s", name)
+	}
+	id, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid %s %q", name, param)
+	}
+	return id, nil
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("[warn] writing response:", err)
+	}
+}
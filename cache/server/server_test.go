@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/omniscale/imposm3/cache"
+)
+
+func TestServer(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "imposm_test")
+	defer os.RemoveAll(cacheDir)
+
+	diffCache := cache.NewDiffCache(cacheDir)
+	if err := diffCache.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer diffCache.Close()
+	for _, ref := range []int64{10, 20} {
+		if err := diffCache.Coords.Add(1, ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := diffCache.Coords.Add(100, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(New(diffCache, 2))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/health", 200, `{"running":0,"status":"ok"}`},
+		{"/coords/get?id=1", 200, `{"id":1,"refs":[10,20]}`},
+		{"/coords/get?id=2", 404, `{"error":"id 2 not found"}`},
+		{"/coords/get?id=x", 400, `{"error":"invalid id \"x\""}`},
+		{"/coords/batch?ids=1,2,100", 200, `{"1":[10,20],"100":[30]}`},
+		{"/coords/contains?id=1&ref=20", 200, `{"contains":true,"id":1,"ref":20}`},
+		{"/coords/contains?id=2&ref=20", 200, `{"contains":false,"id":2,"ref":20}`},
+		{"/ways/get?id=1", 404, `{"error":"id 1 not found"}`},
+		{"/relations/get?id=1", 404, `{"error":"unknown index \"relations\""}`},
+		{"/coords/delete?id=1", 404, `{"error":"unknown query \"delete\""}`},
+	} {
+		resp, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, want interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(tc.path, err)
+		}
+		resp.Body.Close()
+		json.Unmarshal([]byte(tc.want), &want)
+		if resp.StatusCode != tc.status || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %d %v, expected %d %s", tc.path, resp.StatusCode, got, tc.status, tc.want)
+		}
+	}
+}
@@ -10,7 +10,7 @@ require (
 	github.com/lib/pq v0.0.0-20171113044440-8c6ee72f3e6b
 	github.com/omniscale/go-osm v0.2.1
 	github.com/pkg/errors v0.8.0
-	golang.org/x/sys v0.0.0-20171114162044-bf42f188b9bc // indirect
+	golang.org/x/sys v0.0.0-20171114162044-bf42f188b9bc
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/fsnotify.v1 v1.4.2 // indirect
 	gopkg.in/yaml.v2 v2.0.0-20170812160011-eb3733d160e7
@@ -0,0 +1,45 @@
+package import_
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pbfFiles returns the PBF files for the -read option. read is either a
+// single file or a directory with .pbf files. The files of a directory are
+// sorted by name.
+func pbfFiles(read string) ([]string, error) {
+	fi, err := os.Stat(read)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading PBF")
+	}
+	if !fi.IsDir() {
+		return []string{read}, nil
+	}
+
+	f, err := os.Open(read)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading PBF directory")
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading PBF directory")
+	}
+	sort.Strings(names)
+
+	var files []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".pbf") {
+			files = append(files, filepath.Join(read, name))
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("no .pbf files in %s", read)
+	}
+	return files, nil
+}
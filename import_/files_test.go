@@ -0,0 +1,45 @@
+package import_
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPBFFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imposm_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := pbfFiles(dir); err == nil {
+		t.Error("expected error for directory without PBF files")
+	}
+
+	for _, name := range []string{"b.osm.pbf", "a.osm.pbf", "readme.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := pbfFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "a.osm.pbf"), filepath.Join(dir, "b.osm.pbf")}
+	if !reflect.DeepEqual(files, expected) {
+		t.Error(files)
+	}
+
+	files, err = pbfFiles(filepath.Join(dir, "b.osm.pbf"))
+	if err != nil || !reflect.DeepEqual(files, expected[1:]) {
+		t.Error(files, err)
+	}
+
+	if _, err := pbfFiles(filepath.Join(dir, "missing.pbf")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
@@ -92,14 +92,18 @@ func Import(importOpts config.Import) {
 
 	if importOpts.Read != "" {
 		step := log.Step("Reading OSM data")
+		files, err := pbfFiles(importOpts.Read)
+		if err != nil {
+			log.Fatal(err)
+		}
 		err = osmCache.Open()
 		if err != nil {
 			log.Fatal("[error] opening cache files: ", err)
 		}
-		progress := stats.NewStatsReporter()
 
-		if !importOpts.Appendcache {
-			// enable optimization if we don't append to existing cache
+		if !importOpts.Appendcache && len(files) == 1 {
+			// enable optimization if we don't append to existing cache.
+			// multiple files are not sorted by ID across all files.
 			osmCache.Coords.SetLinearImport(true)
 		}
 
@@ -108,25 +112,57 @@ func Import(importOpts config.Import) {
 			readLimiter = nil
 		}
 
-		err := reader.ReadPbf(importOpts.Read,
-			osmCache,
-			progress,
-			tagmapping,
-			readLimiter,
-		)
-		if err != nil {
-			log.Fatal(err)
+		// elements in multiple files (e.g. nodes at the border of
+		// adjacent extracts) are overwritten in the cache
+		elementCounts = &stats.ElementCounts{}
+		for _, file := range files {
+			if len(files) > 1 {
+				log.Printf("[info] reading %s", file)
+			}
+			progress := stats.NewStatsReporter()
+			err := reader.ReadPbf(file,
+				osmCache,
+				progress,
+				tagmapping,
+				readLimiter,
+			)
+			if err != nil {
+				log.Fatal(err)
+			}
+			counts := progress.Stop()
+			if len(files) > 1 {
+				log.Printf("[info] read %s: %d coords, %d nodes, %d ways, %d relations",
+					file, counts.Coords.Current, counts.Nodes.Current, counts.Ways.Current, counts.Relations.Current)
+			}
+			elementCounts.Coords.Current += counts.Coords.Current
+			elementCounts.Nodes.Current += counts.Nodes.Current
+			elementCounts.Ways.Current += counts.Ways.Current
+			elementCounts.Relations.Current += counts.Relations.Current
+		}
+		if len(files) > 1 {
+			log.Printf("[info] read %d files: %d coords, %d nodes, %d ways, %d relations",
+				len(files), elementCounts.Coords.Current, elementCounts.Nodes.Current,
+				elementCounts.Ways.Current, elementCounts.Relations.Current)
 		}
 
 		osmCache.Coords.SetLinearImport(false)
-		elementCounts = progress.Stop()
 		osmCache.Close()
 		step()
 		if importOpts.Diff {
-			diffstate, err := estimateFromPBF(importOpts.Read, baseOpts.DiffStateBefore, baseOpts.ReplicationURL, baseOpts.ReplicationInterval)
-			if err != nil {
-				log.Println("[error] parsing diff state form PBF", err)
-			} else if diffstate != nil {
+			// start with the oldest file, to not miss changes of any file
+			var diffstate *state.DiffState
+			for _, file := range files {
+				fileState, err := estimateFromPBF(file, baseOpts.DiffStateBefore, baseOpts.ReplicationURL, baseOpts.ReplicationInterval)
+				if err != nil {
+					log.Println("[error] parsing diff state form PBF", err)
+					diffstate = nil
+					break
+				}
+				if fileState != nil && (diffstate == nil || fileState.Sequence < diffstate.Sequence) {
+					diffstate = fileState
+				}
+			}
+			if diffstate != nil {
 				os.MkdirAll(baseOpts.DiffDir, 0755)
 				err := state.WriteFile(filepath.Join(baseOpts.DiffDir, update.LastStateFilename), diffstate)
 				if err != nil {
@@ -174,6 +210,9 @@ func Import(importOpts config.Import) {
 		if diffCache != nil {
 			diffCache.Coords.SetLinearImport(true)
 			diffCache.Ways.SetLinearImport(true)
+			if diffCache.Relations != nil {
+				diffCache.Relations.SetLinearImport(true)
+			}
 		}
 		osmCache.Coords.SetReadOnly(true)
 
@@ -228,7 +267,9 @@ func Import(importOpts config.Import) {
 		progress.Stop()
 
 		if importOpts.Diff {
-			diffCache.Close()
+			if err := diffCache.Close(); err != nil {
+				log.Fatal("[fatal] Writing diff cache:", err)
+			}
 		}
 
 		writeFinished()
@@ -129,6 +129,10 @@ func (d *Deleter) deleteRelation(id int64, deleteRefs bool, deleteMembers bool)
 				if err := d.diffCache.CoordsRel.DeleteRef(m.ID, id); err != nil {
 					return err
 				}
+			} else if m.Type == osm.RelationMember && d.diffCache.Relations != nil {
+				if err := d.diffCache.Relations.DeleteRef(m.ID, id); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -374,6 +374,24 @@ func Update(
 			relIDs[rel] = struct{}{}
 		}
 	}
+	if diffCache.Relations != nil {
+		// mark depending super-relations for (re)insert, till no new
+		// relations are found
+		queue := make([]int64, 0, len(relIDs))
+		for relID := range relIDs {
+			queue = append(queue, relID)
+		}
+		for len(queue) > 0 {
+			relID := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			for _, rel := range diffCache.Relations.Get(relID) {
+				if _, ok := relIDs[rel]; !ok {
+					relIDs[rel] = struct{}{}
+					queue = append(queue, rel)
+				}
+			}
+		}
+	}
 
 	for relID := range relIDs {
 		rel, err := osmCache.Relations.GetRelation(relID)
@@ -116,12 +116,8 @@ NextRel:
 		}
 
 		if inserted && rw.diffCache != nil {
-			rw.diffCache.Ways.AddFromMembers(r.ID, allMembers)
-			rw.diffCache.CoordsRel.AddFromMembers(r.ID, allMembers)
-			for _, member := range allMembers {
-				if member.Way != nil {
-					rw.diffCache.Coords.AddFromWay(member.Way)
-				}
+			if err := rw.addToDiffCache(r.ID, allMembers); err != nil {
+				log.Printf("[error] adding relation %d to diff cache: %s", r.ID, err)
 			}
 		}
 		if inserted && rw.expireor != nil {
@@ -135,6 +131,30 @@ NextRel:
 	rw.wg.Done()
 }
 
+// addToDiffCache adds the refs of the relation and of its way members to
+// the diff cache.
+func (rw *RelationWriter) addToDiffCache(relID int64, members []osm.Member) error {
+	if err := rw.diffCache.Ways.AddFromMembers(relID, members); err != nil {
+		return err
+	}
+	if err := rw.diffCache.CoordsRel.AddFromMembers(relID, members); err != nil {
+		return err
+	}
+	if rw.diffCache.Relations != nil {
+		if err := rw.diffCache.Relations.AddFromMembers(relID, members); err != nil {
+			return err
+		}
+	}
+	for _, member := range members {
+		if member.Way != nil {
+			if err := rw.diffCache.Coords.AddFromWay(member.Way); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func handleMultiPolygon(rw *RelationWriter, r *osm.Relation, geos *geosp.Geos) bool {
 	matches := rw.polygonMatcher.MatchRelation(r)
 	if matches == nil {
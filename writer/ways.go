@@ -125,7 +125,9 @@ func (ww *WayWriter) loop() {
 			expire.ExpireProjectedNodes(ww.expireor, w.Nodes, ww.srid, insertedPolygon)
 		}
 		if (inserted || insertedPolygon) && ww.diffCache != nil {
-			ww.diffCache.Coords.AddFromWay(w)
+			if err := ww.diffCache.Coords.AddFromWay(w); err != nil {
+				log.Printf("[error] adding way %d to diff cache: %s", w.ID, err)
+			}
 		}
 	}
 	ww.wg.Done()